@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"upd-loader-go/internal/generator"
+	"upd-loader-go/internal/parser"
+	"upd-loader-go/internal/xsd"
+)
+
+func main() {
+	specPath := flag.String("spec", "data/updgen/cases.json", "JSON spec file with a single spec or {\"cases\": [...]}")
+	outDir := flag.String("out", "./temp/updgen", "Output directory for generated containers")
+	xsdPath := flag.String("xsd", "", "XSD schema to check generated documents against")
+	verify := flag.Bool("verify", false, "Parse generated containers back with UPDParser")
+	only := flag.String("case", "", "Generate only the case with this name")
+	flag.Parse()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	specs, err := generator.LoadSpecs(*specPath)
+	if err != nil {
+		logger.Fatalf("Failed to load specs: %v", err)
+	}
+
+	var schema *xsd.Schema
+	if *xsdPath != "" {
+		schema, err = xsd.LoadFile(*xsdPath)
+		if err != nil {
+			logger.Fatalf("Failed to load XSD: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		logger.Fatalf("Failed to create output directory: %v", err)
+	}
+
+	failed := false
+	for _, spec := range specs {
+		if *only != "" && spec.Name != *only {
+			continue
+		}
+		if err := generate(spec, *outDir, schema, *verify, logger); err != nil {
+			fmt.Printf("❌ %s: %v\n", spec.Name, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// generate writes a container for the spec and optionally checks it
+func generate(spec generator.Spec, outDir string, schema *xsd.Schema, verify bool, logger *logrus.Logger) error {
+	doc, err := spec.Document()
+	if err != nil {
+		return err
+	}
+
+	opts := spec.Options()
+	zipPath := filepath.Join(outDir, spec.Name+".zip")
+
+	file, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	if err := generator.WriteContainer(file, doc, opts); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ %s: %d lines, total %s -> %s\n", spec.Name, len(doc.Content.Items), doc.Content.TotalWithVAT.StringFixed(2), zipPath)
+
+	if schema != nil {
+		var buf bytes.Buffer
+		if err := generator.WriteUPDXML(&buf, doc, opts); err != nil {
+			return err
+		}
+		violations, err := schema.Validate(&buf)
+		if err != nil {
+			return err
+		}
+		for _, violation := range violations {
+			fmt.Printf("   ⚠️ %s\n", violation)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d schema violations", len(violations))
+		}
+	}
+
+	if verify {
+		// Parse a copy so the extraction directory does not clash between cases
+		checkDir, err := os.MkdirTemp(outDir, "verify_*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(checkDir)
+
+		data, err := os.ReadFile(zipPath)
+		if err != nil {
+			return err
+		}
+		checkPath := filepath.Join(checkDir, filepath.Base(zipPath))
+		if err := os.WriteFile(checkPath, data, 0644); err != nil {
+			return err
+		}
+
+		parsed, err := parser.NewUPDParser(spec.Encoding, logger).ParseUPDArchive(checkPath)
+		if err != nil {
+			return err
+		}
+		if len(parsed.Content.Items) != len(doc.Content.Items) || !parsed.Content.TotalWithVAT.Equal(doc.Content.TotalWithVAT) {
+			return fmt.Errorf("parsed %d lines, total %s; expected %d lines, total %s",
+				len(parsed.Content.Items), parsed.Content.TotalWithVAT, len(doc.Content.Items), doc.Content.TotalWithVAT)
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ module upd-loader-go
 go 1.24
 
 require (
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/joho/godotenv v1.5.1
 	github.com/shopspring/decimal v1.3.1
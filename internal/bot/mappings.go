@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"upd-loader-go/internal/models"
+)
+
+// handleMapCommand handles /map command resolving unmatched UPD line
+func (b *TelegramUPDBot) handleMapCommand(update tgbotapi.Update) {
+	chatID := update.Message.Chat.ID
+	args := update.Message.CommandArguments()
+	if strings.TrimSpace(args) == "" {
+		msg := tgbotapi.NewMessage(chatID, "ℹ️ Укажите товар поставщика и товар МойСклад через точку с запятой:\n/map <ИНН поставщика>; <артикул поставщика>; <название поставщика>; <артикул или название в МойСклад>\n\nАртикул поставщика можно оставить пустым.")
+		b.bot.Send(msg)
+		return
+	}
+
+	mapping, err := b.processor.LearnMapping(args)
+	if err != nil {
+		b.logger.Warningf("Failed to learn item mapping: %v", err)
+		b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Не удалось сохранить сопоставление:\n%v", err)))
+		return
+	}
+
+	supplierItem := mapping.SupplierName
+	if mapping.SupplierArticle != "" {
+		supplierItem = fmt.Sprintf("артикул %s", mapping.SupplierArticle)
+	}
+	b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Сопоставление сохранено:\n%s (ИНН %s) → %s\n\nОтправьте УПД еще раз.", supplierItem, mapping.SupplierINN, mapping.AssortmentName)))
+}
+
+// handleMappingsCommand handles /mappings command sending mappings as CSV
+func (b *TelegramUPDBot) handleMappingsCommand(update tgbotapi.Update) {
+	chatID := update.Message.Chat.ID
+
+	file, count, err := b.processor.ExportMappings()
+	if err != nil {
+		b.logger.Errorf("Mappings export error: %v", err)
+		b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Ошибка выгрузки сопоставлений:\n%v", err)))
+		return
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: file.FileName, Bytes: file.Content})
+	doc.Caption = fmt.Sprintf("🔗 Сопоставлений товаров: %d\nИзмените файл и отправьте его обратно, чтобы загрузить сопоставления.", count)
+	if _, err := b.bot.Send(doc); err != nil {
+		b.logger.Errorf("Failed to send mappings file: %v", err)
+	}
+}
+
+// handleMappingsImport imports mappings from CSV document
+func (b *TelegramUPDBot) handleMappingsImport(chatID int64, fileID string) {
+	fileContent, err := b.downloadFile(fileID)
+	if err != nil {
+		b.logger.Errorf("Failed to download file: %v", err)
+		b.bot.Send(tgbotapi.NewMessage(chatID, "❌ Произошла ошибка при скачивании файла.\nПопробуйте еще раз или обратитесь к администратору."))
+		return
+	}
+
+	count, err := b.processor.ImportMappings(fileContent)
+	if err != nil {
+		b.logger.Warningf("Mappings import error: %v", err)
+		b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Ошибка загрузки сопоставлений:\n%v", err)))
+		return
+	}
+
+	b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Загружено сопоставлений: %d", count)))
+}
+
+// callbackPick is callback data prefix of candidate buttons: pick:<id>:<index>
+const callbackPick = "pick:"
+
+// sendCandidateChoices asks the user to choose MoySkald products for UPD
+// lines that have candidates but no confident match
+func (b *TelegramUPDBot) sendCandidateChoices(chatID int64, items []models.UnmatchedItem) {
+	for _, item := range items {
+		if len(item.Candidates) == 0 {
+			continue
+		}
+
+		id := b.choices.add(item)
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for i, candidate := range item.Candidates {
+			label := fmt.Sprintf("%s — %.0f%%", candidate.Name, candidate.Confidence*100)
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s%s:%d", callbackPick, id, i)),
+			))
+		}
+
+		text := fmt.Sprintf("❓ Выберите товар МойСклад для позиции УПД:\n%s", item.Name)
+		if item.Article != "" {
+			text += fmt.Sprintf(" (артикул: %s)", item.Article)
+		}
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		if _, err := b.bot.Send(msg); err != nil {
+			b.logger.Errorf("Failed to send product candidates: %v", err)
+		}
+	}
+}
+
+// handlePickCallback saves the candidate chosen for an unmatched UPD line
+// as item mapping
+func (b *TelegramUPDBot) handlePickCallback(query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	id, indexStr, _ := strings.Cut(strings.TrimPrefix(query.Data, callbackPick), ":")
+	index, err := strconv.Atoi(indexStr)
+	item, ok := b.choices.take(id)
+	if err != nil || !ok || index < 0 || index >= len(item.Candidates) {
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "Выбор устарел"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, query.Message.Text+"\n\n⌛ Выбор устарел. Отправьте УПД еще раз."))
+		return
+	}
+
+	candidate := item.Candidates[index]
+	if _, err := b.processor.ChooseCandidate(item, candidate); err != nil {
+		b.logger.Errorf("Failed to save chosen candidate: %v", err)
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "Ошибка"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%s\n\n❌ Не удалось сохранить сопоставление:\n%v", query.Message.Text, err)))
+		return
+	}
+
+	b.logger.Infof("User %d mapped %s to %s %s", query.From.ID, item.Name, candidate.Type, candidate.Name)
+	b.bot.Request(tgbotapi.NewCallback(query.ID, "Сопоставление сохранено"))
+	b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%s\n\n✅ %s\nСопоставление сохранено. Когда выберете все позиции, отправьте УПД еще раз.", query.Message.Text, candidate.Name)))
+}
@@ -0,0 +1,503 @@
+package bot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"upd-loader-go/internal/moysklad"
+)
+
+const (
+	// pendingTTL is how long an upload plan or product choice waits for the user
+	pendingTTL = 30 * time.Minute
+	// maxPlanLines limits plan lines shown in a message
+	maxPlanLines = 30
+	// maxMessageLength is Telegram limit of message text in UTF-16 code units
+	maxMessageLength = 4096
+
+	callbackConfirm = "confirm:"
+	callbackUpdate  = "update:"
+	callbackCancel  = "cancel:"
+)
+
+// pendingItem is a value waiting for a user decision
+type pendingItem[T any] struct {
+	value   T
+	created time.Time
+}
+
+// pendingStore keeps values such as upload plans until the user acts on
+// them or they expire
+type pendingStore[T any] struct {
+	mu    sync.Mutex
+	items map[string]*pendingItem[T]
+}
+
+func newPendingStore[T any]() *pendingStore[T] {
+	return &pendingStore[T]{items: make(map[string]*pendingItem[T])}
+}
+
+// add stores value and returns its ID
+func (s *pendingStore[T]) add(value T) string {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, pending := range s.items {
+		if now.Sub(pending.created) > pendingTTL {
+			delete(s.items, key)
+		}
+	}
+	s.items[id] = &pendingItem[T]{value: value, created: now}
+	return id
+}
+
+// take removes value from the store, so it is acted on at most once
+func (s *pendingStore[T]) take(id string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero T
+	pending, ok := s.items[id]
+	if !ok {
+		return zero, false
+	}
+	delete(s.items, id)
+
+	if time.Since(pending.created) > pendingTTL {
+		return zero, false
+	}
+	return pending.value, true
+}
+
+// handleDocumentPlan builds upload plan and asks for confirmation
+func (b *TelegramUPDBot) handleDocumentPlan(chatID int64, messageID int, fileContent []byte, filename string) {
+	plan, failure := b.processor.PlanUPDFile(fileContent, filename)
+	if failure != nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, failure.Message)
+		b.bot.Send(editMsg)
+		b.sendCandidateChoices(chatID, failure.UnmatchedItems)
+		b.sendStoreChoice(chatID, failure.StoreChoice, fileContent, filename)
+		return
+	}
+
+	if plan.AlreadyLoaded() {
+		result := b.processor.ExecutePlan(plan)
+		editMsg := tgbotapi.NewEditMessageText(chatID, messageID, result.Message)
+		b.bot.Send(editMsg)
+		return
+	}
+
+	id := b.plans.add(plan)
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Загрузить", callbackConfirm+id),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", callbackCancel+id),
+		),
+	}
+	if len(plan.CounterpartyChanges) > 0 && !plan.UpdateCounterparty {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Загрузить и обновить реквизиты", callbackUpdate+id),
+		))
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	editMsg := tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, formatPlan(plan), keyboard)
+	if _, err := b.bot.Send(editMsg); err != nil {
+		b.logger.Errorf("Failed to send upload plan: %v", err)
+
+		// The plan is still pending: reply with a short summary and the same
+		// buttons, so the upload can be confirmed or cancelled
+		msg := tgbotapi.NewMessage(chatID, formatPlanSummary(plan))
+		msg.ReplyMarkup = keyboard
+		if _, err := b.bot.Send(msg); err != nil {
+			b.logger.Errorf("Failed to send upload plan summary: %v", err)
+		}
+	}
+}
+
+// handleCallback handles inline keyboard buttons of upload plans
+func (b *TelegramUPDBot) handleCallback(query *tgbotapi.CallbackQuery) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Errorf("Panic in handleCallback: %v", r)
+		}
+	}()
+
+	if !b.config.IsAuthorizedUser(query.From.ID) {
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "❌ У вас нет доступа к этому боту."))
+		return
+	}
+	if query.Message == nil {
+		b.bot.Request(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	if strings.HasPrefix(query.Data, callbackPick) {
+		b.handlePickCallback(query)
+		return
+	}
+	if strings.HasPrefix(query.Data, callbackStore) {
+		b.handleStoreCallback(query)
+		return
+	}
+
+	var id string
+	confirm, updateCounterparty := false, false
+	switch {
+	case strings.HasPrefix(query.Data, callbackConfirm):
+		id = strings.TrimPrefix(query.Data, callbackConfirm)
+		confirm = true
+	case strings.HasPrefix(query.Data, callbackUpdate):
+		id = strings.TrimPrefix(query.Data, callbackUpdate)
+		confirm, updateCounterparty = true, true
+	case strings.HasPrefix(query.Data, callbackCancel):
+		id = strings.TrimPrefix(query.Data, callbackCancel)
+	default:
+		b.bot.Request(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+
+	plan, ok := b.plans.take(id)
+	if !ok {
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "План устарел или уже выполнен"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, appendNote(query.Message.Text, "\n\n⌛ План устарел или уже выполнен. Отправьте УПД еще раз.")))
+		return
+	}
+
+	if !confirm {
+		b.logger.Infof("Upload plan cancelled by user %d", query.From.ID)
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "Загрузка отменена"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, appendNote(query.Message.Text, "\n\n❌ Загрузка отменена.")))
+		return
+	}
+
+	b.logger.Infof("Upload plan confirmed by user %d", query.From.ID)
+	if updateCounterparty {
+		plan.UpdateCounterparty = true
+	}
+	b.bot.Request(tgbotapi.NewCallback(query.ID, "Загружаю..."))
+	b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, "🔄 Загружаю УПД в МойСклад по плану..."))
+
+	result := b.processor.ExecutePlan(plan)
+	b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, result.Message))
+
+	if result.Success {
+		b.logger.Infof("UPD successfully processed for user %d", query.From.ID)
+		b.sendPrintable(chatID, result.UPDDocument)
+	} else {
+		b.logger.Warningf("UPD processing error for user %d: %s", query.From.ID, result.ErrorCode)
+	}
+}
+
+// formatPlan formats upload plan for confirmation. Lines that do not fit
+// into a Telegram message are summarized as a count.
+func formatPlan(plan *moysklad.UploadPlan) string {
+	content := plan.UPDDocument.Content
+	currency := content.CurrencySymbol()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📋 План загрузки УПД № %s от %s\n\n", content.InvoiceNumber, content.InvoiceDate.Format("02.01.2006")))
+
+	purchase := plan.Direction == moysklad.DirectionPurchase
+	ourINN, partyINN, partyLabel := content.Seller.INN, content.Buyer.INN, "Покупатель"
+	if purchase {
+		ourINN, partyINN, partyLabel = content.Buyer.INN, content.Seller.INN, "Поставщик"
+		sb.WriteString("📥 Входящий УПД от поставщика\n")
+	}
+
+	sb.WriteString(fmt.Sprintf("🏢 Организация: %s (ИНН: %s)\n", plan.Organization.Name, ourINN))
+	if account := plan.OrganizationAccount; account != nil {
+		sb.WriteString(fmt.Sprintf("🏦 Счет организации: %s %s\n", account.AccountNumber, account.BankName))
+	}
+	if plan.NewCounterparty {
+		sb.WriteString(fmt.Sprintf("🏪 %s: %s (ИНН: %s) — будет создан\n", partyLabel, plan.Counterparty.Name, partyINN))
+	} else {
+		sb.WriteString(fmt.Sprintf("🏪 %s: %s (ИНН: %s)\n", partyLabel, plan.Counterparty.Name, partyINN))
+	}
+	if len(plan.CounterpartyChanges) > 0 {
+		if plan.UpdateCounterparty {
+			sb.WriteString("📝 Реквизиты контрагента будут обновлены по УПД:\n")
+		} else {
+			sb.WriteString("📝 Реквизиты контрагента отличаются от УПД:\n")
+		}
+		for _, change := range plan.CounterpartyChanges {
+			sb.WriteString(fmt.Sprintf("   %s\n", formatCounterpartyChange(change)))
+		}
+	}
+	if plan.CustomerInvoice != nil {
+		sb.WriteString(fmt.Sprintf("🧾 Счет покупателю: %s\n", plan.CustomerInvoice.Name))
+	} else if !purchase && plan.ExistingDemand == nil {
+		sb.WriteString("🧾 Счет покупателю: не найден, отгрузка не будет к нему привязана\n")
+	}
+	if plan.CustomerOrder != nil {
+		sb.WriteString(fmt.Sprintf("🧾 Заказ покупателя: %s\n", plan.CustomerOrder.Name))
+	}
+	if purchase {
+		if plan.PurchaseOrder != nil {
+			sb.WriteString(fmt.Sprintf("🧾 Заказ поставщику: %s\n", plan.PurchaseOrder.Name))
+		} else if plan.ExistingSupply == nil {
+			sb.WriteString("🧾 Заказ поставщику: не найден, приемка не будет к нему привязана\n")
+		}
+	}
+	if plan.Store != nil {
+		if label := storeSourceLabel(plan.StoreSource); label != "" {
+			sb.WriteString(fmt.Sprintf("🏬 Склад: %s (%s)\n", plan.Store.Name, label))
+		} else {
+			sb.WriteString(fmt.Sprintf("🏬 Склад: %s\n", plan.Store.Name))
+		}
+	}
+	if !content.IsDefaultCurrency() {
+		sb.WriteString(fmt.Sprintf("💱 Валюта: %s, курс %s\n", content.CurrencyISOCode(), content.ExchangeRate.String()))
+	}
+	sb.WriteString("\n")
+
+	switch {
+	case purchase && plan.ExistingSupply != nil:
+		sb.WriteString(fmt.Sprintf("📦 Приемка: %s — уже создана, будет использована\n", plan.ExistingSupply.Name))
+	case purchase:
+		sb.WriteString(fmt.Sprintf("📦 Приемка: вх. № %s — будет создана\n", plan.Supply.IncomingNumber))
+	case plan.ExistingDemand != nil:
+		sb.WriteString(fmt.Sprintf("📦 Отгрузка: %s — уже создана, будет использована\n", plan.ExistingDemand.Name))
+	default:
+		sb.WriteString(fmt.Sprintf("📦 Отгрузка: %s — будет создана\n", plan.Demand.Name))
+	}
+	if purchase {
+		sb.WriteString(fmt.Sprintf("📄 Счет-фактура полученный: вх. № %s — будет создан\n", plan.FactureIn.IncomingNumber))
+	} else {
+		sb.WriteString(fmt.Sprintf("📄 Счет-фактура: %s — будет создан\n", plan.FactureOut.Name))
+	}
+	if len(plan.Attachments) > 0 {
+		names := make([]string, 0, len(plan.Attachments))
+		for _, file := range plan.Attachments {
+			names = append(names, file.FileName)
+		}
+		sb.WriteString(fmt.Sprintf("📎 Файлы к документам: %s\n", strings.Join(names, ", ")))
+	}
+	sb.WriteString("\n")
+
+	var footer strings.Builder
+	if len(plan.Lines) > 0 {
+		if plan.ProductFolder != nil {
+			footer.WriteString(fmt.Sprintf("📁 Новые товары и услуги будут помещены в группу «%s»\n", plan.ProductFolder.Name))
+		}
+		footer.WriteString(fmt.Sprintf("\n💵 Сумма позиций: %s %s\n", plan.Total.StringFixed(2), currency))
+		if !plan.Residual.IsZero() {
+			footer.WriteString(fmt.Sprintf("⚠️ Отличается от итога УПД %s %s на %s %s\n", content.TotalWithVAT.StringFixed(2), currency, plan.Residual.StringFixed(2), currency))
+		}
+		footer.WriteString("\n")
+	}
+	footer.WriteString("Подтвердите загрузку в МойСклад.")
+
+	if len(plan.Lines) > 0 {
+		sb.WriteString("🛒 Позиции:\n")
+
+		// Reserve room for the note about lines left out
+		moreNote := fmt.Sprintf("… и еще %d позиций\n", len(plan.Lines))
+		budget := maxMessageLength - textLength(sb.String()) - textLength(footer.String()) - textLength(moreNote)
+		shown := 0
+		for i, line := range plan.Lines {
+			if i >= maxPlanLines {
+				break
+			}
+			entry := formatPlanLine(i+1, line, currency)
+			if textLength(entry) > budget {
+				break
+			}
+			budget -= textLength(entry)
+			sb.WriteString(entry)
+			shown++
+		}
+		if shown < len(plan.Lines) {
+			sb.WriteString(fmt.Sprintf("… и еще %d позиций\n", len(plan.Lines)-shown))
+		}
+	}
+
+	sb.WriteString(footer.String())
+	return truncateText(sb.String(), maxMessageLength)
+}
+
+// formatPlanLine formats a single plan line
+func formatPlanLine(number int, line moysklad.PlanLine, currency string) string {
+	var sb strings.Builder
+	label := matchedByLabel(line.MatchedBy)
+	if line.MatchedBy == "fuzzy" {
+		label = fmt.Sprintf("%s, %.0f%%", label, line.Confidence*100)
+	}
+	sb.WriteString(fmt.Sprintf("%d. %s → %s (%s)\n", number, line.Name, line.Assortment, label))
+	if line.MatchedBy == "new" && len(line.Candidates) > 0 {
+		best := line.Candidates[0]
+		sb.WriteString(fmt.Sprintf("   ⚠️ Похожий товар в МойСклад: %s (%.0f%%)\n", best.Name, best.Confidence*100))
+	}
+	vat := "без НДС"
+	if line.VATEnabled {
+		vat = fmt.Sprintf("НДС %d%%", line.VAT)
+	}
+	sb.WriteString(fmt.Sprintf("   %s × %.2f %s (%s), %s\n", formatQuantity(line.Quantity), line.Price/100, currency, priceSourceLabel(line.PriceSource), vat))
+	if line.Shortage {
+		sb.WriteString(fmt.Sprintf("   ⚠️ На складе %s, остаток уйдет в минус\n", formatQuantity(line.Stock)))
+	}
+	return sb.String()
+}
+
+// formatPlanSummary formats a short plan for when the full plan cannot be sent
+func formatPlanSummary(plan *moysklad.UploadPlan) string {
+	content := plan.UPDDocument.Content
+	text := fmt.Sprintf("📋 План загрузки УПД № %s от %s\n\n", content.InvoiceNumber, content.InvoiceDate.Format("02.01.2006"))
+	if plan.Counterparty != nil {
+		text += fmt.Sprintf("🏪 Контрагент: %s\n", plan.Counterparty.Name)
+	}
+	text += fmt.Sprintf("🛒 Позиций: %d\n💵 Сумма позиций: %s %s\n\n", len(plan.Lines), plan.Total.StringFixed(2), content.CurrencySymbol())
+	text += "⚠️ Полный план не удалось показать. Подтвердите загрузку в МойСклад."
+	return truncateText(text, maxMessageLength)
+}
+
+// textLength returns text length as Telegram counts it
+func textLength(text string) int {
+	length := 0
+	for _, r := range text {
+		length += utf16.RuneLen(r)
+	}
+	return length
+}
+
+// truncateText cuts text to limit, marking the cut with an ellipsis
+func truncateText(text string, limit int) string {
+	if textLength(text) <= limit {
+		return text
+	}
+
+	const ellipsis = "\n…"
+	budget := limit - textLength(ellipsis)
+	length := 0
+	for i, r := range text {
+		length += utf16.RuneLen(r)
+		if length > budget {
+			return text[:i] + ellipsis
+		}
+	}
+	return text
+}
+
+// appendNote appends note to message text keeping it within Telegram limit
+func appendNote(text, note string) string {
+	return truncateText(text, maxMessageLength-textLength(note)) + note
+}
+
+// formatCounterpartyChange describes counterparty requisite differing from UPD
+func formatCounterpartyChange(change moysklad.CounterpartyChange) string {
+	if change.Field == "accounts" {
+		return fmt.Sprintf("Новый счет: %s", change.New)
+	}
+
+	label := change.Field
+	switch change.Field {
+	case "companyType":
+		label = "Тип"
+	case "legalTitle":
+		label = "Полное наименование"
+	case "legalLastName":
+		label = "Фамилия"
+	case "legalFirstName":
+		label = "Имя"
+	case "legalMiddleName":
+		label = "Отчество"
+	case "legalAddress":
+		label = "Юридический адрес"
+	case "actualAddress":
+		label = "Фактический адрес"
+	case "kpp":
+		label = "КПП"
+	case "ogrn":
+		label = "ОГРН"
+	case "ogrnip":
+		label = "ОГРНИП"
+	case "okpo":
+		label = "ОКПО"
+	}
+	old := change.Old
+	if old == "" {
+		old = "не указан"
+	}
+	return fmt.Sprintf("%s: %s → %s", label, old, change.New)
+}
+
+// matchedByLabel describes how line was matched to assortment
+func matchedByLabel(matchedBy string) string {
+	switch matchedBy {
+	case "mapping":
+		return "по сопоставлению"
+	case "barcode":
+		return "по штрихкоду"
+	case "article":
+		return "по артикулу"
+	case "code":
+		return "по коду"
+	case "externalCode":
+		return "по внешнему коду"
+	case "name":
+		return "по названию"
+	case "fuzzy":
+		return "по сходству"
+	case "service":
+		return "услуга по умолчанию"
+	case "new":
+		return "будет создан"
+	default:
+		return matchedBy
+	}
+}
+
+// priceSourceLabel describes where line price was taken from
+func priceSourceLabel(source string) string {
+	switch source {
+	case "upd":
+		return "цена из УПД"
+	case "purchaseorder":
+		return "цена из заказа поставщику"
+	case "customerorder":
+		return "цена из заказа покупателя"
+	default:
+		return "цена из счета"
+	}
+}
+
+// storeSourceLabel describes where the demand or supply store comes from
+func storeSourceLabel(source string) string {
+	switch source {
+	case moysklad.StoreFromInvoice:
+		return "из счета"
+	case moysklad.StoreFromOrder:
+		return "из заказа покупателя"
+	case moysklad.StoreFromPurchaseOrder:
+		return "из заказа поставщику"
+	case moysklad.StoreFromCounterparty:
+		return "по правилу для контрагента"
+	case moysklad.StoreFromChoice:
+		return "выбран для контрагента"
+	case moysklad.StoreFromOrganization:
+		return "по умолчанию для организации"
+	case moysklad.StoreSingle:
+		return "единственный склад"
+	default:
+		return ""
+	}
+}
+
+// formatQuantity formats quantity without trailing zeros
+func formatQuantity(quantity float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", quantity), "0"), ".")
+}
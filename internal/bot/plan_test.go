@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+	"upd-loader-go/internal/moysklad"
+)
+
+func testPlan(lines int, nameLength int) *moysklad.UploadPlan {
+	content := models.NewUPDContent("209", time.Date(2025, 6, 26, 0, 0, 0, 0, time.UTC),
+		models.Organization{Name: "ООО \"Продавец\"", INN: "7843316106"},
+		models.Organization{Name: "ООО \"Покупатель\"", INN: "7701234567"})
+
+	plan := &moysklad.UploadPlan{
+		UPDDocument:  &models.UPDDocument{Content: *content},
+		Organization: &moysklad.Organization{Name: "ООО \"Продавец\""},
+		Counterparty: &moysklad.Counterparty{Name: "ООО \"Покупатель\""},
+		Demand:       &moysklad.Demand{Name: "00001"},
+		FactureOut:   &moysklad.FactureOut{Name: "00001"},
+		Total:        decimal.NewFromInt(1000),
+	}
+	for i := 0; i < lines; i++ {
+		plan.Lines = append(plan.Lines, moysklad.PlanLine{
+			Name:       fmt.Sprintf("%d %s", i+1, strings.Repeat("Труба 📦 ", nameLength)),
+			Assortment: "Труба",
+			MatchedBy:  "article",
+			Quantity:   1,
+			Price:      10000,
+			VAT:        20,
+			VATEnabled: true,
+		})
+	}
+	return plan
+}
+
+func TestFormatPlanFitsMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     int
+		lineWords int
+		wantMore  string
+	}{
+		{"short plan", 3, 1, ""},
+		{"more lines than shown", 100, 1, "… и еще 70 позиций"},
+		{"long line names", 30, 60, "… и еще "},
+		{"one huge line", 1, 1000, "… и еще 1 позиций"},
+	}
+
+	for _, tt := range tests {
+		text := formatPlan(testPlan(tt.lines, tt.lineWords))
+		if length := textLength(text); length > maxMessageLength {
+			t.Errorf("%s: plan is %d characters, limit %d", tt.name, length, maxMessageLength)
+		}
+		if !strings.HasSuffix(text, "Подтвердите загрузку в МойСклад.") {
+			t.Errorf("%s: plan lost its footer", tt.name)
+		}
+		if tt.wantMore == "" && strings.Contains(text, "… и еще") {
+			t.Errorf("%s: unexpected note about lines left out", tt.name)
+		}
+		if tt.wantMore != "" && !strings.Contains(text, tt.wantMore) {
+			t.Errorf("%s: plan has no %q note", tt.name, tt.wantMore)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	text := strings.Repeat("я📦", 3000)
+	truncated := truncateText(text, maxMessageLength)
+	if length := textLength(truncated); length > maxMessageLength || length < maxMessageLength-2 {
+		t.Errorf("truncated text is %d characters, want close to %d", length, maxMessageLength)
+	}
+	if !strings.HasSuffix(truncated, "…") {
+		t.Error("truncated text has no ellipsis")
+	}
+	if got := truncateText("коротко", maxMessageLength); got != "коротко" {
+		t.Errorf("short text changed: %q", got)
+	}
+
+	note := "\n\n❌ Загрузка отменена."
+	if got := appendNote(text, note); textLength(got) > maxMessageLength || !strings.HasSuffix(got, note) {
+		t.Errorf("appendNote exceeded the limit or lost the note: %d characters", textLength(got))
+	}
+}
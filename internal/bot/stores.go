@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"upd-loader-go/internal/models"
+	"upd-loader-go/internal/moysklad"
+)
+
+// callbackStore is callback data prefix of store buttons: store:<id>:<index>
+const callbackStore = "store:"
+
+// storeChoice is a store choice waiting for the user along with the UPD
+// file uploaded again once the store is chosen
+type storeChoice struct {
+	choice      models.StoreChoice
+	fileContent []byte
+	filename    string
+}
+
+// sendStoreChoice asks the user to choose the store of demands to the buyer
+// or supplies from the supplier when it cannot be resolved
+func (b *TelegramUPDBot) sendStoreChoice(chatID int64, choice *models.StoreChoice, fileContent []byte, filename string) {
+	if choice == nil || len(choice.Stores) == 0 {
+		return
+	}
+
+	id := b.stores.add(storeChoice{choice: *choice, fileContent: fileContent, filename: filename})
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, store := range choice.Stores {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(store.Name, fmt.Sprintf("%s%s:%d", callbackStore, id, i)),
+		))
+	}
+
+	text := fmt.Sprintf("❓ Выберите склад для отгрузок покупателю %s (ИНН: %s):", choice.PartyName, choice.PartyINN)
+	if choice.Direction == moysklad.DirectionPurchase {
+		text = fmt.Sprintf("❓ Выберите склад для приемок от поставщика %s (ИНН: %s):", choice.PartyName, choice.PartyINN)
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := b.bot.Send(msg); err != nil {
+		b.logger.Errorf("Failed to send store choice: %v", err)
+	}
+}
+
+// handleStoreCallback remembers the store chosen for the counterparty and
+// uploads the UPD again
+func (b *TelegramUPDBot) handleStoreCallback(query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	id, indexStr, _ := strings.Cut(strings.TrimPrefix(query.Data, callbackStore), ":")
+	index, err := strconv.Atoi(indexStr)
+	pending, ok := b.stores.take(id)
+	if err != nil || !ok || index < 0 || index >= len(pending.choice.Stores) {
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "Выбор устарел"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, query.Message.Text+"\n\n⌛ Выбор устарел. Отправьте УПД еще раз."))
+		return
+	}
+
+	store, err := b.processor.ChooseStore(pending.choice, pending.choice.Stores[index].ID)
+	if err != nil {
+		b.logger.Errorf("Failed to choose store: %v", err)
+		b.bot.Request(tgbotapi.NewCallback(query.ID, "Ошибка"))
+		b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%s\n\n❌ Не удалось выбрать склад:\n%v", query.Message.Text, err)))
+		return
+	}
+
+	b.logger.Infof("User %d chose store %s for counterparty %s", query.From.ID, store.Name, pending.choice.PartyINN)
+	b.bot.Request(tgbotapi.NewCallback(query.ID, "Склад выбран"))
+	b.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%s\n\n✅ %s\nСклад запомнен для контрагента до перезапуска бота.", query.Message.Text, store.Name)))
+
+	sentMsg, err := b.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("🔄 Повторяю обработку %s...", pending.filename)))
+	if err != nil {
+		b.logger.Errorf("Failed to send processing message: %v", err)
+		return
+	}
+	b.processDocument(chatID, sentMsg.MessageID, query.From.ID, pending.fileContent, pending.filename)
+}
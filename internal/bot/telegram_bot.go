@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/sirupsen/logrus"
 
 	"upd-loader-go/internal/config"
+	"upd-loader-go/internal/models"
+	"upd-loader-go/internal/moysklad"
 	"upd-loader-go/internal/processor"
 )
 
@@ -17,6 +20,9 @@ type TelegramUPDBot struct {
 	config    *config.Config
 	bot       *tgbotapi.BotAPI
 	processor *processor.UPDProcessor
+	plans     *pendingStore[*moysklad.UploadPlan]
+	choices   *pendingStore[models.UnmatchedItem]
+	stores    *pendingStore[storeChoice]
 	logger    *logrus.Logger
 }
 
@@ -33,6 +39,9 @@ func NewTelegramUPDBot(cfg *config.Config, logger *logrus.Logger) (*TelegramUPDB
 		config:    cfg,
 		bot:       bot,
 		processor: processor,
+		plans:     newPendingStore[*moysklad.UploadPlan](),
+		choices:   newPendingStore[models.UnmatchedItem](),
+		stores:    newPendingStore[storeChoice](),
 		logger:    logger,
 	}, nil
 }
@@ -41,6 +50,9 @@ func NewTelegramUPDBot(cfg *config.Config, logger *logrus.Logger) (*TelegramUPDB
 func (b *TelegramUPDBot) Run() error {
 	b.logger.Info("Starting Telegram bot...")
 
+	// Attributes for UPD metadata missing in MoySkald are reported at startup
+	b.processor.VerifyAttributes()
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
@@ -49,6 +61,8 @@ func (b *TelegramUPDBot) Run() error {
 	for update := range updates {
 		if update.Message != nil {
 			go b.handleUpdate(update)
+		} else if update.CallbackQuery != nil {
+			go b.handleCallback(update.CallbackQuery)
 		}
 	}
 
@@ -89,6 +103,12 @@ func (b *TelegramUPDBot) handleCommand(update tgbotapi.Update) {
 		b.handleHelpCommand(update)
 	case "status":
 		b.handleStatusCommand(update)
+	case "export":
+		b.handleExportCommand(update)
+	case "map":
+		b.handleMapCommand(update)
+	case "mappings":
+		b.handleMappingsCommand(update)
 	default:
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❓ Неизвестная команда. Используйте /help для получения справки.")
 		b.bot.Send(msg)
@@ -120,6 +140,11 @@ func (b *TelegramUPDBot) handleHelpCommand(update tgbotapi.Update) {
 /start - Начать работу с ботом
 /help - Показать эту справку
 /status - Проверить статус подключения к МойСклад
+/export <ID или ссылка> - Сформировать УПД по отгрузке МойСклад
+/map <ИНН>; <артикул>; <название>; <товар МойСклад> - Сопоставить товар поставщика с товаром МойСклад
+/mappings - Выгрузить сопоставления товаров в CSV
+
+🔗 Чтобы загрузить сопоставления, отправьте CSV файл в формате выгрузки /mappings.
 
 📎 Как загрузить УПД:
 1. Отправьте ZIP архив с УПД документом
@@ -151,20 +176,25 @@ func (b *TelegramUPDBot) handleStatusCommand(update tgbotapi.Update) {
 	statusInfo := b.processor.GetMoySkaldStatus()
 
 	var resultMessage string
-	if success, ok := statusInfo["success"].(bool); ok && success {
+	if statusInfo.Success {
 		// Format detailed success message
-		employee, _ := statusInfo["employee"].(map[string]interface{})
-		organization, _ := statusInfo["organization"].(map[string]interface{})
-		permissions, _ := statusInfo["permissions"].(map[string]interface{})
-
-		employeeName, _ := employee["name"].(string)
-		employeeEmail, _ := employee["email"].(string)
-		orgName, _ := organization["name"].(string)
-		orgINN, _ := organization["inn"].(string)
-
-		canCreateInvoices, _ := permissions["can_create_invoices"].(bool)
-		canAccessCounterparties, _ := permissions["can_access_counterparties"].(bool)
-		organizationsCount, _ := permissions["organizations_count"].(float64)
+		var employeeName, employeeEmail string
+		if statusInfo.Employee != nil {
+			employeeName, employeeEmail = statusInfo.Employee.Name, statusInfo.Employee.Email
+		}
+		var organizations strings.Builder
+		for _, organization := range statusInfo.Organizations {
+			organizations.WriteString("   " + formatOrganizationStatus(organization) + "\n")
+		}
+		var attributes strings.Builder
+		if len(statusInfo.AttributeProblems) > 0 {
+			attributes.WriteString("⚠️ Дополнительные поля для данных УПД:\n")
+			for _, problem := range statusInfo.AttributeProblems {
+				attributes.WriteString("   • " + problem + "\n")
+			}
+			attributes.WriteString("\n")
+		}
+		permissions := statusInfo.Permissions
 
 		resultMessage = fmt.Sprintf(`✅ Статус системы: Все работает!
 
@@ -172,26 +202,21 @@ func (b *TelegramUPDBot) handleStatusCommand(update tgbotapi.Update) {
    Имя: %s
    Email: %s
 
-🏢 Организация:
-   Название: %s
-   ИНН: %s
-
-🔐 Права доступа:
+🏢 Организации:
+%s
+%s🔐 Права доступа:
    %s Создание счетов-фактур
    %s Работа с контрагентами
-   📊 Организаций: %.0f
+   📊 Организаций: %d
 
 🤖 Telegram бот: Активен
 📁 Временная папка: Доступна
 
 🎉 Готов к обработке УПД документов!`,
-			employeeName, employeeEmail, orgName, orgINN,
-			boolToEmoji(canCreateInvoices), boolToEmoji(canAccessCounterparties), organizationsCount)
+			employeeName, employeeEmail, organizations.String(), attributes.String(),
+			boolToEmoji(permissions.CanCreateInvoices), boolToEmoji(permissions.CanAccessCounterparties), permissions.OrganizationsCount)
 	} else {
 		// Format error message
-		errorStr, _ := statusInfo["error"].(string)
-		details, _ := statusInfo["details"].(string)
-
 		resultMessage = fmt.Sprintf(`⚠️ Статус системы: Есть проблемы
 
 ❌ МойСклад API: %s
@@ -202,7 +227,7 @@ func (b *TelegramUPDBot) handleStatusCommand(update tgbotapi.Update) {
 💡 Рекомендации:
 • Проверьте токен МойСклад API
 • Убедитесь в наличии прав доступа
-• Обратитесь к администратору`, errorStr, details)
+• Обратитесь к администратору`, statusInfo.Error, statusInfo.Details)
 	}
 
 	// Edit the status message
@@ -210,6 +235,43 @@ func (b *TelegramUPDBot) handleStatusCommand(update tgbotapi.Update) {
 	b.bot.Send(editMsg)
 }
 
+// handleExportCommand handles /export command
+func (b *TelegramUPDBot) handleExportCommand(update tgbotapi.Update) {
+	demandRef := update.Message.CommandArguments()
+	if demandRef == "" {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "ℹ️ Укажите ID отгрузки или ссылку на нее:\n/export <ID или ссылка>")
+		b.bot.Send(msg)
+		return
+	}
+
+	statusMsg := tgbotapi.NewMessage(update.Message.Chat.ID, "🔄 Формирую УПД по отгрузке...")
+	sentMsg, err := b.bot.Send(statusMsg)
+	if err != nil {
+		b.logger.Errorf("Failed to send export message: %v", err)
+		return
+	}
+
+	result, err := b.processor.ExportDemandUPD(demandRef)
+	if err != nil {
+		b.logger.Errorf("UPD export error: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(update.Message.Chat.ID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка формирования УПД:\n%v", err))
+		b.bot.Send(editMsg)
+		return
+	}
+
+	doc := tgbotapi.NewDocument(update.Message.Chat.ID, tgbotapi.FileBytes{Name: result.FileName, Bytes: result.Content})
+	doc.Caption = result.UPDDocument.Summary()
+	if _, err := b.bot.Send(doc); err != nil {
+		b.logger.Errorf("Failed to send UPD container: %v", err)
+		editMsg := tgbotapi.NewEditMessageText(update.Message.Chat.ID, sentMsg.MessageID, "❌ Не удалось отправить файл УПД.")
+		b.bot.Send(editMsg)
+		return
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(update.Message.Chat.ID, sentMsg.MessageID, "✅ УПД сформирован")
+	b.bot.Send(editMsg)
+}
+
 // handleDocument handles document uploads
 func (b *TelegramUPDBot) handleDocument(update tgbotapi.Update) {
 	userID := update.Message.From.ID
@@ -217,6 +279,12 @@ func (b *TelegramUPDBot) handleDocument(update tgbotapi.Update) {
 
 	b.logger.Infof("Received document from user %d: %s", userID, document.FileName)
 
+	// CSV documents are item mappings, not UPD
+	if strings.HasSuffix(strings.ToLower(document.FileName), ".csv") {
+		b.handleMappingsImport(update.Message.Chat.ID, document.FileID)
+		return
+	}
+
 	// Send processing message
 	processingMsg := tgbotapi.NewMessage(update.Message.Chat.ID,
 		fmt.Sprintf(`📄 Получен файл: %s
@@ -240,17 +308,42 @@ func (b *TelegramUPDBot) handleDocument(update tgbotapi.Update) {
 		return
 	}
 
+	b.processDocument(update.Message.Chat.ID, sentMsg.MessageID, userID, fileContent, document.FileName)
+}
+
+// processDocument uploads UPD file and reports the result in the message.
+// In confirm mode the upload plan is shown instead of uploading.
+func (b *TelegramUPDBot) processDocument(chatID int64, messageID int, userID int64, fileContent []byte, filename string) {
+	if b.config.UploadMode == "confirm" {
+		b.handleDocumentPlan(chatID, messageID, fileContent, filename)
+		return
+	}
+
 	// Process UPD
-	result := b.processor.ProcessUPDFile(fileContent, document.FileName)
+	result := b.processor.ProcessUPDFile(fileContent, filename)
 
 	// Send result
-	editMsg := tgbotapi.NewEditMessageText(update.Message.Chat.ID, sentMsg.MessageID, result.Message)
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, result.Message)
 	b.bot.Send(editMsg)
 
 	if result.Success {
 		b.logger.Infof("UPD successfully processed for user %d", userID)
+		b.sendPrintable(chatID, result.UPDDocument)
 	} else {
 		b.logger.Warningf("UPD processing error for user %d: %s", userID, result.ErrorCode)
+		b.sendCandidateChoices(chatID, result.UnmatchedItems)
+		b.sendStoreChoice(chatID, result.StoreChoice, fileContent, filename)
+	}
+}
+
+// sendPrintable sends rendered printable UPD forms
+func (b *TelegramUPDBot) sendPrintable(chatID int64, updDocument *models.UPDDocument) {
+	for _, file := range b.processor.RenderPrintable(updDocument) {
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: file.FileName, Bytes: file.Content})
+		doc.Caption = "🖨 Печатная форма УПД"
+		if _, err := b.bot.Send(doc); err != nil {
+			b.logger.Errorf("Failed to send printable form %s: %v", file.FileName, err)
+		}
 	}
 }
 
@@ -296,4 +389,35 @@ func boolToEmoji(b bool) string {
 		return "✅"
 	}
 	return "❌"
+}
+
+// formatOrganizationStatus describes organization readiness for /status
+func formatOrganizationStatus(status moysklad.OrganizationStatus) string {
+	organization := status.Organization
+	line := fmt.Sprintf("%s %s", boolToEmoji(status.Ready()), organization.Name)
+	if organization.INN != "" {
+		requisites := "ИНН " + organization.INN
+		if organization.KPP != "" {
+			requisites += ", КПП " + organization.KPP
+		}
+		line += " (" + requisites + ")"
+	}
+
+	var notes []string
+	if status.Default {
+		notes = append(notes, "по умолчанию")
+	}
+	switch {
+	case organization.INN == "":
+		notes = append(notes, "не указан ИНН")
+	case status.Ambiguous:
+		notes = append(notes, "такие же ИНН и КПП у другой организации")
+	}
+	if status.Accounts == 0 {
+		notes = append(notes, "нет расчетного счета")
+	}
+	if len(notes) > 0 {
+		line += " — " + strings.Join(notes, ", ")
+	}
+	return line
 }
\ No newline at end of file
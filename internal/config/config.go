@@ -5,8 +5,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"upd-loader-go/internal/models"
 )
 
 // Config holds all configuration for the application
@@ -20,13 +23,75 @@ type Config struct {
 	MoySkladAPIURL        string
 	MoySkladOrganizationID string
 
+	// MoySkald API limits
+	MoySkladRateLimit     float64
+	MoySkladMaxConcurrent int
+	MoySkladMaxRetries    int
+
+	// MoySkald reference data cache
+	MoySkladCacheTTL  time.Duration
+	MoySkladCacheSize int
+	MoySkladCacheFile string
+
 	// Application settings
 	TempDir     string
 	LogLevel    string
 	MaxFileSize int64
 
-	// UPD file encoding
+	// Encoding of UPD files that declare none in the XML prolog and are
+	// not UTF-8
 	UPDEncoding string
+
+	// Upload mode: direct uploads immediately, confirm shows the upload
+	// plan and waits for confirmation
+	UploadMode string
+
+	// Missing products policy: fail, create or quarantine (create in
+	// QuarantineFolder)
+	MissingProducts  string
+	QuarantineFolder string
+
+	// CSV file of counterparty item to MoySkald product mappings
+	ItemMappingsFile string
+
+	// Fuzzy match confidence from 0 to 1 above which products are matched
+	// without asking
+	MatchThreshold float64
+
+	// Assortment match strategies in order: barcode, article, code,
+	// externalCode, name
+	MatchStrategies []string
+
+	// Existing counterparty requisites differing from UPD: off, propose
+	// (report and update on request) or apply
+	CounterpartyUpdates string
+
+	// Counterparty groups (tags) counterparties are resolved in; new
+	// counterparties are put in the first one
+	CounterpartyGroups []string
+
+	// Demand and supply stores when the linked documents have none, by
+	// counterparty INN and by organization INN or ID: store name or ID
+	CounterpartyStores map[string]string
+	OrganizationStores map[string]string
+
+	// Demand positions exceeding store stock: off, warn or fail
+	StockCheck string
+
+	// Printable form settings
+	PrintableFormat string
+	PDFFontPath     string
+
+	// Files attached to created documents: all (archive and printable
+	// forms), archive or none
+	AttachFiles string
+
+	// XSD schema exported UPD are checked against; empty disables the check
+	UPDSchemaPath string
+
+	// Demand and invoice attributes UPD metadata is written to by field,
+	// one of models.AttributeFields
+	DocumentAttributes map[string]string
 }
 
 // Load loads configuration from environment variables
@@ -42,6 +107,16 @@ func Load() (*Config, error) {
 		TempDir:                getEnvWithDefault("TEMP_DIR", "./temp"),
 		LogLevel:               getEnvWithDefault("LOG_LEVEL", "INFO"),
 		UPDEncoding:            "windows-1251",
+		UploadMode:             strings.ToLower(getEnvWithDefault("UPLOAD_MODE", "direct")),
+		MissingProducts:        strings.ToLower(getEnvWithDefault("MISSING_PRODUCTS", "fail")),
+		QuarantineFolder:       getEnvWithDefault("QUARANTINE_FOLDER", "УПД: на проверку"),
+		ItemMappingsFile:       getEnvWithDefault("ITEM_MAPPINGS_FILE", "./temp/item_mappings.csv"),
+		CounterpartyUpdates:    strings.ToLower(getEnvWithDefault("COUNTERPARTY_UPDATES", "propose")),
+		StockCheck:             strings.ToLower(getEnvWithDefault("STOCK_CHECK", "warn")),
+		PrintableFormat:        strings.ToLower(getEnvWithDefault("PRINTABLE_FORMAT", "pdf")),
+		PDFFontPath:            getEnvWithDefault("PDF_FONT_PATH", "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"),
+		AttachFiles:            strings.ToLower(getEnvWithDefault("ATTACH_FILES", "all")),
+		UPDSchemaPath:          getEnvWithDefault("UPD_XSD_PATH", "./data/XSD_UPD_503/ON_NSCHFDOPPR.xsd"),
 	}
 
 	// Parse authorized users
@@ -68,9 +143,156 @@ func Load() (*Config, error) {
 	}
 	config.MaxFileSize = maxFileSize
 
+	// Parse MoySkald API limits
+	rateLimitStr := getEnvWithDefault("MOYSKLAD_RATE_LIMIT", "15")
+	rateLimit, err := strconv.ParseFloat(rateLimitStr, 64)
+	if err != nil || rateLimit <= 0 {
+		return nil, fmt.Errorf("invalid MOYSKLAD_RATE_LIMIT: %s", rateLimitStr)
+	}
+	config.MoySkladRateLimit = rateLimit
+
+	maxConcurrentStr := getEnvWithDefault("MOYSKLAD_MAX_CONCURRENT", "5")
+	maxConcurrent, err := strconv.Atoi(maxConcurrentStr)
+	if err != nil || maxConcurrent <= 0 {
+		return nil, fmt.Errorf("invalid MOYSKLAD_MAX_CONCURRENT: %s", maxConcurrentStr)
+	}
+	config.MoySkladMaxConcurrent = maxConcurrent
+
+	maxRetriesStr := getEnvWithDefault("MOYSKLAD_MAX_RETRIES", "3")
+	maxRetries, err := strconv.Atoi(maxRetriesStr)
+	if err != nil || maxRetries < 0 {
+		return nil, fmt.Errorf("invalid MOYSKLAD_MAX_RETRIES: %s", maxRetriesStr)
+	}
+	config.MoySkladMaxRetries = maxRetries
+
+	// Parse MoySkald cache settings
+	cacheTTLStr := getEnvWithDefault("MOYSKLAD_CACHE_TTL", "10m")
+	cacheTTL, err := time.ParseDuration(cacheTTLStr)
+	if err != nil || cacheTTL < 0 {
+		return nil, fmt.Errorf("invalid MOYSKLAD_CACHE_TTL: %s", cacheTTLStr)
+	}
+	config.MoySkladCacheTTL = cacheTTL
+
+	cacheSizeStr := getEnvWithDefault("MOYSKLAD_CACHE_SIZE", "5000")
+	cacheSize, err := strconv.Atoi(cacheSizeStr)
+	if err != nil || cacheSize <= 0 {
+		return nil, fmt.Errorf("invalid MOYSKLAD_CACHE_SIZE: %s", cacheSizeStr)
+	}
+	config.MoySkladCacheSize = cacheSize
+	config.MoySkladCacheFile = os.Getenv("MOYSKLAD_CACHE_FILE")
+
+	// Parse fuzzy match threshold
+	thresholdStr := getEnvWithDefault("FUZZY_MATCH_THRESHOLD", "0.9")
+	threshold, err := strconv.ParseFloat(thresholdStr, 64)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("invalid FUZZY_MATCH_THRESHOLD: %s", thresholdStr)
+	}
+	config.MatchThreshold = threshold
+
+	// Parse match strategies
+	strategiesStr := getEnvWithDefault("MATCH_STRATEGIES", "barcode,article,code,externalCode,name")
+	for _, strategy := range strings.Split(strategiesStr, ",") {
+		switch strings.ToLower(strings.TrimSpace(strategy)) {
+		case "barcode", "article", "code", "name":
+			config.MatchStrategies = append(config.MatchStrategies, strings.ToLower(strings.TrimSpace(strategy)))
+		case "externalcode":
+			config.MatchStrategies = append(config.MatchStrategies, "externalCode")
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid MATCH_STRATEGIES: %s", strategiesStr)
+		}
+	}
+
+	// Parse counterparty groups
+	for _, group := range strings.Split(os.Getenv("COUNTERPARTY_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			config.CounterpartyGroups = append(config.CounterpartyGroups, group)
+		}
+	}
+
+	// Parse store rules
+	if config.CounterpartyStores, err = parseRules("COUNTERPARTY_STORES"); err != nil {
+		return nil, err
+	}
+	if config.OrganizationStores, err = parseRules("ORGANIZATION_STORES"); err != nil {
+		return nil, err
+	}
+
+	// Parse document attributes for UPD metadata
+	attributes, err := parseRules("UPD_ATTRIBUTES")
+	if err != nil {
+		return nil, err
+	}
+	config.DocumentAttributes = make(map[string]string, len(attributes))
+	for field, attribute := range attributes {
+		known := ""
+		for _, name := range models.AttributeFields {
+			if strings.EqualFold(field, name) {
+				known = name
+			}
+		}
+		if known == "" {
+			return nil, fmt.Errorf("invalid UPD_ATTRIBUTES: %s", field)
+		}
+		config.DocumentAttributes[known] = attribute
+	}
+
+	switch config.UploadMode {
+	case "direct", "confirm":
+	default:
+		return nil, fmt.Errorf("invalid UPLOAD_MODE: %s", config.UploadMode)
+	}
+
+	switch config.MissingProducts {
+	case "fail", "create", "quarantine":
+	default:
+		return nil, fmt.Errorf("invalid MISSING_PRODUCTS: %s", config.MissingProducts)
+	}
+
+	switch config.CounterpartyUpdates {
+	case "off", "propose", "apply":
+	default:
+		return nil, fmt.Errorf("invalid COUNTERPARTY_UPDATES: %s", config.CounterpartyUpdates)
+	}
+
+	switch config.StockCheck {
+	case "off", "warn", "fail":
+	default:
+		return nil, fmt.Errorf("invalid STOCK_CHECK: %s", config.StockCheck)
+	}
+
+	switch config.PrintableFormat {
+	case "html", "pdf", "both", "none":
+	default:
+		return nil, fmt.Errorf("invalid PRINTABLE_FORMAT: %s", config.PrintableFormat)
+	}
+
+	switch config.AttachFiles {
+	case "all", "archive", "none":
+	default:
+		return nil, fmt.Errorf("invalid ATTACH_FILES: %s", config.AttachFiles)
+	}
+
 	return config, nil
 }
 
+// parseRules parses comma-separated key=value rules of the variable
+func parseRules(name string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, rule := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(rule, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid %s: %s", name, rule)
+		}
+		rules[key] = value
+	}
+	return rules, nil
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() []string {
 	var errors []string
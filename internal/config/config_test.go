@@ -0,0 +1,32 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestDocumentAttributes(t *testing.T) {
+	// Every UPD metadata field is accepted, case-insensitively
+	var rules []string
+	for _, field := range models.AttributeFields {
+		rules = append(rules, strings.ToUpper(field)+"=Поле "+field)
+	}
+	t.Setenv("UPD_ATTRIBUTES", strings.Join(rules, ","))
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, field := range models.AttributeFields {
+		if got := cfg.DocumentAttributes[field]; got != "Поле "+field {
+			t.Errorf("attribute for %s = %q, want %q", field, got, "Поле "+field)
+		}
+	}
+
+	t.Setenv("UPD_ATTRIBUTES", "docFlowId=ID,unknownField=Поле")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "UPD_ATTRIBUTES") {
+		t.Errorf("Load with unknown field: err = %v, want invalid UPD_ATTRIBUTES", err)
+	}
+}
@@ -0,0 +1,153 @@
+package generator_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"upd-loader-go/internal/generator"
+	"upd-loader-go/internal/models"
+	"upd-loader-go/internal/parser"
+	"upd-loader-go/internal/xsd"
+)
+
+const (
+	casesPath = "../../data/updgen/cases.json"
+)
+
+var schemaPaths = map[string]string{
+	generator.FormatVersion501: "../../data/XSD__DOCS_FORMS_37774-UPD/ON_NSCHFDOPPR.xsd",
+	generator.FormatVersion:    "../../data/XSD_UPD_503/ON_NSCHFDOPPR.xsd",
+}
+
+// TestRoundTrip generates every case in its fixture version and in the
+// current version, checks it against the bundled schema of the version and
+// parses the container back comparing totals and lines
+func TestRoundTrip(t *testing.T) {
+	specs, err := generator.LoadSpecs(casesPath)
+	if err != nil {
+		t.Fatalf("failed to load cases: %v", err)
+	}
+	schemas := make(map[string]*xsd.Schema)
+	for version, path := range schemaPaths {
+		if schemas[version], err = xsd.LoadFile(path); err != nil {
+			t.Fatalf("failed to load %s schema: %v", version, err)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var cases []generator.Spec
+	for _, spec := range specs {
+		if spec.Version == "" {
+			spec.Version = generator.FormatVersion
+		}
+		cases = append(cases, spec)
+		if spec.Version != generator.FormatVersion {
+			current := spec
+			current.Name += "_" + generator.FormatVersion
+			current.Version = generator.FormatVersion
+			cases = append(cases, current)
+		}
+	}
+
+	for _, spec := range cases {
+		t.Run(spec.Name, func(t *testing.T) {
+			if spec.Generate != nil && spec.Generate.Count > 1000 && testing.Short() {
+				t.Skip("large case in short mode")
+			}
+
+			expected, err := spec.Document()
+			if err != nil {
+				t.Fatalf("failed to build document: %v", err)
+			}
+			opts := spec.Options()
+			schema := schemas[spec.Version]
+			if schema == nil {
+				t.Fatalf("no schema for version %q", spec.Version)
+			}
+
+			var xmlBuf bytes.Buffer
+			if err := generator.WriteUPDXML(&xmlBuf, expected, opts); err != nil {
+				t.Fatalf("failed to write XML: %v", err)
+			}
+			violations, err := schema.Validate(&xmlBuf)
+			if err != nil {
+				t.Fatalf("failed to validate XML: %v", err)
+			}
+			for _, violation := range violations {
+				t.Errorf("schema violation: %s", violation)
+			}
+
+			zipPath := filepath.Join(t.TempDir(), spec.Name+".zip")
+			file, err := os.Create(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := generator.WriteContainer(file, expected, opts); err != nil {
+				t.Fatalf("failed to write container: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			upd := parser.NewUPDParser(spec.Encoding, logger)
+			parsed, err := upd.ParseUPDArchive(zipPath)
+			if err != nil {
+				t.Fatalf("failed to parse container: %v", err)
+			}
+			defer upd.CleanupTempFiles(zipPath)
+
+			compareContent(t, &expected.Content, &parsed.Content)
+		})
+	}
+}
+
+func compareContent(t *testing.T, expected, parsed *models.UPDContent) {
+	t.Helper()
+
+	if parsed.InvoiceNumber != expected.InvoiceNumber {
+		t.Errorf("invoice number = %q, want %q", parsed.InvoiceNumber, expected.InvoiceNumber)
+	}
+	if !parsed.InvoiceDate.Equal(expected.InvoiceDate) {
+		t.Errorf("invoice date = %v, want %v", parsed.InvoiceDate, expected.InvoiceDate)
+	}
+	if parsed.Seller.INN != expected.Seller.INN || parsed.Buyer.INN != expected.Buyer.INN {
+		t.Errorf("seller/buyer INN = %s/%s, want %s/%s", parsed.Seller.INN, parsed.Buyer.INN, expected.Seller.INN, expected.Buyer.INN)
+	}
+	if parsed.CurrencyCode != expected.CurrencyCode {
+		t.Errorf("currency = %s, want %s", parsed.CurrencyCode, expected.CurrencyCode)
+	}
+	if !expected.IsDefaultCurrency() && !parsed.ExchangeRate.Equal(expected.ExchangeRate) {
+		t.Errorf("exchange rate = %s, want %s", parsed.ExchangeRate, expected.ExchangeRate)
+	}
+	if parsed.RequisiteNumber != expected.RequisiteNumber {
+		t.Errorf("basis number = %q, want %q", parsed.RequisiteNumber, expected.RequisiteNumber)
+	}
+
+	if !parsed.TotalWithoutVAT.Equal(expected.TotalWithoutVAT) ||
+		!parsed.TotalVAT.Equal(expected.TotalVAT) ||
+		!parsed.TotalWithVAT.Equal(expected.TotalWithVAT) {
+		t.Errorf("totals = %s + %s = %s, want %s + %s = %s",
+			parsed.TotalWithoutVAT, parsed.TotalVAT, parsed.TotalWithVAT,
+			expected.TotalWithoutVAT, expected.TotalVAT, expected.TotalWithVAT)
+	}
+
+	if len(parsed.Items) != len(expected.Items) {
+		t.Fatalf("parsed %d lines, want %d", len(parsed.Items), len(expected.Items))
+	}
+	for i, want := range expected.Items {
+		got := parsed.Items[i]
+		if got.Name != want.Name || got.Article != want.Article || got.UnitCode != want.UnitCode || got.UnitName != want.UnitName ||
+			!got.Quantity.Equal(want.Quantity) || !got.Price.Equal(want.Price) || got.VATRate != want.VATRate || got.Kind != want.Kind ||
+			!got.AmountWithoutVAT.Equal(want.AmountWithoutVAT) || !got.VATAmount.Equal(want.VATAmount) || !got.AmountWithVAT.Equal(want.AmountWithVAT) {
+			t.Errorf("line %d = %+v, want %+v", i+1, got, want)
+			return
+		}
+	}
+}
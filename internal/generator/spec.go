@@ -0,0 +1,323 @@
+// Package generator builds synthetic UPD documents and writes them as
+// Taxcom-style containers (meta.xml, card.xml and ON_NSCHFDOPPR XML).
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// Spec declaratively describes a synthetic UPD container
+type Spec struct {
+	Name         string        `json:"name"`
+	Encoding     string        `json:"encoding,omitempty"`
+	Version      string        `json:"version,omitempty"`
+	Seed         int64         `json:"seed,omitempty"`
+	Number       string        `json:"number"`
+	Date         string        `json:"date,omitempty"`
+	Seller       PartySpec     `json:"seller"`
+	Buyer        PartySpec     `json:"buyer"`
+	CurrencyCode string        `json:"currency_code,omitempty"`
+	CurrencyName string        `json:"currency_name,omitempty"`
+	ExchangeRate string        `json:"exchange_rate,omitempty"`
+	BasisNumber  string        `json:"basis_number,omitempty"`
+	Items        []ItemSpec    `json:"items,omitempty"`
+	Generate     *GenerateSpec `json:"generate,omitempty"`
+}
+
+// PartySpec describes seller or buyer
+type PartySpec struct {
+	Type       string `json:"type"` // legal or individual
+	Name       string `json:"name,omitempty"`
+	Surname    string `json:"surname,omitempty"`
+	FirstName  string `json:"first_name,omitempty"`
+	Patronymic string `json:"patronymic,omitempty"`
+	INN        string `json:"inn"`
+	KPP        string `json:"kpp,omitempty"`
+	Address    string `json:"address,omitempty"`
+}
+
+// ItemSpec describes a single invoice line
+type ItemSpec struct {
+	Name     string `json:"name"`
+	Article  string `json:"article,omitempty"`
+	UnitCode string `json:"unit_code,omitempty"`
+	UnitName string `json:"unit_name,omitempty"`
+	Quantity string `json:"quantity"`
+	Price    string `json:"price"`
+	VATRate  string `json:"vat_rate,omitempty"`
+	// Kind is ПрТовРаб: 1 for goods (default), 2 for work, 3 for services
+	Kind string `json:"kind,omitempty"`
+}
+
+// GenerateSpec describes lines generated in bulk
+type GenerateSpec struct {
+	Count        int      `json:"count"`
+	NamePrefix   string   `json:"name_prefix,omitempty"`
+	ArticleStart int      `json:"article_start,omitempty"`
+	Quantities   []string `json:"quantities,omitempty"`
+	Prices       []string `json:"prices,omitempty"`
+	VATRates     []string `json:"vat_rates,omitempty"`
+}
+
+// specFile is the on-disk format: a single spec or a list of cases
+type specFile struct {
+	Cases []Spec `json:"cases"`
+}
+
+// LoadSpecs loads specs from a JSON file containing either one spec or {"cases": [...]}
+func LoadSpecs(path string) ([]Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec file: %v", err)
+	}
+
+	var file specFile
+	if err := json.Unmarshal(data, &file); err == nil && len(file.Cases) > 0 {
+		return file.Cases, nil
+	}
+
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse spec file: %v", err)
+	}
+	return []Spec{spec}, nil
+}
+
+// defaultDate dates specs without a date, so that generated containers do
+// not depend on when they were generated
+var defaultDate = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// date returns the document date of the spec
+func (s *Spec) date() (time.Time, error) {
+	if s.Date == "" {
+		return defaultDate, nil
+	}
+	date, err := time.Parse("2006-01-02", s.Date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: %v", s.Date, err)
+	}
+	return date, nil
+}
+
+// Document builds UPD document model from the spec
+func (s *Spec) Document() (*models.UPDDocument, error) {
+	rng := rand.New(rand.NewSource(s.Seed))
+
+	date, err := s.date()
+	if err != nil {
+		return nil, err
+	}
+
+	seller, err := s.Seller.organization()
+	if err != nil {
+		return nil, fmt.Errorf("seller: %v", err)
+	}
+	buyer, err := s.Buyer.organization()
+	if err != nil {
+		return nil, fmt.Errorf("buyer: %v", err)
+	}
+
+	content := models.NewUPDContent(s.Number, date, seller, buyer)
+	if s.CurrencyCode != "" {
+		content.CurrencyCode = s.CurrencyCode
+	}
+	content.CurrencyName = s.CurrencyName
+	if s.ExchangeRate != "" {
+		rate, err := decimal.NewFromString(s.ExchangeRate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exchange rate %q: %v", s.ExchangeRate, err)
+		}
+		content.ExchangeRate = rate
+	}
+	content.RequisiteNumber = s.BasisNumber
+
+	for _, itemSpec := range s.items() {
+		item, err := itemSpec.item(len(content.Items) + 1)
+		if err != nil {
+			return nil, err
+		}
+		content.Items = append(content.Items, item)
+		content.TotalWithoutVAT = content.TotalWithoutVAT.Add(item.AmountWithoutVAT)
+		content.TotalVAT = content.TotalVAT.Add(item.VATAmount)
+		content.TotalWithVAT = content.TotalWithVAT.Add(item.AmountWithVAT)
+	}
+
+	return NewDocument(content, s.Options().version(), newUUID(rng), newUUID(rng)), nil
+}
+
+// Options returns writer options for the spec encoding and format version.
+// The document is written as created at the start of its date, so the same
+// spec always gives the same container.
+func (s *Spec) Options() Options {
+	date, err := s.date()
+	if err != nil {
+		date = defaultDate
+	}
+	return Options{Encoding: s.Encoding, Version: s.Version, Now: func() time.Time { return date }}
+}
+
+// NewDocument wraps content into a container document of the format version
+// with the given document flow ID and file GUID
+func NewDocument(content *models.UPDContent, version, docFlowID, guid string) *models.UPDDocument {
+	fileID := FileID(version, content, content.InvoiceDate, guid)
+
+	return &models.UPDDocument{
+		MetaInfo: models.MetaInfo{
+			DocFlowID:        docFlowID,
+			MainDocumentPath: "1/" + fileID + ".xml",
+			CardPath:         "1/card.xml",
+		},
+		CardInfo: models.CardInfo{
+			ExternalIdentifier: fileID,
+			Title:              "Универсальный передаточный документ",
+			Date:               content.InvoiceDate,
+			SenderINN:          content.Seller.INN,
+			SenderKPP:          content.Seller.KPP,
+			SenderName:         content.Seller.Name,
+		},
+		Content: *content,
+	}
+}
+
+// items returns explicit items followed by generated ones
+func (s *Spec) items() []ItemSpec {
+	items := append([]ItemSpec(nil), s.Items...)
+	if s.Generate == nil || s.Generate.Count <= 0 {
+		return items
+	}
+
+	g := s.Generate
+	prefix := g.NamePrefix
+	if prefix == "" {
+		prefix = "Товар"
+	}
+	quantities := defaultValues(g.Quantities, "1")
+	prices := defaultValues(g.Prices, "100")
+	vatRates := defaultValues(g.VATRates, "20%")
+
+	for i := 0; i < g.Count; i++ {
+		article := ""
+		if g.ArticleStart > 0 {
+			article = fmt.Sprintf("%d", g.ArticleStart+i)
+		}
+		items = append(items, ItemSpec{
+			Name:     fmt.Sprintf("%s %d", prefix, i+1),
+			Article:  article,
+			Quantity: quantities[i%len(quantities)],
+			Price:    prices[i%len(prices)],
+			VATRate:  vatRates[i%len(vatRates)],
+		})
+	}
+
+	return items
+}
+
+// item converts spec line to invoice item calculating amounts
+func (is ItemSpec) item(lineNumber int) (models.InvoiceItem, error) {
+	quantity, err := decimal.NewFromString(is.Quantity)
+	if err != nil {
+		return models.InvoiceItem{}, fmt.Errorf("line %d: invalid quantity %q", lineNumber, is.Quantity)
+	}
+	price, err := decimal.NewFromString(is.Price)
+	if err != nil {
+		return models.InvoiceItem{}, fmt.Errorf("line %d: invalid price %q", lineNumber, is.Price)
+	}
+
+	vatRate := is.VATRate
+	if vatRate == "" {
+		vatRate = "20%"
+	}
+	kind := is.Kind
+	if kind == "" {
+		kind = models.KindGoods
+	}
+	unitCode, unitName := is.UnitCode, is.UnitName
+	if unitCode == "" {
+		unitCode, unitName = "796", "шт"
+	}
+
+	amount := quantity.Mul(price).Round(2)
+	vatAmount := decimal.Zero
+	withVAT := amount
+
+	if percent, ok := vatPercent(vatRate); ok {
+		if strings.Contains(vatRate, "/") {
+			// Calculated rate: the price already includes VAT
+			vatAmount = amount.Mul(percent).Div(percent.Add(decimal.NewFromInt(100))).Round(2)
+			amount = withVAT.Sub(vatAmount)
+		} else {
+			vatAmount = amount.Mul(percent).Div(decimal.NewFromInt(100)).Round(2)
+			withVAT = amount.Add(vatAmount)
+		}
+	}
+
+	return models.InvoiceItem{
+		LineNumber:       lineNumber,
+		Name:             is.Name,
+		UnitCode:         unitCode,
+		UnitName:         unitName,
+		Quantity:         quantity,
+		Price:            price,
+		AmountWithoutVAT: amount,
+		VATRate:          vatRate,
+		VATAmount:        vatAmount,
+		AmountWithVAT:    withVAT,
+		Article:          is.Article,
+		Kind:             kind,
+	}, nil
+}
+
+// organization converts party spec to organization model
+func (ps PartySpec) organization() (models.Organization, error) {
+	switch ps.Type {
+	case "individual":
+		if len(ps.INN) != 12 {
+			return models.Organization{}, fmt.Errorf("individual INN must have 12 digits: %q", ps.INN)
+		}
+		name := strings.TrimSpace(strings.Join([]string{ps.Surname, ps.FirstName, ps.Patronymic}, " "))
+		if name == "" {
+			name = ps.Name
+		}
+		return models.Organization{Name: name, INN: ps.INN, Address: textAddress(ps.Address)}, nil
+	case "legal", "":
+		if len(ps.INN) != 10 {
+			return models.Organization{}, fmt.Errorf("legal entity INN must have 10 digits: %q", ps.INN)
+		}
+		return models.Organization{Name: ps.Name, INN: ps.INN, KPP: ps.KPP, Address: textAddress(ps.Address)}, nil
+	default:
+		return models.Organization{}, fmt.Errorf("unknown party type %q", ps.Type)
+	}
+}
+
+func textAddress(address string) *models.Address {
+	if address == "" {
+		return nil
+	}
+	return &models.Address{Street: address}
+}
+
+func defaultValues(values []string, defaultValue string) []string {
+	if len(values) == 0 {
+		return []string{defaultValue}
+	}
+	return values
+}
+
+// newUUID returns a version 4 UUID from the seeded source, so generated
+// containers are reproducible. Use models.NewUUID for real documents.
+func newUUID(rng *rand.Rand) string {
+	b := make([]byte, 16)
+	rng.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
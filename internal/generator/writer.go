@@ -0,0 +1,552 @@
+package generator
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"upd-loader-go/internal/models"
+)
+
+const (
+	// FormatVersion is the current UPD format version, written by default
+	FormatVersion = "5.03"
+	// FormatVersion501 is the previous format version the generator fixtures
+	// are written in; its schema is bundled with the repository
+	FormatVersion501 = "5.01"
+	// FilePrefix is the ИдФайл prefix of the seller's UPD file
+	FilePrefix = "ON_NSCHFDOPPR"
+
+	defaultEncoding     = "windows-1251"
+	programVersion      = "UPD Loader"
+	defaultCurrencyName = "Российский рубль"
+	shipmentFact        = "Документ об отгрузке товаров (выполнении работ), передаче имущественных прав (документ об оказании услуг)"
+	documentName        = "Счет-фактура и документ об отгрузке товаров (выполнении работ), передаче имущественных прав (документ об оказании услуг)"
+)
+
+var vatPercentRe = regexp.MustCompile(`^(\d+)(%|/\d+)$`)
+
+// Options controls XML and container output
+type Options struct {
+	// Encoding is "windows-1251" (default) or "utf-8"
+	Encoding string
+	// Version is the format version: FormatVersion (default) or FormatVersion501
+	Version string
+	// Function is Документ@Функция: СЧФДОП (default), ДОП or СЧФ
+	Function string
+	// SignerPosition and SignerName describe the signer block
+	SignerPosition string
+	SignerName     string
+	// Now returns the time written to ДатаИнфПр and ВремИнфПр, time.Now
+	// when nil
+	Now func() time.Time
+}
+
+func (o Options) encoding() string {
+	if o.Encoding == "" {
+		return defaultEncoding
+	}
+	return strings.ToLower(o.Encoding)
+}
+
+func (o Options) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
+	}
+	return o.Now()
+}
+
+func (o Options) version() string {
+	if o.Version == "" {
+		return FormatVersion
+	}
+	return o.Version
+}
+
+// FileID builds ИдФайл for the format version:
+// ON_NSCHFDOPPR_<receiver>_<sender>_<date>_<guid> in 5.01, followed by
+// _0_0_0_0_0_00 in 5.03 for a primary document without corrections
+func FileID(version string, content *models.UPDContent, date time.Time, guid string) string {
+	fileID := fmt.Sprintf("%s_%s_%s_%s_%s",
+		FilePrefix, participantID(content.Buyer), participantID(content.Seller), date.Format("20060102"), guid)
+	if version == FormatVersion501 {
+		return fileID
+	}
+	return fileID + "_0_0_0_0_0_00"
+}
+
+// participantID returns EDO participant identifier built from INN and KPP
+func participantID(org models.Organization) string {
+	if org.KPP != "" {
+		return org.INN + "_" + org.KPP
+	}
+	return org.INN
+}
+
+// WriteContainer writes a Taxcom-style ZIP container for the document
+func WriteContainer(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		path  string
+		write func(io.Writer) error
+	}{
+		{"meta.xml", func(fw io.Writer) error { return writeMeta(fw, doc, opts) }},
+		{doc.MetaInfo.CardPath, func(fw io.Writer) error { return writeCard(fw, doc, opts) }},
+		{doc.MetaInfo.MainDocumentPath, func(fw io.Writer) error { return WriteUPDXML(fw, doc, opts) }},
+	}
+
+	for _, file := range files {
+		fw, err := archive.Create(file.path)
+		if err != nil {
+			return err
+		}
+		if err := file.write(fw); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file.path, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+// WriteUPDXML writes the ON_NSCHFDOPPR document in the format version of opts
+func WriteUPDXML(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	switch opts.version() {
+	case FormatVersion:
+		return writeUPD503(w, doc, opts)
+	case FormatVersion501:
+		return writeUPD501(w, doc, opts)
+	default:
+		return fmt.Errorf("unsupported format version: %s", opts.Version)
+	}
+}
+
+// writeUPD501 writes the ON_NSCHFDOPPR 5.01 document
+func writeUPD501(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	x, err := newXMLWriter(w, opts.encoding())
+	if err != nil {
+		return err
+	}
+
+	content := doc.Content
+	function := opts.function()
+	now := opts.now()
+
+	x.start("Файл", "ИдФайл", documentFileID(doc), "ВерсФорм", FormatVersion501, "ВерсПрог", programVersion)
+	x.empty("СвУчДокОбор", "ИдОтпр", participantID(content.Seller), "ИдПол", participantID(content.Buyer))
+	x.start("Документ",
+		"КНД", "1115131",
+		"Функция", function,
+		"ПоФактХЖ", shipmentFact,
+		"НаимДокОпр", documentName,
+		"ДатаИнфПр", now.Format("02.01.2006"),
+		"ВремИнфПр", now.Format("15.04.05"),
+		"НаимЭконСубСост", economicSubject(content.Seller))
+
+	x.start("СвСчФакт",
+		"НомерСчФ", content.InvoiceNumber,
+		"ДатаСчФ", content.InvoiceDate.Format("02.01.2006"),
+		"КодОКВ", currencyCode(&content))
+	x.party("СвПрод", content.Seller, FormatVersion501)
+	x.start("ГрузОт")
+	x.text("ОнЖе", "он же")
+	x.end()
+	x.party("ГрузПолуч", content.Buyer, FormatVersion501)
+	x.party("СвПокуп", content.Buyer, FormatVersion501)
+
+	// Currency name and rate are additional information in 5.01
+	currencyName := content.CurrencyName
+	if currencyName == "" && content.IsDefaultCurrency() {
+		currencyName = defaultCurrencyName
+	}
+	var currencyAttrs []string
+	if currencyName != "" {
+		currencyAttrs = append(currencyAttrs, "НаимОКВ", currencyName)
+	}
+	if !content.IsDefaultCurrency() && content.ExchangeRate.GreaterThan(decimal.Zero) {
+		currencyAttrs = append(currencyAttrs, "КурсВал", content.ExchangeRate.StringFixed(4))
+	}
+	if len(currencyAttrs) > 0 {
+		x.empty("ДопСвФХЖ1", currencyAttrs...)
+	}
+	x.end() // СвСчФакт
+
+	x.start("ТаблСчФакт")
+	for _, item := range content.Items {
+		x.item501(item)
+	}
+	x.start("ВсегоОпл",
+		"СтТовБезНДСВсего", amount(content.TotalWithoutVAT),
+		"СтТовУчНалВсего", amount(content.TotalWithVAT))
+	x.vatSum("СумНалВсего", content.TotalVAT, allWithoutVAT(content.Items))
+	x.end() // ВсегоОпл
+	x.end() // ТаблСчФакт
+
+	x.start("СвПродПер")
+	x.start("СвПер", "СодОпер", "Товары переданы", "ДатаПер", content.InvoiceDate.Format("02.01.2006"))
+	basisDate := content.RequisiteDate
+	if basisDate.IsZero() {
+		basisDate = content.InvoiceDate
+	}
+	if content.RequisiteNumber != "" {
+		x.empty("ОснПер",
+			"НаимОсн", "Счет",
+			"НомОсн", content.RequisiteNumber,
+			"ДатаОсн", basisDate.Format("02.01.2006"))
+	} else {
+		x.empty("ОснПер", "НаимОсн", "Без документа-основания", "ДатаОсн", basisDate.Format("02.01.2006"))
+	}
+	x.end() // СвПер
+	x.end() // СвПродПер
+
+	x.signer501(content.Seller, opts)
+
+	x.end() // Документ
+	x.end() // Файл
+
+	return x.close()
+}
+
+func (o Options) function() string {
+	if o.Function == "" {
+		return "СЧФДОП"
+	}
+	return o.Function
+}
+
+// documentFileID returns ИдФайл of the document: the main document file
+// name or the external identifier
+func documentFileID(doc *models.UPDDocument) string {
+	if fileID := strings.TrimSuffix(pathBase(doc.MetaInfo.MainDocumentPath), ".xml"); fileID != "" {
+		return fileID
+	}
+	return doc.CardInfo.ExternalIdentifier
+}
+
+func currencyCode(content *models.UPDContent) string {
+	if content.CurrencyCode == "" {
+		return models.DefaultCurrencyCode
+	}
+	return content.CurrencyCode
+}
+
+// writeMeta writes Taxcom container description
+func writeMeta(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	x, err := newXMLWriter(w, opts.encoding())
+	if err != nil {
+		return err
+	}
+
+	x.start("ContainerDescription", "xmlns", "http://api-invoice.taxcom.ru/meta")
+	x.start("DocFlow", "Id", doc.MetaInfo.DocFlowID)
+	x.start("Documents")
+	x.start("Document", "ReglamentCode", "UniversalTransferDocument", "TransactionCode", "MainDocument")
+	x.start("Files")
+	x.empty("MainImage", "Path", doc.MetaInfo.MainDocumentPath)
+	x.empty("ExternalCard", "Path", doc.MetaInfo.CardPath)
+	x.end() // Files
+	x.end() // Document
+	x.end() // Documents
+	x.end() // DocFlow
+	x.end() // ContainerDescription
+
+	return x.close()
+}
+
+// writeCard writes Taxcom document card
+func writeCard(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	x, err := newXMLWriter(w, opts.encoding())
+	if err != nil {
+		return err
+	}
+
+	card := doc.CardInfo
+	x.start("Card", "xmlns", "http://api-invoice.taxcom.ru/card")
+	x.empty("Identifiers", "ExternalIdentifier", card.ExternalIdentifier)
+	x.empty("Type")
+	x.empty("Description", "Title", card.Title, "Date", card.Date.Format("2006-01-02T15:04:05"))
+	x.start("Sender")
+	abonent := []string{"Id", participantID(models.Organization{INN: card.SenderINN, KPP: card.SenderKPP}), "Name", card.SenderName, "Inn", card.SenderINN}
+	if card.SenderKPP != "" {
+		abonent = append(abonent, "Kpp", card.SenderKPP)
+	}
+	x.empty("Abonent", abonent...)
+	x.end() // Sender
+	x.empty("Receiver")
+	x.end() // Card
+
+	return x.close()
+}
+
+// xmlWriter is a small helper over xml.Encoder that remembers the first error
+type xmlWriter struct {
+	out   io.Writer
+	buf   *bytes.Buffer
+	enc   *xml.Encoder
+	names []string
+	err   error
+}
+
+func newXMLWriter(w io.Writer, enc string) (*xmlWriter, error) {
+	switch enc {
+	case "utf-8", "windows-1251":
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", enc)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<?xml version=\"1.0\" encoding=\"%s\"?>\n", enc)
+
+	x := &xmlWriter{buf: buf, enc: xml.NewEncoder(buf)}
+	x.enc.Indent("", "\t")
+	if enc == "windows-1251" {
+		x.out = encoding.ReplaceUnsupported(charmap.Windows1251.NewEncoder()).Writer(w)
+	} else {
+		x.out = w
+	}
+	return x, nil
+}
+
+func (x *xmlWriter) start(name string, attrs ...string) {
+	if x.err != nil {
+		return
+	}
+	el := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		el.Attr = append(el.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	x.names = append(x.names, name)
+	x.err = x.enc.EncodeToken(el)
+
+	// Flush large documents in chunks to keep memory bounded
+	if x.err == nil && x.buf.Len() > 64*1024 {
+		x.err = x.flush()
+	}
+}
+
+func (x *xmlWriter) end() {
+	if x.err != nil || len(x.names) == 0 {
+		return
+	}
+	name := x.names[len(x.names)-1]
+	x.names = x.names[:len(x.names)-1]
+	x.err = x.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+func (x *xmlWriter) empty(name string, attrs ...string) {
+	x.start(name, attrs...)
+	x.end()
+}
+
+func (x *xmlWriter) text(name, value string) {
+	x.start(name)
+	if x.err == nil {
+		x.err = x.enc.EncodeToken(xml.CharData(value))
+	}
+	x.end()
+}
+
+func (x *xmlWriter) flush() error {
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := x.out.Write(x.buf.Bytes())
+	x.buf.Reset()
+	return err
+}
+
+func (x *xmlWriter) close() error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := x.flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(x.out, "\n")
+	return err
+}
+
+// party writes seller/buyer block. Foreign address text carries the country
+// name since 5.03.
+func (x *xmlWriter) party(name string, org models.Organization, version string) {
+	x.start(name)
+	x.start("ИдСв")
+	if len(org.INN) == 12 {
+		surname, firstName, patronymic := splitFIO(org.Name)
+		x.start("СвИП", "ИННФЛ", org.INN)
+		x.fio(surname, firstName, patronymic)
+		x.end()
+	} else {
+		attrs := []string{"НаимОрг", org.Name, "ИННЮЛ", org.INN}
+		if org.KPP != "" {
+			attrs = append(attrs, "КПП", org.KPP)
+		}
+		x.empty("СвЮЛУч", attrs...)
+	}
+	x.end() // ИдСв
+
+	if text := org.Address.String(); text != "" {
+		x.start("Адрес")
+		if version == FormatVersion501 {
+			x.empty("АдрИнф", "КодСтр", "643", "АдрТекст", text)
+		} else {
+			x.empty("АдрИнф", "КодСтр", "643", "НаимСтран", "РОССИЯ", "АдрТекст", text)
+		}
+		x.end()
+	}
+	x.end()
+}
+
+// signer501 writes Подписант block: the head of the seller organization or
+// the entrepreneur, acting within official duties
+func (x *xmlWriter) signer501(seller models.Organization, opts Options) {
+	x.start("Подписант", "ОблПолн", "0", "Статус", "1", "ОснПолн", "Должностные обязанности")
+	surname, name, patronymic := splitFIO(opts.SignerName)
+	if len(seller.INN) == 12 {
+		if opts.SignerName == "" {
+			surname, name, patronymic = splitFIO(seller.Name)
+		}
+		x.start("ИП", "ИННФЛ", seller.INN)
+	} else {
+		position := opts.SignerPosition
+		if position == "" {
+			position = "Руководитель"
+		}
+		x.start("ЮЛ", "ИННЮЛ", seller.INN, "Должн", position)
+	}
+	x.fio(surname, name, patronymic)
+	x.end()
+	x.end() // Подписант
+}
+
+func (x *xmlWriter) fio(surname, name, patronymic string) {
+	attrs := []string{"Фамилия", surname, "Имя", name}
+	if patronymic != "" {
+		attrs = append(attrs, "Отчество", patronymic)
+	}
+	x.empty("ФИО", attrs...)
+}
+
+// item501 writes a СведТов line
+func (x *xmlWriter) item501(item models.InvoiceItem) {
+	attrs := []string{
+		"НомСтр", fmt.Sprintf("%d", item.LineNumber),
+		"НаимТов", item.Name,
+	}
+	if item.UnitCode != "" {
+		attrs = append(attrs, "ОКЕИ_Тов", item.UnitCode)
+	}
+	attrs = append(attrs,
+		"КолТов", item.Quantity.String(),
+		"ЦенаТов", item.Price.String(),
+		"СтТовБезНДС", amount(item.AmountWithoutVAT),
+		"НалСт", item.VATRate,
+		"СтТовУчНал", amount(item.AmountWithVAT),
+	)
+
+	x.start("СведТов", attrs...)
+	x.start("Акциз")
+	x.text("БезАкциз", "без акциза")
+	x.end()
+	x.vatSum("СумНал", item.VATAmount, isWithoutVAT(item.VATRate))
+
+	// Unit name and product code are additional line information in 5.01
+	extra := []string{"ПрТовРаб", itemKind(item)}
+	if item.UnitName != "" {
+		extra = append(extra, "НаимЕдИзм", item.UnitName)
+	}
+	if item.Article != "" {
+		extra = append(extra, "КодТов", item.Article)
+	}
+	x.empty("ДопСведТов", extra...)
+	x.end()
+}
+
+// itemKind returns ПрТовРаб of the line: 1 for goods unless the line says
+// it is a work, service or property right
+func itemKind(item models.InvoiceItem) string {
+	if item.Kind == "" {
+		return models.KindGoods
+	}
+	return item.Kind
+}
+
+// vatSum writes СумНал-style block with either amount or "без НДС"
+func (x *xmlWriter) vatSum(name string, value decimal.Decimal, withoutVAT bool) {
+	x.start(name)
+	if withoutVAT {
+		x.text("БезНДС", "без НДС")
+	} else {
+		x.text("СумНал", amount(value))
+	}
+	x.end()
+}
+
+// vatPercent extracts numeric rate from НалСт value like "20%" or "20/120"
+func vatPercent(rate string) (decimal.Decimal, bool) {
+	matches := vatPercentRe.FindStringSubmatch(strings.TrimSpace(rate))
+	if matches == nil {
+		return decimal.Zero, false
+	}
+	value, err := decimal.NewFromString(matches[1])
+	return value, err == nil
+}
+
+func isWithoutVAT(rate string) bool {
+	_, ok := vatPercent(rate)
+	return !ok
+}
+
+func allWithoutVAT(items []models.InvoiceItem) bool {
+	if len(items) == 0 {
+		return false
+	}
+	for _, item := range items {
+		if !isWithoutVAT(item.VATRate) {
+			return false
+		}
+	}
+	return true
+}
+
+func amount(value decimal.Decimal) string {
+	return value.StringFixed(2)
+}
+
+func economicSubject(org models.Organization) string {
+	if org.KPP != "" {
+		return fmt.Sprintf("%s, ИНН/КПП %s/%s", org.Name, org.INN, org.KPP)
+	}
+	return fmt.Sprintf("%s, ИНН %s", org.Name, org.INN)
+}
+
+// splitFIO splits full name into surname, name and patronymic
+func splitFIO(fullName string) (string, string, string) {
+	parts := strings.Fields(fullName)
+	switch len(parts) {
+	case 0:
+		return "-", "-", ""
+	case 1:
+		return parts[0], "-", ""
+	case 2:
+		return parts[0], parts[1], ""
+	default:
+		return parts[0], parts[1], strings.Join(parts[2:], " ")
+	}
+}
+
+func pathBase(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
@@ -0,0 +1,167 @@
+package generator
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// writeUPD503 writes the ON_NSCHFDOPPR 5.03 document. Compared to 5.01 it has
+// no СвУчДокОбор, names invoice requisites НомерДок/ДатаДок, moves currency
+// to ДенИзм, refers to the shipping document in ДокПодтвОтгрНом and
+// describes basis documents and the signer with Рекв*/Подписант attributes
+// of the new format.
+func writeUPD503(w io.Writer, doc *models.UPDDocument, opts Options) error {
+	x, err := newXMLWriter(w, opts.encoding())
+	if err != nil {
+		return err
+	}
+
+	content := doc.Content
+	function := opts.function()
+	now := opts.now()
+	invoiceDate := content.InvoiceDate.Format("02.01.2006")
+
+	x.start("Файл", "ИдФайл", documentFileID(doc), "ВерсФорм", FormatVersion, "ВерсПрог", programVersion)
+	x.start("Документ",
+		"КНД", "1115131",
+		"Функция", function,
+		"ПоФактХЖ", shipmentFact,
+		"НаимДокОпр", documentName,
+		"ДатаИнфПр", now.Format("02.01.2006"),
+		"ВремИнфПр", now.Format("15.04.05"),
+		"НаимЭконСубСост", economicSubject(content.Seller))
+
+	x.start("СвСчФакт", "НомерДок", content.InvoiceNumber, "ДатаДок", invoiceDate)
+	x.party("СвПрод", content.Seller, FormatVersion)
+	x.start("ГрузОт")
+	x.text("ОнЖе", "он же")
+	x.end()
+	x.party("ГрузПолуч", content.Buyer, FormatVersion)
+	if function != "СЧФ" {
+		// The UPD itself is the shipping document
+		x.empty("ДокПодтвОтгрНом",
+			"РеквНаимДок", "Универсальный передаточный документ",
+			"РеквНомерДок", content.InvoiceNumber,
+			"РеквДатаДок", invoiceDate)
+	}
+	x.party("СвПокуп", content.Buyer, FormatVersion)
+
+	currencyName := content.CurrencyName
+	if currencyName == "" {
+		if content.IsDefaultCurrency() {
+			currencyName = defaultCurrencyName
+		} else {
+			// НаимОКВ is required, the code is the best name we know
+			currencyName = currencyCode(&content)
+		}
+	}
+	currencyAttrs := []string{"КодОКВ", currencyCode(&content), "НаимОКВ", currencyName}
+	if !content.IsDefaultCurrency() && content.ExchangeRate.GreaterThan(decimal.Zero) {
+		currencyAttrs = append(currencyAttrs, "КурсВал", content.ExchangeRate.StringFixed(4))
+	}
+	x.empty("ДенИзм", currencyAttrs...)
+	x.end() // СвСчФакт
+
+	x.start("ТаблСчФакт")
+	for _, item := range content.Items {
+		x.item503(item)
+	}
+	x.start("ВсегоОпл",
+		"СтТовБезНДСВсего", amount(content.TotalWithoutVAT),
+		"СтТовУчНалВсего", amount(content.TotalWithVAT))
+	x.vatSum("СумНалВсего", content.TotalVAT, allWithoutVAT(content.Items))
+	x.end() // ВсегоОпл
+	x.end() // ТаблСчФакт
+
+	x.start("СвПродПер")
+	x.start("СвПер", "СодОпер", "Товары переданы", "ДатаПер", invoiceDate)
+	basisDate := content.RequisiteDate
+	if basisDate.IsZero() {
+		basisDate = content.InvoiceDate
+	}
+	if content.RequisiteNumber != "" {
+		x.empty("ОснПер",
+			"РеквНаимДок", "Счет",
+			"РеквНомерДок", content.RequisiteNumber,
+			"РеквДатаДок", basisDate.Format("02.01.2006"))
+	} else {
+		x.empty("ОснПер", "РеквНаимДок", "Без документа-основания", "РеквДатаДок", basisDate.Format("02.01.2006"))
+	}
+	x.end() // СвПер
+	x.end() // СвПродПер
+
+	x.signer503(content.Seller, opts)
+
+	x.end() // Документ
+	x.end() // Файл
+
+	return x.close()
+}
+
+// signer503 writes Подписант block signed with a qualified signature, with
+// authority confirmed by the certificate data
+func (x *xmlWriter) signer503(seller models.Organization, opts Options) {
+	surname, name, patronymic := splitFIO(opts.SignerName)
+	var attrs []string
+	if len(seller.INN) == 12 {
+		if opts.SignerName == "" {
+			surname, name, patronymic = splitFIO(seller.Name)
+		}
+	} else {
+		position := opts.SignerPosition
+		if position == "" {
+			position = "Руководитель"
+		}
+		attrs = append(attrs, "Должн", position)
+	}
+	attrs = append(attrs, "ТипПодпис", "1", "СпосПодтПолном", "1")
+
+	x.start("Подписант", attrs...)
+	x.fio(surname, name, patronymic)
+	x.end()
+}
+
+// item503 writes a СведТов line. The unit name is a line attribute and the
+// country of origin is written in СвДТ and ДопСведТов since 5.03.
+func (x *xmlWriter) item503(item models.InvoiceItem) {
+	attrs := []string{
+		"НомСтр", fmt.Sprintf("%d", item.LineNumber),
+		"НаимТов", item.Name,
+	}
+	if item.UnitCode != "" {
+		attrs = append(attrs, "ОКЕИ_Тов", item.UnitCode)
+	}
+	if item.UnitName != "" {
+		attrs = append(attrs, "НаимЕдИзм", item.UnitName)
+	}
+	attrs = append(attrs,
+		"КолТов", item.Quantity.String(),
+		"ЦенаТов", item.Price.String(),
+		"СтТовБезНДС", amount(item.AmountWithoutVAT),
+		"НалСт", item.VATRate,
+		"СтТовУчНал", amount(item.AmountWithVAT),
+	)
+
+	x.start("СведТов", attrs...)
+	if item.CountryCode != "" {
+		x.empty("СвДТ", "КодПроисх", item.CountryCode)
+	}
+	extra := []string{"ПрТовРаб", itemKind(item)}
+	if item.Article != "" {
+		extra = append(extra, "КодТов", item.Article)
+	}
+	x.start("ДопСведТов", extra...)
+	if item.CountryName != "" {
+		x.text("КрНаимСтрПр", item.CountryName)
+	}
+	x.end() // ДопСведТов
+	x.start("Акциз")
+	x.text("БезАкциз", "без акциза")
+	x.end()
+	x.vatSum("СумНал", item.VATAmount, isWithoutVAT(item.VATRate))
+	x.end()
+}
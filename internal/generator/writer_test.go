@@ -0,0 +1,89 @@
+package generator_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"upd-loader-go/internal/generator"
+)
+
+func TestSpecOutputIsReproducible(t *testing.T) {
+	specs, err := generator.LoadSpecs(casesPath)
+	if err != nil {
+		t.Fatalf("failed to load cases: %v", err)
+	}
+
+	var cases []generator.Spec
+	for _, spec := range specs[:2] {
+		for _, version := range []string{generator.FormatVersion501, generator.FormatVersion} {
+			spec.Version = version
+			cases = append(cases, spec)
+		}
+	}
+
+	write := func() [][]byte {
+		var outputs [][]byte
+		for _, spec := range cases {
+			doc, err := spec.Document()
+			if err != nil {
+				t.Fatalf("%s: failed to build document: %v", spec.Name, err)
+			}
+			var buf bytes.Buffer
+			if err := generator.WriteContainer(&buf, doc, spec.Options()); err != nil {
+				t.Fatalf("%s: failed to write container: %v", spec.Name, err)
+			}
+			outputs = append(outputs, buf.Bytes())
+		}
+		return outputs
+	}
+
+	first := write()
+	// Seconds of the wall clock must not leak into the output
+	time.Sleep(1100 * time.Millisecond)
+	for i, second := range write() {
+		if !bytes.Equal(first[i], second) {
+			t.Errorf("%s %s: containers of the same spec differ", cases[i].Name, cases[i].Version)
+		}
+	}
+}
+
+func TestOptionsNow(t *testing.T) {
+	spec := generator.Spec{
+		Number: "1",
+		Date:   "2025-06-26",
+		Seller: generator.PartySpec{Type: "legal", Name: "ООО \"Продавец\"", INN: "7843316106", KPP: "784301001"},
+		Buyer:  generator.PartySpec{Type: "legal", Name: "ООО \"Покупатель\"", INN: "7701234567", KPP: "770101001"},
+		Items:  []generator.ItemSpec{{Name: "Труба", Quantity: "1", Price: "100", VATRate: "20%"}},
+	}
+	doc, err := spec.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2025, 6, 27, 9, 30, 15, 0, time.Local)
+	tests := []struct {
+		name string
+		opts generator.Options
+		want string
+	}{
+		{"spec date", spec.Options(), `ДатаИнфПр="26.06.2025" ВремИнфПр="00.00.00"`},
+		{"clock", generator.Options{Now: func() time.Time { return now }}, `ДатаИнфПр="27.06.2025" ВремИнфПр="09.30.15"`},
+	}
+
+	for _, tt := range tests {
+		for _, version := range []string{generator.FormatVersion501, generator.FormatVersion} {
+			opts := tt.opts
+			opts.Encoding = "utf-8"
+			opts.Version = version
+			var buf bytes.Buffer
+			if err := generator.WriteUPDXML(&buf, doc, opts); err != nil {
+				t.Fatalf("%s %s: %v", tt.name, version, err)
+			}
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("%s %s: document has no %s", tt.name, version, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package models
+
+// DefaultCurrencyCode is the OKV code of the Russian ruble
+const DefaultCurrencyCode = "643"
+
+// currencyInfo describes a currency known by its OKV code
+type currencyInfo struct {
+	isoCode string
+	symbol  string
+}
+
+// knownCurrencies maps OKV numeric codes to ISO 4217 codes and display symbols
+var knownCurrencies = map[string]currencyInfo{
+	"643": {isoCode: "RUB", symbol: "₽"},
+	"840": {isoCode: "USD", symbol: "$"},
+	"978": {isoCode: "EUR", symbol: "€"},
+	"156": {isoCode: "CNY", symbol: "¥"},
+	"933": {isoCode: "BYN", symbol: "Br"},
+	"398": {isoCode: "KZT", symbol: "₸"},
+	"051": {isoCode: "AMD", symbol: "֏"},
+	"417": {isoCode: "KGS", symbol: "сом"},
+	"860": {isoCode: "UZS", symbol: "сум"},
+	"826": {isoCode: "GBP", symbol: "£"},
+	"392": {isoCode: "JPY", symbol: "¥"},
+	"949": {isoCode: "TRY", symbol: "₺"},
+	"356": {isoCode: "INR", symbol: "₹"},
+	"756": {isoCode: "CHF", symbol: "CHF"},
+	"784": {isoCode: "AED", symbol: "AED"},
+}
+
+// CurrencyISOCode returns ISO 4217 code for the OKV currency code.
+// Unknown codes are returned as is.
+func CurrencyISOCode(okvCode string) string {
+	if info, ok := knownCurrencies[okvCode]; ok {
+		return info.isoCode
+	}
+	return okvCode
+}
+
+// IsDefaultCurrency reports whether the content is in rubles
+func (c *UPDContent) IsDefaultCurrency() bool {
+	return c.CurrencyCode == "" || c.CurrencyCode == DefaultCurrencyCode
+}
+
+// CurrencyISOCode returns ISO 4217 code of the document currency
+func (c *UPDContent) CurrencyISOCode() string {
+	if c.IsDefaultCurrency() {
+		return CurrencyISOCode(DefaultCurrencyCode)
+	}
+	return CurrencyISOCode(c.CurrencyCode)
+}
+
+// CurrencySymbol returns a short currency label for messages
+func (c *UPDContent) CurrencySymbol() string {
+	code := c.CurrencyCode
+	if code == "" {
+		code = DefaultCurrencyCode
+	}
+	if info, ok := knownCurrencies[code]; ok {
+		return info.symbol
+	}
+	if c.CurrencyName != "" {
+		return c.CurrencyName
+	}
+	return code
+}
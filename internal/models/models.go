@@ -1,23 +1,59 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/shopspring/decimal"
 )
 
-// Address represents an organization address
+// Address represents an organization address. Addresses given as a single
+// line of text are kept in Street.
 type Address struct {
 	PostalCode string `json:"postal_code,omitempty"`
 	RegionCode string `json:"region_code,omitempty"`
 	Region     string `json:"region,omitempty"`
+	District   string `json:"district,omitempty"`
 	City       string `json:"city,omitempty"`
+	Settlement string `json:"settlement,omitempty"`
 	Street     string `json:"street,omitempty"`
 	House      string `json:"house,omitempty"`
 	Apartment  string `json:"apartment,omitempty"`
 }
 
+// String formats address as a single line
+func (a *Address) String() string {
+	if a == nil {
+		return ""
+	}
+	var parts []string
+	for _, part := range []string{a.PostalCode, a.Region, a.District, a.City, a.Settlement, a.Street, a.House, a.Apartment} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BankAccount represents a bank account of an organization
+type BankAccount struct {
+	AccountNumber        string `json:"account_number"`
+	BankName             string `json:"bank_name,omitempty"`
+	BIC                  string `json:"bic,omitempty"`
+	CorrespondentAccount string `json:"correspondent_account,omitempty"`
+}
+
+// Party kinds of UPD participants, named as MoySkald company types
+const (
+	PartyLegal        = "legal"
+	PartyEntrepreneur = "entrepreneur"
+	PartyIndividual   = "individual"
+)
+
 // MetaInfo contains metadata from meta.xml
 type MetaInfo struct {
 	DocFlowID        string `json:"doc_flow_id"`
@@ -33,8 +69,29 @@ type CardInfo struct {
 	SenderINN          string    `json:"sender_inn,omitempty"`
 	SenderKPP          string    `json:"sender_kpp,omitempty"`
 	SenderName         string    `json:"sender_name,omitempty"`
+	// SenderID is the EDO abonent ID of the sender
+	SenderID string `json:"sender_id,omitempty"`
 }
 
+// UPD metadata fields written to document attributes
+const (
+	// FieldDocFlowID is the EDO document flow ID from meta.xml
+	FieldDocFlowID = "docFlowId"
+	// FieldExternalID is the external identifier from card.xml
+	FieldExternalID = "externalId"
+	// FieldBasisNumber and FieldBasisDate are the number and date of the
+	// basis document (ОснПер)
+	FieldBasisNumber = "basisNumber"
+	FieldBasisDate   = "basisDate"
+	// FieldCardTitle is the document title from card.xml
+	FieldCardTitle = "cardTitle"
+	// FieldSenderID is the EDO abonent ID of the sender from card.xml
+	FieldSenderID = "senderId"
+)
+
+// AttributeFields lists UPD metadata fields in the order they are written
+var AttributeFields = []string{FieldDocFlowID, FieldExternalID, FieldBasisNumber, FieldBasisDate, FieldCardTitle, FieldSenderID}
+
 // InvoiceItem represents an invoice line item
 type InvoiceItem struct {
 	LineNumber       int             `json:"line_number"`
@@ -48,6 +105,23 @@ type InvoiceItem struct {
 	VATAmount        decimal.Decimal `json:"vat_amount"`
 	AmountWithVAT    decimal.Decimal `json:"amount_with_vat"`
 	Article          string          `json:"article,omitempty"`
+	Code             string          `json:"code,omitempty"`
+	GTIN             string          `json:"gtin,omitempty"`
+	Kind             string          `json:"kind,omitempty"`
+	CountryCode      string          `json:"country_code,omitempty"`
+	CountryName      string          `json:"country_name,omitempty"`
+}
+
+// Line kinds, ПрТовРаб values of UPD
+const (
+	KindGoods   = "1"
+	KindWork    = "2"
+	KindService = "3"
+)
+
+// IsService reports whether the line is a work or service (ПрТовРаб 2 or 3)
+func (i *InvoiceItem) IsService() bool {
+	return i.Kind == KindWork || i.Kind == KindService
 }
 
 // Organization represents organization information
@@ -56,6 +130,33 @@ type Organization struct {
 	INN     string   `json:"inn"`
 	KPP     string   `json:"kpp,omitempty"`
 	Address *Address `json:"address,omitempty"`
+
+	// Kind is PartyLegal, PartyEntrepreneur or PartyIndividual. Empty when
+	// not known, then it is derived from INN length.
+	Kind string `json:"kind,omitempty"`
+	// Surname, FirstName and Patronymic are set for entrepreneurs and
+	// individuals
+	Surname    string `json:"surname,omitempty"`
+	FirstName  string `json:"first_name,omitempty"`
+	Patronymic string `json:"patronymic,omitempty"`
+	// OGRN is ОГРН of a legal entity or ОГРНИП of an entrepreneur
+	OGRN string `json:"ogrn,omitempty"`
+	OKPO string `json:"okpo,omitempty"`
+	// ActualAddress is the shipping or delivery address of the party when
+	// it differs from Address
+	ActualAddress *Address      `json:"actual_address,omitempty"`
+	BankAccounts  []BankAccount `json:"bank_accounts,omitempty"`
+}
+
+// PartyKind returns Kind, deriving it from INN length when not set
+func (o *Organization) PartyKind() string {
+	if o.Kind != "" {
+		return o.Kind
+	}
+	if len(o.INN) == 12 {
+		return PartyIndividual
+	}
+	return PartyLegal
 }
 
 // UPDContent represents the main UPD content
@@ -69,10 +170,16 @@ type UPDContent struct {
 	// Optional fields with defaults
 	Items           []InvoiceItem   `json:"items"`
 	CurrencyCode    string          `json:"currency_code"`
+	CurrencyName    string          `json:"currency_name,omitempty"`
+	ExchangeRate    decimal.Decimal `json:"exchange_rate"`
 	TotalWithoutVAT decimal.Decimal `json:"total_without_vat"`
 	TotalVAT        decimal.Decimal `json:"total_vat"`
 	TotalWithVAT    decimal.Decimal `json:"total_with_vat"`
 	RequisiteNumber string          `json:"requisite_number,omitempty"`
+	// RequisiteDate is the date of the basis document, zero when missing
+	RequisiteDate time.Time `json:"requisite_date,omitempty"`
+	// FileID is ИдФайл of the UPD XML
+	FileID string `json:"file_id,omitempty"`
 }
 
 // UPDDocument represents a complete UPD document
@@ -87,10 +194,44 @@ func (u *UPDDocument) DocumentID() string {
 	return u.CardInfo.ExternalIdentifier
 }
 
+// FileName returns the UPD file name without extension: ИдФайл, the main
+// document file name when ИдФайл is missing, or the document identifier
+func (u *UPDDocument) FileName() string {
+	if u.Content.FileID != "" {
+		return u.Content.FileID
+	}
+	if u.MetaInfo.MainDocumentPath != "" {
+		base := path.Base(u.MetaInfo.MainDocumentPath)
+		return strings.TrimSuffix(base, path.Ext(base))
+	}
+	return u.DocumentID()
+}
+
+// ExternalCode returns a stable key identifying the document across uploads.
+// It is based on document flow ID or file identifier, falling back to a hash
+// of the document requisites.
+func (u *UPDDocument) ExternalCode() string {
+	if u.MetaInfo.DocFlowID != "" {
+		return "UPD-" + u.MetaInfo.DocFlowID
+	}
+	if u.CardInfo.ExternalIdentifier != "" && len(u.CardInfo.ExternalIdentifier) <= 250 {
+		return "UPD-" + u.CardInfo.ExternalIdentifier
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%s",
+		u.Content.Seller.INN,
+		u.Content.Buyer.INN,
+		u.Content.InvoiceNumber,
+		u.Content.InvoiceDate.Format("2006-01-02"),
+		u.Content.TotalWithVAT.StringFixed(2),
+	)))
+	return "UPD-" + hex.EncodeToString(hash[:16])
+}
+
 // Summary returns a brief description of the document
 func (u *UPDDocument) Summary() string {
 	return fmt.Sprintf(
-		"УПД № %s от %s\nПоставщик: %s (ИНН: %s)\nПокупатель: %s (ИНН: %s)\nСумма: %s ₽",
+		"УПД № %s от %s\nПоставщик: %s (ИНН: %s)\nПокупатель: %s (ИНН: %s)\nСумма: %s %s",
 		u.Content.InvoiceNumber,
 		u.Content.InvoiceDate.Format("02.01.2006"),
 		u.Content.Seller.Name,
@@ -98,6 +239,7 @@ func (u *UPDDocument) Summary() string {
 		u.Content.Buyer.Name,
 		u.Content.Buyer.INN,
 		u.Content.TotalWithVAT.StringFixed(2),
+		u.Content.CurrencySymbol(),
 	)
 }
 
@@ -109,6 +251,59 @@ type ProcessingResult struct {
 	MoySkladInvoiceID    string      `json:"moysklad_invoice_id,omitempty"`
 	MoySkladInvoiceURL   string      `json:"moysklad_invoice_url,omitempty"`
 	ErrorCode            string      `json:"error_code,omitempty"`
+	AlreadyLoaded        bool        `json:"already_loaded,omitempty"`
+	RolledBack           []string    `json:"rolled_back,omitempty"`
+	RollbackFailed       []string    `json:"rollback_failed,omitempty"`
+	CreatedProducts      []string    `json:"created_products,omitempty"`
+	UnmatchedItems       []UnmatchedItem `json:"unmatched_items,omitempty"`
+	StoreChoice          *StoreChoice    `json:"store_choice,omitempty"`
+}
+
+// UnmatchedItem is an UPD line without confident product match along with
+// candidates for the user to choose from
+type UnmatchedItem struct {
+	PartyINN   string           `json:"party_inn"`
+	Article    string           `json:"article,omitempty"`
+	Name       string           `json:"name"`
+	Candidates []MatchCandidate `json:"candidates,omitempty"`
+}
+
+// MatchCandidate is a MoySkald product or service similar to an UPD line
+type MatchCandidate struct {
+	Type       string  `json:"type"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Article    string  `json:"article,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+// StoreChoice asks the user to choose the store of demands to a buyer or
+// supplies from a supplier when it cannot be resolved. Direction is "sale"
+// for demands and "purchase" for supplies.
+type StoreChoice struct {
+	Direction string        `json:"direction,omitempty"`
+	PartyINN  string        `json:"party_inn"`
+	PartyName string        `json:"party_name"`
+	Stores    []StoreOption `json:"stores"`
+}
+
+// StoreOption is a MoySkald store offered for choice
+type StoreOption struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// RenderedFile represents a printable form of UPD document
+type RenderedFile struct {
+	FileName string `json:"file_name"`
+	Content  []byte `json:"-"`
+}
+
+// ExportResult represents an outgoing UPD container built from MoySkald documents
+type ExportResult struct {
+	FileName    string       `json:"file_name"`
+	Content     []byte       `json:"-"`
+	UPDDocument *UPDDocument `json:"upd_document,omitempty"`
 }
 
 // NewUPDContent creates a new UPDContent with default values
@@ -119,9 +314,10 @@ func NewUPDContent(invoiceNumber string, invoiceDate time.Time, seller, buyer Or
 		Seller:          seller,
 		Buyer:           buyer,
 		Items:           make([]InvoiceItem, 0),
-		CurrencyCode:    "643", // RUB
+		CurrencyCode:    DefaultCurrencyCode,
+		ExchangeRate:    decimal.NewFromInt(1),
 		TotalWithoutVAT: decimal.Zero,
 		TotalVAT:        decimal.Zero,
 		TotalWithVAT:    decimal.Zero,
 	}
-}
\ No newline at end of file
+}
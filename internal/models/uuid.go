@@ -0,0 +1,18 @@
+package models
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// NewUUID returns a random version 4 UUID, used for document flow IDs and
+// file GUIDs of generated UPD containers
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
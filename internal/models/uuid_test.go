@@ -0,0 +1,22 @@
+package models
+
+import (
+	"regexp"
+	"testing"
+)
+
+var uuidV4Re = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewUUID()
+		if !uuidV4Re.MatchString(id) {
+			t.Fatalf("NewUUID() = %q, not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewUUID() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
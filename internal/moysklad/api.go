@@ -7,9 +7,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -33,11 +33,32 @@ type API struct {
 	token          string
 	organizationID string
 	client         *http.Client
+	limits         Limits
+	limiter        *rateLimiter
+	slots          chan struct{}
+	cache          *referenceCache
+	mappings       *mappingStore
+	options        UploadOptions
+	chosenStores   sync.Map     // direction and counterparty INN to store ID chosen by the user
+	tokenValidTill atomic.Int64 // UnixNano the verified token is trusted until
 	logger         *logrus.Logger
 }
 
 // NewAPI creates a new MoySkald API client
-func NewAPI(baseURL, token, organizationID string, logger *logrus.Logger) *API {
+func NewAPI(baseURL, token, organizationID string, limits Limits, cacheOptions CacheOptions, options UploadOptions, logger *logrus.Logger) *API {
+	limits = limits.withDefaults()
+	options = options.withDefaults()
+
+	cache := newReferenceCache(cacheOptions)
+	if err := cache.load(); err != nil {
+		logger.Warnf("Failed to load MoySkald cache from %s: %v", cacheOptions.FilePath, err)
+	}
+
+	mappings := newMappingStore(options.MappingsFile)
+	if err := mappings.load(); err != nil {
+		logger.Warnf("Failed to load item mappings from %s: %v", options.MappingsFile, err)
+	}
+
 	return &API{
 		baseURL:        baseURL,
 		token:          token,
@@ -45,7 +66,13 @@ func NewAPI(baseURL, token, organizationID string, logger *logrus.Logger) *API {
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		logger: logger,
+		limits:  limits,
+		limiter: newRateLimiter(limits.RequestsPerSecond, limits.Burst),
+		slots:   make(chan struct{}, limits.MaxConcurrent),
+		cache:    cache,
+		mappings: mappings,
+		options:  options,
+		logger:   logger,
 	}
 }
 
@@ -67,13 +94,41 @@ func (api *API) makeRequest(method, endpoint string, data interface{}, params ma
 		fullURL = u.String()
 	}
 
-	var body io.Reader
+	var jsonData []byte
 	if data != nil {
-		jsonData, err := json.Marshal(data)
+		var err error
+		jsonData, err = json.Marshal(data)
 		if err != nil {
 			return nil, err
 		}
-		body = bytes.NewBuffer(jsonData)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := api.doRequest(method, fullURL, endpoint, jsonData, data)
+
+		if attempt >= api.limits.MaxRetries || !canRetry(method, resp, err) {
+			return resp, err
+		}
+
+		delay := api.limits.retryDelay(resp, attempt)
+		if resp != nil {
+			if resp.StatusCode == http.StatusTooManyRequests {
+				api.limiter.pause(time.Now().Add(delay))
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		api.logger.Warnf("MoySkald API: retrying %s %s in %v (attempt %d of %d)", method, endpoint, delay, attempt+1, api.limits.MaxRetries)
+		time.Sleep(delay)
+	}
+}
+
+// doRequest performs a single HTTP attempt respecting rate and concurrency limits
+func (api *API) doRequest(method, fullURL, endpoint string, jsonData []byte, data interface{}) (*http.Response, error) {
+	var body io.Reader
+	if jsonData != nil {
+		body = bytes.NewReader(jsonData)
 	}
 
 	req, err := http.NewRequest(method, fullURL, body)
@@ -86,6 +141,10 @@ func (api *API) makeRequest(method, endpoint string, data interface{}, params ma
 	req.Header.Set("Content-Type", "application/json;charset=utf-8")
 	req.Header.Set("Accept", "application/json;charset=utf-8")
 
+	api.limiter.wait()
+	api.slots <- struct{}{}
+	defer func() { <-api.slots }()
+
 	start := time.Now()
 	resp, err := api.client.Do(req)
 	duration := time.Since(start)
@@ -121,8 +180,13 @@ func (api *API) logRequest(method, endpoint string, resp *http.Response, duratio
 	}
 }
 
-// VerifyToken verifies API token validity
+// VerifyToken verifies API token validity. Successful verification is
+// cached for the cache TTL.
 func (api *API) VerifyToken() bool {
+	if time.Now().UnixNano() < api.tokenValidTill.Load() {
+		return true
+	}
+
 	resp, err := api.makeRequest("GET", "/context/employee", nil, nil)
 	if err != nil {
 		api.logger.Errorf("Token verification error: %v", err)
@@ -130,276 +194,183 @@ func (api *API) VerifyToken() bool {
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode == 200
+	if resp.StatusCode != 200 {
+		return false
+	}
+	api.tokenValidTill.Store(time.Now().Add(api.cache.ttl).UnixNano())
+	return true
 }
 
 // VerifyAPIAccess verifies API access and returns detailed information
-func (api *API) VerifyAPIAccess() map[string]interface{} {
+func (api *API) VerifyAPIAccess() *AccessStatus {
 	api.logger.Info("Verifying MoySkald API access...")
 
 	// Check basic API access
 	resp, err := api.makeRequest("GET", "/context/employee", nil, nil)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Network error: %v", err),
-			"details": "Check internet connection and api.moysklad.ru availability",
+		return &AccessStatus{
+			Error:   fmt.Sprintf("Network error: %v", err),
+			Details: "Check internet connection and api.moysklad.ru availability",
 		}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("API access error: %d", resp.StatusCode),
-			"details": string(body),
+		return &AccessStatus{
+			Error:   fmt.Sprintf("API access error: %d", resp.StatusCode),
+			Details: string(body),
 		}
 	}
 
-	var employeeData map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&employeeData); err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   "Failed to decode employee data",
-			"details": err.Error(),
+	var employee Employee
+	if err := json.NewDecoder(resp.Body).Decode(&employee); err != nil {
+		return &AccessStatus{
+			Error:   "Failed to decode employee data",
+			Details: err.Error(),
 		}
 	}
 
-	// Get organization information
-	orgResp, err := api.makeRequest("GET", "/entity/organization", nil, nil)
+	// Get organizations, bypassing the cache so that status is current
+	api.cache.invalidate(cacheOrganization, organizationsKey)
+	organizations, err := api.organizations()
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to get organizations: %v", err),
+		return &AccessStatus{
+			Error:   "Failed to get organizations",
+			Details: err.Error(),
 		}
 	}
-	defer orgResp.Body.Close()
 
-	if orgResp.StatusCode != 200 {
-		body, _ := io.ReadAll(orgResp.Body)
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("No access to organizations: %d", orgResp.StatusCode),
-			"details": string(body),
+	if len(organizations) == 0 {
+		return &AccessStatus{
+			Error:   "No organizations found",
+			Details: "No available organizations in MoySkald account",
 		}
 	}
 
-	var orgData map[string]interface{}
-	if err := json.NewDecoder(orgResp.Body).Decode(&orgData); err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   "Failed to decode organization data",
-			"details": err.Error(),
+	statuses := organizationStatuses(organizations, api.organizationID)
+	organization := organizations[0]
+	if api.organizationID != "" {
+		organization = nil
+		for _, status := range statuses {
+			if status.Default {
+				organization = status.Organization
+			}
 		}
-	}
-
-	organizations, ok := orgData["rows"].([]interface{})
-	if !ok || len(organizations) == 0 {
-		return map[string]interface{}{
-			"success": false,
-			"error":   "No organizations found",
-			"details": "No available organizations in MoySkald account",
+		if organization == nil {
+			return &AccessStatus{
+				Error:   "Default organization not found",
+				Details: fmt.Sprintf("Organization %s from MOYSKLAD_ORGANIZATION_ID is not among active organizations of MoySkald account", api.organizationID),
+			}
 		}
 	}
 
 	// Check permissions
 	permissions := api.checkPermissions()
+	permissions.OrganizationsCount = len(organizations)
 
-	mainOrg := organizations[0].(map[string]interface{})
+	attributeProblems, err := api.VerifyAttributes()
+	if err != nil {
+		attributeProblems = []string{err.Error()}
+	}
 
-	return map[string]interface{}{
-		"success": true,
-		"employee": map[string]interface{}{
-			"name":  employeeData["name"],
-			"email": employeeData["email"],
-		},
-		"organization": map[string]interface{}{
-			"name": mainOrg["name"],
-			"inn":  mainOrg["inn"],
-			"id":   mainOrg["id"],
-		},
-		"permissions": permissions,
-		"api_info": map[string]interface{}{
-			"base_url":         api.baseURL,
-			"response_time_ms": "< 10000",
-		},
+	return &AccessStatus{
+		Success:       true,
+		Employee:      &employee,
+		Organization:  organization,
+		Organizations: statuses,
+		Permissions:   permissions,
+		BaseURL:       api.baseURL,
+
+		AttributeProblems: attributeProblems,
 	}
 }
 
 // checkPermissions checks various API permissions
-func (api *API) checkPermissions() map[string]interface{} {
-	permissions := map[string]interface{}{
-		"organizations_count": 0,
-		"stores_count":        0,
-	}
+func (api *API) checkPermissions() Permissions {
+	var permissions Permissions
 
 	// Check invoice creation access
 	resp, err := api.makeRequest("GET", "/entity/factureout", nil, nil)
-	permissions["can_create_invoices"] = err == nil && resp != nil && resp.StatusCode == 200
+	permissions.CanCreateInvoices = err == nil && resp != nil && resp.StatusCode == 200
 	if resp != nil {
 		resp.Body.Close()
 	}
 
 	// Check counterparty access
 	resp, err = api.makeRequest("GET", "/entity/counterparty", nil, nil)
-	permissions["can_access_counterparties"] = err == nil && resp != nil && resp.StatusCode == 200
+	permissions.CanAccessCounterparties = err == nil && resp != nil && resp.StatusCode == 200
 	if resp != nil {
 		resp.Body.Close()
 	}
 
 	// Check stores access
-	resp, err = api.makeRequest("GET", "/entity/store", nil, nil)
-	canAccessStores := err == nil && resp != nil && resp.StatusCode == 200
-	permissions["can_access_stores"] = canAccessStores
-	if resp != nil && canAccessStores {
-		var storeData map[string]interface{}
-		json.NewDecoder(resp.Body).Decode(&storeData)
-		if stores, ok := storeData["rows"].([]interface{}); ok {
-			permissions["stores_count"] = len(stores)
-		}
-		resp.Body.Close()
-	}
+	storesCount, err := api.countRows("/entity/store", nil)
+	permissions.CanAccessStores = err == nil
+	permissions.StoresCount = storesCount
 
 	return permissions
 }
 
-// CreateInvoiceFromUPD creates invoice and demand from UPD document
-func (api *API) CreateInvoiceFromUPD(updDocument *models.UPDDocument) (map[string]interface{}, error) {
+// CreateInvoiceFromUPD creates invoice and demand from UPD document and
+// attaches files to them
+func (api *API) CreateInvoiceFromUPD(updDocument *models.UPDDocument, attachments []models.RenderedFile) (*UploadResult, error) {
 	api.logger.Infof("Creating documents for UPD: %s", updDocument.DocumentID())
+	defer api.persistCache()
 
-	// Find supplier organization by INN
-	supplierOrg, err := api.findOrganizationByINN(updDocument.Content.Seller.INN)
-	if err != nil {
-		return nil, &APIError{Message: fmt.Sprintf("Supplier organization with INN %s not found in MoySkald", updDocument.Content.Seller.INN)}
-	}
-
-	// Get or create buyer counterparty
-	buyerCounterparty, err := api.getOrCreateCounterparty(updDocument.Content.Buyer)
-	if err != nil {
-		return nil, err
-	}
-
-	// Step 1: Create demand (shipment) as base document
-	api.logger.Info("Creating demand as base document...")
-	demand, err := api.createDemand(updDocument, supplierOrg, buyerCounterparty)
+	plan, err := api.PlanUpload(updDocument)
 	if err != nil {
 		return nil, err
 	}
+	plan.Attachments = attachments
+	return api.executePlan(plan)
+}
 
-	// Step 2: Create invoice based on demand
-	api.logger.Info("Creating invoice based on demand...")
-	invoiceData := api.mapUPDToFactureOut(updDocument, supplierOrg, buyerCounterparty, demand)
+// findByExternalCode finds document by external code. Returns zero value
+// when the document does not exist.
+func findByExternalCode[T any](api *API, endpoint, externalCode string) (T, error) {
+	var zero T
 
-	resp, err := api.makeRequest("POST", "/entity/factureout", invoiceData, nil)
+	page, err := getPage[T](api, endpoint, map[string]string{"filter": "externalCode=" + externalCode, "limit": "1"})
 	if err != nil {
-		return nil, &APIError{Message: fmt.Sprintf("Network error creating invoice: %v", err)}
+		return zero, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 200 {
-		var result map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return nil, &APIError{Message: fmt.Sprintf("Failed to decode invoice response: %v", err)}
-		}
-
-		api.logger.Infof("Invoice successfully created: %s", result["id"])
-		return map[string]interface{}{
-			"factureout": result,
-			"demand":     demand,
-			"success":    true,
-		}, nil
+	if len(page.Rows) == 0 {
+		return zero, nil
 	}
-
-	body, _ := io.ReadAll(resp.Body)
-	errorMsg := fmt.Sprintf("Error creating invoice: %d - %s", resp.StatusCode, string(body))
-	api.logger.Error(errorMsg)
-	return nil, &APIError{Message: errorMsg}
+	return page.Rows[0], nil
 }
 
-// findOrganizationByINN finds organization by INN
-func (api *API) findOrganizationByINN(inn string) (map[string]interface{}, error) {
-	params := map[string]string{"filter": "inn=" + inn}
-	resp, err := api.makeRequest("GET", "/entity/organization", nil, params)
-	if err != nil {
-		return nil, err
+// newCounterpartyPayload builds counterparty to create for UPD participant
+// with requisites, addresses and bank accounts from UPD
+func (api *API) newCounterpartyPayload(party models.Organization) *Counterparty {
+	counterparty := counterpartyRequisites(party)
+	if len(api.options.CounterpartyGroups) > 0 {
+		// Created counterparty must be found by the next upload
+		counterparty.Tags = api.options.CounterpartyGroups[:1]
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 200 {
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			return nil, err
-		}
-
-		if organizations, ok := data["rows"].([]interface{}); ok && len(organizations) > 0 {
-			org := organizations[0].(map[string]interface{})
-			api.logger.Infof("Found organization by INN %s: %s", inn, org["name"])
-			return org, nil
-		}
-	}
-
-	api.logger.Warningf("Organization with INN %s not found", inn)
-	return nil, fmt.Errorf("organization not found")
+	return counterparty
 }
 
-// getOrCreateCounterparty gets existing or creates new counterparty
-func (api *API) getOrCreateCounterparty(buyer models.Organization) (map[string]interface{}, error) {
-	// Search by INN
-	params := map[string]string{"filter": "inn=" + buyer.INN}
-	resp, err := api.makeRequest("GET", "/entity/counterparty", nil, params)
-	if err != nil {
-		return nil, &APIError{Message: fmt.Sprintf("Network error searching counterparty: %v", err)}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 200 {
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err == nil {
-			if counterparties, ok := data["rows"].([]interface{}); ok && len(counterparties) > 0 {
-				counterparty := counterparties[0].(map[string]interface{})
-				api.logger.Infof("Found existing counterparty: %s", counterparty["name"])
-				return counterparty, nil
-			}
-		}
-	}
-
-	// Create new counterparty
-	api.logger.Infof("Creating new counterparty: %s", buyer.Name)
+// createCounterparty creates counterparty
+func (api *API) createCounterparty(counterpartyData *Counterparty) (*Counterparty, error) {
+	api.logger.Infof("Creating new counterparty: %s (%s, INN: %s, KPP: %s)", counterpartyData.Name, counterpartyData.CompanyType, counterpartyData.INN, counterpartyData.KPP)
 
-	// Determine counterparty type by INN length
-	isIndividual := len(buyer.INN) == 12
-
-	counterpartyData := map[string]interface{}{
-		"name":        buyer.Name,
-		"inn":         buyer.INN,
-		"companyType": "legal",
-	}
-
-	if isIndividual {
-		counterpartyData["companyType"] = "individual"
-		api.logger.Infof("Creating counterparty as individual entrepreneur (INN: %s)", buyer.INN)
-	} else {
-		if buyer.KPP != "" {
-			counterpartyData["kpp"] = buyer.KPP
-		}
-		api.logger.Infof("Creating counterparty as legal entity (INN: %s, KPP: %s)", buyer.INN, buyer.KPP)
-	}
-
-	resp, err = api.makeRequest("POST", "/entity/counterparty", counterpartyData, nil)
+	resp, err := api.makeRequest("POST", "/entity/counterparty", counterpartyData, nil)
 	if err != nil {
 		return nil, &APIError{Message: fmt.Sprintf("Network error creating counterparty: %v", err)}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
-		var result map[string]interface{}
+		var result Counterparty
 		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 			return nil, &APIError{Message: fmt.Sprintf("Failed to decode counterparty response: %v", err)}
 		}
 
-		api.logger.Infof("Counterparty successfully created: %s", result["name"])
-		return result, nil
+		api.logger.Infof("Counterparty successfully created: %s", result.Name)
+		api.cache.invalidate(cacheCounterparty, counterpartyData.INN)
+		return &result, nil
 	}
 
 	body, _ := io.ReadAll(resp.Body)
@@ -408,62 +379,73 @@ func (api *API) getOrCreateCounterparty(buyer models.Organization) (map[string]i
 	return nil, &APIError{Message: errorMsg}
 }
 
-// createDemand creates demand (shipment) document
-func (api *API) createDemand(updDocument *models.UPDDocument, organization, counterparty map[string]interface{}) (map[string]interface{}, error) {
-	content := updDocument.Content
-
-	// Format date for MoySkald: YYYY-MM-DD HH:MM:SS.sss
-	momentStr := content.InvoiceDate.Format("2006-01-02 15:04:05.000")
-
-	// Find customer invoice by requisite number
-	customerInvoice, err := api.findCustomerInvoice(content.RequisiteNumber, counterparty)
-	if err != nil {
-		return nil, &APIError{Message: fmt.Sprintf("Customer invoice with number '%s' not found.\nCreate invoice with specified number and try again.", content.RequisiteNumber)}
+// planDemand resolves customer invoice, store and positions for the demand
+// and fills them into the plan
+func (api *API) planDemand(plan *UploadPlan) error {
+	content := plan.UPDDocument.Content
+
+	// Find customer invoice by requisite number. Without an invoice the
+	// demand is linked to the customer order with this number, if any.
+	var priceDocument *Meta
+	if customerInvoice, err := api.findCustomerInvoice(content.RequisiteNumber, plan.Counterparty); err == nil {
+		plan.CustomerInvoice = customerInvoice
+		plan.CustomerOrder = api.getCustomerOrder(customerInvoice.CustomerOrder)
+		priceDocument = customerInvoice.Meta
+	} else {
+		plan.CustomerOrder = api.findCustomerOrder(content.RequisiteNumber, plan.Counterparty)
+		if plan.CustomerOrder != nil {
+			api.logger.Warningf("Customer invoice '%s' not found, demand is linked to customer order %s", content.RequisiteNumber, plan.CustomerOrder.Name)
+			priceDocument = plan.CustomerOrder.Meta
+		} else {
+			api.logger.Warningf("Customer invoice and order '%s' not found, demand is not linked to them", content.RequisiteNumber)
+		}
 	}
 
-	// Get store from customer invoice
-	store, err := api.getStoreFromInvoice(customerInvoice)
+	store, source, err := api.resolveDemandStore(plan)
 	if err != nil {
-		return nil, &APIError{Message: fmt.Sprintf("Store not specified in customer invoice '%s'.\nSpecify store in invoice and try again.", customerInvoice["name"])}
+		return err
 	}
 
-	api.logger.Infof("Final store for demand: %s (ID: %s)", store["name"], store["id"])
+	api.logger.Infof("Final store for demand: %s (ID: %s, from %s)", store.Name, store.ID, source)
 
-	// Create demand data
-	demandData := map[string]interface{}{
-		"name":   "О" + content.InvoiceNumber, // Prefix "О" + UPD number
-		"moment": momentStr,
-		"organization": map[string]interface{}{
-			"meta": organization["meta"],
-		},
-		"agent": map[string]interface{}{
-			"meta": counterparty["meta"],
-		},
-		"store": map[string]interface{}{
-			"meta": store["meta"],
-		},
-		"vatEnabled":  true,
-		"vatIncluded": true,
-		"positions":   []interface{}{},
+	// Add positions
+	positions, lines, err := api.createPositionsFromUPD(&content, content.Buyer.INN, priceDocument, true)
+	if err != nil {
+		return err
 	}
 
-	// Link to customer invoice if found
-	if customerInvoice != nil {
-		demandData["invoicesOut"] = []interface{}{
-			map[string]interface{}{
-				"meta": customerInvoice["meta"],
-			},
-		}
+	plan.Store = store
+	plan.StoreSource = source
+	plan.Lines = lines
+	plan.positions = positions
+	if err := api.checkStock(plan); err != nil {
+		return err
 	}
 
-	// Add positions
-	positions, err := api.createPositionsFromUPD(&content, customerInvoice)
-	if err != nil {
-		return nil, err
+	plan.Demand = &Demand{
+		Name:         "О" + content.InvoiceNumber, // Prefix "О" + UPD number
+		ExternalCode: plan.ExternalCode,
+		Moment:       content.InvoiceDate.Format(momentLayout),
+		Organization: &Organization{Meta: plan.Organization.Meta},
+		Store:        &Store{Meta: store.Meta},
+		Rate:         plan.Rate,
+		VatEnabled:   documentVATEnabled(positions),
+		VatIncluded:  boolPtr(true),
+
+		OrganizationAccount: accountRef(plan.OrganizationAccount),
+		Attributes:          api.documentAttributes("demand", plan.UPDDocument),
+	}
+	if plan.CustomerInvoice != nil {
+		plan.Demand.InvoicesOut = []*InvoiceOut{{Meta: plan.CustomerInvoice.Meta}}
 	}
-	demandData["positions"] = positions
+	if plan.CustomerOrder != nil {
+		plan.Demand.CustomerOrder = &CustomerOrder{Meta: plan.CustomerOrder.Meta}
+	}
+	return nil
+}
 
-	// Create demand
+// createDemand creates demand (shipment) document
+func (api *API) createDemand(demandData *Demand) (*Demand, error) {
 	resp, err := api.makeRequest("POST", "/entity/demand", demandData, nil)
 	if err != nil {
 		return nil, &APIError{Message: fmt.Sprintf("Network error creating demand: %v", err)}
@@ -471,13 +453,13 @@ func (api *API) createDemand(updDocument *models.UPDDocument, organization, coun
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
-		var result map[string]interface{}
+		var result Demand
 		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 			return nil, &APIError{Message: fmt.Sprintf("Failed to decode demand response: %v", err)}
 		}
 
-		api.logger.Infof("Demand successfully created: %s", result["id"])
-		return result, nil
+		api.logger.Infof("Demand successfully created: %s", result.ID)
+		return &result, nil
 	}
 
 	body, _ := io.ReadAll(resp.Body)
@@ -486,294 +468,399 @@ func (api *API) createDemand(updDocument *models.UPDDocument, organization, coun
 	return nil, &APIError{Message: errorMsg}
 }
 
-// mapUPDToFactureOut converts UPD to MoySkald invoice format
-func (api *API) mapUPDToFactureOut(updDocument *models.UPDDocument, organization, counterparty, demand map[string]interface{}) map[string]interface{} {
-	content := updDocument.Content
-
-	// Format date for MoySkald: YYYY-MM-DD HH:MM:SS.sss
-	momentStr := content.InvoiceDate.Format("2006-01-02 15:04:05.000")
+// createFactureOut creates invoice (счет-фактура) document
+func (api *API) createFactureOut(invoiceData *FactureOut) (*FactureOut, error) {
+	api.logger.Debugf("Creating invoice: %s", invoiceData.Name)
 
-	invoiceData := map[string]interface{}{
-		"name":   content.InvoiceNumber, // UPD number as is
-		"moment": momentStr,
-		"organization": map[string]interface{}{
-			"meta": organization["meta"],
-		},
-		"agent": map[string]interface{}{
-			"meta": counterparty["meta"],
-		},
-		"vatEnabled":  true,
-		"vatIncluded": true,
-		"demands": []interface{}{
-			map[string]interface{}{
-				"meta": demand["meta"],
-			},
-		},
-		"positions": []interface{}{},
+	resp, err := api.makeRequest("POST", "/entity/factureout", invoiceData, nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error creating invoice: %v", err)}
 	}
+	defer resp.Body.Close()
 
-	// Add positions (reuse same logic as demand)
-	customerInvoice, _ := api.findCustomerInvoice(content.RequisiteNumber, nil)
-	positions, _ := api.createPositionsFromUPD(&content, customerInvoice)
-	invoiceData["positions"] = positions
+	if resp.StatusCode == 200 {
+		var result FactureOut
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, &APIError{Message: fmt.Sprintf("Failed to decode invoice response: %v", err)}
+		}
 
-	api.logger.Debugf("Creating invoice: %s based on demand %s", invoiceData["name"], demand["id"])
+		api.logger.Infof("Invoice successfully created: %s", result.ID)
+		return &result, nil
+	}
 
-	return invoiceData
+	body, _ := io.ReadAll(resp.Body)
+	errorMsg := fmt.Sprintf("Error creating invoice: %d - %s", resp.StatusCode, string(body))
+	api.logger.Error(errorMsg)
+	return nil, &APIError{Message: errorMsg}
 }
 
-// createPositionsFromUPD creates document positions from UPD
-func (api *API) createPositionsFromUPD(content *models.UPDContent, customerInvoice map[string]interface{}) ([]interface{}, error) {
-	var positions []interface{}
+// createPositionsFromUPD creates document positions from UPD and describes
+// how each line was matched. With documentPriceFirst prices are taken from
+// the base document (customer invoice or order) when it is given, otherwise
+// from UPD. Without it UPD prices are used and the base document (purchase
+// order) only supplies prices of lines without amount.
+func (api *API) createPositionsFromUPD(content *models.UPDContent, partyINN string, priceDocument *Meta, documentPriceFirst bool) ([]*Position, []PlanLine, error) {
+	var positions []*Position
+	var lines []PlanLine
 	var missingItems []string
+	var mapCommands []string
+	var unmatched []models.UnmatchedItem
+	newItems := make(map[string]newAssortment)
+
+	// Positions of base document for price matching are loaded on first use
+	var invoicePositions map[string]decimal.Decimal
+	documentSource := "invoiceout"
+	if priceDocument != nil && priceDocument.Type != "" {
+		documentSource = priceDocument.Type
+	}
+	documentPrices := func() map[string]decimal.Decimal {
+		if invoicePositions == nil {
+			invoicePositions = api.getDocumentPrices(priceDocument)
+		}
+		return invoicePositions
+	}
 
-	// Get positions from invoice for price matching
-	invoicePositions := make(map[string]int64)
-	if customerInvoice != nil {
-		invoicePositions = api.getInvoicePositions(customerInvoice)
+	// Counterparty item mappings take precedence over catalog search
+	mapped := make(map[int]*ItemMapping)
+	for i := range content.Items {
+		if mapping := api.mappings.lookup(partyINN, &content.Items[i]); mapping != nil {
+			mapped[i] = mapping
+		}
 	}
 
-	// Add positions from UPD
-	for _, item := range content.Items {
-		// Find product by article first
-		var product map[string]interface{}
-		if item.Article != "" {
-			api.logger.Infof("Searching product by article: %s", item.Article)
-			product = api.findProductByArticle(item.Article)
-			if product != nil {
-				api.logger.Infof("✅ Product found by article %s: %s (ID: %s)", item.Article, product["name"], product["id"])
-			} else {
-				api.logger.Warningf("❌ Product not found by article: %s", item.Article)
+	// Resolve other lines in bulk by match strategies in configured order.
+	// Each strategy looks up only lines left by the previous ones.
+	found := make(map[int]*Product)
+	foundBy := make(map[int]string)
+	for _, strategy := range api.options.MatchStrategies {
+		var values []string
+		for i := range content.Items {
+			if mapped[i] == nil && found[i] == nil {
+				if value := strategyValue(strategy, &content.Items[i]); value != "" {
+					values = append(values, value)
+				}
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		byValue, err := api.findAssortmentBy(strategy, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range content.Items {
+			if mapped[i] != nil || found[i] != nil {
+				continue
+			}
+			if value := strategyValue(strategy, &content.Items[i]); value != "" && byValue[value] != nil {
+				found[i], foundBy[i] = byValue[value], strategy
 			}
 		}
+	}
 
-		// If not found by article, search by name
+	// Add positions from UPD
+	for i, item := range content.Items {
+		vat, err := itemVAT(&item)
+		if err != nil {
+			return nil, nil, err
+		}
+		quantity := roundQuantity(item.Quantity)
+		if !quantity.Equal(item.Quantity) {
+			api.logger.Warningf("Quantity %s of %s rounded to %s", item.Quantity.String(), item.Name, quantity.String())
+		}
+
+		// Use mapped item, otherwise item found by match strategies
+		product, matchedBy := found[i], foundBy[i]
+		if mapping := mapped[i]; mapping != nil {
+			matchedBy = "mapping"
+			product = &Product{Meta: mapping.meta(api.baseURL), ID: mapping.AssortmentID, Name: mapping.AssortmentName}
+			api.logger.Infof("✅ Item %s mapped to %s %s", item.Name, mapping.AssortmentType, mapping.AssortmentName)
+		} else if product != nil {
+			api.logger.Infof("✅ %s found by %s: %s (ID: %s)", product.Meta.Type, matchedBy, product.Name, product.ID)
+		} else {
+			api.logger.Warningf("❌ Item not found by %s: %s (article: %s)", strings.Join(api.options.MatchStrategies, ", "), item.Name, item.Article)
+		}
+
+		// Last resort: rank similar assortment, match only a confident candidate
+		var candidates []models.MatchCandidate
+		confidence := 1.0
 		if product == nil {
-			api.logger.Infof("Searching product by name: %s", item.Name)
-			product = api.findProduct(item.Name)
-			if product != nil {
-				api.logger.Infof("✅ Product found by name: %s (ID: %s)", product["name"], product["id"])
-			} else {
-				api.logger.Warningf("❌ Product not found by name: %s", item.Name)
+			candidates = api.findCandidates(&item)
+			if match := api.confidentMatch(candidates); match != nil {
+				matchedBy, confidence = "fuzzy", match.Confidence
+				product = &Product{Meta: api.candidateMeta(match), ID: match.ID, Name: match.Name, Article: match.Article}
+				api.logger.Infof("✅ Product matched by similarity %.0f%%: %s (ID: %s)", match.Confidence*100, product.Name, product.ID)
+			} else if len(candidates) > 0 {
+				api.logger.Warningf("❓ No confident match for %s, best candidate %s (%.0f%%)", item.Name, candidates[0].Name, candidates[0].Confidence*100)
 			}
 		}
 
 		if product != nil {
-			// Determine price: from invoice first, then from UPD
-			priceKopecks := int64(item.Price.Mul(decimal.NewFromInt(100)).IntPart())
-
-			// Search price in invoice by article
-			if item.Article != "" {
-				if invoicePrice, exists := invoicePositions["article:"+item.Article]; exists && invoicePrice > 0 {
-					priceKopecks = invoicePrice
-					api.logger.Infof("Using price from invoice by article %s: %.2f rub", item.Article, float64(priceKopecks)/100)
+			// Determine price: from base document first for sales, from UPD
+			// first for purchases
+			price, priceSource := updPrice(&item, vat), "upd"
+			if priceDocument != nil && (documentPriceFirst || !price.IsPositive()) {
+				// Mapped items are named differently in the document, so
+				// the product name is tried too
+				keys := []string{"name:" + item.Name, "name:" + product.Name}
+				if item.Article != "" {
+					keys = append([]string{"article:" + item.Article}, keys...)
 				}
-			}
-			// If not found by article, search by name
-			if priceKopecks == int64(item.Price.Mul(decimal.NewFromInt(100)).IntPart()) {
-				if invoicePrice, exists := invoicePositions["name:"+item.Name]; exists && invoicePrice > 0 {
-					priceKopecks = invoicePrice
-					api.logger.Infof("Using price from invoice by name '%s': %.2f rub", item.Name, float64(priceKopecks)/100)
-				} else {
-					api.logger.Warningf("Price for product '%s' not found in invoice, using UPD price: %.2f rub", item.Name, float64(priceKopecks)/100)
+				for _, key := range keys {
+					if documentPrice, exists := documentPrices()[key]; exists && documentPrice.IsPositive() {
+						price, priceSource = documentPrice, documentSource
+						api.logger.Infof("Using price from %s by %s: %s", documentSource, key, fromKopecks(price).StringFixed(2))
+						break
+					}
+				}
+				if priceSource == "upd" {
+					api.logger.Warningf("Price for product '%s' not found in %s, using UPD price: %s", item.Name, documentSource, fromKopecks(price).StringFixed(2))
 				}
 			}
 
-			position := map[string]interface{}{
-				"quantity": item.Quantity.InexactFloat64(),
-				"price":    priceKopecks,
-				"assortment": map[string]interface{}{
-					"meta": product["meta"],
-				},
-				"vat": api.getVATRate(item.VATRate),
+			position := &Position{
+				Quantity:   quantity.InexactFloat64(),
+				Price:      price.InexactFloat64(),
+				Assortment: &Assortment{Meta: product.Meta},
+				VAT:        vat.Rate,
+				VatEnabled: boolPtr(vat.Enabled),
 			}
 			positions = append(positions, position)
+			lines = append(lines, PlanLine{
+				Name:        item.Name,
+				Article:     item.Article,
+				Assortment:  product.Name,
+				MatchedBy:   matchedBy,
+				Confidence:  confidence,
+				Quantity:    position.Quantity,
+				Price:       position.Price,
+				PriceSource: priceSource,
+				VAT:         position.VAT,
+				VATEnabled:  *position.VatEnabled,
+			})
+		} else if api.options.MissingProducts != MissingProductsFail {
+			// Missing product is created on execution with UPD price
+			key := item.Article + "|" + item.Name
+			planned, ok := newItems[key]
+			if !ok {
+				planned.product, planned.service = api.newAssortmentPayload(&item, vat)
+				newItems[key] = planned
+			}
+
+			position := &Position{
+				Quantity:   quantity.InexactFloat64(),
+				Price:      updPrice(&item, vat).InexactFloat64(),
+				VAT:        vat.Rate,
+				VatEnabled: boolPtr(vat.Enabled),
+			}
+			positions = append(positions, position)
+			lines = append(lines, PlanLine{
+				Name:        item.Name,
+				Article:     item.Article,
+				Assortment:  item.Name,
+				MatchedBy:   "new",
+				Quantity:    position.Quantity,
+				Price:       position.Price,
+				PriceSource: "upd",
+				VAT:         position.VAT,
+				VATEnabled:  *position.VatEnabled,
+				NewProduct:  planned.product,
+				NewService:  planned.service,
+				Candidates:  candidates,
+			})
 		} else {
 			articleInfo := item.Article
 			if articleInfo == "" {
 				articleInfo = "не указан"
 			}
 			missingItems = append(missingItems, fmt.Sprintf("%s (артикул: %s)", item.Name, articleInfo))
+			for _, candidate := range candidates {
+				missingItems[len(missingItems)-1] += fmt.Sprintf("\n   ? %s — %.0f%%", candidate.Name, candidate.Confidence*100)
+			}
+			mapCommands = append(mapCommands, fmt.Sprintf("/map %s; %s; %s; <артикул или название в МойСклад>", partyINN, item.Article, item.Name))
+			unmatched = append(unmatched, models.UnmatchedItem{PartyINN: partyINN, Article: item.Article, Name: item.Name, Candidates: candidates})
 		}
 	}
 
 	// If there are missing items, return error
 	if len(missingItems) > 0 {
 		errorMsg := fmt.Sprintf("The following products from UPD are not found in MoySkald:\n• %s\n\nCreate these products in MoySkald manually and retry UPD upload.", strings.Join(missingItems, "\n• "))
-		return nil, &APIError{Message: errorMsg}
+		errorMsg += fmt.Sprintf("\n\nIf the products exist under other names, map them and retry:\n%s", strings.Join(mapCommands, "\n"))
+		return nil, nil, &UnmatchedItemsError{Message: errorMsg, Items: unmatched}
 	}
 
 	// If no positions from UPD, use any available service
 	if len(positions) == 0 {
-		totalPriceKopecks := int64(1000 * 100) // 1000 rub default
-		if content.TotalWithVAT.GreaterThan(decimal.Zero) {
-			totalPriceKopecks = int64(content.TotalWithVAT.Mul(decimal.NewFromInt(100)).IntPart())
+		totalPrice := decimal.NewFromInt(1000 * 100) // 1000 rub default
+		if content.TotalWithVAT.IsPositive() {
+			totalPrice = toKopecks(content.TotalWithVAT)
 		}
 
 		service := api.getAnyAvailableService()
 		if service == nil {
-			return nil, &APIError{Message: "No available services in MoySkald to create document position.\nCreate at least one service in MoySkald and try again."}
+			return nil, nil, &APIError{Message: "No available services in MoySkald to create document position.\nCreate at least one service in MoySkald and try again."}
 		}
 
-		positions = append(positions, map[string]interface{}{
-			"quantity": 1,
-			"price":    totalPriceKopecks,
-			"assortment": map[string]interface{}{
-				"meta": service["meta"],
-			},
-			"vat": 18,
+		vat := documentVAT(content)
+		position := &Position{
+			Quantity:   1,
+			Price:      totalPrice.InexactFloat64(),
+			Assortment: &Assortment{Meta: service.Meta},
+			VAT:        vat.Rate,
+			VatEnabled: boolPtr(vat.Enabled),
+		}
+		positions = append(positions, position)
+		lines = append(lines, PlanLine{
+			Name:        "Document total",
+			Assortment:  service.Name,
+			MatchedBy:   "service",
+			Quantity:    position.Quantity,
+			Price:       position.Price,
+			PriceSource: "upd",
+			VAT:         position.VAT,
+			VATEnabled:  vat.Enabled,
 		})
 	}
 
-	return positions, nil
+	return positions, lines, nil
 }
 
-// getInvoicePositions gets positions from invoice for price matching
-func (api *API) getInvoicePositions(customerInvoice map[string]interface{}) map[string]int64 {
-	positions := make(map[string]int64)
+// getDocumentPrices gets position prices of customer invoice or purchase
+// order for price matching
+func (api *API) getDocumentPrices(document *Meta) map[string]decimal.Decimal {
+	positions := make(map[string]decimal.Decimal)
 
-	// Get full invoice information with positions
-	if meta, ok := customerInvoice["meta"].(map[string]interface{}); ok {
-		if href, ok := meta["href"].(string); ok {
-			resp, err := api.makeRequest("GET", strings.TrimPrefix(href, api.baseURL)+"?expand=positions.assortment", nil, nil)
-			if err != nil {
-				api.logger.Errorf("Error getting invoice positions: %v", err)
-				return positions
-			}
-			defer resp.Body.Close()
+	// Get full document information with positions
+	if document.Href != "" {
+		resp, err := api.makeRequest("GET", strings.TrimPrefix(document.Href, api.baseURL)+"?expand=positions.assortment", nil, nil)
+		if err != nil {
+			api.logger.Errorf("Error getting document positions: %v", err)
+			return positions
+		}
+		defer resp.Body.Close()
 
-			if resp.StatusCode == 200 {
-				var invoiceData map[string]interface{}
-				if err := json.NewDecoder(resp.Body).Decode(&invoiceData); err == nil {
-					if positionsData, ok := invoiceData["positions"]; ok {
-						api.parseInvoicePositions(positionsData, positions)
-					}
-				}
+		if resp.StatusCode == 200 {
+			var documentData struct {
+				Positions *Positions `json:"positions"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&documentData); err == nil && documentData.Positions != nil {
+				api.parseInvoicePositions(documentData.Positions, positions)
 			}
 		}
 	}
 
-	api.logger.Infof("Loaded %d positions from invoice for price matching", len(positions))
+	api.logger.Infof("Loaded %d positions from %s for price matching", len(positions), document.Type)
 	return positions
 }
 
 // parseInvoicePositions parses positions from invoice data
-func (api *API) parseInvoicePositions(positionsData interface{}, positions map[string]int64) {
-	switch data := positionsData.(type) {
-	case map[string]interface{}:
-		if rows, ok := data["rows"].([]interface{}); ok {
-			for _, pos := range rows {
-				api.parsePosition(pos, positions)
-			}
-		} else if href, ok := data["meta"].(map[string]interface{})["href"].(string); ok {
-			// Load positions separately
-			resp, err := api.makeRequest("GET", strings.TrimPrefix(href, api.baseURL), nil, nil)
-			if err == nil {
-				defer resp.Body.Close()
-				if resp.StatusCode == 200 {
-					var positionsResult map[string]interface{}
-					if json.NewDecoder(resp.Body).Decode(&positionsResult) == nil {
-						if rows, ok := positionsResult["rows"].([]interface{}); ok {
-							for _, pos := range rows {
-								api.parsePosition(pos, positions)
-							}
-						}
-					}
-				}
-			}
+func (api *API) parseInvoicePositions(invoicePositions *Positions, positions map[string]decimal.Decimal) {
+	rows := invoicePositions.Rows
+	if !invoicePositions.complete() && invoicePositions.Meta != nil && invoicePositions.Meta.Href != "" {
+		// Load positions separately
+		loaded, err := listAll[*Position](api, strings.TrimPrefix(invoicePositions.Meta.Href, api.baseURL), map[string]string{"expand": "assortment"})
+		if err != nil {
+			api.logger.Errorf("Error loading invoice positions: %v", err)
 		}
-	case []interface{}:
-		for _, pos := range data {
-			api.parsePosition(pos, positions)
+		if loaded != nil {
+			rows = loaded
 		}
 	}
+
+	for _, position := range rows {
+		api.parsePosition(position, positions)
+	}
 }
 
 // parsePosition parses individual position
-func (api *API) parsePosition(pos interface{}, positions map[string]int64) {
-	if position, ok := pos.(map[string]interface{}); ok {
-		if assortment, ok := position["assortment"].(map[string]interface{}); ok {
-			productName, _ := assortment["name"].(string)
-			productArticle, _ := assortment["article"].(string)
-			price, _ := position["price"].(float64)
-
-			if productArticle != "" {
-				positions["article:"+productArticle] = int64(price)
-			}
-			if productName != "" {
-				positions["name:"+productName] = int64(price)
-			}
-		}
+func (api *API) parsePosition(position *Position, positions map[string]decimal.Decimal) {
+	if position == nil || position.Assortment == nil {
+		return
 	}
-}
 
-// findProduct finds product by name
-func (api *API) findProduct(productName string) map[string]interface{} {
-	params := map[string]string{"filter": "name=" + productName}
-	resp, err := api.makeRequest("GET", "/entity/product", nil, params)
-	if err != nil {
-		api.logger.Errorf("Error searching product: %v", err)
-		return nil
+	price := decimal.NewFromFloat(position.Price).Round(0)
+	if position.Assortment.Article != "" {
+		positions["article:"+position.Assortment.Article] = price
 	}
-	defer resp.Body.Close()
+	if position.Assortment.Name != "" {
+		positions["name:"+position.Assortment.Name] = price
+	}
+}
 
-	if resp.StatusCode == 200 {
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err == nil {
-			if products, ok := data["rows"].([]interface{}); ok && len(products) > 0 {
-				product := products[0].(map[string]interface{})
-				api.logger.Debugf("Found product: %s", product["name"])
-				return product
-			}
+// findAssortmentBy finds products, services, variants and bundles whose
+// field matches any of the values. Values are looked up with multi-value
+// filters in a few requests; the first item found for each value wins.
+// Meta type of returned items tells which entity they are.
+func (api *API) findAssortmentBy(field string, values []string) (map[string]*Product, error) {
+	products := make(map[string]*Product)
+
+	// Take cached products and look up only the rest
+	var missing []string
+	for _, value := range values {
+		var cached Product
+		if api.cache.get(cacheProduct, field+"="+value, &cached) {
+			products[value] = &cached
+		} else {
+			missing = append(missing, value)
 		}
 	}
 
-	api.logger.Warningf("Product '%s' not found in MoySkald", productName)
-	return nil
-}
+	filters := multiValueFilters(field, missing)
+	if len(filters) == 0 {
+		return products, nil
+	}
 
-// findProductByArticle finds product by article
-func (api *API) findProductByArticle(article string) map[string]interface{} {
-	params := map[string]string{"filter": "article=" + article}
-	resp, err := api.makeRequest("GET", "/entity/product", nil, params)
-	if err != nil {
-		api.logger.Errorf("Error searching product by article: %v", err)
-		return nil
+	api.logger.Infof("Searching %d items by %s in %d request(s), %d cached", len(missing), field, len(filters), len(values)-len(missing))
+
+	// Match returned products to requested values ignoring case
+	requested := make(map[string]string, len(missing))
+	for _, value := range missing {
+		requested[strings.ToLower(value)] = value
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 200 {
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err == nil {
-			if products, ok := data["rows"].([]interface{}); ok && len(products) > 0 {
-				product := products[0].(map[string]interface{})
-				api.logger.Debugf("Found product by article %s: %s", article, product["name"])
-				return product
+	for _, filter := range filters {
+		for product, err := range listRows[*Product](api, "/entity/assortment", map[string]string{"filter": filter}) {
+			if err != nil {
+				return nil, err
+			}
+			if product == nil || product.Meta == nil {
+				continue
+			}
+
+			for _, key := range product.fieldValues(field) {
+				value, ok := requested[strings.ToLower(key)]
+				if !ok {
+					continue
+				}
+				if _, exists := products[value]; !exists {
+					products[value] = product
+					api.cache.set(cacheProduct, field+"="+value, product)
+				}
 			}
 		}
 	}
 
-	api.logger.Debugf("Product with article %s not found", article)
-	return nil
+	api.logger.Debugf("Found %d items by %s", len(products), field)
+	return products, nil
 }
 
-// getAnyAvailableService gets any available service
-func (api *API) getAnyAvailableService() map[string]interface{} {
-	resp, err := api.makeRequest("GET", "/entity/service", nil, nil)
-	if err != nil {
-		api.logger.Errorf("Error getting services: %v", err)
-		return nil
+// getAnyAvailableService gets the first active service
+func (api *API) getAnyAvailableService() *Service {
+	var cached Service
+	if api.cache.get(cacheService, "any", &cached) {
+		return &cached
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 200 {
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err == nil {
-			if services, ok := data["rows"].([]interface{}); ok && len(services) > 0 {
-				service := services[0].(map[string]interface{})
-				api.logger.Debugf("Using available service: %s", service["name"])
-				return service
-			}
+	for service, err := range listRows[*Service](api, "/entity/service", nil) {
+		if err != nil {
+			api.logger.Errorf("Error getting services: %v", err)
+			return nil
+		}
+		if service != nil && !service.Archived {
+			api.logger.Debugf("Using available service: %s", service.Name)
+			api.cache.set(cacheService, "any", service)
+			return service
 		}
 	}
 
@@ -782,7 +869,7 @@ func (api *API) getAnyAvailableService() map[string]interface{} {
 }
 
 // findCustomerInvoice finds customer invoice by requisite number
-func (api *API) findCustomerInvoice(requisiteNumber string, counterparty map[string]interface{}) (map[string]interface{}, error) {
+func (api *API) findCustomerInvoice(requisiteNumber string, counterparty *Counterparty) (*InvoiceOut, error) {
 	if requisiteNumber == "" {
 		api.logger.Debug("Requisite number not found")
 		return nil, fmt.Errorf("requisite number not provided")
@@ -800,44 +887,14 @@ func (api *API) findCustomerInvoice(requisiteNumber string, counterparty map[str
 	for _, pattern := range searchPatterns {
 		api.logger.Debugf("Searching invoice with filter: %s", pattern)
 
-		params := map[string]string{"filter": pattern}
-		resp, err := api.makeRequest("GET", "/entity/invoiceout", nil, params)
-		if err != nil {
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == 200 {
-			var data map[string]interface{}
-			if err := json.NewDecoder(resp.Body).Decode(&data); err == nil {
-				if invoices, ok := data["rows"].([]interface{}); ok && len(invoices) > 0 {
-					invoice := invoices[0].(map[string]interface{})
-
-					// Get full invoice information
-					if meta, ok := invoice["meta"].(map[string]interface{}); ok {
-						if href, ok := meta["href"].(string); ok {
-							fullResp, err := api.makeRequest("GET", strings.TrimPrefix(href, api.baseURL), nil, nil)
-							if err == nil {
-								defer fullResp.Body.Close()
-								if fullResp.StatusCode == 200 {
-									var invoiceData map[string]interface{}
-									if json.NewDecoder(fullResp.Body).Decode(&invoiceData) == nil {
-										agentName := "unknown"
-										if agent, ok := invoiceData["agent"].(map[string]interface{}); ok {
-											if name, ok := agent["name"].(string); ok {
-												agentName = name
-											}
-										}
-
-										api.logger.Infof("Found supplier invoice: %s (counterparty: %s, filter: %s)", invoice["name"], agentName, pattern)
-										return invoiceData, nil
-									}
-								}
-							}
-						}
-					}
-				}
+		if invoice := api.findInvoiceOut(pattern); invoice != nil {
+			agentName := "unknown"
+			if invoice.Agent != nil && invoice.Agent.Name != "" {
+				agentName = invoice.Agent.Name
 			}
+
+			api.logger.Infof("Found supplier invoice: %s (counterparty: %s, filter: %s)", invoice.Name, agentName, pattern)
+			return invoice, nil
 		}
 	}
 
@@ -845,68 +902,201 @@ func (api *API) findCustomerInvoice(requisiteNumber string, counterparty map[str
 	return nil, fmt.Errorf("invoice not found")
 }
 
+// findInvoiceOut finds the first customer invoice matching the filter and loads it in full
+func (api *API) findInvoiceOut(filter string) *InvoiceOut {
+	params := map[string]string{"filter": filter}
+	resp, err := api.makeRequest("GET", "/entity/invoiceout", nil, params)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil
+	}
+
+	var data ListResponse[*InvoiceOut]
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil || len(data.Rows) == 0 || data.Rows[0] == nil {
+		return nil
+	}
+
+	// Get full invoice information
+	invoice := data.Rows[0]
+	if invoice.Meta == nil || invoice.Meta.Href == "" {
+		return nil
+	}
+
+	fullResp, err := api.makeRequest("GET", strings.TrimPrefix(invoice.Meta.Href, api.baseURL), nil, nil)
+	if err != nil {
+		return nil
+	}
+	defer fullResp.Body.Close()
+
+	if fullResp.StatusCode != 200 {
+		return nil
+	}
+
+	var invoiceData InvoiceOut
+	if json.NewDecoder(fullResp.Body).Decode(&invoiceData) != nil {
+		return nil
+	}
+	return &invoiceData
+}
+
+// findCustomerOrder finds customer order by requisite number. Returns nil
+// when there is no matching order.
+func (api *API) findCustomerOrder(requisiteNumber string, counterparty *Counterparty) *CustomerOrder {
+	if requisiteNumber == "" {
+		return nil
+	}
+
+	filter := "name=" + requisiteNumber
+	if counterparty != nil && counterparty.Meta != nil {
+		filter += ";agent=" + counterparty.Meta.Href
+	}
+
+	page, err := getPage[*CustomerOrder](api, "/entity/customerorder", map[string]string{"filter": filter, "limit": "1"})
+	if err != nil {
+		api.logger.Warningf("Error searching customer order %s: %v", requisiteNumber, err)
+		return nil
+	}
+	if len(page.Rows) == 0 || page.Rows[0] == nil {
+		return nil
+	}
+
+	api.logger.Infof("Found customer order: %s", page.Rows[0].Name)
+	return page.Rows[0]
+}
+
+// getCustomerOrder loads customer order the invoice is based on. Returns
+// nil when there is none.
+func (api *API) getCustomerOrder(order *CustomerOrder) *CustomerOrder {
+	if order == nil || order.Meta == nil || order.Meta.Href == "" {
+		return nil
+	}
+
+	resp, err := api.makeRequest("GET", strings.TrimPrefix(order.Meta.Href, api.baseURL), nil, nil)
+	if err != nil {
+		api.logger.Warningf("Error loading customer order: %v", err)
+		return order
+	}
+	defer resp.Body.Close()
+
+	var loaded CustomerOrder
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&loaded) != nil {
+		api.logger.Warningf("Error loading customer order: %d", resp.StatusCode)
+		return order
+	}
+	return &loaded
+}
+
 // getStoreFromInvoice gets store from customer invoice
-func (api *API) getStoreFromInvoice(customerInvoice map[string]interface{}) (map[string]interface{}, error) {
+func (api *API) getStoreFromInvoice(customerInvoice *InvoiceOut) (*Store, error) {
 	if customerInvoice == nil {
 		return nil, fmt.Errorf("customer invoice is nil")
 	}
 
-	api.logger.Infof("Found customer invoice: %s", customerInvoice["name"])
+	api.logger.Infof("Found customer invoice: %s", customerInvoice.Name)
 
 	// Look for store in invoice
-	if store, ok := customerInvoice["store"]; ok && store != nil {
-		if storeMap, ok := store.(map[string]interface{}); ok {
-			storeName, _ := storeMap["name"].(string)
-			storeID, _ := storeMap["id"].(string)
-
-			// If store doesn't have direct name/id, it might be a meta reference
-			if storeName == "" && storeID == "" {
-				if meta, ok := storeMap["meta"].(map[string]interface{}); ok {
-					if href, ok := meta["href"].(string); ok {
-						// Get full store information
-						storeResp, err := api.makeRequest("GET", strings.TrimPrefix(href, api.baseURL), nil, nil)
-						if err == nil {
-							defer storeResp.Body.Close()
-							if storeResp.StatusCode == 200 {
-								var storeData map[string]interface{}
-								if json.NewDecoder(storeResp.Body).Decode(&storeData) == nil {
-									storeName, _ = storeData["name"].(string)
-									storeID, _ = storeData["id"].(string)
-									api.logger.Debugf("Got full store information: %s (ID: %s)", storeName, storeID)
-									return storeData, nil
-								}
-							}
-						}
-					}
-				}
-			}
+	store := customerInvoice.Store
+	if store == nil {
+		return nil, fmt.Errorf("store not specified in invoice")
+	}
 
-			if storeName != "" || storeID != "" {
-				api.logger.Infof("Store from invoice: %s (ID: %s)", storeName, storeID)
-				return storeMap, nil
-			}
+	// If store doesn't have direct name/id, it is a meta reference
+	if store.Name == "" && store.ID == "" && store.Meta != nil && store.Meta.Href != "" {
+		// Get full store information
+		var storeData Store
+		if err := api.getEntity(cacheStore, store.Meta.Href, &storeData); err == nil {
+			api.logger.Debugf("Got full store information: %s (ID: %s)", storeData.Name, storeData.ID)
+			return &storeData, nil
+		}
+	}
+
+	if store.Meta == nil {
+		return nil, fmt.Errorf("store not specified in invoice")
+	}
+
+	api.logger.Infof("Store from invoice: %s (ID: %s)", store.Name, store.ID)
+	return store, nil
+}
+
+// getEntity loads entity by href into v using the reference cache
+func (api *API) getEntity(kind, href string, v interface{}) error {
+	if api.cache.get(kind, href, v) {
+		return nil
+	}
+
+	resp, err := api.makeRequest("GET", strings.TrimPrefix(href, api.baseURL), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{Message: fmt.Sprintf("Error loading %s: %d - %s", kind, resp.StatusCode, string(body))}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return err
+	}
+
+	api.cache.set(kind, href, v)
+	return nil
+}
+
+// getDocumentRate builds document rate (currency and exchange rate) from UPD.
+// Returns nil for ruble documents when the currency is not found, so the
+// account default currency is used.
+func (api *API) getDocumentRate(content *models.UPDContent) (*Rate, error) {
+	isoCode := content.CurrencyISOCode()
+
+	currency, err := api.findCurrencyByISOCode(isoCode, content.CurrencyCode)
+	if err != nil {
+		if content.IsDefaultCurrency() {
+			api.logger.Warningf("Currency %s not found, using account default currency", isoCode)
+			return nil, nil
 		}
+		return nil, &APIError{Message: fmt.Sprintf("Currency %s (code %s) not found in MoySkald.\nAdd the currency to the MoySkald currency directory and try again.", isoCode, content.CurrencyCode)}
 	}
 
-	return nil, fmt.Errorf("store not specified in invoice")
+	rateValue := content.ExchangeRate
+	if rateValue.LessThanOrEqual(decimal.Zero) {
+		rateValue = decimal.NewFromInt(1)
+	}
+
+	api.logger.Infof("Document currency: %s, rate %s", isoCode, rateValue)
+	return &Rate{
+		Currency: &Currency{Meta: currency.Meta},
+		Value:    rateValue.InexactFloat64(),
+	}, nil
 }
 
-// getVATRate converts VAT rate string to numeric value
-func (api *API) getVATRate(vatRateStr string) int {
-	if vatRateStr == "" {
-		return 18
+// findCurrencyByISOCode finds currency by ISO code, falling back to the OKV numeric code
+func (api *API) findCurrencyByISOCode(isoCode, okvCode string) (*Currency, error) {
+	var currencies []*Currency
+	if !api.cache.get(cacheCurrency, "all", &currencies) {
+		var err error
+		currencies, err = listAll[*Currency](api, "/entity/currency", nil)
+		if err != nil {
+			return nil, err
+		}
+		api.cache.set(cacheCurrency, "all", currencies)
 	}
 
-	// Extract number from string like "18%" or "20%"
-	re := regexp.MustCompile(`(\d+)`)
-	matches := re.FindStringSubmatch(vatRateStr)
-	if len(matches) > 1 {
-		if rate, err := strconv.Atoi(matches[1]); err == nil {
-			return rate
+	for _, currency := range currencies {
+		if currency == nil {
+			continue
+		}
+		if strings.EqualFold(currency.ISOCode, isoCode) || (okvCode != "" && currency.Code == okvCode) {
+			api.logger.Debugf("Found currency %s: %s", isoCode, currency.Name)
+			return currency, nil
 		}
 	}
 
-	return 18 // Default
+	return nil, fmt.Errorf("currency not found")
 }
 
 // GetInvoiceURL returns invoice URL in MoySkald web interface
@@ -920,7 +1110,7 @@ func (api *API) GetDemandURL(demandID string) string {
 }
 
 // GetInvoiceInfo gets invoice information
-func (api *API) GetInvoiceInfo(invoiceID string) (map[string]interface{}, error) {
+func (api *API) GetInvoiceInfo(invoiceID string) (*FactureOut, error) {
 	resp, err := api.makeRequest("GET", "/entity/factureout/"+invoiceID, nil, nil)
 	if err != nil {
 		return nil, err
@@ -928,11 +1118,11 @@ func (api *API) GetInvoiceInfo(invoiceID string) (map[string]interface{}, error)
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
-		var data map[string]interface{}
+		var data FactureOut
 		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 			return nil, err
 		}
-		return data, nil
+		return &data, nil
 	}
 
 	api.logger.Errorf("Error getting invoice information: %d", resp.StatusCode)
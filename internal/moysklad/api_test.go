@@ -0,0 +1,127 @@
+package moysklad
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestParseInvoicePositionsExpandsAssortment(t *testing.T) {
+	api := newTestAPI(t, positionsHandler(t, 150), fastLimits())
+	invoicePositions := &Positions{Meta: &Meta{Href: api.baseURL + "/entity/invoicein/1/positions", Size: 150}}
+
+	positions := make(map[string]decimal.Decimal)
+	api.parseInvoicePositions(invoicePositions, positions)
+
+	if len(positions) != 300 {
+		t.Fatalf("got %d price keys, want article and name keys for 150 positions", len(positions))
+	}
+	for key, want := range map[string]int64{"article:A-0": 100, "name:Товар 0": 100, "article:A-149": 15000, "name:Товар 149": 15000} {
+		if price, ok := positions[key]; !ok || !price.Equal(decimal.NewFromInt(want)) {
+			t.Errorf("positions[%q] = %s, %v; want %d", key, price, ok, want)
+		}
+	}
+}
+
+func TestVerifyTokenConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	api := NewAPI(server.URL, "token", "", fastLimits(), CacheOptions{TTL: time.Minute}, UploadOptions{}, logger)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !api.VerifyToken() {
+				t.Error("VerifyToken() = false, want true")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The token is trusted until the cache TTL expires
+	before := calls.Load()
+	if !api.VerifyToken() || calls.Load() != before {
+		t.Errorf("verified token requested again: %d calls, want %d", calls.Load(), before)
+	}
+}
+
+func TestCreatePositionsPriceSource(t *testing.T) {
+	var documentRequests atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/entity/assortment":
+			w.Write([]byte(`{"meta":{"size":2},"rows":[
+				{"meta":{"href":"https://api/entity/product/1","type":"product"},"id":"1","name":"Труба","article":"A-1"},
+				{"meta":{"href":"https://api/entity/product/2","type":"product"},"id":"2","name":"Лист","article":"A-2"}]}`))
+		case "/entity/purchaseorder/1":
+			documentRequests.Add(1)
+			w.Write([]byte(`{"positions":{"meta":{"size":2},"rows":[
+				{"price":50000,"assortment":{"name":"Труба","article":"A-1"}},
+				{"price":70000,"assortment":{"name":"Лист","article":"A-2"}}]}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}
+
+	item := func(article, amount string) models.InvoiceItem {
+		return models.InvoiceItem{
+			Name:          article,
+			Article:       article,
+			Quantity:      decimal.NewFromInt(1),
+			VATRate:       "20%",
+			AmountWithVAT: decimal.RequireFromString(amount),
+		}
+	}
+
+	tests := []struct {
+		name               string
+		documentPriceFirst bool
+		items              []models.InvoiceItem
+		wantPrices         []float64
+		wantSources        []string
+		wantRequests       int32
+	}{
+		{"sale takes document prices", true, []models.InvoiceItem{item("A-1", "600"), item("A-2", "0")}, []float64{50000, 70000}, []string{"purchaseorder", "purchaseorder"}, 1},
+		{"purchase takes UPD prices", false, []models.InvoiceItem{item("A-1", "600"), item("A-2", "840")}, []float64{60000, 84000}, []string{"upd", "upd"}, 0},
+		{"purchase line without amount", false, []models.InvoiceItem{item("A-1", "600"), item("A-2", "0")}, []float64{60000, 70000}, []string{"upd", "purchaseorder"}, 1},
+	}
+
+	for _, tt := range tests {
+		documentRequests.Store(0)
+		api := newTestAPI(t, handler, fastLimits())
+		api.options.MatchStrategies = []string{MatchByArticle}
+		content := &models.UPDContent{Items: tt.items}
+		document := &Meta{Href: api.baseURL + "/entity/purchaseorder/1", Type: "purchaseorder"}
+
+		_, lines, err := api.createPositionsFromUPD(content, "7843316106", document, tt.documentPriceFirst)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, line := range lines {
+			if line.Price != tt.wantPrices[i] || line.PriceSource != tt.wantSources[i] {
+				t.Errorf("%s: line %d price %.0f from %s, want %.0f from %s", tt.name, i, line.Price, line.PriceSource, tt.wantPrices[i], tt.wantSources[i])
+			}
+		}
+		if got := documentRequests.Load(); got != tt.wantRequests {
+			t.Errorf("%s: %d purchase order requests, want %d", tt.name, got, tt.wantRequests)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package moysklad
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"upd-loader-go/internal/models"
+)
+
+// attributeEntities are documents UPD metadata is written to
+var attributeEntities = []string{"demand", "factureout"}
+
+// attributeTypes returns attribute types the field can be written to. The
+// basis date is written as a moment to time attributes.
+func attributeTypes(field string) []string {
+	if field == models.FieldBasisDate {
+		return []string{"string", "text", "time"}
+	}
+	return []string{"string", "text"}
+}
+
+// entityAttributes returns attribute definitions of the entity
+func (api *API) entityAttributes(entity string) ([]*Attribute, error) {
+	var cached []*Attribute
+	if api.cache.get(cacheAttribute, entity, &cached) {
+		return cached, nil
+	}
+
+	attributes, err := listAll[*Attribute](api, "/entity/"+entity+"/metadata/attributes", nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Error loading %s attributes: %v", entity, err)}
+	}
+	if len(attributes) > 0 {
+		api.cache.set(cacheAttribute, entity, attributes)
+	}
+	return attributes, nil
+}
+
+// findAttribute finds attribute definition by name. Returns nil when there
+// is no such attribute.
+func findAttribute(attributes []*Attribute, name string) *Attribute {
+	for _, attribute := range attributes {
+		if strings.EqualFold(strings.TrimSpace(attribute.Name), strings.TrimSpace(name)) {
+			return attribute
+		}
+	}
+	return nil
+}
+
+// VerifyAttributes checks that attributes configured for UPD metadata are
+// defined on demands and invoices with a type the field can be written to.
+// Returns descriptions of problems; such fields are not written.
+func (api *API) VerifyAttributes() ([]string, error) {
+	if len(api.options.Attributes) == 0 {
+		return nil, nil
+	}
+
+	var problems []string
+	for _, entity := range attributeEntities {
+		api.cache.invalidate(cacheAttribute, entity)
+		attributes, err := api.entityAttributes(entity)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, field := range models.AttributeFields {
+			name := api.options.Attributes[field]
+			if name == "" {
+				continue
+			}
+			attribute := findAttribute(attributes, name)
+			switch {
+			case attribute == nil:
+				problems = append(problems, fmt.Sprintf("%s: attribute '%s' for %s not found", entity, name, field))
+			case !slices.Contains(attributeTypes(field), attribute.Type):
+				problems = append(problems, fmt.Sprintf("%s: attribute '%s' for %s has type %s, expected %s", entity, name, field, attribute.Type, strings.Join(attributeTypes(field), " or ")))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// documentAttributes builds attribute values of the entity from UPD
+// metadata. Fields without attribute definition or value are skipped.
+func (api *API) documentAttributes(entity string, updDocument *models.UPDDocument) []*Attribute {
+	if len(api.options.Attributes) == 0 {
+		return nil
+	}
+
+	attributes, err := api.entityAttributes(entity)
+	if err != nil {
+		api.logger.Warningf("UPD metadata is not written to %s attributes: %v", entity, err)
+		return nil
+	}
+
+	var values []*Attribute
+	for _, field := range models.AttributeFields {
+		name := api.options.Attributes[field]
+		if name == "" {
+			continue
+		}
+		attribute := findAttribute(attributes, name)
+		if attribute == nil {
+			api.logger.Debugf("Attribute '%s' for %s not found in %s", name, field, entity)
+			continue
+		}
+		if value := attributeValue(attribute.Type, field, updDocument); value != nil {
+			values = append(values, &Attribute{Meta: attribute.Meta, Value: value})
+		}
+	}
+	return values
+}
+
+// attributeValue returns UPD metadata field as value of the attribute type:
+// text for string attributes and a moment for time ones. Returns nil when
+// the field is empty or cannot be written to the type.
+func attributeValue(attributeType, field string, updDocument *models.UPDDocument) interface{} {
+	if !slices.Contains(attributeTypes(field), attributeType) {
+		return nil
+	}
+
+	var text string
+	switch field {
+	case models.FieldDocFlowID:
+		text = updDocument.MetaInfo.DocFlowID
+	case models.FieldExternalID:
+		text = updDocument.CardInfo.ExternalIdentifier
+	case models.FieldBasisNumber:
+		text = updDocument.Content.RequisiteNumber
+	case models.FieldBasisDate:
+		date := updDocument.Content.RequisiteDate
+		if date.IsZero() {
+			return nil
+		}
+		if attributeType == "time" {
+			return date.Format(momentLayout)
+		}
+		text = date.Format("02.01.2006")
+	case models.FieldCardTitle:
+		text = updDocument.CardInfo.Title
+	case models.FieldSenderID:
+		text = updDocument.CardInfo.SenderID
+	}
+
+	if text == "" {
+		return nil
+	}
+	return text
+}
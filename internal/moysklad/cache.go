@@ -0,0 +1,239 @@
+package moysklad
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache kinds of reference entities
+const (
+	cacheOrganization = "organization"
+	cacheCounterparty = "counterparty"
+	cacheProduct      = "product"
+	cacheService      = "service"
+	cacheStore        = "store"
+	cacheUOM          = "uom"
+	cacheCurrency     = "currency"
+	cacheCountry      = "country"
+	cachePriceType    = "pricetype"
+	cacheAttribute    = "attribute"
+)
+
+// CacheOptions configures reference data cache. Zero TTL disables caching.
+type CacheOptions struct {
+	TTL        time.Duration
+	MaxEntries int
+	FilePath   string
+}
+
+// cacheEntry is a cached entity stored as JSON so it can be persisted
+type cacheEntry struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires"`
+}
+
+// referenceCache is a size-bounded LRU cache with per-entry expiration
+type referenceCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	filePath   string
+	entries    map[string]*list.Element
+	order      *list.List
+	dirty      bool
+}
+
+func newReferenceCache(options CacheOptions) *referenceCache {
+	maxEntries := options.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 5000
+	}
+
+	return &referenceCache{
+		ttl:        options.TTL,
+		maxEntries: maxEntries,
+		filePath:   options.FilePath,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func cacheKey(kind, key string) string {
+	return kind + ":" + key
+}
+
+// get decodes cached value into v and reports whether it was found
+func (c *referenceCache) get(kind, key string, v interface{}) bool {
+	if c.ttl <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[cacheKey(kind, key)]
+	if !ok {
+		return false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.Expires) {
+		c.removeElement(element)
+		return false
+	}
+
+	if err := json.Unmarshal(entry.Value, v); err != nil {
+		c.removeElement(element)
+		return false
+	}
+
+	c.order.MoveToFront(element)
+	return true
+}
+
+// set stores value evicting least recently used entries above the size bound
+func (c *referenceCache) set(kind, key string, v interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fullKey := cacheKey(kind, key)
+	entry := &cacheEntry{Key: fullKey, Value: data, Expires: time.Now().Add(c.ttl)}
+
+	if element, ok := c.entries[fullKey]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[fullKey] = c.order.PushFront(entry)
+	}
+
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+	}
+	c.dirty = true
+}
+
+// invalidate removes a single entry
+func (c *referenceCache) invalidate(kind, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[cacheKey(kind, key)]; ok {
+		c.removeElement(element)
+	}
+}
+
+// invalidateKind removes all entries of the kind
+func (c *referenceCache) invalidateKind(kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := kind + ":"
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(element)
+		}
+	}
+}
+
+func (c *referenceCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	delete(c.entries, entry.Key)
+	c.order.Remove(element)
+	c.dirty = true
+}
+
+// load restores non-expired entries from the cache file
+func (c *referenceCache) load() error {
+	if c.filePath == "" || c.ttl <= 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored []*cacheEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	// Entries are stored most recent first
+	for i := len(stored) - 1; i >= 0; i-- {
+		entry := stored[i]
+		if entry == nil || now.After(entry.Expires) {
+			continue
+		}
+		if element, ok := c.entries[entry.Key]; ok {
+			c.removeElement(element)
+		}
+		c.entries[entry.Key] = c.order.PushFront(entry)
+	}
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+	}
+	c.dirty = false
+	return nil
+}
+
+// save writes cache to the cache file if it changed
+func (c *referenceCache) save() error {
+	if c.filePath == "" || c.ttl <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	stored := make([]*cacheEntry, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		stored = append(stored, element.Value.(*cacheEntry))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.filePath), 0755); err != nil {
+		return err
+	}
+	tempPath := c.filePath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, c.filePath)
+}
+
+// persistCache saves the cache file, logging failures
+func (api *API) persistCache() {
+	if err := api.cache.save(); err != nil {
+		api.logger.Warnf("Failed to save MoySkald cache: %v", err)
+	}
+}
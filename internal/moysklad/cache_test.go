@@ -0,0 +1,151 @@
+package moysklad
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func cached(c *referenceCache, kind, key string) (string, bool) {
+	var value string
+	ok := c.get(kind, key, &value)
+	return value, ok
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newReferenceCache(CacheOptions{TTL: 50 * time.Millisecond})
+	c.set(cacheStore, "main", "Основной")
+
+	if value, ok := cached(c, cacheStore, "main"); !ok || value != "Основной" {
+		t.Fatalf("get = %q, %v, want cached value", value, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := cached(c, cacheStore, "main"); ok {
+		t.Error("expired entry is returned")
+	}
+	if c.order.Len() != 0 || len(c.entries) != 0 {
+		t.Errorf("expired entry is kept: %d entries", c.order.Len())
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := newReferenceCache(CacheOptions{})
+	c.set(cacheStore, "main", "Основной")
+
+	if _, ok := cached(c, cacheStore, "main"); ok {
+		t.Error("cache without TTL returned an entry")
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	// MaxEntries comes from MOYSKLAD_CACHE_SIZE
+	c := newReferenceCache(CacheOptions{TTL: time.Hour, MaxEntries: 3})
+	c.set(cacheStore, "1", "1")
+	c.set(cacheStore, "2", "2")
+	c.set(cacheStore, "3", "3")
+
+	// Reading the oldest entry makes "2" the least recently used
+	if _, ok := cached(c, cacheStore, "1"); !ok {
+		t.Fatal("entry 1 is not cached")
+	}
+	c.set(cacheStore, "4", "4")
+
+	if c.order.Len() != 3 {
+		t.Errorf("%d entries, want 3", c.order.Len())
+	}
+	for key, want := range map[string]bool{"1": true, "2": false, "3": true, "4": true} {
+		if _, ok := cached(c, cacheStore, key); ok != want {
+			t.Errorf("entry %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	// Updating an entry does not grow the cache
+	c.set(cacheStore, "3", "three")
+	if value, _ := cached(c, cacheStore, "3"); value != "three" || c.order.Len() != 3 {
+		t.Errorf("updated entry = %q with %d entries, want \"three\" with 3", value, c.order.Len())
+	}
+}
+
+func TestCacheDefaultSize(t *testing.T) {
+	if c := newReferenceCache(CacheOptions{TTL: time.Hour}); c.maxEntries != 5000 {
+		t.Errorf("default size %d, want 5000", c.maxEntries)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := newReferenceCache(CacheOptions{TTL: time.Hour})
+	c.set(cacheCounterparty, "7701234567", "a")
+	c.set(cacheCounterparty, "7801234567", "b")
+	c.set(cacheProduct, "A-1", "c")
+	c.set(cacheService, "S-1", "d")
+
+	c.invalidate(cacheCounterparty, "7701234567")
+	if _, ok := cached(c, cacheCounterparty, "7701234567"); ok {
+		t.Error("invalidated entry is cached")
+	}
+	if _, ok := cached(c, cacheCounterparty, "7801234567"); !ok {
+		t.Error("other entry of the kind is invalidated")
+	}
+
+	c.invalidateKind(cacheProduct)
+	if _, ok := cached(c, cacheProduct, "A-1"); ok {
+		t.Error("entry of invalidated kind is cached")
+	}
+	if _, ok := cached(c, cacheService, "S-1"); !ok {
+		t.Error("entry of other kind is invalidated")
+	}
+	if c.order.Len() != 2 {
+		t.Errorf("%d entries, want 2", c.order.Len())
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "moysklad.json")
+	options := CacheOptions{TTL: time.Hour, MaxEntries: 3, FilePath: path}
+
+	c := newReferenceCache(options)
+	c.set(cacheStore, "1", "1")
+	c.set(cacheStore, "2", "2")
+	c.set(cacheStore, "3", "3")
+	cached(c, cacheStore, "1")
+	// Expired entries are not restored
+	c.set(cacheUOM, "796", "шт")
+	c.entries[cacheKey(cacheUOM, "796")].Value.(*cacheEntry).Expires = time.Now().Add(-time.Minute)
+
+	if err := c.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+
+	loaded := newReferenceCache(options)
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if loaded.dirty {
+		t.Error("loaded cache is dirty")
+	}
+	// "2" was evicted by the expired entry, "1" was read after "3" and the
+	// expired entry is not restored
+	var keys []string
+	for element := loaded.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*cacheEntry).Key)
+	}
+	if want := []string{"store:1", "store:3"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("loaded keys %q, want %q", keys, want)
+	}
+	if value, ok := cached(loaded, cacheStore, "1"); !ok || value != "1" {
+		t.Errorf("entry 1 = %q, %v, want \"1\"", value, ok)
+	}
+}
+
+func TestCacheLoadMissingFile(t *testing.T) {
+	c := newReferenceCache(CacheOptions{TTL: time.Hour, FilePath: filepath.Join(t.TempDir(), "missing.json")})
+	if err := c.load(); err != nil {
+		t.Errorf("load of missing file failed: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package moysklad
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"upd-loader-go/internal/models"
+)
+
+// Counterparty update policies
+const (
+	// CounterpartyUpdatesOff ignores requisites of existing counterparties
+	CounterpartyUpdatesOff = "off"
+	// CounterpartyUpdatesPropose reports requisites differing from UPD and
+	// updates them only when the user asks
+	CounterpartyUpdatesPropose = "propose"
+	// CounterpartyUpdatesApply updates requisites from UPD automatically
+	CounterpartyUpdatesApply = "apply"
+)
+
+// CounterpartyChange is a counterparty requisite that differs from UPD.
+// Field is the MoySkald field name.
+type CounterpartyChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// findCounterparty resolves UPD participant to counterparty. Counterparties
+// with the participant's INN are narrowed down to active ones in configured
+// groups, then an exact INN+KPP match is preferred, then the head office.
+// Returns nil when there is no such counterparty and an error when the
+// choice is ambiguous or only archived counterparties match.
+func (api *API) findCounterparty(party models.Organization) (*Counterparty, error) {
+	counterparties, err := api.counterpartiesByINN(party.INN)
+	if err != nil {
+		return nil, err
+	}
+
+	var active, archived []*Counterparty
+	for _, counterparty := range counterparties {
+		switch {
+		case !api.inCounterpartyGroups(counterparty):
+			api.logger.Debugf("Counterparty %s skipped: not in groups %s", counterparty.Name, strings.Join(api.options.CounterpartyGroups, ", "))
+		case counterparty.Archived:
+			archived = append(archived, counterparty)
+		default:
+			active = append(active, counterparty)
+		}
+	}
+
+	if len(active) == 0 {
+		if len(archived) > 0 {
+			return nil, &APIError{Message: fmt.Sprintf("Counterparty with INN %s is archived in MoySkald: %s.\nRestore it from the archive and retry UPD upload.", party.INN, describeCounterparties(archived))}
+		}
+		return nil, nil
+	}
+
+	if party.KPP != "" {
+		var exact []*Counterparty
+		for _, counterparty := range active {
+			if counterparty.KPP == party.KPP {
+				exact = append(exact, counterparty)
+			}
+		}
+		if len(exact) == 1 {
+			api.logger.Infof("Found counterparty by INN %s and KPP %s: %s", party.INN, party.KPP, exact[0].Name)
+			return exact[0], nil
+		}
+		if len(exact) > 1 {
+			return nil, ambiguousCounterparties(party, exact)
+		}
+	}
+
+	if len(active) == 1 {
+		api.logger.Infof("Found existing counterparty: %s", active[0].Name)
+		return active[0], nil
+	}
+
+	var headOffices []*Counterparty
+	for _, counterparty := range active {
+		if isHeadOfficeKPP(counterparty.KPP) {
+			headOffices = append(headOffices, counterparty)
+		}
+	}
+	if len(headOffices) == 1 {
+		api.logger.Infof("Found head office counterparty by INN %s: %s (KPP %s)", party.INN, headOffices[0].Name, headOffices[0].KPP)
+		return headOffices[0], nil
+	}
+	return nil, ambiguousCounterparties(party, active)
+}
+
+// counterpartiesByINN returns all counterparties with INN including archived
+func (api *API) counterpartiesByINN(inn string) ([]*Counterparty, error) {
+	var cached []*Counterparty
+	if api.cache.get(cacheCounterparty, inn, &cached) {
+		api.logger.Debugf("Counterparties with INN %s found in cache: %d", inn, len(cached))
+		return cached, nil
+	}
+
+	counterparties, err := listAll[*Counterparty](api, "/entity/counterparty", map[string]string{"filter": "inn=" + inn + ";archived=true;archived=false"})
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Error searching counterparty: %v", err)}
+	}
+	if len(counterparties) > 0 {
+		api.cache.set(cacheCounterparty, inn, counterparties)
+	}
+	return counterparties, nil
+}
+
+// inCounterpartyGroups reports whether counterparty is in any of configured
+// groups. Any counterparty matches when no groups are configured.
+func (api *API) inCounterpartyGroups(counterparty *Counterparty) bool {
+	if len(api.options.CounterpartyGroups) == 0 {
+		return true
+	}
+	for _, group := range api.options.CounterpartyGroups {
+		for _, tag := range counterparty.Tags {
+			if strings.EqualFold(tag, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHeadOfficeKPP reports whether KPP is issued at the organization's
+// location: reason code 01 in positions 5-6. Branches have other codes.
+func isHeadOfficeKPP(kpp string) bool {
+	return len(kpp) == 9 && kpp[4:6] == "01"
+}
+
+// ambiguousCounterparties reports several counterparties matching UPD participant
+func ambiguousCounterparties(party models.Organization, counterparties []*Counterparty) error {
+	requisites := "INN " + party.INN
+	if party.KPP != "" {
+		requisites += " KPP " + party.KPP
+	}
+	return &APIError{Message: fmt.Sprintf("Several counterparties in MoySkald match %s: %s.\nSet the right KPP, archive duplicates or restrict counterparty groups and retry UPD upload.", requisites, describeCounterparties(counterparties))}
+}
+
+// describeCounterparties lists counterparties with KPP for messages
+func describeCounterparties(counterparties []*Counterparty) string {
+	descriptions := make([]string, 0, len(counterparties))
+	for _, counterparty := range counterparties {
+		description := counterparty.Name
+		if counterparty.KPP != "" {
+			description += fmt.Sprintf(" (KPP %s)", counterparty.KPP)
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// counterpartyRequisites builds counterparty requisites from UPD participant
+func counterpartyRequisites(party models.Organization) *Counterparty {
+	counterparty := &Counterparty{
+		Name:          party.Name,
+		LegalAddress:  party.Address.String(),
+		ActualAddress: party.ActualAddress.String(),
+		INN:           party.INN,
+		OKPO:          party.OKPO,
+		CompanyType:   party.PartyKind(),
+	}
+
+	switch counterparty.CompanyType {
+	case models.PartyLegal:
+		counterparty.LegalTitle = party.Name
+		counterparty.KPP = party.KPP
+		counterparty.OGRN = party.OGRN
+	case models.PartyEntrepreneur:
+		counterparty.OGRNIP = party.OGRN
+	}
+
+	// Full name of entrepreneurs and individuals is built by MoySkald from
+	// name parts
+	if counterparty.CompanyType != models.PartyLegal {
+		if party.Surname != "" {
+			counterparty.LegalLastName = party.Surname
+			counterparty.LegalFirstName = party.FirstName
+			counterparty.LegalMiddleName = party.Patronymic
+		} else {
+			counterparty.LegalTitle = party.Name
+		}
+	}
+
+	var accounts []*Account
+	for _, account := range party.BankAccounts {
+		if account.AccountNumber == "" {
+			continue
+		}
+		accounts = append(accounts, &Account{
+			AccountNumber:        account.AccountNumber,
+			BankName:             account.BankName,
+			BIC:                  account.BIC,
+			CorrespondentAccount: account.CorrespondentAccount,
+			IsDefault:            len(accounts) == 0,
+		})
+	}
+	if accounts != nil {
+		counterparty.Accounts = &Accounts{Rows: accounts}
+	}
+	return counterparty
+}
+
+// planCounterpartyUpdate compares existing counterparty with requisites from
+// UPD and returns the update payload with differing fields. Values missing in
+// UPD are kept, and UPD older than the last change of the counterparty does
+// not override it.
+func (api *API) planCounterpartyUpdate(existing *Counterparty, party models.Organization, documentDate time.Time) (*Counterparty, []CounterpartyChange) {
+	if existing.Updated != "" {
+		if updated, err := time.Parse(momentLayout, existing.Updated); err == nil && documentDate.Before(updated.Truncate(24*time.Hour)) {
+			api.logger.Debugf("Counterparty %s changed after UPD date, requisites are not compared", existing.Name)
+			return nil, nil
+		}
+	}
+
+	requisites := counterpartyRequisites(party)
+	update := &Counterparty{}
+	var changes []CounterpartyChange
+	compare := func(field, current, proposed string, set func(string)) {
+		if proposed == "" || strings.EqualFold(strings.TrimSpace(current), strings.TrimSpace(proposed)) {
+			return
+		}
+		set(proposed)
+		changes = append(changes, CounterpartyChange{Field: field, Old: current, New: proposed})
+	}
+
+	// Company type is known only when UPD tells a legal entity, an
+	// entrepreneur and an individual apart
+	if party.Kind != "" {
+		compare("companyType", existing.CompanyType, requisites.CompanyType, func(v string) { update.CompanyType = v })
+	}
+	compare("legalTitle", existing.LegalTitle, requisites.LegalTitle, func(v string) { update.LegalTitle = v })
+	compare("legalLastName", existing.LegalLastName, requisites.LegalLastName, func(v string) { update.LegalLastName = v })
+	compare("legalFirstName", existing.LegalFirstName, requisites.LegalFirstName, func(v string) { update.LegalFirstName = v })
+	compare("legalMiddleName", existing.LegalMiddleName, requisites.LegalMiddleName, func(v string) { update.LegalMiddleName = v })
+	compare("legalAddress", existing.LegalAddress, requisites.LegalAddress, func(v string) { update.LegalAddress = v })
+	compare("actualAddress", existing.ActualAddress, requisites.ActualAddress, func(v string) { update.ActualAddress = v })
+	compare("kpp", existing.KPP, requisites.KPP, func(v string) { update.KPP = v })
+	compare("ogrn", existing.OGRN, requisites.OGRN, func(v string) { update.OGRN = v })
+	compare("ogrnip", existing.OGRNIP, requisites.OGRNIP, func(v string) { update.OGRNIP = v })
+	compare("okpo", existing.OKPO, requisites.OKPO, func(v string) { update.OKPO = v })
+
+	// Accounts are added, existing ones are passed back so they are kept
+	if requisites.Accounts != nil {
+		accounts, err := api.entityAccounts("/entity/counterparty", existing.ID, existing.Accounts)
+		if err != nil {
+			api.logger.Warningf("Failed to load accounts of counterparty %s: %v", existing.Name, err)
+		} else {
+			known := make(map[string]bool, len(accounts))
+			for _, account := range accounts {
+				known[account.AccountNumber] = true
+			}
+			rows := append([]*Account(nil), accounts...)
+			for _, account := range requisites.Accounts.Rows {
+				if known[account.AccountNumber] {
+					continue
+				}
+				account.IsDefault = len(rows) == 0
+				rows = append(rows, account)
+				changes = append(changes, CounterpartyChange{Field: "accounts", New: account.AccountNumber})
+			}
+			if len(rows) > len(accounts) {
+				update.Accounts = &Accounts{Rows: rows}
+			}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	api.logger.Infof("Counterparty %s requisites differ from UPD in %d fields", existing.Name, len(changes))
+	return update, changes
+}
+
+// entityAccounts returns bank accounts of counterparty or organization.
+// Accounts are loaded unless the entity came with all of them.
+func (api *API) entityAccounts(endpoint, id string, accounts *Accounts) ([]*Account, error) {
+	switch {
+	case accounts == nil || (accounts.Meta != nil && accounts.Meta.Size == 0):
+		return nil, nil
+	case accounts.complete():
+		return accounts.Rows, nil
+	}
+	return listAll[*Account](api, endpoint+"/"+id+"/accounts", nil)
+}
+
+// updateCounterparty updates counterparty requisites
+func (api *API) updateCounterparty(counterparty *Counterparty, update *Counterparty) error {
+	if err := api.updateEntity("/entity/counterparty", counterparty.ID, update); err != nil {
+		return err
+	}
+	api.cache.invalidate(cacheCounterparty, counterparty.INN)
+	api.logger.Infof("Counterparty %s requisites updated from UPD", counterparty.Name)
+	return nil
+}
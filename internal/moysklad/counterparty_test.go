@@ -0,0 +1,87 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestFindCounterparty(t *testing.T) {
+	const inn = "7701234567"
+	headOffice := &Counterparty{ID: "head", Name: "ООО \"Покупатель\"", INN: inn, KPP: "770101001"}
+	branch := &Counterparty{ID: "branch", Name: "ООО \"Покупатель\" филиал", INN: inn, KPP: "780143001"}
+	archived := &Counterparty{ID: "archived", Name: "ООО \"Покупатель\" старый", INN: inn, KPP: "770101001", Archived: true}
+	tagged := &Counterparty{ID: "tagged", Name: "ООО \"Покупатель\" опт", INN: inn, KPP: "780143001", Tags: []string{"оптовики"}}
+
+	tests := []struct {
+		name    string
+		rows    []*Counterparty
+		groups  []string
+		kpp     string
+		wantID  string
+		wantErr string
+	}{
+		{name: "not found"},
+		{name: "exact INN and KPP", rows: []*Counterparty{headOffice, branch}, kpp: "780143001", wantID: "branch"},
+		{name: "single counterparty with other KPP", rows: []*Counterparty{branch}, kpp: "770101001", wantID: "branch"},
+		{name: "head office without KPP", rows: []*Counterparty{branch, headOffice}, wantID: "head"},
+		{name: "head office for unknown KPP", rows: []*Counterparty{branch, headOffice}, kpp: "770102001", wantID: "head"},
+		{name: "archived skipped", rows: []*Counterparty{archived, branch}, kpp: "770101001", wantID: "branch"},
+		{name: "only archived", rows: []*Counterparty{archived}, wantErr: "is archived in MoySkald: ООО \"Покупатель\" старый (KPP 770101001)"},
+		{name: "group restriction", rows: []*Counterparty{headOffice, tagged}, groups: []string{"Оптовики"}, wantID: "tagged"},
+		{name: "no counterparty in groups", rows: []*Counterparty{headOffice}, groups: []string{"оптовики"}},
+		{
+			name:    "same KPP",
+			rows:    []*Counterparty{headOffice, {ID: "copy", Name: "Покупатель", INN: inn, KPP: "770101001"}},
+			kpp:     "770101001",
+			wantErr: "Several counterparties in MoySkald match INN 7701234567 KPP 770101001: ООО \"Покупатель\" (KPP 770101001), Покупатель (KPP 770101001)",
+		},
+		{
+			name:    "no head office",
+			rows:    []*Counterparty{branch, tagged},
+			wantErr: "Several counterparties in MoySkald match INN 7701234567: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/entity/counterparty" {
+					t.Errorf("unexpected request %s", r.URL.Path)
+					return
+				}
+				if filter := r.URL.Query().Get("filter"); !strings.Contains(filter, "inn="+inn) || !strings.Contains(filter, "archived=true") {
+					t.Errorf("filter %q, want INN with archived counterparties", filter)
+				}
+				rows := tt.rows
+				if rows == nil {
+					rows = []*Counterparty{}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"meta": map[string]int{"size": len(rows)}, "rows": rows})
+			}
+			api := newTestAPI(t, handler, fastLimits())
+			api.options.CounterpartyGroups = tt.groups
+
+			counterparty, err := api.findCounterparty(models.Organization{Name: "ООО \"Покупатель\"", INN: inn, KPP: tt.kpp})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findCounterparty failed: %v", err)
+			}
+			gotID := ""
+			if counterparty != nil {
+				gotID = counterparty.ID
+			}
+			if gotID != tt.wantID {
+				t.Errorf("counterparty %q, want %q", gotID, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package moysklad
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/shopspring/decimal"
+)
+
+// momentLayout is the date format used by MoySkald API
+const momentLayout = "2006-01-02 15:04:05.000"
+
+// Meta is entity metadata. Entities reference each other by meta only.
+type Meta struct {
+	Href         string `json:"href"`
+	MetadataHref string `json:"metadataHref,omitempty"`
+	Type         string `json:"type,omitempty"`
+	MediaType    string `json:"mediaType,omitempty"`
+	UUIDHref     string `json:"uuidHref,omitempty"`
+	DownloadHref string `json:"downloadHref,omitempty"`
+	Size         int    `json:"size,omitempty"`
+	Limit        int    `json:"limit,omitempty"`
+	Offset       int    `json:"offset,omitempty"`
+	NextHref     string `json:"nextHref,omitempty"`
+	PreviousHref string `json:"previousHref,omitempty"`
+}
+
+// ListResponse is the envelope of entity list responses
+type ListResponse[T any] struct {
+	Meta *Meta `json:"meta,omitempty"`
+	Rows []T   `json:"rows"`
+}
+
+// Employee represents MoySkald employee (context user)
+type Employee struct {
+	Meta  *Meta  `json:"meta,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// Organization represents own legal entity
+type Organization struct {
+	Meta         *Meta  `json:"meta,omitempty"`
+	ID           string `json:"id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	LegalTitle   string `json:"legalTitle,omitempty"`
+	LegalAddress string `json:"legalAddress,omitempty"`
+	INN          string `json:"inn,omitempty"`
+	KPP          string `json:"kpp,omitempty"`
+	CompanyType  string `json:"companyType,omitempty"`
+	Archived     bool   `json:"archived,omitempty"`
+
+	Accounts *Accounts `json:"accounts,omitempty"`
+}
+
+// Counterparty represents a counterparty (buyer or supplier)
+type Counterparty struct {
+	Meta            *Meta     `json:"meta,omitempty"`
+	ID              string    `json:"id,omitempty"`
+	Name            string    `json:"name,omitempty"`
+	LegalTitle      string    `json:"legalTitle,omitempty"`
+	LegalAddress    string    `json:"legalAddress,omitempty"`
+	ActualAddress   string    `json:"actualAddress,omitempty"`
+	INN             string    `json:"inn,omitempty"`
+	KPP             string    `json:"kpp,omitempty"`
+	OGRN            string    `json:"ogrn,omitempty"`
+	OGRNIP          string    `json:"ogrnip,omitempty"`
+	OKPO            string    `json:"okpo,omitempty"`
+	CompanyType     string    `json:"companyType,omitempty"`
+	LegalLastName   string    `json:"legalLastName,omitempty"`
+	LegalFirstName  string    `json:"legalFirstName,omitempty"`
+	LegalMiddleName string    `json:"legalMiddleName,omitempty"`
+	Accounts        *Accounts `json:"accounts,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	Archived        bool      `json:"archived,omitempty"`
+	Updated         string    `json:"updated,omitempty"`
+}
+
+// Account is a bank account of counterparty or organization
+type Account struct {
+	Meta                 *Meta  `json:"meta,omitempty"`
+	ID                   string `json:"id,omitempty"`
+	AccountNumber        string `json:"accountNumber,omitempty"`
+	BankName             string `json:"bankName,omitempty"`
+	BIC                  string `json:"bic,omitempty"`
+	CorrespondentAccount string `json:"correspondentAccount,omitempty"`
+	IsDefault            bool   `json:"isDefault,omitempty"`
+}
+
+// UOM represents unit of measure
+type UOM struct {
+	Meta *Meta  `json:"meta,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	Code string `json:"code,omitempty"`
+}
+
+// Product represents a product. Assortment lookups decode services, variants
+// and bundles into it too, Meta.Type tells which entity it is.
+type Product struct {
+	Meta          *Meta               `json:"meta,omitempty"`
+	ID            string              `json:"id,omitempty"`
+	Name          string              `json:"name,omitempty"`
+	Code          string              `json:"code,omitempty"`
+	Article       string              `json:"article,omitempty"`
+	ExternalCode  string              `json:"externalCode,omitempty"`
+	Barcodes      []map[string]string `json:"barcodes,omitempty"` // keyed by barcode type, e.g. ean13
+	UOM           *UOM                `json:"uom,omitempty"`
+	Country       *Country            `json:"country,omitempty"`
+	ProductFolder *ProductFolder      `json:"productFolder,omitempty"`
+	VAT           *int                `json:"vat,omitempty"`
+	VatEnabled    *bool               `json:"vatEnabled,omitempty"`
+	BuyPrice      *Price              `json:"buyPrice,omitempty"`
+	SalePrices    []*SalePrice        `json:"salePrices,omitempty"`
+	Archived      bool                `json:"archived,omitempty"`
+}
+
+// Service represents a service
+type Service struct {
+	Meta          *Meta          `json:"meta,omitempty"`
+	ID            string         `json:"id,omitempty"`
+	Name          string         `json:"name,omitempty"`
+	Code          string         `json:"code,omitempty"`
+	UOM           *UOM           `json:"uom,omitempty"`
+	ProductFolder *ProductFolder `json:"productFolder,omitempty"`
+	VAT           *int           `json:"vat,omitempty"`
+	VatEnabled    *bool          `json:"vatEnabled,omitempty"`
+	BuyPrice      *Price         `json:"buyPrice,omitempty"`
+	SalePrices    []*SalePrice   `json:"salePrices,omitempty"`
+	Archived      bool           `json:"archived,omitempty"`
+}
+
+// ProductFolder represents a group of products and services
+type ProductFolder struct {
+	Meta *Meta  `json:"meta,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Country represents a country directory entry. Code is the OKSM digital code.
+type Country struct {
+	Meta *Meta  `json:"meta,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	Code string `json:"code,omitempty"`
+}
+
+// Price is a price in kopecks
+type Price struct {
+	Value    float64   `json:"value"`
+	Currency *Currency `json:"currency,omitempty"`
+}
+
+// PriceType is a sale price type
+type PriceType struct {
+	Meta *Meta  `json:"meta,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// SalePrice is a sale price of the given type in kopecks
+type SalePrice struct {
+	Value     float64    `json:"value"`
+	Currency  *Currency  `json:"currency,omitempty"`
+	PriceType *PriceType `json:"priceType,omitempty"`
+}
+
+// Assortment is a position item: product, service, variant or bundle
+type Assortment struct {
+	Meta         *Meta  `json:"meta,omitempty"`
+	ID           string `json:"id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Article      string `json:"article,omitempty"`
+	ExternalCode string `json:"externalCode,omitempty"`
+	UOM          *UOM   `json:"uom,omitempty"`
+}
+
+// Store represents a warehouse
+type Store struct {
+	Meta *Meta  `json:"meta,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Currency represents a currency directory entry
+type Currency struct {
+	Meta     *Meta  `json:"meta,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	FullName string `json:"fullName,omitempty"`
+	Code     string `json:"code,omitempty"`
+	ISOCode  string `json:"isoCode,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+}
+
+// Rate is document currency and exchange rate
+type Rate struct {
+	Currency *Currency `json:"currency"`
+	Value    float64   `json:"value,omitempty"`
+}
+
+// Position is a document line. Price is in kopecks.
+type Position struct {
+	Meta       *Meta       `json:"meta,omitempty"`
+	ID         string      `json:"id,omitempty"`
+	Quantity   float64     `json:"quantity"`
+	Price      float64     `json:"price"`
+	Discount   float64     `json:"discount"`
+	VAT        int         `json:"vat"`
+	VatEnabled *bool       `json:"vatEnabled,omitempty"`
+	Assortment *Assortment `json:"assortment,omitempty"`
+}
+
+// Collection is a nested collection of entity, such as document positions
+// or counterparty accounts. MoySkald returns it as a list envelope (rows are
+// present only when expanded) and accepts a plain array.
+type Collection[T any] struct {
+	Meta *Meta
+	Rows []T
+}
+
+// Positions is document positions collection
+type Positions = Collection[*Position]
+
+// Accounts is counterparty bank accounts collection
+type Accounts = Collection[*Account]
+
+// MarshalJSON writes collection as a plain array. Collection read without
+// rows is written back as the list envelope, so that cached entities keep it.
+func (c Collection[T]) MarshalJSON() ([]byte, error) {
+	if c.Rows == nil {
+		if c.Meta != nil {
+			return json.Marshal(ListResponse[T]{Meta: c.Meta})
+		}
+		return []byte("[]"), nil
+	}
+	return json.Marshal(c.Rows)
+}
+
+// UnmarshalJSON reads collection either as a list envelope or a plain array
+func (c *Collection[T]) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, &c.Rows)
+	}
+
+	var list ListResponse[T]
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	c.Meta, c.Rows = list.Meta, list.Rows
+	return nil
+}
+
+// complete reports whether all rows are present. Expanded collections
+// contain only the first page of rows.
+func (c *Collection[T]) complete() bool {
+	return c.Rows != nil && (c.Meta == nil || len(c.Rows) >= c.Meta.Size)
+}
+
+// InvoiceOut represents customer invoice (счет покупателю)
+type InvoiceOut struct {
+	Meta         *Meta         `json:"meta,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Name         string        `json:"name,omitempty"`
+	Description  string        `json:"description,omitempty"`
+	Moment       string        `json:"moment,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Agent        *Counterparty `json:"agent,omitempty"`
+	Store        *Store        `json:"store,omitempty"`
+	Rate         *Rate         `json:"rate,omitempty"`
+	VatEnabled   *bool         `json:"vatEnabled,omitempty"`
+	VatIncluded  *bool         `json:"vatIncluded,omitempty"`
+	Positions    *Positions    `json:"positions,omitempty"`
+
+	CustomerOrder *CustomerOrder `json:"customerOrder,omitempty"`
+}
+
+// CustomerOrder represents customer order (заказ покупателя)
+type CustomerOrder struct {
+	Meta  *Meta  `json:"meta,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Store *Store `json:"store,omitempty"`
+}
+
+// Demand represents shipment (отгрузка)
+type Demand struct {
+	Meta         *Meta         `json:"meta,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Name         string        `json:"name,omitempty"`
+	Description  string        `json:"description,omitempty"`
+	ExternalCode string        `json:"externalCode,omitempty"`
+	Moment       string        `json:"moment,omitempty"`
+	Applicable   *bool         `json:"applicable,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Agent        *Counterparty `json:"agent,omitempty"`
+	Store        *Store        `json:"store,omitempty"`
+	Rate         *Rate         `json:"rate,omitempty"`
+	VatEnabled   *bool         `json:"vatEnabled,omitempty"`
+	VatIncluded  *bool         `json:"vatIncluded,omitempty"`
+	Positions    *Positions    `json:"positions,omitempty"`
+	InvoicesOut  []*InvoiceOut `json:"invoicesOut,omitempty"`
+
+	CustomerOrder       *CustomerOrder `json:"customerOrder,omitempty"`
+	OrganizationAccount *Account       `json:"organizationAccount,omitempty"`
+	Attributes          []*Attribute   `json:"attributes,omitempty"`
+}
+
+// FactureOut represents outgoing invoice (счет-фактура выданный)
+type FactureOut struct {
+	Meta         *Meta         `json:"meta,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Name         string        `json:"name,omitempty"`
+	ExternalCode string        `json:"externalCode,omitempty"`
+	Moment       string        `json:"moment,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Agent        *Counterparty `json:"agent,omitempty"`
+	Rate         *Rate         `json:"rate,omitempty"`
+	VatEnabled   *bool         `json:"vatEnabled,omitempty"`
+	VatIncluded  *bool         `json:"vatIncluded,omitempty"`
+	Demands      []*Demand     `json:"demands,omitempty"`
+	Positions    *Positions    `json:"positions,omitempty"`
+	Attributes   []*Attribute  `json:"attributes,omitempty"`
+}
+
+// Attribute is a custom document attribute: a definition when loaded from
+// entity metadata, meta and value in document payloads
+type Attribute struct {
+	Meta  *Meta       `json:"meta,omitempty"`
+	ID    string      `json:"id,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PurchaseOrder represents order to supplier (заказ поставщику)
+type PurchaseOrder struct {
+	Meta         *Meta         `json:"meta,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Name         string        `json:"name,omitempty"`
+	Moment       string        `json:"moment,omitempty"`
+	Organization *Organization `json:"organization,omitempty"`
+	Agent        *Counterparty `json:"agent,omitempty"`
+	Store        *Store        `json:"store,omitempty"`
+	Positions    *Positions    `json:"positions,omitempty"`
+}
+
+// Supply represents incoming goods receipt (приемка)
+type Supply struct {
+	Meta           *Meta          `json:"meta,omitempty"`
+	ID             string         `json:"id,omitempty"`
+	Name           string         `json:"name,omitempty"`
+	ExternalCode   string         `json:"externalCode,omitempty"`
+	Moment         string         `json:"moment,omitempty"`
+	Applicable     *bool          `json:"applicable,omitempty"`
+	IncomingNumber string         `json:"incomingNumber,omitempty"`
+	IncomingDate   string         `json:"incomingDate,omitempty"`
+	Organization   *Organization  `json:"organization,omitempty"`
+	Agent          *Counterparty  `json:"agent,omitempty"`
+	Store          *Store         `json:"store,omitempty"`
+	Rate           *Rate          `json:"rate,omitempty"`
+	VatEnabled     *bool          `json:"vatEnabled,omitempty"`
+	VatIncluded    *bool          `json:"vatIncluded,omitempty"`
+	Positions      *Positions     `json:"positions,omitempty"`
+	PurchaseOrder  *PurchaseOrder `json:"purchaseOrder,omitempty"`
+
+	OrganizationAccount *Account `json:"organizationAccount,omitempty"`
+}
+
+// FactureIn represents received invoice (счет-фактура полученный).
+// Its positions are taken from linked supplies.
+type FactureIn struct {
+	Meta           *Meta         `json:"meta,omitempty"`
+	ID             string        `json:"id,omitempty"`
+	Name           string        `json:"name,omitempty"`
+	ExternalCode   string        `json:"externalCode,omitempty"`
+	Moment         string        `json:"moment,omitempty"`
+	IncomingNumber string        `json:"incomingNumber,omitempty"`
+	IncomingDate   string        `json:"incomingDate,omitempty"`
+	Organization   *Organization `json:"organization,omitempty"`
+	Agent          *Counterparty `json:"agent,omitempty"`
+	Rate           *Rate         `json:"rate,omitempty"`
+	Supplies       []*Supply     `json:"supplies,omitempty"`
+}
+
+// Upload directions
+const (
+	// DirectionSale is an UPD issued by our organization
+	DirectionSale = "sale"
+	// DirectionPurchase is an UPD received by our organization from a supplier
+	DirectionPurchase = "purchase"
+)
+
+// UploadResult holds documents created from UPD: demand and factureout for
+// sales, supply and facturein for purchases. AlreadyExists is set when the
+// UPD was loaded before and existing documents are returned.
+type UploadResult struct {
+	Direction     string
+	FactureOut    *FactureOut
+	Demand        *Demand
+	FactureIn     *FactureIn
+	Supply        *Supply
+	AlreadyExists bool
+	// CreatedAssortment lists products and services created for lines
+	// without matching assortment
+	CreatedAssortment []string
+	// Residual is UPD total payable minus the document total
+	Residual decimal.Decimal
+	// StockShortages describe demand lines exceeding store stock
+	StockShortages []string
+	// AttachedFiles are names of files attached to the documents,
+	// AttachmentErrors describe documents the files were not attached to
+	AttachedFiles    []string
+	AttachmentErrors []string
+	// CounterpartyChanges are counterparty requisites differing from UPD,
+	// CounterpartyUpdated is set when they were updated
+	CounterpartyChanges []CounterpartyChange
+	CounterpartyUpdated bool
+}
+
+// AccessStatus is the result of API access verification
+type AccessStatus struct {
+	Success  bool
+	Error    string
+	Details  string
+	Employee *Employee
+	// Organization is the configured default organization, the first one
+	// when no default is configured. Organizations lists all of them.
+	Organization  *Organization
+	Organizations []OrganizationStatus
+	Permissions   Permissions
+	BaseURL       string
+
+	// AttributeProblems describe attributes configured for UPD metadata
+	// that are missing or have unsupported type
+	AttributeProblems []string
+}
+
+// Permissions describes API permissions available to the token
+type Permissions struct {
+	CanCreateInvoices       bool
+	CanAccessCounterparties bool
+	CanAccessStores         bool
+	OrganizationsCount      int
+	StoresCount             int
+}
+
+// boolValue returns value of optional flag
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+// boolPtr returns pointer to flag value
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// intPtr returns pointer to number, so that zero is sent as well
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,200 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// GetDemandUPDContent loads demand with related entities and maps it to UPD content
+func (api *API) GetDemandUPDContent(demandID string) (*models.UPDContent, error) {
+	api.logger.Infof("Loading demand %s for UPD export", demandID)
+	defer api.persistCache()
+
+	params := map[string]string{
+		"expand": "organization,agent,positions.assortment.uom,rate.currency,invoicesOut",
+	}
+	resp, err := api.makeRequest("GET", "/entity/demand/"+demandID, nil, params)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error loading demand: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{Message: fmt.Sprintf("Error loading demand %s: %d - %s", demandID, resp.StatusCode, string(body))}
+	}
+
+	var demand Demand
+	if err := json.NewDecoder(resp.Body).Decode(&demand); err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Failed to decode demand response: %v", err)}
+	}
+
+	if demand.Organization == nil || demand.Agent == nil {
+		return nil, &APIError{Message: fmt.Sprintf("Demand %s has no organization or counterparty", demandID)}
+	}
+
+	moment := time.Now()
+	if parsed, err := time.Parse(momentLayout, demand.Moment); err == nil {
+		moment = parsed
+	}
+
+	organization := exportParty(demand.Organization.Name, demand.Organization.LegalTitle, demand.Organization.INN, demand.Organization.KPP, demand.Organization.LegalAddress)
+	agent := exportParty(demand.Agent.Name, demand.Agent.LegalTitle, demand.Agent.INN, demand.Agent.KPP, demand.Agent.LegalAddress)
+	content := models.NewUPDContent(demand.Name, moment, organization, agent)
+
+	if demand.Rate != nil {
+		if currency := demand.Rate.Currency; currency != nil {
+			if currency.Code != "" {
+				content.CurrencyCode = currency.Code
+			}
+			content.CurrencyName = currency.FullName
+		}
+		if demand.Rate.Value > 0 {
+			content.ExchangeRate = decimal.NewFromFloat(demand.Rate.Value)
+		}
+	}
+
+	if len(demand.InvoicesOut) > 0 && demand.InvoicesOut[0] != nil {
+		content.RequisiteNumber = demand.InvoicesOut[0].Name
+	}
+
+	vatEnabled := boolValue(demand.VatEnabled)
+	vatIncluded := boolValue(demand.VatIncluded)
+
+	rows, err := api.getDemandPositionRows(&demand)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range rows {
+		api.resolveUOM(row)
+		item := exportItem(row, i+1, vatEnabled, vatIncluded)
+		content.Items = append(content.Items, item)
+		content.TotalWithoutVAT = content.TotalWithoutVAT.Add(item.AmountWithoutVAT)
+		content.TotalVAT = content.TotalVAT.Add(item.VATAmount)
+		content.TotalWithVAT = content.TotalWithVAT.Add(item.AmountWithVAT)
+	}
+
+	if len(content.Items) == 0 {
+		return nil, &APIError{Message: fmt.Sprintf("Demand %s has no positions", demand.Name)}
+	}
+
+	api.logger.Infof("Demand %s mapped to UPD: %d lines, total %s", demand.Name, len(content.Items), content.TotalWithVAT.StringFixed(2))
+	return content, nil
+}
+
+// getDemandPositionRows returns expanded positions, loading them separately when needed
+func (api *API) getDemandPositionRows(demand *Demand) ([]*Position, error) {
+	positions := demand.Positions
+	if positions == nil {
+		return nil, nil
+	}
+	if positions.complete() {
+		return positions.Rows, nil
+	}
+	if positions.Meta == nil || positions.Meta.Href == "" {
+		return nil, nil
+	}
+
+	return listAll[*Position](api, strings.TrimPrefix(positions.Meta.Href, api.baseURL), map[string]string{"expand": "assortment.uom"})
+}
+
+// resolveUOM loads unit of measure of the position when it was not expanded
+func (api *API) resolveUOM(position *Position) {
+	if position.Assortment == nil || position.Assortment.UOM == nil {
+		return
+	}
+	uom := position.Assortment.UOM
+	if uom.Code != "" || uom.Meta == nil || uom.Meta.Href == "" {
+		return
+	}
+
+	var loaded UOM
+	if err := api.getEntity(cacheUOM, uom.Meta.Href, &loaded); err != nil {
+		api.logger.Warnf("Failed to load unit of measure: %v", err)
+		return
+	}
+	position.Assortment.UOM = &loaded
+}
+
+// exportParty maps organization or counterparty requisites to UPD party
+func exportParty(name, legalTitle, inn, kpp, legalAddress string) models.Organization {
+	if legalTitle != "" {
+		name = legalTitle
+	}
+
+	org := models.Organization{Name: name, INN: inn, KPP: kpp}
+	if len(inn) == 12 {
+		// Individual entrepreneurs are written with ФИО only
+		org.KPP = ""
+		org.Name = strings.TrimSpace(strings.TrimPrefix(org.Name, "ИП "))
+	}
+	if legalAddress != "" {
+		org.Address = &models.Address{Street: legalAddress}
+	}
+	return org
+}
+
+// exportItem maps demand position to UPD line. Position discount is
+// applied to the price, as MoySkald does when computing position sum.
+func exportItem(position *Position, lineNumber int, vatEnabled, vatIncluded bool) models.InvoiceItem {
+	quantity := decimal.NewFromFloat(position.Quantity)
+	price := decimal.NewFromFloat(position.Price).Div(hundred)
+	if position.Discount != 0 {
+		price = price.Mul(hundred.Sub(decimal.NewFromFloat(position.Discount))).Div(hundred)
+	}
+	vat := decimal.NewFromInt(int64(position.VAT))
+
+	item := models.InvoiceItem{
+		LineNumber: lineNumber,
+		Quantity:   quantity,
+		UnitCode:   "796",
+		UnitName:   "шт",
+		Kind:       models.KindGoods,
+	}
+
+	if assortment := position.Assortment; assortment != nil {
+		item.Name = assortment.Name
+		item.Article = assortment.Article
+		if assortment.Meta != nil && assortment.Meta.Type == "service" {
+			item.Kind = models.KindService
+		}
+		if assortment.UOM != nil && assortment.UOM.Code != "" {
+			item.UnitCode = assortment.UOM.Code
+			item.UnitName = assortment.UOM.Name
+		}
+	}
+
+	amount := quantity.Mul(price).Round(2)
+	switch {
+	case !vatEnabled:
+		item.VATRate = "без НДС"
+		item.AmountWithoutVAT = amount
+		item.AmountWithVAT = amount
+	case vatIncluded:
+		item.VATRate = vat.String() + "%"
+		item.AmountWithVAT = amount
+		item.VATAmount = amount.Mul(vat).Div(hundred.Add(vat)).Round(2)
+		item.AmountWithoutVAT = amount.Sub(item.VATAmount)
+	default:
+		item.VATRate = vat.String() + "%"
+		item.AmountWithoutVAT = amount
+		item.VATAmount = amount.Mul(vat).Div(hundred).Round(2)
+		item.AmountWithVAT = amount.Add(item.VATAmount)
+	}
+
+	// ЦенаТов is the unit price without VAT
+	item.Price = price
+	if vatEnabled && vatIncluded && !quantity.IsZero() {
+		item.Price = item.AmountWithoutVAT.Div(quantity).Round(2)
+	}
+
+	return item
+}
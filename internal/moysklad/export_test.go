@@ -0,0 +1,104 @@
+package moysklad
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestExportItem(t *testing.T) {
+	tests := []struct {
+		name        string
+		position    Position
+		vatEnabled  bool
+		vatIncluded bool
+
+		rate                       string
+		price, noVAT, vat, withVAT string
+	}{
+		{
+			name:       "without discount",
+			position:   Position{Quantity: 1.5, Price: 1234, VAT: 10},
+			vatEnabled: true,
+			rate:       "10%", price: "12.34", noVAT: "18.51", vat: "1.85", withVAT: "20.36",
+		},
+		{
+			name:       "discount, VAT on top",
+			position:   Position{Quantity: 2, Price: 10000, Discount: 10, VAT: 20},
+			vatEnabled: true,
+			rate:       "20%", price: "90", noVAT: "180", vat: "36", withVAT: "216",
+		},
+		{
+			name:        "discount, VAT included",
+			position:    Position{Quantity: 2, Price: 10000, Discount: 10, VAT: 20},
+			vatEnabled:  true,
+			vatIncluded: true,
+			rate:        "20%", price: "75", noVAT: "150", vat: "30", withVAT: "180",
+		},
+		{
+			name:     "fractional discount without VAT",
+			position: Position{Quantity: 3, Price: 1999, Discount: 5},
+			rate:     "без НДС", price: "18.9905", noVAT: "56.97", vat: "0", withVAT: "56.97",
+		},
+		{
+			name:       "full discount",
+			position:   Position{Quantity: 1, Price: 5000, Discount: 100, VAT: 20},
+			vatEnabled: true,
+			rate:       "20%", price: "0", noVAT: "0", vat: "0", withVAT: "0",
+		},
+	}
+
+	for _, tt := range tests {
+		item := exportItem(&tt.position, 1, tt.vatEnabled, tt.vatIncluded)
+		if item.VATRate != tt.rate ||
+			!item.Price.Equal(decimal.RequireFromString(tt.price)) ||
+			!item.AmountWithoutVAT.Equal(decimal.RequireFromString(tt.noVAT)) ||
+			!item.VATAmount.Equal(decimal.RequireFromString(tt.vat)) ||
+			!item.AmountWithVAT.Equal(decimal.RequireFromString(tt.withVAT)) {
+			t.Errorf("%s: got %s, price %s, %s + %s = %s; want %s, price %s, %s + %s = %s", tt.name,
+				item.VATRate, item.Price, item.AmountWithoutVAT, item.VATAmount, item.AmountWithVAT,
+				tt.rate, tt.price, tt.noVAT, tt.vat, tt.withVAT)
+		}
+	}
+}
+
+func TestGetDemandPositionRowsExpandsAssortment(t *testing.T) {
+	api := newTestAPI(t, positionsHandler(t, 150), fastLimits())
+	demand := &Demand{Positions: &Positions{Meta: &Meta{Href: api.baseURL + "/entity/demand/1/positions", Size: 150}}}
+
+	rows, err := api.getDemandPositionRows(demand)
+	if err != nil {
+		t.Fatalf("getDemandPositionRows failed: %v", err)
+	}
+	if len(rows) != 150 {
+		t.Fatalf("got %d positions, want 150", len(rows))
+	}
+	for i, row := range rows {
+		item := exportItem(row, i+1, false, false)
+		if item.Name == "" || item.Article == "" || item.UnitName != "шт" {
+			t.Fatalf("position %d is not expanded: %+v", i+1, item)
+		}
+	}
+}
+
+func TestExportItemKind(t *testing.T) {
+	tests := []struct {
+		name       string
+		assortment *Assortment
+		want       string
+	}{
+		{"product", &Assortment{Meta: &Meta{Type: "product"}}, models.KindGoods},
+		{"variant", &Assortment{Meta: &Meta{Type: "variant"}}, models.KindGoods},
+		{"service", &Assortment{Meta: &Meta{Type: "service"}}, models.KindService},
+		{"not expanded", nil, models.KindGoods},
+	}
+
+	for _, tt := range tests {
+		item := exportItem(&Position{Quantity: 1, Price: 100, Assortment: tt.assortment}, 1, false, false)
+		if item.Kind != tt.want {
+			t.Errorf("%s: kind = %q, want %q", tt.name, item.Kind, tt.want)
+		}
+	}
+}
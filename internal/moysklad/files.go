@@ -0,0 +1,88 @@
+package moysklad
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"upd-loader-go/internal/models"
+)
+
+// maxFilesPerRequest is the number of files MoySkald accepts in one request
+const maxFilesPerRequest = 10
+
+// fileContent is a file attached to a document, content is base64 encoded
+type fileContent struct {
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+// attachUploadFiles attaches files to the documents of the upload: the base
+// document and the invoice. Documents are already created, so failures are
+// recorded in AttachmentErrors instead of failing the upload.
+func (api *API) attachUploadFiles(result *UploadResult, files []models.RenderedFile) {
+	if len(files) == 0 {
+		return
+	}
+
+	type document struct {
+		endpoint, id, name string
+	}
+	var documents []document
+	if result.Direction == DirectionPurchase {
+		if result.Supply != nil {
+			documents = append(documents, document{"/entity/supply", result.Supply.ID, "supply " + result.Supply.Name})
+		}
+		if result.FactureIn != nil {
+			documents = append(documents, document{"/entity/facturein", result.FactureIn.ID, "received invoice " + result.FactureIn.Name})
+		}
+	} else {
+		if result.Demand != nil {
+			documents = append(documents, document{"/entity/demand", result.Demand.ID, "demand " + result.Demand.Name})
+		}
+		if result.FactureOut != nil {
+			documents = append(documents, document{"/entity/factureout", result.FactureOut.ID, "invoice " + result.FactureOut.Name})
+		}
+	}
+
+	attached := false
+	for _, doc := range documents {
+		if err := api.attachFiles(doc.endpoint, doc.id, files); err != nil {
+			api.logger.Warningf("Failed to attach files to %s: %v", doc.name, err)
+			result.AttachmentErrors = append(result.AttachmentErrors, fmt.Sprintf("%s: %v", doc.name, err))
+			continue
+		}
+		api.logger.Infof("Attached %d files to %s", len(files), doc.name)
+		attached = true
+	}
+	if attached {
+		for _, file := range files {
+			result.AttachedFiles = append(result.AttachedFiles, file.FileName)
+		}
+	}
+}
+
+// attachFiles uploads files to the entity
+func (api *API) attachFiles(endpoint, id string, files []models.RenderedFile) error {
+	for start := 0; start < len(files); start += maxFilesPerRequest {
+		chunk := files[start:min(start+maxFilesPerRequest, len(files))]
+		payload := make([]fileContent, 0, len(chunk))
+		for _, file := range chunk {
+			payload = append(payload, fileContent{
+				Filename: file.FileName,
+				Content:  base64.StdEncoding.EncodeToString(file.Content),
+			})
+		}
+
+		resp, err := api.makeRequest("POST", endpoint+"/"+id+"/files", payload, nil)
+		if err != nil {
+			return &APIError{Message: fmt.Sprintf("Network error attaching files: %v", err)}
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return &APIError{Message: fmt.Sprintf("Error attaching files: %d - %s", resp.StatusCode, string(body))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package moysklad
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"upd-loader-go/internal/models"
+)
+
+// mappingHeader is the header of the mapping CSV file
+var mappingHeader = []string{"supplier_inn", "supplier_article", "supplier_name", "moysklad_type", "moysklad_id", "moysklad_name"}
+
+// ItemMapping maps a counterparty item, identified by its article or name,
+// to MoySkald product or service
+type ItemMapping struct {
+	SupplierINN     string
+	SupplierArticle string
+	SupplierName    string
+	AssortmentType  string // product, service, variant or bundle
+	AssortmentID    string
+	AssortmentName  string
+}
+
+// key returns mapping key: by article when the counterparty sets articles,
+// by name otherwise
+func (m *ItemMapping) key() string {
+	if m.SupplierArticle != "" {
+		return mappingKey(m.SupplierINN, "article", m.SupplierArticle)
+	}
+	return mappingKey(m.SupplierINN, "name", m.SupplierName)
+}
+
+// meta builds assortment meta from mapped type and ID
+func (m *ItemMapping) meta(baseURL string) *Meta {
+	return &Meta{
+		Href:      fmt.Sprintf("%s/entity/%s/%s", baseURL, m.AssortmentType, m.AssortmentID),
+		Type:      m.AssortmentType,
+		MediaType: "application/json",
+	}
+}
+
+func mappingKey(inn, field, value string) string {
+	return inn + "|" + field + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// mappingStore keeps item mappings in memory and in a CSV file
+type mappingStore struct {
+	mu       sync.Mutex
+	filePath string
+	mappings map[string]*ItemMapping
+}
+
+func newMappingStore(filePath string) *mappingStore {
+	return &mappingStore{
+		filePath: filePath,
+		mappings: make(map[string]*ItemMapping),
+	}
+}
+
+// lookup finds mapping of UPD line: by article first, then by name
+func (s *mappingStore) lookup(inn string, item *models.InvoiceItem) *ItemMapping {
+	if inn == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item.Article != "" {
+		if mapping, ok := s.mappings[mappingKey(inn, "article", item.Article)]; ok {
+			return mapping
+		}
+	}
+	return s.mappings[mappingKey(inn, "name", item.Name)]
+}
+
+// put adds or replaces mappings and saves the file. Mappings are not changed
+// when the file cannot be saved.
+func (s *mappingStore) put(mappings ...*ItemMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// previous holds replaced mappings by key, nil for added ones
+	previous := make(map[string]*ItemMapping, len(mappings))
+	for _, mapping := range mappings {
+		key := mapping.key()
+		if _, ok := previous[key]; !ok {
+			previous[key] = s.mappings[key]
+		}
+		s.mappings[key] = mapping
+	}
+
+	if err := s.save(); err != nil {
+		for key, mapping := range previous {
+			if mapping == nil {
+				delete(s.mappings, key)
+			} else {
+				s.mappings[key] = mapping
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// list returns mappings sorted by counterparty and item
+func (s *mappingStore) list() []*ItemMapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.mappings))
+	for key := range s.mappings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mappings := make([]*ItemMapping, 0, len(keys))
+	for _, key := range keys {
+		mappings = append(mappings, s.mappings[key])
+	}
+	return mappings
+}
+
+// load reads mappings from the file
+func (s *mappingStore) load() error {
+	if s.filePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mappings, err := parseMappings(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mapping := range mappings {
+		s.mappings[mapping.key()] = mapping
+	}
+	return nil
+}
+
+// save writes mappings to the file. Must be called with the lock held.
+func (s *mappingStore) save() error {
+	if s.filePath == "" {
+		return nil
+	}
+
+	mappings := make([]*ItemMapping, 0, len(s.mappings))
+	for _, mapping := range s.mappings {
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].key() < mappings[j].key() })
+
+	var buf bytes.Buffer
+	if err := writeMappings(&buf, mappings); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.filePath), 0755); err != nil {
+		return err
+	}
+	tempPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tempPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, s.filePath)
+}
+
+// writeMappings writes mappings as CSV with header
+func writeMappings(w io.Writer, mappings []*ItemMapping) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(mappingHeader); err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		record := []string{m.SupplierINN, m.SupplierArticle, m.SupplierName, m.AssortmentType, m.AssortmentID, m.AssortmentName}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// parseMappings parses mapping CSV. Both comma and semicolon separated files
+// are accepted, since spreadsheets save CSV with semicolons in Russian locale.
+func parseMappings(data []byte) ([]*ItemMapping, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty mapping file")
+	}
+
+	// Columns are found by header so their order does not matter
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range mappingHeader {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("column %s not found, expected header: %s", name, strings.Join(mappingHeader, ","))
+		}
+	}
+
+	var mappings []*ItemMapping
+	for line, record := range records[1:] {
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		mapping := &ItemMapping{
+			SupplierINN:     field("supplier_inn"),
+			SupplierArticle: field("supplier_article"),
+			SupplierName:    field("supplier_name"),
+			AssortmentType:  strings.ToLower(field("moysklad_type")),
+			AssortmentID:    field("moysklad_id"),
+			AssortmentName:  field("moysklad_name"),
+		}
+		if mapping.SupplierINN == "" && mapping.SupplierArticle == "" && mapping.SupplierName == "" && mapping.AssortmentID == "" {
+			continue
+		}
+
+		switch {
+		case mapping.SupplierINN == "":
+			return nil, fmt.Errorf("line %d: supplier_inn is empty", line+2)
+		case mapping.SupplierArticle == "" && mapping.SupplierName == "":
+			return nil, fmt.Errorf("line %d: supplier_article or supplier_name is required", line+2)
+		case mapping.AssortmentID == "":
+			return nil, fmt.Errorf("line %d: moysklad_id is empty", line+2)
+		}
+		switch mapping.AssortmentType {
+		case "product", "service", "variant", "bundle":
+		case "":
+			mapping.AssortmentType = "product"
+		default:
+			return nil, fmt.Errorf("line %d: invalid moysklad_type %s", line+2, mapping.AssortmentType)
+		}
+
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// ExportMappings returns all item mappings as CSV
+func (api *API) ExportMappings() ([]byte, int, error) {
+	mappings := api.mappings.list()
+
+	var buf bytes.Buffer
+	if err := writeMappings(&buf, mappings); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), len(mappings), nil
+}
+
+// ImportMappings adds mappings from CSV, replacing mappings of the same
+// items. Returns number of imported mappings.
+func (api *API) ImportMappings(data []byte) (int, error) {
+	mappings, err := parseMappings(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := api.mappings.put(mappings...); err != nil {
+		return 0, fmt.Errorf("failed to save mappings: %v", err)
+	}
+
+	api.logger.Infof("Imported %d item mappings", len(mappings))
+	return len(mappings), nil
+}
+
+// LearnMapping maps counterparty item to MoySkald product or service found
+// by article or name. It is used when a user resolves an unmatched UPD line.
+func (api *API) LearnMapping(inn, supplierArticle, supplierName, assortmentRef string) (*ItemMapping, error) {
+	mapping := &ItemMapping{
+		SupplierINN:     strings.TrimSpace(inn),
+		SupplierArticle: strings.TrimSpace(supplierArticle),
+		SupplierName:    strings.TrimSpace(supplierName),
+	}
+	assortmentRef = strings.TrimSpace(assortmentRef)
+	if mapping.SupplierINN == "" || (mapping.SupplierArticle == "" && mapping.SupplierName == "") || assortmentRef == "" {
+		return nil, &APIError{Message: "Counterparty INN, supplier article or name and MoySkald item are required"}
+	}
+
+	var item *Product
+	for _, field := range []string{MatchByArticle, MatchByCode, MatchByName} {
+		if items, err := api.findAssortmentBy(field, []string{assortmentRef}); err == nil && items[assortmentRef] != nil {
+			item = items[assortmentRef]
+			break
+		}
+	}
+	if item == nil {
+		return nil, &APIError{Message: fmt.Sprintf("Product or service %s not found in MoySkald", assortmentRef)}
+	}
+	mapping.AssortmentType, mapping.AssortmentID, mapping.AssortmentName = item.Meta.Type, item.ID, item.Name
+
+	return api.SaveMapping(mapping)
+}
+
+// SaveMapping stores mapping of counterparty item to known MoySkald
+// product or service
+func (api *API) SaveMapping(mapping *ItemMapping) (*ItemMapping, error) {
+	if mapping.SupplierINN == "" || (mapping.SupplierArticle == "" && mapping.SupplierName == "") || mapping.AssortmentID == "" {
+		return nil, &APIError{Message: "Counterparty INN, supplier article or name and MoySkald item are required"}
+	}
+	if err := api.mappings.put(mapping); err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Failed to save mapping: %v", err)}
+	}
+
+	api.logger.Infof("Saved mapping for %s of counterparty %s: %s %s", mapping.key(), mapping.SupplierINN, mapping.AssortmentType, mapping.AssortmentName)
+	return mapping, nil
+}
@@ -0,0 +1,149 @@
+package moysklad
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMappings(t *testing.T) {
+	pipe := &ItemMapping{SupplierINN: "7701234567", SupplierArticle: "A-1", SupplierName: "Труба 100x2,5", AssortmentType: "product", AssortmentID: "p-1", AssortmentName: "Труба"}
+	service := &ItemMapping{SupplierINN: "7701234567", SupplierName: "Доставка", AssortmentType: "service", AssortmentID: "s-1", AssortmentName: "Доставка"}
+
+	tests := []struct {
+		name    string
+		csv     string
+		want    []*ItemMapping
+		wantErr string
+	}{
+		{
+			name: "comma separated",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				"7701234567,A-1,\"Труба 100x2,5\",product,p-1,Труба\n" +
+				"7701234567,,Доставка,service,s-1,Доставка\n",
+			want: []*ItemMapping{pipe, service},
+		},
+		{
+			name: "semicolon separated with BOM",
+			csv: "\xef\xbb\xbfsupplier_inn;supplier_article;supplier_name;moysklad_type;moysklad_id;moysklad_name\r\n" +
+				"7701234567;A-1;Труба 100x2,5;Product;p-1;Труба\r\n" +
+				"7701234567;;Доставка;service;s-1;Доставка\r\n",
+			want: []*ItemMapping{pipe, service},
+		},
+		{
+			name: "columns found by header",
+			csv: "Moysklad_ID, supplier_name,supplier_inn,moysklad_name,supplier_article,moysklad_type,comment\n" +
+				"p-1, \"Труба 100x2,5 \",7701234567,Труба,A-1,product,лишняя колонка\n",
+			want: []*ItemMapping{pipe},
+		},
+		{
+			name: "default type and empty lines",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				",,,,,\n" +
+				"7701234567,,Доставка,,s-1,Доставка\n",
+			want: []*ItemMapping{{SupplierINN: "7701234567", SupplierName: "Доставка", AssortmentType: "product", AssortmentID: "s-1", AssortmentName: "Доставка"}},
+		},
+		{name: "empty file", csv: "", wantErr: "empty mapping file"},
+		{name: "missing column", csv: "supplier_inn,supplier_name,moysklad_id\n", wantErr: "column supplier_article not found"},
+		{name: "invalid CSV", csv: "supplier_inn,\"supplier_article\n", wantErr: "invalid CSV"},
+		{
+			name: "empty INN",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				",A-1,Труба,product,p-1,Труба\n",
+			wantErr: "line 2: supplier_inn is empty",
+		},
+		{
+			name: "no article or name",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				"7701234567,A-1,Труба,product,p-1,Труба\n" +
+				"7701234567,,,product,p-2,Фланец\n",
+			wantErr: "line 3: supplier_article or supplier_name is required",
+		},
+		{
+			name: "empty ID",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				"7701234567,A-1,Труба,product,,Труба\n",
+			wantErr: "line 2: moysklad_id is empty",
+		},
+		{
+			name: "invalid type",
+			csv: "supplier_inn,supplier_article,supplier_name,moysklad_type,moysklad_id,moysklad_name\n" +
+				"7701234567,A-1,Труба,material,p-1,Труба\n",
+			wantErr: "line 2: invalid moysklad_type material",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMappings([]byte(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mappings:\n%s\nwant:\n%s", formatMappings(got), formatMappings(tt.want))
+			}
+		})
+	}
+}
+
+func formatMappings(mappings []*ItemMapping) string {
+	var lines []string
+	for _, m := range mappings {
+		lines = append(lines, strings.Join([]string{m.SupplierINN, m.SupplierArticle, m.SupplierName, m.AssortmentType, m.AssortmentID, m.AssortmentName}, "|"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestMappingsRoundTrip(t *testing.T) {
+	mappings := []*ItemMapping{
+		{SupplierINN: "7701234567", SupplierArticle: "A-1", SupplierName: "Труба \"ГОСТ\"; 100x2,5", AssortmentType: "product", AssortmentID: "p-1", AssortmentName: "Труба"},
+		{SupplierINN: "7801234567", SupplierName: "Доставка", AssortmentType: "service", AssortmentID: "s-1", AssortmentName: "Доставка"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeMappings(&buf, mappings); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got, err := parseMappings(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, mappings) {
+		t.Errorf("mappings:\n%s\nwant:\n%s", formatMappings(got), formatMappings(mappings))
+	}
+}
+
+func TestMappingStorePutKeepsMappingsOnSaveError(t *testing.T) {
+	dir := t.TempDir()
+	store := newMappingStore(filepath.Join(dir, "mappings.csv"))
+	saved := &ItemMapping{SupplierINN: "7701234567", SupplierArticle: "A-1", AssortmentType: "product", AssortmentID: "p-1"}
+	if err := store.put(saved); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// The mappings directory cannot be created under a file
+	blocker := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store.filePath = filepath.Join(blocker, "mappings.csv")
+
+	replaced := &ItemMapping{SupplierINN: "7701234567", SupplierArticle: "A-1", AssortmentType: "product", AssortmentID: "p-2"}
+	added := &ItemMapping{SupplierINN: "7701234567", SupplierName: "Доставка", AssortmentType: "service", AssortmentID: "s-1"}
+	if err := store.put(replaced, added); err == nil {
+		t.Fatal("put succeeded, want save error")
+	}
+
+	if got := store.list(); len(got) != 1 || got[0] != saved {
+		t.Errorf("mappings after failed save:\n%s\nwant:\n%s", formatMappings(got), formatMappings([]*ItemMapping{saved}))
+	}
+}
@@ -0,0 +1,263 @@
+package moysklad
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"upd-loader-go/internal/models"
+)
+
+const (
+	// defaultMatchThreshold is the confidence above which a line is matched
+	// automatically
+	defaultMatchThreshold = 0.9
+	// matchMargin is how much the best candidate must lead the second one to
+	// be matched automatically
+	matchMargin = 0.05
+	// minCandidateConfidence drops candidates too different to be offered
+	minCandidateConfidence = 0.4
+	// maxCandidates limits candidates offered for a line
+	maxCandidates = 5
+	// searchLimit limits rows of a single search request
+	searchLimit = 20
+)
+
+// homoglyphs maps Cyrillic letters to Latin letters looking the same, so
+// that "100х2,5" typed with Cyrillic х equals "100x2,5"
+var homoglyphs = strings.NewReplacer(
+	"а", "a", "в", "b", "е", "e", "ё", "e", "к", "k", "м", "m", "н", "h",
+	"о", "o", "р", "p", "с", "c", "т", "t", "у", "y", "х", "x",
+)
+
+var (
+	decimalCommaPattern  = regexp.MustCompile(`(\d),(\d)`)
+	sizePattern          = regexp.MustCompile(`(\d)\s*[x*×]\s*(\d)`)
+	trailingZerosPattern = regexp.MustCompile(`(\d+)(?:\.0+|(\.\d*?[1-9])0+)(\D|$)`)
+	unitPattern          = regexp.MustCompile(`(\d)\s+(mm|cm|m|kg|г|л|mл|шt)(\s|$)`)
+)
+
+// strategyValue returns the UPD line field compared by match strategy
+func strategyValue(strategy string, item *models.InvoiceItem) string {
+	switch strategy {
+	case MatchByBarcode:
+		return item.GTIN
+	case MatchByArticle:
+		return item.Article
+	case MatchByCode, MatchByExternalCode:
+		return item.Code
+	case MatchByName:
+		return item.Name
+	default:
+		return ""
+	}
+}
+
+// fieldValues returns values of assortment field compared by match strategy
+func (p *Product) fieldValues(field string) []string {
+	switch field {
+	case MatchByBarcode:
+		var values []string
+		for _, barcode := range p.Barcodes {
+			for _, value := range barcode {
+				values = append(values, value)
+			}
+		}
+		return values
+	case MatchByArticle:
+		return []string{p.Article}
+	case MatchByCode:
+		return []string{p.Code}
+	case MatchByExternalCode:
+		return []string{p.ExternalCode}
+	default:
+		return []string{p.Name}
+	}
+}
+
+// UnmatchedItemsError is returned when UPD lines have no matching products.
+// Items hold candidates for the user to choose from.
+type UnmatchedItemsError struct {
+	Message string
+	Items   []models.UnmatchedItem
+}
+
+func (e *UnmatchedItemsError) Error() string {
+	return e.Message
+}
+
+// normalizeName brings product name to a form where spelling variants of
+// the same product compare equal: case, Cyrillic/Latin homoglyphs,
+// punctuation, decimal separators, sizes and units
+func normalizeName(name string) string {
+	s := homoglyphs.Replace(strings.ToLower(name))
+	s = decimalCommaPattern.ReplaceAllString(s, "$1.$2")
+
+	// Keep letters, digits and decimal points, everything else separates words
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '*' || r == '×':
+			return r
+		default:
+			return ' '
+		}
+	}, s)
+
+	s = sizePattern.ReplaceAllString(s, "${1}x${2}")
+	// Units are merged first, so "100.50 мм" and "100.50мм" lose zeros alike
+	s = unitPattern.ReplaceAllString(s, "$1$2$3")
+	s = trailingZerosPattern.ReplaceAllString(s, "${1}${2}${3}")
+
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		fields[i] = strings.Trim(field, ".*×")
+	}
+	return strings.Join(strings.Fields(strings.Join(fields, " ")), " ")
+}
+
+// nameSimilarity scores normalized names from 0 to 1 combining word overlap
+// and character trigram overlap, so that both reordered words and small
+// typos are tolerated
+func nameSimilarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	return 0.6*dice(strings.Fields(a), strings.Fields(b)) + 0.4*dice(trigrams(a), trigrams(b))
+}
+
+// dice computes Dice coefficient of two multisets
+func dice(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	common := 0
+	for _, s := range b {
+		if counts[s] > 0 {
+			counts[s]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(a)+len(b))
+}
+
+// trigrams returns character trigrams of the string without spaces
+func trigrams(s string) []string {
+	runes := []rune(strings.ReplaceAll(s, " ", ""))
+	if len(runes) < 3 {
+		return []string{string(runes)}
+	}
+	result := make([]string, 0, len(runes)-2)
+	for i := 0; i+3 <= len(runes); i++ {
+		result = append(result, string(runes[i:i+3]))
+	}
+	return result
+}
+
+// findCandidates searches assortment similar to UPD line and returns
+// candidates ranked by confidence
+func (api *API) findCandidates(item *models.InvoiceItem) []models.MatchCandidate {
+	normalized := normalizeName(item.Name)
+	if normalized == "" {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var candidates []models.MatchCandidate
+	for _, query := range searchQueries(item) {
+		page, err := getPage[*Product](api, "/entity/assortment", map[string]string{"search": query, "limit": strconv.Itoa(searchLimit)})
+		if err != nil {
+			api.logger.Warningf("Error searching assortment for '%s': %v", query, err)
+			break
+		}
+
+		for _, row := range page.Rows {
+			if row == nil || row.Meta == nil || seen[row.Meta.Href] {
+				continue
+			}
+			seen[row.Meta.Href] = true
+
+			switch row.Meta.Type {
+			case "product", "service", "variant", "bundle":
+			default:
+				continue
+			}
+
+			confidence := nameSimilarity(normalized, normalizeName(row.Name))
+			if item.Article != "" && strings.EqualFold(item.Article, row.Article) {
+				confidence = (confidence + 1) / 2
+			}
+			if confidence < minCandidateConfidence {
+				continue
+			}
+			candidates = append(candidates, models.MatchCandidate{
+				Type:       row.Meta.Type,
+				ID:         row.ID,
+				Name:       row.Name,
+				Article:    row.Article,
+				Confidence: confidence,
+			})
+		}
+
+		// Narrower queries only help when the full name finds nothing good
+		if len(candidates) > 0 {
+			break
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	return candidates
+}
+
+// searchQueries returns search queries for UPD line from the most to the
+// least specific: article, full name, first two words and the first word
+func searchQueries(item *models.InvoiceItem) []string {
+	var queries []string
+	if item.Article != "" {
+		queries = append(queries, item.Article)
+	}
+	queries = append(queries, item.Name)
+
+	words := strings.FieldsFunc(item.Name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 2 {
+		queries = append(queries, words[0]+" "+words[1])
+	}
+	if len(words) > 1 && len([]rune(words[0])) >= 3 {
+		queries = append(queries, words[0])
+	}
+	return queries
+}
+
+// confidentMatch returns the best candidate if it is above the threshold
+// and clearly ahead of the next one
+func (api *API) confidentMatch(candidates []models.MatchCandidate) *models.MatchCandidate {
+	if len(candidates) == 0 || candidates[0].Confidence < api.options.MatchThreshold {
+		return nil
+	}
+	if len(candidates) > 1 && candidates[0].Confidence-candidates[1].Confidence < matchMargin {
+		return nil
+	}
+	return &candidates[0]
+}
+
+// candidateMeta builds assortment meta of a candidate
+func (api *API) candidateMeta(candidate *models.MatchCandidate) *Meta {
+	mapping := &ItemMapping{AssortmentType: candidate.Type, AssortmentID: candidate.ID}
+	return mapping.meta(api.baseURL)
+}
@@ -0,0 +1,105 @@
+package moysklad
+
+import (
+	"sort"
+	"testing"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"extra space", "Труба  поликарбонатная  100х2,5 мм", "Труба поликарбонатная 100х2,5 мм"},
+		{"different dash", "Профиль-соединитель НР 10 мм", "Профиль – соединитель НР 10 мм"},
+		{"Cyrillic х and Latin x", "Лист 2100х6000", "Лист 2100x6000"},
+		{"size with decimal comma", "Труба 100х2,5", "Труба 100x2.5"},
+		{"spaces around size sign", "Лист 2100 x 6000", "Лист 2100х6000"},
+		{"case", "ТРУБА ПРОЗРАЧНАЯ", "труба прозрачная"},
+		{"trailing zeros before unit", "Труба 100.50мм", "Труба 100.50 мм"},
+		{"trailing zeros and decimal comma", "Труба 100,50 мм", "Труба 100.5мм"},
+		{"integer with zero fraction", "Лист 4.0 мм", "Лист 4мм"},
+	}
+
+	for _, tt := range tests {
+		if a, b := normalizeName(tt.a), normalizeName(tt.b); a != b {
+			t.Errorf("%s: normalizeName(%q) = %q, normalizeName(%q) = %q", tt.name, tt.a, a, tt.b, b)
+		}
+	}
+
+	// Significant digits are kept
+	for _, tt := range []struct{ name, want string }{
+		{"Труба 100.50мм", "tpyбa 100.5mm"},
+		{"Труба 1.05 мм", "tpyбa 1.05mm"},
+		{"Лист 100х2,5", "лиct 100x2.5"},
+		{"Лист 4.0 мм", "лиct 4mm"},
+		{"Лист 10 шт", "лиct 10шt"},
+	} {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		min, max float64
+	}{
+		{"spelling variants", "Труба 100х2,5  мм", "труба 100x2.5мм", 1, 1},
+		{"reordered words", "Труба прозрачная 100x2.5", "Труба 100x2.5 прозрачная", 0.8, 1},
+		{"typo", "Поликарбонат монолитный", "Поликарбонат монолитнный", 0.6, 0.95},
+		{"different size", "Труба 100x2.5", "Труба 120x3", 0.2, 0.6},
+		{"different product", "Труба 100x2.5", "Саморез 4.2x19", 0, 0.3},
+		{"empty", "", "Труба", 0, 0},
+	}
+
+	for _, tt := range tests {
+		got := nameSimilarity(normalizeName(tt.a), normalizeName(tt.b))
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: nameSimilarity(%q, %q) = %.2f, want %.2f..%.2f", tt.name, tt.a, tt.b, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestConfidentMatch(t *testing.T) {
+	api := newTestAPI(t, nil, fastLimits())
+
+	tests := []struct {
+		name       string
+		item       string
+		assortment []string
+		want       string
+	}{
+		{"extra space", "Труба  поликарбонатная 100х2,5", []string{"Труба поликарбонатная 100х2,5", "Труба поликарбонатная 120х3"}, "Труба поликарбонатная 100х2,5"},
+		{"different dash", "Профиль-соединитель 10 мм", []string{"Профиль – соединитель 10 мм", "Профиль торцевой 10 мм"}, "Профиль – соединитель 10 мм"},
+		{"Cyrillic х and Latin x", "Лист 2100х6000 прозрачный", []string{"Лист 2100x6000 прозрачный"}, "Лист 2100x6000 прозрачный"},
+		{"decimal comma and Latin x", "Труба 100х2,5 мм", []string{"Труба 100x2.5 мм", "Труба 100x3 мм"}, "Труба 100x2.5 мм"},
+		{"trailing zeros", "Труба 100.50мм", []string{"Труба 100,5 мм"}, "Труба 100,5 мм"},
+		{"only similar", "Труба 100x2.5", []string{"Труба 120x3"}, ""},
+		{"two equal candidates", "Труба 100x2.5", []string{"Труба 100х2,5", "труба 100x2.5"}, ""},
+		{"no candidates", "Труба 100x2.5", nil, ""},
+	}
+
+	for _, tt := range tests {
+		normalized := normalizeName(tt.item)
+		var candidates []models.MatchCandidate
+		for _, name := range tt.assortment {
+			candidates = append(candidates, models.MatchCandidate{Name: name, Confidence: nameSimilarity(normalized, normalizeName(name))})
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Confidence > candidates[j].Confidence
+		})
+
+		got := ""
+		if match := api.confidentMatch(candidates); match != nil {
+			got = match.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s: confidentMatch = %q, want %q (candidates %+v)", tt.name, got, tt.want, candidates)
+		}
+	}
+}
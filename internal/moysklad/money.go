@@ -0,0 +1,80 @@
+package moysklad
+
+import (
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// Money and quantities are computed on decimals and rounded only where
+// MoySkald stores a value: prices and sums to whole kopecks, quantities to
+// quantityPlaces. Rounding is half away from zero as in Russian accounting.
+
+// quantityPlaces is the number of decimal places of position quantity
+const quantityPlaces = 3
+
+var hundred = decimal.NewFromInt(100)
+
+// toKopecks converts amount in currency units to whole kopecks
+func toKopecks(amount decimal.Decimal) decimal.Decimal {
+	return amount.Shift(2).Round(0)
+}
+
+// fromKopecks converts kopecks to currency units
+func fromKopecks(kopecks decimal.Decimal) decimal.Decimal {
+	return kopecks.Shift(-2)
+}
+
+// roundQuantity rounds quantity to the precision MoySkald keeps
+func roundQuantity(quantity decimal.Decimal) decimal.Decimal {
+	return quantity.Round(quantityPlaces)
+}
+
+// positionSum is position sum in kopecks as MoySkald computes it
+func positionSum(price, quantity decimal.Decimal) decimal.Decimal {
+	return price.Mul(quantity).Round(0)
+}
+
+// updPrice returns unit price of UPD line in kopecks including VAT, since
+// documents are created with VAT included in prices. The price is derived
+// from the line amount, which is what the totals are made of; ЦенаТов is
+// the price without VAT and may have more than two decimals. Quantities
+// that round to zero fall back to ЦенаТов.
+func updPrice(item *models.InvoiceItem, vat VAT) decimal.Decimal {
+	quantity := roundQuantity(item.Quantity)
+	if item.AmountWithVAT.IsPositive() && quantity.IsPositive() {
+		return toKopecks(item.AmountWithVAT.Div(quantity))
+	}
+
+	price := item.Price
+	if vat.Enabled {
+		price = price.Mul(hundred.Add(decimal.NewFromInt(int64(vat.Rate)))).Div(hundred)
+	}
+	return toKopecks(price)
+}
+
+// positionsTotal is the document total in currency units
+func positionsTotal(positions []*Position) decimal.Decimal {
+	total := decimal.Zero
+	for _, position := range positions {
+		total = total.Add(positionSum(decimal.NewFromFloat(position.Price), decimal.NewFromFloat(position.Quantity)))
+	}
+	return fromKopecks(total)
+}
+
+// reconcileTotals compares document total with UPD total payable
+// (ВсегоОпл) and sets plan residual: UPD total minus document total.
+// Residual is zero when UPD has no total.
+func (api *API) reconcileTotals(plan *UploadPlan) {
+	content := plan.UPDDocument.Content
+	plan.Total = positionsTotal(plan.positions)
+	if !content.TotalWithVAT.IsPositive() {
+		plan.Residual = decimal.Zero
+		return
+	}
+
+	plan.Residual = content.TotalWithVAT.Sub(plan.Total)
+	if !plan.Residual.IsZero() {
+		api.logger.Warningf("Document total %s differs from UPD total %s by %s", plan.Total.StringFixed(2), content.TotalWithVAT.StringFixed(2), plan.Residual.StringFixed(2))
+	}
+}
@@ -0,0 +1,54 @@
+package moysklad
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestUPDPrice(t *testing.T) {
+	vat20 := VAT{Rate: 20, Enabled: true}
+
+	tests := []struct {
+		name          string
+		quantity      string
+		price         string
+		amountWithVAT string
+		vat           VAT
+		want          string
+	}{
+		{"from amount", "2", "5125", "12300", vat20, "615000"},
+		{"from amount with fractional quantity", "0.333", "412.37", "164.78", vat20, "49483"},
+		{"quantity rounded to kopecks", "1.0004", "100", "120", vat20, "12000"},
+		{"ЦенаТов with VAT", "0", "100", "0", vat20, "12000"},
+		{"ЦенаТов without VAT", "1", "99.999", "0", noVAT, "10000"},
+		// 0.0004 rounds to zero quantity: the amount cannot be divided
+		{"quantity rounding to zero", "0.0004", "100", "0.05", vat20, "12000"},
+		{"negative quantity", "-1", "100", "120", vat20, "12000"},
+	}
+
+	for _, tt := range tests {
+		item := &models.InvoiceItem{
+			Quantity:      decimal.RequireFromString(tt.quantity),
+			Price:         decimal.RequireFromString(tt.price),
+			AmountWithVAT: decimal.RequireFromString(tt.amountWithVAT),
+		}
+		if got := updPrice(item, tt.vat); !got.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("%s: updPrice = %s kopecks, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPositionsTotal(t *testing.T) {
+	positions := []*Position{
+		{Quantity: 0.333, Price: 49483},
+		{Quantity: 12.5, Price: 1884},
+		{Quantity: 1, Price: 0},
+	}
+	// 164.78 + 235.50
+	if got := positionsTotal(positions); !got.Equal(decimal.RequireFromString("400.28")) {
+		t.Errorf("positionsTotal = %s, want 400.28", got)
+	}
+}
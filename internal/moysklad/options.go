@@ -0,0 +1,85 @@
+package moysklad
+
+// Missing product policies
+const (
+	// MissingProductsFail aborts upload when a line has no matching product
+	MissingProductsFail = "fail"
+	// MissingProductsCreate creates missing products and services
+	MissingProductsCreate = "create"
+	// MissingProductsQuarantine creates missing products and services in
+	// the quarantine folder for later review
+	MissingProductsQuarantine = "quarantine"
+)
+
+// Match strategies: assortment fields compared with UPD line fields
+const (
+	// MatchByBarcode compares barcodes with GTIN of the line
+	MatchByBarcode = "barcode"
+	// MatchByArticle compares article with supplier article of the line
+	MatchByArticle = "article"
+	// MatchByCode compares code with supplier code of the line
+	MatchByCode = "code"
+	// MatchByExternalCode compares externalCode with supplier code of the line
+	MatchByExternalCode = "externalCode"
+	// MatchByName compares name with name of the line
+	MatchByName = "name"
+)
+
+// DefaultMatchStrategies is the default order of match strategies
+var DefaultMatchStrategies = []string{MatchByBarcode, MatchByArticle, MatchByCode, MatchByExternalCode, MatchByName}
+
+// UploadOptions configures how UPD documents are mapped to MoySkald entities
+type UploadOptions struct {
+	MissingProducts  string
+	QuarantineFolder string
+	// MappingsFile is the CSV file of counterparty item mappings. Mappings
+	// are kept in memory only when empty.
+	MappingsFile string
+	// MatchThreshold is the fuzzy match confidence from 0 to 1 above which
+	// a line is matched without asking. Values above 1 disable auto-match.
+	MatchThreshold float64
+	// MatchStrategies are assortment lookups tried in order for every line
+	MatchStrategies []string
+	// CounterpartyUpdates is the policy for requisites of existing
+	// counterparties differing from UPD
+	CounterpartyUpdates string
+	// CounterpartyGroups restricts counterparty resolution to counterparties
+	// in any of the groups (tags). New counterparties are put in the first.
+	CounterpartyGroups []string
+	// CounterpartyStores and OrganizationStores map counterparty INN and
+	// organization INN or ID to store name or ID. Demands ship from it and
+	// supplies receive to it when the linked documents have no store.
+	CounterpartyStores map[string]string
+	OrganizationStores map[string]string
+	// StockCheck is the policy for demand positions exceeding store stock
+	StockCheck string
+	// Attributes map UPD metadata fields (see models.AttributeFields) to names of
+	// demand and invoice attributes they are written to
+	Attributes map[string]string
+}
+
+// defaultQuarantineFolder is the folder for products created in quarantine mode
+const defaultQuarantineFolder = "УПД: на проверку"
+
+// withDefaults fills empty options
+func (o UploadOptions) withDefaults() UploadOptions {
+	if o.MissingProducts == "" {
+		o.MissingProducts = MissingProductsFail
+	}
+	if len(o.MatchStrategies) == 0 {
+		o.MatchStrategies = DefaultMatchStrategies
+	}
+	if o.MatchThreshold <= 0 {
+		o.MatchThreshold = defaultMatchThreshold
+	}
+	if o.CounterpartyUpdates == "" {
+		o.CounterpartyUpdates = CounterpartyUpdatesPropose
+	}
+	if o.StockCheck == "" {
+		o.StockCheck = StockCheckWarn
+	}
+	if o.QuarantineFolder == "" {
+		o.QuarantineFolder = defaultQuarantineFolder
+	}
+	return o
+}
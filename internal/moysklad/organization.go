@@ -0,0 +1,197 @@
+package moysklad
+
+import (
+	"fmt"
+	"strings"
+
+	"upd-loader-go/internal/models"
+)
+
+// organizationsKey is the cache key of the list of all organizations
+const organizationsKey = "all"
+
+// OrganizationStatus describes whether UPD can be loaded to an organization
+type OrganizationStatus struct {
+	Organization *Organization
+	// Default is set for the configured default organization
+	Default bool
+	// Accounts is the number of bank accounts of the organization
+	Accounts int
+	// Ambiguous is set when another organization has the same INN and KPP
+	// and is chosen instead, so UPD never reach this one
+	Ambiguous bool
+}
+
+// Ready reports whether UPD can be routed to the organization
+func (s OrganizationStatus) Ready() bool {
+	return s.Organization.INN != "" && !s.Ambiguous
+}
+
+// organizations returns all active organizations of the account
+func (api *API) organizations() ([]*Organization, error) {
+	var cached []*Organization
+	if api.cache.get(cacheOrganization, organizationsKey, &cached) {
+		api.logger.Debugf("Organizations found in cache: %d", len(cached))
+		return cached, nil
+	}
+
+	organizations, err := listAll[*Organization](api, "/entity/organization", nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Error loading organizations: %v", err)}
+	}
+	if len(organizations) > 0 {
+		api.cache.set(cacheOrganization, organizationsKey, organizations)
+	}
+	return organizations, nil
+}
+
+// findOrganization resolves UPD participant to our organization. Among
+// organizations with the participant's INN an exact INN+KPP match is
+// preferred, then the configured default organization, then the head
+// office. Returns nil when the participant is not our organization and an
+// error when the choice is ambiguous.
+func (api *API) findOrganization(party models.Organization) (*Organization, error) {
+	if party.INN == "" {
+		return nil, nil
+	}
+
+	organizations, err := api.organizations()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*Organization
+	for _, organization := range organizations {
+		if organization.INN == party.INN && !organization.Archived {
+			candidates = append(candidates, organization)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	if party.KPP != "" {
+		var exact []*Organization
+		for _, organization := range candidates {
+			if organization.KPP == party.KPP {
+				exact = append(exact, organization)
+			}
+		}
+		if len(exact) > 0 {
+			candidates = exact
+		}
+	}
+
+	if len(candidates) == 1 {
+		api.logger.Infof("Found organization by INN %s: %s", party.INN, candidates[0].Name)
+		return candidates[0], nil
+	}
+	for _, organization := range candidates {
+		if organization.ID == api.organizationID {
+			api.logger.Infof("Found default organization by INN %s: %s", party.INN, organization.Name)
+			return organization, nil
+		}
+	}
+
+	var headOffices []*Organization
+	for _, organization := range candidates {
+		if isHeadOfficeKPP(organization.KPP) {
+			headOffices = append(headOffices, organization)
+		}
+	}
+	if len(headOffices) == 1 {
+		api.logger.Infof("Found head office organization by INN %s: %s (KPP %s)", party.INN, headOffices[0].Name, headOffices[0].KPP)
+		return headOffices[0], nil
+	}
+
+	requisites := "INN " + party.INN
+	if party.KPP != "" {
+		requisites += " KPP " + party.KPP
+	}
+	return nil, &APIError{Message: fmt.Sprintf("Several organizations in MoySkald match %s: %s.\nSet MOYSKLAD_ORGANIZATION_ID to the organization UPD are loaded to.", requisites, describeOrganizations(candidates))}
+}
+
+// describeOrganizations lists organizations with KPP for messages
+func describeOrganizations(organizations []*Organization) string {
+	descriptions := make([]string, 0, len(organizations))
+	for _, organization := range organizations {
+		description := organization.Name
+		if organization.KPP != "" {
+			description += fmt.Sprintf(" (KPP %s)", organization.KPP)
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// organizationAccount chooses the bank account of our organization for
+// documents: the account of our party in UPD when the organization has it,
+// otherwise the default account. Returns nil when the organization has no
+// accounts.
+func (api *API) organizationAccount(organization *Organization, party models.Organization) *Account {
+	var accounts []*Account
+	if !api.cache.get(cacheOrganization, "accounts:"+organization.ID, &accounts) {
+		var err error
+		accounts, err = api.entityAccounts("/entity/organization", organization.ID, organization.Accounts)
+		if err != nil {
+			api.logger.Warningf("Failed to load accounts of organization %s: %v", organization.Name, err)
+			return nil
+		}
+		api.cache.set(cacheOrganization, "accounts:"+organization.ID, accounts)
+	}
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	for _, requisites := range party.BankAccounts {
+		for _, account := range accounts {
+			if requisites.AccountNumber != "" && account.AccountNumber == requisites.AccountNumber {
+				api.logger.Infof("Organization account %s is taken from UPD", account.AccountNumber)
+				return account
+			}
+		}
+	}
+	for _, account := range accounts {
+		if account.IsDefault {
+			return account
+		}
+	}
+	return accounts[0]
+}
+
+// accountRef references account in document payload
+func accountRef(account *Account) *Account {
+	if account == nil {
+		return nil
+	}
+	return &Account{Meta: account.Meta}
+}
+
+// organizationStatuses describes readiness of organizations. The default
+// organization is the one with defaultID.
+func organizationStatuses(organizations []*Organization, defaultID string) []OrganizationStatus {
+	statuses := make([]OrganizationStatus, 0, len(organizations))
+	for _, organization := range organizations {
+		status := OrganizationStatus{
+			Organization: organization,
+			Default:      defaultID != "" && organization.ID == defaultID,
+		}
+		if organization.Accounts != nil {
+			if organization.Accounts.Meta != nil {
+				status.Accounts = organization.Accounts.Meta.Size
+			} else {
+				status.Accounts = len(organization.Accounts.Rows)
+			}
+		}
+
+		// Of organizations with the same INN and KPP only the default one
+		// receives UPD
+		for _, other := range organizations {
+			if other != organization && other.INN == organization.INN && other.KPP == organization.KPP && !status.Default {
+				status.Ambiguous = true
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,157 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pageLimit is the maximum page size for entity lists
+	pageLimit = 1000
+	// expandPageLimit is the maximum page size MoySkald expands nested
+	// entities for; with a larger limit expand is silently ignored
+	expandPageLimit = 100
+	// filterChunkSize bounds the number of values in one multi-value filter
+	// to keep request URLs reasonably short
+	filterChunkSize = 50
+)
+
+// listRows iterates over all rows of a list endpoint following nextHref.
+// Iteration stops at the first error, which is yielded with a zero row.
+func listRows[T any](api *API, endpoint string, params map[string]string) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		pageParams := make(map[string]string, len(params)+2)
+		for k, v := range params {
+			pageParams[k] = v
+		}
+		if _, ok := pageParams["limit"]; !ok {
+			pageParams["limit"] = strconv.Itoa(pageLimit)
+		}
+		offset, _ := strconv.Atoi(pageParams["offset"])
+
+		for {
+			pageParams["offset"] = strconv.Itoa(offset)
+			page, err := getPage[T](api, endpoint, pageParams)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+
+			for _, row := range page.Rows {
+				if !yield(row, nil) {
+					return
+				}
+			}
+
+			if page.Meta == nil || page.Meta.NextHref == "" || len(page.Rows) == 0 {
+				return
+			}
+			if page.Meta.Limit > 0 {
+				offset += page.Meta.Limit
+			} else {
+				offset += len(page.Rows)
+			}
+		}
+	}
+}
+
+// listAll collects all rows of a list endpoint
+func listAll[T any](api *API, endpoint string, params map[string]string) ([]T, error) {
+	var rows []T
+	for row, err := range listRows[T](api, endpoint, params) {
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// getPage loads a single list page. Pages with expand are limited to
+// expandPageLimit rows.
+func getPage[T any](api *API, endpoint string, params map[string]string) (*ListResponse[T], error) {
+	resp, err := api.makeRequest("GET", endpoint, nil, expandLimit(params))
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error loading %s: %v", endpoint, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{Message: fmt.Sprintf("Error loading %s: %d - %s", endpoint, resp.StatusCode, string(body))}
+	}
+
+	var page ListResponse[T]
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Failed to decode %s response: %v", endpoint, err)}
+	}
+	return &page, nil
+}
+
+// expandLimit returns params with limit not above expandPageLimit when they
+// expand nested entities. A missing limit means the API default of 1000.
+func expandLimit(params map[string]string) map[string]string {
+	if params["expand"] == "" {
+		return params
+	}
+	if limit, err := strconv.Atoi(params["limit"]); err == nil && limit <= expandPageLimit {
+		return params
+	}
+
+	capped := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		capped[k] = v
+	}
+	capped["limit"] = strconv.Itoa(expandPageLimit)
+	return capped
+}
+
+// countRows returns total number of rows of a list endpoint using a single request
+func (api *API) countRows(endpoint string, params map[string]string) (int, error) {
+	countParams := map[string]string{"limit": "1"}
+	for k, v := range params {
+		countParams[k] = v
+	}
+
+	page, err := getPage[json.RawMessage](api, endpoint, countParams)
+	if err != nil {
+		return 0, err
+	}
+	if page.Meta != nil {
+		return page.Meta.Size, nil
+	}
+	return len(page.Rows), nil
+}
+
+// multiValueFilters builds filters matching any of the values
+// (field=A;field=B), split into chunks of filterChunkSize values.
+// Values containing the filter separator cannot be expressed and are skipped.
+func multiValueFilters(field string, values []string) []string {
+	var filters []string
+	var conditions []string
+
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if value == "" || seen[value] || strings.Contains(value, ";") {
+			continue
+		}
+		seen[value] = true
+
+		conditions = append(conditions, field+"="+value)
+		if len(conditions) == filterChunkSize {
+			filters = append(filters, strings.Join(conditions, ";"))
+			conditions = nil
+		}
+	}
+	if len(conditions) > 0 {
+		filters = append(filters, strings.Join(conditions, ";"))
+	}
+
+	return filters
+}
@@ -0,0 +1,106 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// pagedHandler serves total rows {"id": "<n>"} honouring limit and offset and
+// records requested limits
+func pagedHandler(t *testing.T, total int, limits *[]string) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		mu.Lock()
+		*limits = append(*limits, query.Get("limit"))
+		mu.Unlock()
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			limit = pageLimit
+		}
+		offset, _ := strconv.Atoi(query.Get("offset"))
+
+		page := ListResponse[map[string]string]{Meta: &Meta{Size: total, Limit: limit, Offset: offset}}
+		for i := offset; i < min(offset+limit, total); i++ {
+			page.Rows = append(page.Rows, map[string]string{"id": strconv.Itoa(i)})
+		}
+		if offset+limit < total {
+			page.Meta.NextHref = r.URL.String()
+		}
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestListRowsExpandLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		wantLimit string
+		wantPages int
+	}{
+		{"no expand", nil, "1000", 1},
+		{"expand", map[string]string{"expand": "assortment"}, "100", 3},
+		{"expand with large limit", map[string]string{"expand": "assortment", "limit": "1000"}, "100", 3},
+		{"expand with small limit", map[string]string{"expand": "assortment", "limit": "50"}, "50", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var limits []string
+			api := newTestAPI(t, pagedHandler(t, 250, &limits), fastLimits())
+
+			rows, err := listAll[map[string]string](api, "/entity/demand/1/positions", tt.params)
+			if err != nil {
+				t.Fatalf("listAll failed: %v", err)
+			}
+			if len(rows) != 250 || rows[249]["id"] != "249" {
+				t.Fatalf("got %d rows, want 250", len(rows))
+			}
+			if len(limits) != tt.wantPages {
+				t.Errorf("%d requests, want %d", len(limits), tt.wantPages)
+			}
+			for _, limit := range limits {
+				if limit != tt.wantLimit {
+					t.Errorf("requested limit=%s, want %s", limit, tt.wantLimit)
+				}
+			}
+		})
+	}
+}
+
+// positionsHandler serves total document positions like MoySkald does:
+// assortment is expanded only for pages of at most expandPageLimit rows
+func positionsHandler(t *testing.T, total int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			limit = pageLimit
+		}
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		expand := query.Get("expand") != "" && limit <= expandPageLimit
+
+		page := ListResponse[*Position]{Meta: &Meta{Size: total, Limit: limit, Offset: offset}}
+		for i := offset; i < min(offset+limit, total); i++ {
+			assortment := &Assortment{Meta: &Meta{Href: "https://api/entity/product/" + strconv.Itoa(i), Type: "product"}}
+			if expand {
+				assortment.Name = "Товар " + strconv.Itoa(i)
+				assortment.Article = "A-" + strconv.Itoa(i)
+				assortment.UOM = &UOM{Name: "шт", Code: "796"}
+			}
+			page.Rows = append(page.Rows, &Position{Quantity: 1, Price: float64(100 * (i + 1)), Assortment: assortment})
+		}
+		if offset+limit < total {
+			page.Meta.NextHref = r.URL.String()
+		}
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			t.Error(err)
+		}
+	}
+}
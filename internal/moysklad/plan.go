@@ -0,0 +1,420 @@
+package moysklad
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// UploadPlan describes documents an UPD upload creates. It is built by
+// PlanUpload running all lookups without writing to MoySkald and is
+// executed by ExecutePlan.
+type UploadPlan struct {
+	UPDDocument  *models.UPDDocument
+	ExternalCode string
+	// Direction is DirectionSale when the seller is our organization and
+	// DirectionPurchase when the buyer is
+	Direction string
+
+	// ExistingInvoice and ExistingFactureIn are set when the UPD was already
+	// loaded; such plan creates nothing
+	ExistingInvoice   *FactureOut
+	ExistingFactureIn *FactureIn
+	// ExistingDemand and ExistingSupply are set when a previous upload was
+	// interrupted after creating the base document; the document is reused
+	ExistingDemand *Demand
+	ExistingSupply *Supply
+
+	Organization *Organization
+	// OrganizationAccount is the bank account of our organization set on
+	// shipments and supplies; nil when the organization has no accounts
+	OrganizationAccount *Account
+
+	// Counterparty is the other party: buyer for sales, supplier for
+	// purchases. When NewCounterparty is set it is the payload of the
+	// counterparty to create.
+	Counterparty    *Counterparty
+	NewCounterparty bool
+	// CounterpartyChanges are requisites of existing counterparty that
+	// differ from UPD. CounterpartyUpdate is the payload updating them; it
+	// is applied after the documents are created when UpdateCounterparty
+	// is set.
+	CounterpartyChanges []CounterpartyChange
+	CounterpartyUpdate  *Counterparty
+	UpdateCounterparty  bool
+
+	// CustomerInvoice and CustomerOrder are the sale documents the demand is
+	// linked to; the order is found by number when there is no invoice
+	CustomerInvoice *InvoiceOut
+	CustomerOrder   *CustomerOrder
+	PurchaseOrder   *PurchaseOrder
+	// StoreSource tells where the demand store comes from, see StoreFrom*
+	Store       *Store
+	StoreSource string
+	Rate        *Rate
+	Lines       []PlanLine
+	// StockShortages describe lines exceeding store stock
+	StockShortages []string
+	// Total is the sum of positions. Residual is UPD total payable minus
+	// Total, nonzero when prices or rounding differ from the UPD.
+	Total    decimal.Decimal
+	Residual decimal.Decimal
+	// Attachments are files attached to the created documents: the
+	// original UPD archive and its printable forms
+	Attachments []models.RenderedFile
+	// ProductFolder is the quarantine folder for new products and services.
+	// It has no meta when the folder is created on execution.
+	ProductFolder *ProductFolder
+
+	// Payloads of documents to create. Positions and references to the
+	// created counterparty and base document are filled in on execution.
+	Demand     *Demand
+	FactureOut *FactureOut
+	Supply     *Supply
+	FactureIn  *FactureIn
+
+	// positions are document positions, one per line
+	positions []*Position
+}
+
+// PlanLine describes how an UPD line is mapped to a document position
+type PlanLine struct {
+	Name        string
+	Article     string
+	Assortment  string  // matched product or service name
+	MatchedBy   string  // mapping, match strategy, fuzzy, service or new
+	Confidence  float64 // 1 for exact matches, similarity for fuzzy matches
+	Quantity    float64
+	Price       float64 // in kopecks
+	PriceSource string  // upd or type of the document the price is taken from
+	VAT         int
+	VATEnabled  bool // false for lines without VAT
+	// Stock is the current stock of demand store; Shortage is set when the
+	// line exceeds it
+	Stock    float64
+	Shortage bool
+	// NewProduct or NewService is the payload of missing assortment created
+	// on execution. Lines of the same item share the payload.
+	NewProduct *Product
+	NewService *Service
+	// Candidates are similar assortment items not confident enough to be
+	// matched automatically
+	Candidates []models.MatchCandidate
+}
+
+// AlreadyLoaded reports whether the plan refers to a previously loaded UPD
+func (p *UploadPlan) AlreadyLoaded() bool {
+	return p.ExistingInvoice != nil || p.ExistingFactureIn != nil
+}
+
+// PlanUpload resolves everything needed to load UPD without creating anything
+func (api *API) PlanUpload(updDocument *models.UPDDocument) (*UploadPlan, error) {
+	api.logger.Infof("Planning upload of UPD: %s", updDocument.DocumentID())
+	defer api.persistCache()
+
+	plan := &UploadPlan{
+		UPDDocument:  updDocument,
+		ExternalCode: updDocument.ExternalCode(),
+	}
+	content := updDocument.Content
+
+	// Detect direction by our organization: seller for sales, buyer for
+	// purchases. When both parties are our organizations the UPD is a sale
+	// unless the buyer is the default organization.
+	seller, err := api.findOrganization(content.Seller)
+	if err != nil {
+		return nil, err
+	}
+	buyer, err := api.findOrganization(content.Buyer)
+	if err != nil {
+		return nil, err
+	}
+	var ours, party models.Organization
+	switch {
+	case seller != nil && (buyer == nil || buyer.ID != api.organizationID):
+		plan.Direction, plan.Organization, ours, party = DirectionSale, seller, content.Seller, content.Buyer
+	case buyer != nil:
+		plan.Direction, plan.Organization, ours, party = DirectionPurchase, buyer, content.Buyer, content.Seller
+	default:
+		return nil, &APIError{Message: fmt.Sprintf("Neither supplier INN %s nor buyer INN %s belongs to an organization in MoySkald", content.Seller.INN, content.Buyer.INN)}
+	}
+	api.logger.Infof("UPD direction: %s, organization: %s", plan.Direction, plan.Organization.Name)
+
+	// Check whether the UPD was loaded before. Invoice is created last, so
+	// an existing invoice means the previous upload completed.
+	if err := api.findLoadedDocuments(plan); err != nil {
+		return nil, err
+	}
+	if plan.AlreadyLoaded() {
+		api.logger.Infof("UPD %s already loaded", plan.ExternalCode)
+		return plan, nil
+	}
+
+	plan.OrganizationAccount = api.organizationAccount(plan.Organization, ours)
+
+	// Find counterparty or prepare a new one
+	plan.Counterparty, err = api.findCounterparty(party)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Counterparty == nil {
+		api.logger.Infof("Counterparty with INN %s not found, it will be created", party.INN)
+		plan.Counterparty = api.newCounterpartyPayload(party)
+		plan.NewCounterparty = true
+	} else if api.options.CounterpartyUpdates != CounterpartyUpdatesOff {
+		plan.CounterpartyUpdate, plan.CounterpartyChanges = api.planCounterpartyUpdate(plan.Counterparty, party, content.InvoiceDate)
+		plan.UpdateCounterparty = api.options.CounterpartyUpdates == CounterpartyUpdatesApply
+	}
+
+	// Resolve document currency and exchange rate
+	plan.Rate, err = api.getDocumentRate(&content)
+	if err != nil {
+		return nil, err
+	}
+
+	if plan.Direction == DirectionPurchase {
+		err = api.planPurchase(plan)
+	} else {
+		err = api.planSale(plan)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	api.reconcileTotals(plan)
+	api.planNewAssortment(plan)
+	return plan, nil
+}
+
+// findLoadedDocuments fills documents created by previous uploads of the UPD
+func (api *API) findLoadedDocuments(plan *UploadPlan) error {
+	var err error
+	if plan.Direction == DirectionPurchase {
+		if plan.ExistingSupply, err = findByExternalCode[*Supply](api, "/entity/supply", plan.ExternalCode); err != nil {
+			return err
+		}
+		plan.ExistingFactureIn, err = findByExternalCode[*FactureIn](api, "/entity/facturein", plan.ExternalCode)
+		return err
+	}
+
+	if plan.ExistingDemand, err = findByExternalCode[*Demand](api, "/entity/demand", plan.ExternalCode); err != nil {
+		return err
+	}
+	plan.ExistingInvoice, err = findByExternalCode[*FactureOut](api, "/entity/factureout", plan.ExternalCode)
+	return err
+}
+
+// planSale plans demand and factureout
+func (api *API) planSale(plan *UploadPlan) error {
+	content := plan.UPDDocument.Content
+
+	// Demand is the base document. Positions of the invoice repeat the
+	// positions of the demand.
+	if plan.ExistingDemand != nil {
+		api.logger.Infof("Demand %s already exists, only invoice will be created", plan.ExistingDemand.Name)
+		var priceDocument *Meta
+		if customerInvoice, err := api.findCustomerInvoice(content.RequisiteNumber, nil); err == nil {
+			priceDocument = customerInvoice.Meta
+		}
+
+		var err error
+		plan.positions, plan.Lines, err = api.createPositionsFromUPD(&content, content.Buyer.INN, priceDocument, true)
+		if err != nil {
+			return err
+		}
+	} else if err := api.planDemand(plan); err != nil {
+		return err
+	}
+
+	plan.FactureOut = &FactureOut{
+		Name:         content.InvoiceNumber, // UPD number as is
+		ExternalCode: plan.ExternalCode,
+		Moment:       content.InvoiceDate.Format(momentLayout),
+		Organization: &Organization{Meta: plan.Organization.Meta},
+		Rate:         plan.Rate,
+		VatEnabled:   documentVATEnabled(plan.positions),
+		VatIncluded:  boolPtr(true),
+		Attributes:   api.documentAttributes("factureout", plan.UPDDocument),
+	}
+	return nil
+}
+
+// planPurchase plans supply and facturein. Documents get MoySkald numbering,
+// supplier UPD number is kept as incoming number.
+func (api *API) planPurchase(plan *UploadPlan) error {
+	content := plan.UPDDocument.Content
+
+	if plan.ExistingSupply != nil {
+		api.logger.Infof("Supply %s already exists, only received invoice will be created", plan.ExistingSupply.Name)
+	} else if err := api.planSupply(plan); err != nil {
+		return err
+	}
+
+	plan.FactureIn = &FactureIn{
+		ExternalCode:   plan.ExternalCode,
+		Moment:         content.InvoiceDate.Format(momentLayout),
+		IncomingNumber: content.InvoiceNumber,
+		IncomingDate:   content.InvoiceDate.Format(momentLayout),
+		Organization:   &Organization{Meta: plan.Organization.Meta},
+		Rate:           plan.Rate,
+	}
+	return nil
+}
+
+// ExecutePlan creates documents described by a plan built earlier. The UPD
+// is checked again for being loaded since the plan was built.
+func (api *API) ExecutePlan(plan *UploadPlan) (*UploadResult, error) {
+	api.logger.Infof("Executing upload plan for UPD: %s", plan.UPDDocument.DocumentID())
+	defer api.persistCache()
+
+	if !plan.AlreadyLoaded() {
+		loaded := &UploadPlan{Direction: plan.Direction, ExternalCode: plan.ExternalCode}
+		if err := api.findLoadedDocuments(loaded); err != nil {
+			return nil, err
+		}
+		if loaded.AlreadyLoaded() {
+			api.logger.Infof("UPD %s was loaded after planning", plan.ExternalCode)
+			return api.executePlan(loaded)
+		}
+	}
+
+	return api.executePlan(plan)
+}
+
+// executePlan creates counterparty, base document and invoice of the plan,
+// rolling back created entities if a later step fails
+func (api *API) executePlan(plan *UploadPlan) (*UploadResult, error) {
+	if plan.AlreadyLoaded() {
+		return &UploadResult{
+			Direction:     plan.Direction,
+			FactureOut:    plan.ExistingInvoice,
+			Demand:        plan.ExistingDemand,
+			FactureIn:     plan.ExistingFactureIn,
+			Supply:        plan.ExistingSupply,
+			AlreadyExists: true,
+		}, nil
+	}
+
+	// Entities created below are rolled back if a later step fails
+	tx := api.newSaga()
+
+	counterparty := plan.Counterparty
+	if plan.NewCounterparty {
+		created, err := api.createCounterparty(plan.Counterparty)
+		if err != nil {
+			return nil, err
+		}
+		tx.recordCounterparty(created, plan.Counterparty.INN)
+		counterparty = created
+	}
+
+	positions, createdAssortment, err := api.createNewAssortment(plan, tx)
+	if err != nil {
+		return nil, tx.fail(err)
+	}
+
+	var result *UploadResult
+	if plan.Direction == DirectionPurchase {
+		result, err = api.executePurchase(plan, counterparty, positions, tx)
+	} else {
+		result, err = api.executeSale(plan, counterparty, positions, tx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.CreatedAssortment = createdAssortment
+	result.Residual = plan.Residual
+	result.StockShortages = plan.StockShortages
+
+	// Requisites are updated last: the documents are already created, so a
+	// failed update is reported without rolling them back
+	result.CounterpartyChanges = plan.CounterpartyChanges
+	if plan.UpdateCounterparty && plan.CounterpartyUpdate != nil {
+		if err := api.updateCounterparty(counterparty, plan.CounterpartyUpdate); err != nil {
+			api.logger.Warningf("Failed to update counterparty requisites: %v", err)
+		} else {
+			result.CounterpartyUpdated = true
+		}
+	}
+
+	api.attachUploadFiles(result, plan.Attachments)
+	return result, nil
+}
+
+// executeSale creates demand and factureout
+func (api *API) executeSale(plan *UploadPlan, counterparty *Counterparty, positions []*Position, tx *saga) (*UploadResult, error) {
+	// Step 1: Create demand (shipment) as base document, reusing the demand
+	// left by an interrupted previous upload
+	demand := plan.ExistingDemand
+	if demand == nil {
+		api.logger.Info("Creating demand as base document...")
+		demandData := *plan.Demand
+		demandData.Agent = &Counterparty{Meta: counterparty.Meta}
+		demandData.Positions = &Positions{Rows: positions}
+
+		var err error
+		demand, err = api.createDemand(&demandData)
+		if err != nil {
+			return nil, tx.fail(err)
+		}
+		tx.recordDemand(demand)
+	}
+
+	// Step 2: Create invoice based on demand
+	api.logger.Info("Creating invoice based on demand...")
+	invoiceData := *plan.FactureOut
+	invoiceData.Agent = &Counterparty{Meta: counterparty.Meta}
+	invoiceData.Demands = []*Demand{{Meta: demand.Meta}}
+	invoiceData.Positions = &Positions{Rows: positions}
+
+	invoice, err := api.createFactureOut(&invoiceData)
+	if err != nil {
+		return nil, tx.fail(err)
+	}
+
+	return &UploadResult{
+		Direction:  DirectionSale,
+		FactureOut: invoice,
+		Demand:     demand,
+	}, nil
+}
+
+// executePurchase creates supply and facturein
+func (api *API) executePurchase(plan *UploadPlan, counterparty *Counterparty, positions []*Position, tx *saga) (*UploadResult, error) {
+	// Step 1: Create supply as base document, reusing the supply left by an
+	// interrupted previous upload
+	supply := plan.ExistingSupply
+	if supply == nil {
+		api.logger.Info("Creating supply as base document...")
+		supplyData := *plan.Supply
+		supplyData.Agent = &Counterparty{Meta: counterparty.Meta}
+		supplyData.Positions = &Positions{Rows: positions}
+
+		var err error
+		supply, err = api.createSupply(&supplyData)
+		if err != nil {
+			return nil, tx.fail(err)
+		}
+		tx.recordSupply(supply)
+	}
+
+	// Step 2: Create received invoice based on supply
+	api.logger.Info("Creating received invoice based on supply...")
+	invoiceData := *plan.FactureIn
+	invoiceData.Agent = &Counterparty{Meta: counterparty.Meta}
+	invoiceData.Supplies = []*Supply{{Meta: supply.Meta}}
+
+	invoice, err := api.createFactureIn(&invoiceData)
+	if err != nil {
+		return nil, tx.fail(err)
+	}
+
+	return &UploadResult{
+		Direction: DirectionPurchase,
+		FactureIn: invoice,
+		Supply:    supply,
+	}, nil
+}
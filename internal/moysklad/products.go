@@ -0,0 +1,253 @@
+package moysklad
+
+import (
+	"fmt"
+	"strings"
+
+	"upd-loader-go/internal/models"
+)
+
+// newAssortment is a product or service to create for UPD lines of the same item
+type newAssortment struct {
+	product *Product
+	service *Service
+}
+
+// newAssortmentPayload builds product or service to create for UPD line
+// without matching assortment. Prices are set by planNewAssortment.
+func (api *API) newAssortmentPayload(item *models.InvoiceItem, vat VAT) (*Product, *Service) {
+	uom := api.findUOMByCode(item.UnitCode)
+
+	if item.IsService() {
+		service := &Service{
+			Name:       item.Name,
+			VAT:        assortmentVAT(vat),
+			VatEnabled: boolPtr(vat.Enabled),
+		}
+		if uom != nil {
+			service.UOM = &UOM{Meta: uom.Meta}
+		}
+		return nil, service
+	}
+
+	product := &Product{
+		Name:       item.Name,
+		Article:    item.Article,
+		VAT:        assortmentVAT(vat),
+		VatEnabled: boolPtr(vat.Enabled),
+	}
+	if uom != nil {
+		product.UOM = &UOM{Meta: uom.Meta}
+	}
+	if country := api.findCountry(item.CountryCode, item.CountryName); country != nil {
+		product.Country = &Country{Meta: country.Meta}
+	}
+	return product, nil
+}
+
+// assortmentVAT returns VAT rate of product or service to create. The rate
+// is sent even when it is 0%, otherwise MoySkald applies the default rate;
+// products without VAT have no rate.
+func assortmentVAT(vat VAT) *int {
+	if !vat.Enabled {
+		return nil
+	}
+	return intPtr(vat.Rate)
+}
+
+// planNewAssortment sets UPD prices of products and services to create: sale
+// price for sales and buy price for purchases. In quarantine mode it also
+// resolves the quarantine folder.
+func (api *API) planNewAssortment(plan *UploadPlan) {
+	var priceType *PriceType
+	hasNew := false
+
+	for _, line := range plan.Lines {
+		if line.NewProduct == nil && line.NewService == nil {
+			continue
+		}
+		hasNew = true
+
+		var buyPrice *Price
+		var salePrices []*SalePrice
+		if plan.Direction == DirectionPurchase {
+			buyPrice = &Price{Value: line.Price}
+		} else {
+			if priceType == nil {
+				priceType = api.getDefaultPriceType()
+			}
+			if priceType != nil {
+				salePrices = []*SalePrice{{Value: line.Price, PriceType: &PriceType{Meta: priceType.Meta}}}
+			}
+		}
+
+		if line.NewProduct != nil {
+			line.NewProduct.BuyPrice, line.NewProduct.SalePrices = buyPrice, salePrices
+		} else {
+			line.NewService.BuyPrice, line.NewService.SalePrices = buyPrice, salePrices
+		}
+	}
+
+	if hasNew && api.options.MissingProducts == MissingProductsQuarantine {
+		plan.ProductFolder = api.findProductFolder(api.options.QuarantineFolder)
+		if plan.ProductFolder == nil {
+			plan.ProductFolder = &ProductFolder{Name: api.options.QuarantineFolder}
+		}
+	}
+}
+
+// createNewAssortment creates products and services planned for lines
+// without matching assortment and returns document positions referencing
+// them, one per plan line, along with names of created items
+func (api *API) createNewAssortment(plan *UploadPlan, tx *saga) ([]*Position, []string, error) {
+	positions := make([]*Position, len(plan.positions))
+	var created []string
+
+	folder := plan.ProductFolder
+	createdMeta := make(map[interface{}]*Meta)
+
+	for i, planned := range plan.positions {
+		position := *planned
+		positions[i] = &position
+
+		line := plan.Lines[i]
+		var payload interface{}
+		switch {
+		case line.NewProduct != nil:
+			payload = line.NewProduct
+		case line.NewService != nil:
+			payload = line.NewService
+		default:
+			continue
+		}
+
+		// Lines of the same item share the payload and the created entity
+		if meta, ok := createdMeta[payload]; ok {
+			position.Assortment = &Assortment{Meta: meta}
+			continue
+		}
+
+		// Create quarantine folder on first use
+		if folder != nil && folder.Meta == nil {
+			newFolder, err := createEntity(api, "/entity/productfolder", "product folder", &ProductFolder{Name: folder.Name})
+			if err != nil {
+				return nil, nil, err
+			}
+			tx.recordEntity("product folder "+newFolder.Name, "/entity/productfolder", newFolder.ID)
+			folder = newFolder
+		}
+		var folderRef *ProductFolder
+		if folder != nil {
+			folderRef = &ProductFolder{Meta: folder.Meta}
+		}
+
+		var meta *Meta
+		if line.NewProduct != nil {
+			productData := *line.NewProduct
+			productData.ProductFolder = folderRef
+			product, err := createEntity(api, "/entity/product", "product", &productData)
+			if err != nil {
+				return nil, nil, err
+			}
+			tx.recordEntity("product "+product.Name, "/entity/product", product.ID)
+			meta = product.Meta
+			created = append(created, describeNewItem("product", product.Name, product.Article))
+		} else {
+			serviceData := *line.NewService
+			serviceData.ProductFolder = folderRef
+			service, err := createEntity(api, "/entity/service", "service", &serviceData)
+			if err != nil {
+				return nil, nil, err
+			}
+			tx.recordEntity("service "+service.Name, "/entity/service", service.ID)
+			meta = service.Meta
+			created = append(created, describeNewItem("service", service.Name, ""))
+		}
+
+		createdMeta[payload] = meta
+		position.Assortment = &Assortment{Meta: meta}
+	}
+
+	if len(created) > 0 {
+		api.cache.invalidateKind(cacheProduct)
+		api.cache.invalidateKind(cacheService)
+	}
+	return positions, created, nil
+}
+
+// describeNewItem formats created item for the upload result
+func describeNewItem(kind, name, article string) string {
+	if article != "" {
+		return fmt.Sprintf("%s %s (article %s)", kind, name, article)
+	}
+	return fmt.Sprintf("%s %s", kind, name)
+}
+
+// findUOMByCode finds unit of measure by OKEI code. Returns nil when not found.
+func (api *API) findUOMByCode(code string) *UOM {
+	if code == "" {
+		return nil
+	}
+
+	var cached UOM
+	if api.cache.get(cacheUOM, "code:"+code, &cached) {
+		return &cached
+	}
+
+	page, err := getPage[*UOM](api, "/entity/uom", map[string]string{"filter": "code=" + code, "limit": "1"})
+	if err != nil || len(page.Rows) == 0 || page.Rows[0] == nil {
+		api.logger.Warningf("Unit of measure with code %s not found", code)
+		return nil
+	}
+
+	api.cache.set(cacheUOM, "code:"+code, page.Rows[0])
+	return page.Rows[0]
+}
+
+// findCountry finds country by OKSM code or short name. Returns nil when not found.
+func (api *API) findCountry(code, name string) *Country {
+	filter := ""
+	switch {
+	case code != "":
+		filter = "code=" + code
+	case name != "" && name != "-":
+		filter = "name=" + name
+	default:
+		return nil
+	}
+
+	var cached Country
+	if api.cache.get(cacheCountry, filter, &cached) {
+		return &cached
+	}
+
+	page, err := getPage[*Country](api, "/entity/country", map[string]string{"filter": filter, "limit": "1"})
+	if err != nil || len(page.Rows) == 0 || page.Rows[0] == nil {
+		api.logger.Warningf("Country %s not found", strings.TrimPrefix(strings.TrimPrefix(filter, "code="), "name="))
+		return nil
+	}
+
+	api.cache.set(cacheCountry, filter, page.Rows[0])
+	return page.Rows[0]
+}
+
+// getDefaultPriceType returns default sale price type. Returns nil when it
+// cannot be loaded.
+func (api *API) getDefaultPriceType() *PriceType {
+	var priceType PriceType
+	if err := api.getEntity(cachePriceType, api.baseURL+"/context/companysettings/pricetype/default", &priceType); err != nil {
+		api.logger.Warnf("Failed to load default price type, new products will have no sale price: %v", err)
+		return nil
+	}
+	return &priceType
+}
+
+// findProductFolder finds product folder by name. Returns nil when not found.
+func (api *API) findProductFolder(name string) *ProductFolder {
+	page, err := getPage[*ProductFolder](api, "/entity/productfolder", map[string]string{"filter": "name=" + name, "limit": "1"})
+	if err != nil || len(page.Rows) == 0 || page.Rows[0] == nil {
+		api.logger.Infof("Product folder %s not found, it will be created", name)
+		return nil
+	}
+	return page.Rows[0]
+}
@@ -0,0 +1,58 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestNewAssortmentPayloadVAT(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}, fastLimits())
+
+	tests := []struct {
+		name    string
+		item    models.InvoiceItem
+		vatRate string
+		want    []string
+		notWant []string
+	}{
+		{"product 0%", models.InvoiceItem{Name: "Труба экспортная"}, "0%", []string{`"vat":0`, `"vatEnabled":true`}, nil},
+		{"product 20%", models.InvoiceItem{Name: "Труба"}, "20%", []string{`"vat":20`, `"vatEnabled":true`}, nil},
+		{"product without VAT", models.InvoiceItem{Name: "Труба"}, "без НДС", []string{`"vatEnabled":false`}, []string{`"vat":`}},
+		{"service 0%", models.InvoiceItem{Name: "Доставка", Kind: "3"}, "0%", []string{`"vat":0`, `"vatEnabled":true`}, nil},
+	}
+
+	for _, tt := range tests {
+		vat, ok := parseVAT(tt.vatRate)
+		if !ok {
+			t.Fatalf("%s: parseVAT(%q) failed", tt.name, tt.vatRate)
+		}
+
+		var payload interface{}
+		if product, service := api.newAssortmentPayload(&tt.item, vat); product != nil {
+			payload = product
+		} else {
+			payload = service
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range tt.want {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("%s: payload %s has no %s", tt.name, data, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(data), notWant) {
+				t.Errorf("%s: payload %s has %s", tt.name, data, notWant)
+			}
+		}
+	}
+}
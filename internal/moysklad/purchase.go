@@ -0,0 +1,142 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// planSupply resolves purchase order, store and positions for the supply
+// and fills them into the plan
+func (api *API) planSupply(plan *UploadPlan) error {
+	content := plan.UPDDocument.Content
+
+	// Purchase order is optional: the supply is linked to it when found
+	purchaseOrder := api.findPurchaseOrder(content.RequisiteNumber, plan.Counterparty)
+	plan.PurchaseOrder = purchaseOrder
+
+	store, source, err := api.resolveSupplyStore(plan)
+	if err != nil {
+		return err
+	}
+	api.logger.Infof("Final store for supply: %s (ID: %s, from %s)", store.Name, store.ID, source)
+
+	// Incoming positions are priced as the supplier invoiced them, the
+	// purchase order price is used only for lines without amount
+	var priceDocument *Meta
+	if purchaseOrder != nil {
+		priceDocument = purchaseOrder.Meta
+	}
+	positions, lines, err := api.createPositionsFromUPD(&content, content.Seller.INN, priceDocument, false)
+	if err != nil {
+		return err
+	}
+
+	plan.Store = store
+	plan.StoreSource = source
+	plan.Lines = lines
+	plan.positions = positions
+	plan.Supply = &Supply{
+		ExternalCode:   plan.ExternalCode,
+		Moment:         content.InvoiceDate.Format(momentLayout),
+		IncomingNumber: content.InvoiceNumber,
+		IncomingDate:   content.InvoiceDate.Format(momentLayout),
+		Organization:   &Organization{Meta: plan.Organization.Meta},
+		Store:          &Store{Meta: store.Meta},
+		Rate:           plan.Rate,
+		VatEnabled:     documentVATEnabled(positions),
+		VatIncluded:    boolPtr(true),
+
+		OrganizationAccount: accountRef(plan.OrganizationAccount),
+	}
+	if purchaseOrder != nil {
+		plan.Supply.PurchaseOrder = &PurchaseOrder{Meta: purchaseOrder.Meta}
+	}
+	return nil
+}
+
+// findPurchaseOrder finds order to supplier by number from UPD requisites.
+// Returns nil when there is no matching order.
+func (api *API) findPurchaseOrder(requisiteNumber string, supplier *Counterparty) *PurchaseOrder {
+	if requisiteNumber == "" {
+		api.logger.Debug("Requisite number not found, supply will not be linked to purchase order")
+		return nil
+	}
+
+	filter := "name=" + requisiteNumber
+	if supplier != nil && supplier.Meta != nil {
+		filter += ";agent=" + supplier.Meta.Href
+	}
+
+	page, err := getPage[*PurchaseOrder](api, "/entity/purchaseorder", map[string]string{"filter": filter, "limit": "1"})
+	if err != nil {
+		api.logger.Warningf("Error searching purchase order %s: %v", requisiteNumber, err)
+		return nil
+	}
+	if len(page.Rows) == 0 || page.Rows[0] == nil || page.Rows[0].Meta == nil {
+		api.logger.Infof("Purchase order with number %s not found", requisiteNumber)
+		return nil
+	}
+
+	purchaseOrder := page.Rows[0]
+	api.logger.Infof("Found purchase order: %s", purchaseOrder.Name)
+	return purchaseOrder
+}
+
+// createSupply creates supply (приемка) document
+func (api *API) createSupply(supplyData *Supply) (*Supply, error) {
+	resp, err := api.makeRequest("POST", "/entity/supply", supplyData, nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error creating supply: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		var result Supply
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, &APIError{Message: fmt.Sprintf("Failed to decode supply response: %v", err)}
+		}
+
+		api.logger.Infof("Supply successfully created: %s", result.ID)
+		return &result, nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	errorMsg := fmt.Sprintf("Error creating supply: %d - %s", resp.StatusCode, string(body))
+	api.logger.Error(errorMsg)
+	return nil, &APIError{Message: errorMsg}
+}
+
+// createFactureIn creates received invoice (счет-фактура полученный) document
+func (api *API) createFactureIn(invoiceData *FactureIn) (*FactureIn, error) {
+	resp, err := api.makeRequest("POST", "/entity/facturein", invoiceData, nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error creating received invoice: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		var result FactureIn
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, &APIError{Message: fmt.Sprintf("Failed to decode received invoice response: %v", err)}
+		}
+
+		api.logger.Infof("Received invoice successfully created: %s", result.ID)
+		return &result, nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	errorMsg := fmt.Sprintf("Error creating received invoice: %d - %s", resp.StatusCode, string(body))
+	api.logger.Error(errorMsg)
+	return nil, &APIError{Message: errorMsg}
+}
+
+// GetSupplyURL returns supply URL in MoySkald web interface
+func (api *API) GetSupplyURL(supplyID string) string {
+	return fmt.Sprintf("https://online.moysklad.ru/app/#supply/edit?id=%s", supplyID)
+}
+
+// GetFactureInURL returns received invoice URL in MoySkald web interface
+func (api *API) GetFactureInURL(invoiceID string) string {
+	return fmt.Sprintf("https://online.moysklad.ru/app/#facturein/edit?id=%s", invoiceID)
+}
@@ -0,0 +1,159 @@
+package moysklad
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits configures client-side request limiting and retries.
+// MoySkald allows 45 requests per 3 seconds and 5 parallel requests per user.
+type Limits struct {
+	RequestsPerSecond float64
+	Burst             int
+	MaxConcurrent     int
+	MaxRetries        int
+	BaseBackoff       time.Duration
+	MaxBackoff        time.Duration
+}
+
+// DefaultLimits returns limits matching MoySkald API quotas
+func DefaultLimits() Limits {
+	return Limits{
+		RequestsPerSecond: 15,
+		Burst:             5,
+		MaxConcurrent:     5,
+		MaxRetries:        3,
+		BaseBackoff:       500 * time.Millisecond,
+		MaxBackoff:        10 * time.Second,
+	}
+}
+
+// withDefaults fills zero values from DefaultLimits
+func (l Limits) withDefaults() Limits {
+	defaults := DefaultLimits()
+	if l.RequestsPerSecond <= 0 {
+		l.RequestsPerSecond = defaults.RequestsPerSecond
+	}
+	if l.Burst <= 0 {
+		l.Burst = defaults.Burst
+	}
+	if l.MaxConcurrent <= 0 {
+		l.MaxConcurrent = defaults.MaxConcurrent
+	}
+	if l.MaxRetries < 0 {
+		l.MaxRetries = 0
+	}
+	if l.BaseBackoff <= 0 {
+		l.BaseBackoff = defaults.BaseBackoff
+	}
+	if l.MaxBackoff <= 0 {
+		l.MaxBackoff = defaults.MaxBackoff
+	}
+	return l
+}
+
+// rateLimiter is a token bucket shared by all requests of the client.
+// A 429 response pauses the whole bucket until the server allows retrying.
+type rateLimiter struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+	pauseUntil time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available
+func (l *rateLimiter) wait() {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+
+		if now.Before(l.pauseUntil) {
+			delay := l.pauseUntil.Sub(now)
+			l.mu.Unlock()
+			time.Sleep(delay)
+			continue
+		}
+
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return
+		}
+
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// pause stops issuing tokens until the given time
+func (l *rateLimiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until.After(l.pauseUntil) {
+		l.pauseUntil = until
+	}
+	l.tokens = 0
+}
+
+// isRetryableStatus reports whether response status may be retried
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// canRetry applies retry rules: idempotent methods are retried on network
+// errors, 429 and 5xx. POST is retried only on 429, which MoySkald returns
+// before processing the request, so a retry cannot create a duplicate.
+func canRetry(method string, resp *http.Response, err error) bool {
+	idempotent := method != http.MethodPost && method != http.MethodPatch
+
+	if err != nil {
+		return idempotent
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent && isRetryableStatus(resp.StatusCode)
+}
+
+// retryDelay returns delay before the next attempt. Server headers take
+// precedence over exponential backoff.
+func (l Limits) retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		// X-Lognex-Retry-After is in milliseconds
+		if value := resp.Header.Get("X-Lognex-Retry-After"); value != "" {
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				return time.Duration(ms) * time.Millisecond
+			}
+		}
+		if value := resp.Header.Get("Retry-After"); value != "" {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	delay := l.BaseBackoff << attempt
+	if delay <= 0 || delay > l.MaxBackoff {
+		delay = l.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,190 @@
+package moysklad
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestAPI creates a client of a local fake server without cache
+func newTestAPI(t *testing.T, handler http.HandlerFunc, limits Limits) *API {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewAPI(server.URL, "token", "", limits, CacheOptions{}, UploadOptions{}, logger)
+}
+
+// fastLimits are limits that do not slow tests down unless overridden
+func fastLimits() Limits {
+	return Limits{
+		RequestsPerSecond: 1000,
+		Burst:             100,
+		MaxConcurrent:     5,
+		MaxRetries:        3,
+		BaseBackoff:       time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+	}
+}
+
+func request(t *testing.T, api *API, method string) *http.Response {
+	t.Helper()
+	resp, err := api.makeRequest(method, "/entity/demand", nil, nil)
+	if err != nil {
+		t.Fatalf("%s request failed: %v", method, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRateLimiterRate(t *testing.T) {
+	limiter := newRateLimiter(20, 1)
+
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		limiter.wait()
+	}
+	elapsed := time.Since(start)
+
+	// The first token is in the bucket, 10 more take 50ms each
+	if elapsed < 450*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("11 tokens at 20/s with burst 1 took %v, want about 500ms", elapsed)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := newRateLimiter(1, 5)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.wait()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("burst of 5 tokens took %v, want no wait", elapsed)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		inFlight.Add(-1)
+	}
+
+	limits := fastLimits()
+	limits.MaxConcurrent = 2
+	api := newTestAPI(t, handler, limits)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := api.makeRequest(http.MethodGet, "/entity/demand", nil, nil)
+			if err != nil {
+				t.Errorf("GET request failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got != 2 {
+		t.Errorf("max parallel requests = %d, want 2", got)
+	}
+}
+
+func TestRetryAfterOn429(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("X-Lognex-Retry-After", "200")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}
+	api := newTestAPI(t, handler, fastLimits())
+
+	start := time.Now()
+	resp := request(t, api, http.MethodPost)
+	elapsed := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("calls = %d, want 2: POST is retried on 429", calls.Load())
+	}
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("retry after %v, want at least X-Lognex-Retry-After 200ms", elapsed)
+	}
+}
+
+func TestGetRetriedOn5xx(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	api := newTestAPI(t, handler, fastLimits())
+
+	resp := request(t, api, http.MethodGet)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3", calls.Load())
+	}
+}
+
+func TestPostNotRetriedOn5xx(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	api := newTestAPI(t, handler, fastLimits())
+
+	resp := request(t, api, http.MethodPost)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("calls = %d, want 1: POST may have been processed", calls.Load())
+	}
+}
+
+func TestGiveUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	limits := fastLimits()
+	limits.MaxRetries = 2
+	api := newTestAPI(t, handler, limits)
+
+	resp := request(t, api, http.MethodGet)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("calls = %d, want 3: the first attempt and 2 retries", calls.Load())
+	}
+}
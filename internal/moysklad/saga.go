@@ -0,0 +1,190 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// RollbackReport describes compensation of entities created by a failed upload
+type RollbackReport struct {
+	RolledBack []string
+	Failed     []string
+}
+
+// UploadError is returned when upload fails after some entities were
+// created. Rollback holds the result of their compensation.
+type UploadError struct {
+	Err      error
+	Rollback *RollbackReport
+}
+
+func (e *UploadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// sagaStep is a created entity and the action compensating its creation
+type sagaStep struct {
+	description string
+	compensate  func() (string, error)
+}
+
+// saga records entities created during a multi-step upload and compensates
+// them in reverse order when a later step fails
+type saga struct {
+	api   *API
+	steps []sagaStep
+}
+
+func (api *API) newSaga() *saga {
+	return &saga{api: api}
+}
+
+// record registers created entity. compensate returns a description of what
+// was done, e.g. deleted or only unposted.
+func (s *saga) record(description string, compensate func() (string, error)) {
+	s.steps = append(s.steps, sagaStep{description: description, compensate: compensate})
+}
+
+// fail rolls back recorded steps and wraps err with the rollback report.
+// Errors are returned unchanged when nothing was created.
+func (s *saga) fail(err error) error {
+	if len(s.steps) == 0 {
+		return err
+	}
+	return &UploadError{Err: err, Rollback: s.rollback()}
+}
+
+// rollback compensates recorded steps in reverse order. Every step is
+// attempted even if previous compensations failed.
+func (s *saga) rollback() *RollbackReport {
+	report := &RollbackReport{}
+
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		s.api.logger.Warnf("Rolling back %s", step.description)
+
+		result, err := step.compensate()
+		if err != nil {
+			s.api.logger.Errorf("Failed to roll back %s: %v", step.description, err)
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", step.description, err))
+			continue
+		}
+		report.RolledBack = append(report.RolledBack, fmt.Sprintf("%s: %s", step.description, result))
+	}
+
+	s.steps = nil
+	return report
+}
+
+// recordCounterparty registers created counterparty for deletion
+func (s *saga) recordCounterparty(counterparty *Counterparty, inn string) {
+	s.record(fmt.Sprintf("counterparty %s", counterparty.Name), func() (string, error) {
+		if err := s.api.deleteEntity("/entity/counterparty", counterparty.ID); err != nil {
+			return "", err
+		}
+		s.api.cache.invalidate(cacheCounterparty, inn)
+		return "deleted", nil
+	})
+}
+
+// recordEntity registers created entity for deletion
+func (s *saga) recordEntity(description, endpoint, id string) {
+	s.record(description, func() (string, error) {
+		if err := s.api.deleteEntity(endpoint, id); err != nil {
+			return "", err
+		}
+		return "deleted", nil
+	})
+}
+
+// recordDemand registers created demand for deletion. If the demand cannot be
+// deleted it is unposted so that stock written off by it is returned.
+func (s *saga) recordDemand(demand *Demand) {
+	s.record(fmt.Sprintf("demand %s", demand.Name), func() (string, error) {
+		deleteErr := s.api.deleteEntity("/entity/demand", demand.ID)
+		if deleteErr == nil {
+			return "deleted", nil
+		}
+
+		s.api.logger.Warnf("Failed to delete demand %s, unposting it: %v", demand.Name, deleteErr)
+		if err := s.api.updateEntity("/entity/demand", demand.ID, &Demand{Applicable: boolPtr(false)}); err != nil {
+			return "", fmt.Errorf("%v; unposting failed: %v", deleteErr, err)
+		}
+		return "unposted, delete it manually", nil
+	})
+}
+
+// recordSupply registers created supply for deletion. If the supply cannot be
+// deleted it is unposted so that received stock is cancelled.
+func (s *saga) recordSupply(supply *Supply) {
+	s.record(fmt.Sprintf("supply %s", supply.Name), func() (string, error) {
+		deleteErr := s.api.deleteEntity("/entity/supply", supply.ID)
+		if deleteErr == nil {
+			return "deleted", nil
+		}
+
+		s.api.logger.Warnf("Failed to delete supply %s, unposting it: %v", supply.Name, deleteErr)
+		if err := s.api.updateEntity("/entity/supply", supply.ID, &Supply{Applicable: boolPtr(false)}); err != nil {
+			return "", fmt.Errorf("%v; unposting failed: %v", deleteErr, err)
+		}
+		return "unposted, delete it manually", nil
+	})
+}
+
+// createEntity creates entity and returns it as stored by MoySkald
+func createEntity[T any](api *API, endpoint, title string, data *T) (*T, error) {
+	resp, err := api.makeRequest("POST", endpoint, data, nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Network error creating %s: %v", title, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		errorMsg := fmt.Sprintf("Error creating %s: %d - %s", title, resp.StatusCode, string(body))
+		api.logger.Error(errorMsg)
+		return nil, &APIError{Message: errorMsg}
+	}
+
+	var result T
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Failed to decode %s response: %v", title, err)}
+	}
+	api.logger.Infof("Created %s", title)
+	return &result, nil
+}
+
+// deleteEntity deletes entity by ID
+func (api *API) deleteEntity(endpoint, id string) error {
+	resp, err := api.makeRequest("DELETE", endpoint+"/"+id, nil, nil)
+	if err != nil {
+		return &APIError{Message: fmt.Sprintf("Network error deleting %s/%s: %v", endpoint, id, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{Message: fmt.Sprintf("Error deleting %s/%s: %d - %s", endpoint, id, resp.StatusCode, string(body))}
+	}
+	return nil
+}
+
+// updateEntity updates entity fields by ID
+func (api *API) updateEntity(endpoint, id string, data interface{}) error {
+	resp, err := api.makeRequest("PUT", endpoint+"/"+id, data, nil)
+	if err != nil {
+		return &APIError{Message: fmt.Sprintf("Network error updating %s/%s: %v", endpoint, id, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{Message: fmt.Sprintf("Error updating %s/%s: %d - %s", endpoint, id, resp.StatusCode, string(body))}
+	}
+	return nil
+}
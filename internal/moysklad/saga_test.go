@@ -0,0 +1,270 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sagaServer is a fake MoySkald creating entities and failing requests
+// listed in fail, e.g. "POST /entity/factureout" or "DELETE /entity/demand/demand-1"
+type sagaServer struct {
+	t        *testing.T
+	fail     map[string]bool
+	mu       sync.Mutex
+	requests []string
+	// unposted holds IDs of documents updated with applicable=false
+	unposted []string
+	// onCreate is called after an entity of the kind is created
+	onCreate func(kind string)
+}
+
+func (s *sagaServer) handler(w http.ResponseWriter, r *http.Request) {
+	request := r.Method + " " + r.URL.Path
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.mu.Unlock()
+
+	if s.fail[request] {
+		http.Error(w, `{"errors":[{"error":"fail"}]}`, http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/entity/"), "/")
+	kind := parts[0]
+	switch r.Method {
+	case "POST":
+		var entity map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&entity); err != nil {
+			s.t.Errorf("%s: %v", request, err)
+		}
+		id := kind + "-1"
+		entity["id"] = id
+		entity["meta"] = Meta{Href: "https://api/entity/" + kind + "/" + id, Type: kind}
+		if s.onCreate != nil {
+			s.onCreate(kind)
+		}
+		json.NewEncoder(w).Encode(entity)
+	case "PUT":
+		var update struct {
+			Applicable *bool `json:"applicable"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			s.t.Errorf("%s: %v", request, err)
+		}
+		if update.Applicable != nil && !*update.Applicable {
+			s.mu.Lock()
+			s.unposted = append(s.unposted, parts[1])
+			s.mu.Unlock()
+		}
+		w.Write([]byte(`{}`))
+	case "DELETE":
+		w.Write([]byte(`{}`))
+	default:
+		s.t.Errorf("unexpected request %s", request)
+	}
+}
+
+// rollbackRequests returns DELETE and PUT requests made by the rollback
+func (s *sagaServer) rollbackRequests() []string {
+	var requests []string
+	for _, request := range s.requests {
+		if strings.HasPrefix(request, "DELETE ") || strings.HasPrefix(request, "PUT ") {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// sagaPlan is a plan creating counterparty, a product and the documents
+func sagaPlan(direction string) *UploadPlan {
+	plan := &UploadPlan{
+		Direction:       direction,
+		ExternalCode:    "upd-1",
+		Counterparty:    &Counterparty{Name: "ООО \"Покупатель\"", INN: "7701234567"},
+		NewCounterparty: true,
+		Lines:           []PlanLine{{Name: "Труба 100x2.5", NewProduct: &Product{Name: "Труба 100x2.5"}}},
+		positions:       []*Position{{Quantity: 1, Price: 10000}},
+	}
+	if direction == DirectionPurchase {
+		plan.Supply = &Supply{Name: "1"}
+		plan.FactureIn = &FactureIn{Name: "1"}
+	} else {
+		plan.Demand = &Demand{Name: "О1"}
+		plan.FactureOut = &FactureOut{Name: "1"}
+	}
+	return plan
+}
+
+func TestSagaRollback(t *testing.T) {
+	tests := []struct {
+		name           string
+		direction      string
+		fail           []string
+		wantRequests   []string
+		wantRolledBack []string
+		wantFailed     []string
+		wantUnposted   []string
+	}{
+		{
+			name:      "reverse order",
+			direction: DirectionSale,
+			fail:      []string{"POST /entity/factureout"},
+			wantRequests: []string{
+				"DELETE /entity/demand/demand-1",
+				"DELETE /entity/product/product-1",
+				"DELETE /entity/counterparty/counterparty-1",
+			},
+			wantRolledBack: []string{
+				"demand О1: deleted",
+				"product Труба 100x2.5: deleted",
+				"counterparty ООО \"Покупатель\": deleted",
+			},
+		},
+		{
+			name:      "failed compensation",
+			direction: DirectionSale,
+			fail:      []string{"POST /entity/factureout", "DELETE /entity/product/product-1"},
+			wantRequests: []string{
+				"DELETE /entity/demand/demand-1",
+				"DELETE /entity/product/product-1",
+				"DELETE /entity/counterparty/counterparty-1",
+			},
+			wantRolledBack: []string{
+				"demand О1: deleted",
+				"counterparty ООО \"Покупатель\": deleted",
+			},
+			wantFailed: []string{"product Труба 100x2.5: Error deleting /entity/product/product-1: 400"},
+		},
+		{
+			name:      "demand unposted",
+			direction: DirectionSale,
+			fail:      []string{"POST /entity/factureout", "DELETE /entity/demand/demand-1"},
+			wantRequests: []string{
+				"DELETE /entity/demand/demand-1",
+				"PUT /entity/demand/demand-1",
+				"DELETE /entity/product/product-1",
+				"DELETE /entity/counterparty/counterparty-1",
+			},
+			wantRolledBack: []string{
+				"demand О1: unposted, delete it manually",
+				"product Труба 100x2.5: deleted",
+				"counterparty ООО \"Покупатель\": deleted",
+			},
+			wantUnposted: []string{"demand-1"},
+		},
+		{
+			name:      "demand neither deleted nor unposted",
+			direction: DirectionSale,
+			fail:      []string{"POST /entity/factureout", "DELETE /entity/demand/demand-1", "PUT /entity/demand/demand-1"},
+			wantRequests: []string{
+				"DELETE /entity/demand/demand-1",
+				"PUT /entity/demand/demand-1",
+				"DELETE /entity/product/product-1",
+				"DELETE /entity/counterparty/counterparty-1",
+			},
+			wantRolledBack: []string{
+				"product Труба 100x2.5: deleted",
+				"counterparty ООО \"Покупатель\": deleted",
+			},
+			wantFailed: []string{"demand О1: Error deleting /entity/demand/demand-1: 400"},
+		},
+		{
+			name:      "supply unposted",
+			direction: DirectionPurchase,
+			fail:      []string{"POST /entity/facturein", "DELETE /entity/supply/supply-1"},
+			wantRequests: []string{
+				"DELETE /entity/supply/supply-1",
+				"PUT /entity/supply/supply-1",
+				"DELETE /entity/product/product-1",
+				"DELETE /entity/counterparty/counterparty-1",
+			},
+			wantRolledBack: []string{
+				"supply 1: unposted, delete it manually",
+				"product Труба 100x2.5: deleted",
+				"counterparty ООО \"Покупатель\": deleted",
+			},
+			wantUnposted: []string{"supply-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &sagaServer{t: t, fail: make(map[string]bool)}
+			for _, request := range tt.fail {
+				server.fail[request] = true
+			}
+			api := newTestAPI(t, server.handler, fastLimits())
+
+			result, err := api.executePlan(sagaPlan(tt.direction))
+			if result != nil || err == nil {
+				t.Fatalf("executePlan = %v, %v, want error", result, err)
+			}
+			var uploadErr *UploadError
+			if !errors.As(err, &uploadErr) {
+				t.Fatalf("error %v is not UploadError", err)
+			}
+
+			if got := server.rollbackRequests(); !reflect.DeepEqual(got, tt.wantRequests) {
+				t.Errorf("rollback requests %q, want %q", got, tt.wantRequests)
+			}
+			if got := uploadErr.Rollback.RolledBack; !reflect.DeepEqual(got, tt.wantRolledBack) {
+				t.Errorf("rolled back %q, want %q", got, tt.wantRolledBack)
+			}
+			if len(uploadErr.Rollback.Failed) != len(tt.wantFailed) {
+				t.Fatalf("failed %q, want %q", uploadErr.Rollback.Failed, tt.wantFailed)
+			}
+			for i, want := range tt.wantFailed {
+				if !strings.HasPrefix(uploadErr.Rollback.Failed[i], want) {
+					t.Errorf("failed[%d] = %q, want prefix %q", i, uploadErr.Rollback.Failed[i], want)
+				}
+			}
+			if !reflect.DeepEqual(server.unposted, tt.wantUnposted) {
+				t.Errorf("unposted %q, want %q", server.unposted, tt.wantUnposted)
+			}
+		})
+	}
+}
+
+func TestSagaRollbackInvalidatesCounterparty(t *testing.T) {
+	const inn = "7701234567"
+	server := &sagaServer{t: t, fail: map[string]bool{"POST /entity/factureout": true}}
+	api := newTestAPI(t, server.handler, fastLimits())
+	api.cache = newReferenceCache(CacheOptions{TTL: time.Hour})
+
+	// Another upload finds the created counterparty while the demand is
+	// being created
+	server.onCreate = func(kind string) {
+		if kind == "demand" {
+			api.cache.set(cacheCounterparty, inn, []*Counterparty{{ID: "counterparty-1", INN: inn}})
+		}
+	}
+
+	if _, err := api.executePlan(sagaPlan(DirectionSale)); err == nil {
+		t.Fatal("executePlan succeeded, want error")
+	}
+
+	var cached []*Counterparty
+	if api.cache.get(cacheCounterparty, inn, &cached) {
+		t.Errorf("deleted counterparty is still cached: %+v", cached[0])
+	}
+}
+
+func TestSagaNothingCreated(t *testing.T) {
+	server := &sagaServer{t: t, fail: map[string]bool{"POST /entity/counterparty": true}}
+	api := newTestAPI(t, server.handler, fastLimits())
+
+	_, err := api.executePlan(sagaPlan(DirectionSale))
+	var uploadErr *UploadError
+	if err == nil || errors.As(err, &uploadErr) {
+		t.Fatalf("executePlan error %v, want plain error without rollback", err)
+	}
+	if got := server.rollbackRequests(); len(got) != 0 {
+		t.Errorf("rollback requests %q, want none", got)
+	}
+}
@@ -0,0 +1,319 @@
+package moysklad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// Stock check policies for demand positions exceeding store stock
+const (
+	// StockCheckOff does not check stock
+	StockCheckOff = "off"
+	// StockCheckWarn reports shortages in the plan and the result
+	StockCheckWarn = "warn"
+	// StockCheckFail aborts upload when a position exceeds store stock
+	StockCheckFail = "fail"
+)
+
+// Sources of demand and supply store shown in the upload plan: linked
+// customer invoice or order or purchase order, counterparty rule or user
+// choice, organization default or the only store of the account
+const (
+	StoreFromInvoice       = "invoiceout"
+	StoreFromOrder         = "customerorder"
+	StoreFromPurchaseOrder = "purchaseorder"
+	StoreFromCounterparty  = "counterparty"
+	StoreFromChoice        = "choice"
+	StoreFromOrganization  = "organization"
+	StoreSingle            = "single"
+)
+
+// StoreChoiceError is returned when the document store cannot be resolved.
+// Choice holds stores for the user to choose from.
+type StoreChoiceError struct {
+	Message string
+	Choice  models.StoreChoice
+}
+
+func (e *StoreChoiceError) Error() string {
+	return e.Message
+}
+
+// resolveDemandStore resolves demand store: from the customer invoice, then
+// from the customer order, then by rules, see resolveStoreByRules
+func (api *API) resolveDemandStore(plan *UploadPlan) (*Store, string, error) {
+	if plan.CustomerInvoice != nil && plan.CustomerInvoice.Store != nil {
+		if store, err := api.getStoreFromInvoice(plan.CustomerInvoice); err == nil {
+			return store, StoreFromInvoice, nil
+		}
+	}
+	if plan.CustomerOrder != nil && plan.CustomerOrder.Store != nil && plan.CustomerOrder.Store.Meta != nil {
+		var store Store
+		if err := api.getEntity(cacheStore, plan.CustomerOrder.Store.Meta.Href, &store); err == nil {
+			return &store, StoreFromOrder, nil
+		}
+		return plan.CustomerOrder.Store, StoreFromOrder, nil
+	}
+
+	return api.resolveStoreByRules(plan, DirectionSale, plan.UPDDocument.Content.Buyer)
+}
+
+// resolveSupplyStore resolves supply store: from the purchase order, then
+// by rules, see resolveStoreByRules
+func (api *API) resolveSupplyStore(plan *UploadPlan) (*Store, string, error) {
+	if plan.PurchaseOrder != nil && plan.PurchaseOrder.Store != nil && plan.PurchaseOrder.Store.Meta != nil {
+		var store Store
+		if err := api.getEntity(cacheStore, plan.PurchaseOrder.Store.Meta.Href, &store); err == nil {
+			return &store, StoreFromPurchaseOrder, nil
+		}
+		return plan.PurchaseOrder.Store, StoreFromPurchaseOrder, nil
+	}
+
+	return api.resolveStoreByRules(plan, DirectionPurchase, plan.UPDDocument.Content.Seller)
+}
+
+// resolveStoreByRules resolves store of a document without store in linked
+// documents: by counterparty rule, then by organization default, then the
+// store the user chose for the counterparty. The only store of the account
+// is used when nothing else applies, otherwise the user is asked to choose.
+func (api *API) resolveStoreByRules(plan *UploadPlan, direction string, party models.Organization) (*Store, string, error) {
+	inn := party.INN
+	if ref := api.options.CounterpartyStores[inn]; ref != "" {
+		store, err := api.configuredStore(ref, "counterparty "+inn)
+		return store, StoreFromCounterparty, err
+	}
+	for _, key := range []string{plan.Organization.ID, plan.Organization.INN} {
+		if ref := api.options.OrganizationStores[key]; key != "" && ref != "" {
+			store, err := api.configuredStore(ref, "organization "+plan.Organization.Name)
+			return store, StoreFromOrganization, err
+		}
+	}
+	if id, ok := api.chosenStores.Load(chosenStoreKey(direction, inn)); ok {
+		if store, err := api.findStore(id.(string)); err == nil && store != nil {
+			return store, StoreFromChoice, nil
+		}
+	}
+
+	stores, err := api.stores()
+	if err != nil {
+		return nil, "", err
+	}
+	switch len(stores) {
+	case 0:
+		if direction == DirectionPurchase {
+			return nil, "", &APIError{Message: "No stores in MoySkald to receive goods.\nCreate a store in MoySkald and try again."}
+		}
+		return nil, "", &APIError{Message: "No stores in MoySkald to ship goods from.\nCreate a store in MoySkald and try again."}
+	case 1:
+		api.logger.Infof("Linked documents have no store, using the only store %s", stores[0].Name)
+		return stores[0], StoreSingle, nil
+	}
+
+	name := party.Name
+	if plan.Counterparty != nil && plan.Counterparty.Name != "" {
+		name = plan.Counterparty.Name
+	}
+	choice := models.StoreChoice{Direction: direction, PartyINN: inn, PartyName: name}
+	for _, store := range stores {
+		choice.Stores = append(choice.Stores, models.StoreOption{ID: store.ID, Name: store.Name})
+	}
+	message := fmt.Sprintf("Store for demand to %s (INN %s) is not specified in customer invoice or order and no store rule matches.\nChoose the store or specify it in the customer invoice and try again.", name, inn)
+	if direction == DirectionPurchase {
+		message = fmt.Sprintf("Store for supply from %s (INN %s) is not specified in purchase order and no store rule matches.\nChoose the store or specify it in the purchase order and try again.", name, inn)
+	}
+	return nil, "", &StoreChoiceError{Message: message, Choice: choice}
+}
+
+// configuredStore finds store of a configured rule
+func (api *API) configuredStore(ref, rule string) (*Store, error) {
+	store, err := api.findStore(ref)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, &APIError{Message: fmt.Sprintf("Store '%s' configured for %s not found in MoySkald", ref, rule)}
+	}
+	api.logger.Infof("Store %s is taken from the rule for %s", store.Name, rule)
+	return store, nil
+}
+
+// stores returns all stores of the account
+func (api *API) stores() ([]*Store, error) {
+	var cached []*Store
+	if api.cache.get(cacheStore, "all", &cached) {
+		return cached, nil
+	}
+
+	stores, err := listAll[*Store](api, "/entity/store", nil)
+	if err != nil {
+		return nil, &APIError{Message: fmt.Sprintf("Error loading stores: %v", err)}
+	}
+	if len(stores) > 0 {
+		api.cache.set(cacheStore, "all", stores)
+	}
+	return stores, nil
+}
+
+// findStore finds store by ID or name. Returns nil when there is no such store.
+func (api *API) findStore(ref string) (*Store, error) {
+	stores, err := api.stores()
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range stores {
+		if store.ID == ref {
+			return store, nil
+		}
+	}
+	for _, store := range stores {
+		if strings.EqualFold(strings.TrimSpace(store.Name), strings.TrimSpace(ref)) {
+			return store, nil
+		}
+	}
+	return nil, nil
+}
+
+// ChooseStore remembers store chosen by the user for documents of the
+// direction with the counterparty until restart: demands to a buyer or
+// supplies from a supplier. Returns the chosen store.
+func (api *API) ChooseStore(direction, counterpartyINN, storeID string) (*Store, error) {
+	store, err := api.findStore(storeID)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, &APIError{Message: fmt.Sprintf("Store %s not found in MoySkald", storeID)}
+	}
+
+	api.chosenStores.Store(chosenStoreKey(direction, counterpartyINN), store.ID)
+	api.logger.Infof("Store %s chosen for %s with counterparty %s", store.Name, direction, counterpartyINN)
+	return store, nil
+}
+
+// chosenStoreKey is the key of the store chosen for documents of the
+// direction with the counterparty. Choices predating directions are sales.
+func chosenStoreKey(direction, counterpartyINN string) string {
+	if direction == "" {
+		direction = DirectionSale
+	}
+	return direction + ":" + counterpartyINN
+}
+
+// metaID returns entity ID from meta href
+func metaID(meta *Meta) string {
+	if meta == nil {
+		return ""
+	}
+	return meta.Href[strings.LastIndex(meta.Href, "/")+1:]
+}
+
+// stockRow is a row of the current stock report
+type stockRow struct {
+	AssortmentID string  `json:"assortmentId"`
+	Stock        float64 `json:"stock"`
+}
+
+// currentStock returns current stock of assortment on store by assortment ID
+func (api *API) currentStock(storeID string, ids []string) (map[string]decimal.Decimal, error) {
+	stock := make(map[string]decimal.Decimal)
+	for start := 0; start < len(ids); start += filterChunkSize {
+		chunk := ids[start:min(start+filterChunkSize, len(ids))]
+		params := map[string]string{"filter": "storeId=" + storeID + ";assortmentId=" + strings.Join(chunk, ",")}
+		resp, err := api.makeRequest("GET", "/report/stock/all/current", nil, params)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, &APIError{Message: fmt.Sprintf("Error loading stock: %d - %s", resp.StatusCode, string(body))}
+		}
+		var rows []stockRow
+		err = json.NewDecoder(resp.Body).Decode(&rows)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			stock[row.AssortmentID] = decimal.NewFromFloat(row.Stock)
+		}
+	}
+	return stock, nil
+}
+
+// checkStock compares demand positions with the current stock of the plan
+// store and marks lines exceeding it. Services are not stored and new
+// products have no stock yet.
+func (api *API) checkStock(plan *UploadPlan) error {
+	if api.options.StockCheck == StockCheckOff || plan.Store == nil {
+		return nil
+	}
+	storeID := plan.Store.ID
+	if storeID == "" {
+		storeID = metaID(plan.Store.Meta)
+	}
+
+	// Positions of the same assortment are shipped from the same stock
+	required := make(map[string]decimal.Decimal)
+	var ids []string
+	for _, position := range plan.positions {
+		if position.Assortment == nil || position.Assortment.Meta == nil {
+			continue
+		}
+		switch position.Assortment.Meta.Type {
+		case "product", "variant":
+		default:
+			continue
+		}
+		id := metaID(position.Assortment.Meta)
+		if _, ok := required[id]; !ok {
+			ids = append(ids, id)
+		}
+		required[id] = required[id].Add(decimal.NewFromFloat(position.Quantity))
+	}
+
+	stock, err := api.currentStock(storeID, ids)
+	if err != nil {
+		api.logger.Warningf("Failed to check stock on store %s: %v", plan.Store.Name, err)
+		return nil
+	}
+
+	var shortages []string
+	for i, position := range plan.positions {
+		line := &plan.Lines[i]
+		switch {
+		case line.NewProduct != nil:
+			line.Stock, line.Shortage = 0, true
+		case position.Assortment == nil || position.Assortment.Meta == nil:
+			continue
+		default:
+			id := metaID(position.Assortment.Meta)
+			if _, ok := required[id]; !ok {
+				continue
+			}
+			line.Stock = stock[id].InexactFloat64()
+			line.Shortage = required[id].GreaterThan(stock[id])
+		}
+		if line.Shortage {
+			shortages = append(shortages, fmt.Sprintf("%s: %g of %g", line.Assortment, line.Quantity, line.Stock))
+		}
+	}
+
+	if len(shortages) == 0 {
+		return nil
+	}
+	plan.StockShortages = shortages
+	api.logger.Warningf("Demand exceeds stock on store %s: %s", plan.Store.Name, strings.Join(shortages, "; "))
+	if api.options.StockCheck == StockCheckFail {
+		return &APIError{Message: fmt.Sprintf("Not enough stock on store %s:\n%s\nReceive the goods or choose another store and try again.", plan.Store.Name, strings.Join(shortages, "\n"))}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package moysklad
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestResolveDemandStorePrecedence(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/entity/store" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			return
+		}
+		w.Write([]byte(`{"meta":{"size":4},"rows":[
+			{"id":"main","name":"Основной"},
+			{"id":"rule","name":"По правилу"},
+			{"id":"org","name":"Организации"},
+			{"id":"chosen","name":"Выбранный"}]}`))
+	}
+
+	const inn = "7701234567"
+	tests := []struct {
+		name         string
+		counterparty map[string]string
+		organization map[string]string
+		chosen       bool
+		wantStore    string
+		wantSource   string
+	}{
+		{"counterparty rule before choice", map[string]string{inn: "rule"}, nil, true, "rule", StoreFromCounterparty},
+		{"organization default before choice", nil, map[string]string{"org-id": "Организации"}, true, "org", StoreFromOrganization},
+		{"choice without rules", nil, nil, true, "chosen", StoreFromChoice},
+	}
+
+	for _, tt := range tests {
+		api := newTestAPI(t, handler, fastLimits())
+		api.options.CounterpartyStores = tt.counterparty
+		api.options.OrganizationStores = tt.organization
+		if tt.chosen {
+			if _, err := api.ChooseStore(DirectionSale, inn, "chosen"); err != nil {
+				t.Fatalf("%s: ChooseStore failed: %v", tt.name, err)
+			}
+		}
+
+		content := models.NewUPDContent("1", time.Now(), models.Organization{INN: "7843316106"}, models.Organization{INN: inn})
+		plan := &UploadPlan{
+			UPDDocument:  &models.UPDDocument{Content: *content},
+			Organization: &Organization{ID: "org-id", Name: "ООО \"Продавец\""},
+		}
+
+		store, source, err := api.resolveDemandStore(plan)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if store.ID != tt.wantStore || source != tt.wantSource {
+			t.Errorf("%s: store %s from %s, want %s from %s", tt.name, store.ID, source, tt.wantStore, tt.wantSource)
+		}
+	}
+}
+
+func TestResolveSupplyStore(t *testing.T) {
+	const inn = "7843316106"
+	storesJSON := map[int]string{
+		1: `{"meta":{"size":1},"rows":[{"id":"main","name":"Основной"}]}`,
+		2: `{"meta":{"size":2},"rows":[{"id":"main","name":"Основной"},{"id":"org","name":"Организации"}]}`,
+	}
+	stores := 2
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/entity/store":
+			w.Write([]byte(storesJSON[stores]))
+		case "/entity/store/order":
+			w.Write([]byte(`{"id":"order","name":"Из заказа"}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		stores       int
+		orderStore   bool
+		organization map[string]string
+		chosen       string // direction of the store chosen by the user
+		wantStore    string
+		wantSource   string
+	}{
+		{"purchase order store before rules", 2, true, map[string]string{"org-id": "org"}, "", "order", StoreFromPurchaseOrder},
+		{"organization rule", 2, false, map[string]string{"org-id": "org"}, DirectionPurchase, "org", StoreFromOrganization},
+		{"chosen for supplies", 2, false, nil, DirectionPurchase, "org", StoreFromChoice},
+		{"single store", 1, false, nil, "", "main", StoreSingle},
+		{"chosen for demands only", 2, false, nil, DirectionSale, "", ""},
+		{"several stores", 2, false, nil, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		stores = tt.stores
+		api := newTestAPI(t, handler, fastLimits())
+		api.options.OrganizationStores = tt.organization
+		if tt.chosen != "" {
+			if _, err := api.ChooseStore(tt.chosen, inn, "org"); err != nil {
+				t.Fatalf("%s: ChooseStore failed: %v", tt.name, err)
+			}
+		}
+
+		content := models.NewUPDContent("1", time.Now(), models.Organization{INN: inn, Name: "ООО \"Поставщик\""}, models.Organization{INN: "7701234567"})
+		plan := &UploadPlan{
+			UPDDocument:  &models.UPDDocument{Content: *content},
+			Organization: &Organization{ID: "org-id", Name: "ООО \"Покупатель\""},
+		}
+		if tt.orderStore {
+			plan.PurchaseOrder = &PurchaseOrder{Store: &Store{Meta: &Meta{Href: api.baseURL + "/entity/store/order"}}}
+		}
+
+		store, source, err := api.resolveSupplyStore(plan)
+		if tt.wantStore == "" {
+			var choiceErr *StoreChoiceError
+			if !errors.As(err, &choiceErr) {
+				t.Errorf("%s: error %v, want StoreChoiceError", tt.name, err)
+				continue
+			}
+			if choiceErr.Choice.Direction != DirectionPurchase || choiceErr.Choice.PartyINN != inn || len(choiceErr.Choice.Stores) != 2 {
+				t.Errorf("%s: choice %+v, want both stores for supplies from %s", tt.name, choiceErr.Choice, inn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if store.ID != tt.wantStore || source != tt.wantSource {
+			t.Errorf("%s: store %s from %s, want %s from %s", tt.name, store.ID, source, tt.wantStore, tt.wantSource)
+		}
+	}
+}
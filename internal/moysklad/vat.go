@@ -0,0 +1,122 @@
+package moysklad
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// vatRates are VAT rates MoySkald accepts: 22% and 20% general (22% since
+// 2026), 18% before 2019, 10% reduced, 5% and 7% for simplified taxation
+// and 0% for export
+var vatRates = []int{0, 5, 7, 10, 18, 20, 22}
+
+var (
+	vatPercentPattern  = regexp.MustCompile(`^(\d+)\s*%?$`)
+	vatFractionPattern = regexp.MustCompile(`^(\d+)\s*/\s*(\d+)$`)
+)
+
+// VAT is VAT of a document position in MoySkald terms
+type VAT struct {
+	Rate    int
+	Enabled bool
+}
+
+// noVAT is VAT of lines "без НДС" and of lines taxed by a tax agent
+var noVAT = VAT{Rate: 0, Enabled: false}
+
+func isVATRate(rate int) bool {
+	for _, known := range vatRates {
+		if rate == known {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVAT maps НалСт value of UPD line: "20%", calculated rate "20/120",
+// "без НДС" or "НДС исчисляется налоговым агентом"
+func parseVAT(value string) (VAT, bool) {
+	s := strings.ToLower(strings.Join(strings.Fields(value), " "))
+	switch {
+	case s == "без ндс":
+		return noVAT, true
+	case strings.Contains(s, "налоговым агентом"):
+		// Tax agent pays VAT on its own, the seller does not charge it
+		return noVAT, true
+	}
+
+	if m := vatPercentPattern.FindStringSubmatch(s); m != nil {
+		rate, err := strconv.Atoi(m[1])
+		if err == nil && isVATRate(rate) {
+			return VAT{Rate: rate, Enabled: true}, true
+		}
+	}
+	if m := vatFractionPattern.FindStringSubmatch(s); m != nil {
+		rate, err1 := strconv.Atoi(m[1])
+		base, err2 := strconv.Atoi(m[2])
+		if err1 == nil && err2 == nil && rate > 0 && base == 100+rate && isVATRate(rate) {
+			return VAT{Rate: rate, Enabled: true}, true
+		}
+	}
+	return VAT{}, false
+}
+
+// vatFromAmounts derives VAT from amounts when the rate is not specified,
+// snapping the VAT share to the nearest known rate
+func vatFromAmounts(vatAmount, amountWithoutVAT decimal.Decimal) VAT {
+	if !vatAmount.IsPositive() || !amountWithoutVAT.IsPositive() {
+		return noVAT
+	}
+
+	percent := vatAmount.Div(amountWithoutVAT).Mul(decimal.NewFromInt(100)).InexactFloat64()
+	best := vatRates[1]
+	for _, rate := range vatRates[1:] {
+		if abs(percent-float64(rate)) < abs(percent-float64(best)) {
+			best = rate
+		}
+	}
+	return VAT{Rate: best, Enabled: true}
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// itemVAT returns VAT of UPD line
+func itemVAT(item *models.InvoiceItem) (VAT, error) {
+	if strings.TrimSpace(item.VATRate) == "" {
+		return vatFromAmounts(item.VATAmount, item.AmountWithoutVAT), nil
+	}
+
+	vat, ok := parseVAT(item.VATRate)
+	if !ok {
+		return VAT{}, &APIError{Message: fmt.Sprintf("Unsupported VAT rate '%s' of UPD line %d %s", item.VATRate, item.LineNumber, item.Name)}
+	}
+	return vat, nil
+}
+
+// documentVAT returns VAT of the whole document used for a single service
+// position when UPD has no lines
+func documentVAT(content *models.UPDContent) VAT {
+	return vatFromAmounts(content.TotalVAT, content.TotalWithoutVAT)
+}
+
+// documentVATEnabled reports whether document has positions with VAT.
+// Documents of suppliers without VAT have it disabled.
+func documentVATEnabled(positions []*Position) *bool {
+	for _, position := range positions {
+		if position.VatEnabled == nil || *position.VatEnabled {
+			return boolPtr(true)
+		}
+	}
+	return boolPtr(false)
+}
@@ -0,0 +1,170 @@
+package moysklad
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+func TestParseVAT(t *testing.T) {
+	tests := []struct {
+		value string
+		want  VAT
+		ok    bool
+	}{
+		{"0%", VAT{Rate: 0, Enabled: true}, true},
+		{"5%", VAT{Rate: 5, Enabled: true}, true},
+		{"7%", VAT{Rate: 7, Enabled: true}, true},
+		{"10%", VAT{Rate: 10, Enabled: true}, true},
+		{"18%", VAT{Rate: 18, Enabled: true}, true},
+		{"20%", VAT{Rate: 20, Enabled: true}, true},
+		{"22%", VAT{Rate: 22, Enabled: true}, true},
+		{"20", VAT{Rate: 20, Enabled: true}, true},
+		{" 20 % ", VAT{Rate: 20, Enabled: true}, true},
+		{"5/105", VAT{Rate: 5, Enabled: true}, true},
+		{"7/107", VAT{Rate: 7, Enabled: true}, true},
+		{"10/110", VAT{Rate: 10, Enabled: true}, true},
+		{"18/118", VAT{Rate: 18, Enabled: true}, true},
+		{"20/120", VAT{Rate: 20, Enabled: true}, true},
+		{"22 / 122", VAT{Rate: 22, Enabled: true}, true},
+		{"без НДС", noVAT, true},
+		{"Без  НДС", noVAT, true},
+		{"НДС исчисляется налоговым агентом", noVAT, true},
+
+		// Fractional rates are not VAT rates MoySkald accepts
+		{"20.5%", VAT{}, false},
+		{"7,5%", VAT{}, false},
+		{"16,67%", VAT{}, false},
+
+		// Unknown rates and calculated rates with a wrong base
+		{"12%", VAT{}, false},
+		{"20/110", VAT{}, false},
+		{"0/100", VAT{}, false},
+
+		{"", VAT{}, false},
+		{"НДС", VAT{}, false},
+		{"twenty", VAT{}, false},
+		{"-20%", VAT{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseVAT(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseVAT(%q) = %+v, %v; want %+v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVATFromAmounts(t *testing.T) {
+	tests := []struct {
+		name             string
+		vatAmount        string
+		amountWithoutVAT string
+		want             VAT
+	}{
+		{"exact 20%", "200", "1000", VAT{Rate: 20, Enabled: true}},
+		{"exact 10%", "10", "100", VAT{Rate: 10, Enabled: true}},
+		{"exact 22%", "22", "100", VAT{Rate: 22, Enabled: true}},
+		{"rounded 20%", "16.67", "83.33", VAT{Rate: 20, Enabled: true}},
+		{"rounded 5%", "0.05", "0.99", VAT{Rate: 5, Enabled: true}},
+		{"between 7% and 10% snaps to nearest", "9", "100", VAT{Rate: 10, Enabled: true}},
+		{"no VAT amount", "0", "1000", noVAT},
+		{"no amount", "20", "0", noVAT},
+		{"negative VAT amount", "-20", "100", noVAT},
+	}
+
+	for _, tt := range tests {
+		got := vatFromAmounts(decimal.RequireFromString(tt.vatAmount), decimal.RequireFromString(tt.amountWithoutVAT))
+		if got != tt.want {
+			t.Errorf("%s: vatFromAmounts(%s, %s) = %+v, want %+v", tt.name, tt.vatAmount, tt.amountWithoutVAT, got, tt.want)
+		}
+	}
+}
+
+func TestItemVAT(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    models.InvoiceItem
+		want    VAT
+		wantErr bool
+	}{
+		{
+			name: "rate",
+			item: models.InvoiceItem{VATRate: "20%", VATAmount: decimal.NewFromInt(10), AmountWithoutVAT: decimal.NewFromInt(100)},
+			want: VAT{Rate: 20, Enabled: true},
+		},
+		{
+			name: "without VAT",
+			item: models.InvoiceItem{VATRate: "без НДС", AmountWithoutVAT: decimal.NewFromInt(100)},
+			want: noVAT,
+		},
+		{
+			name: "empty rate falls back to amounts",
+			item: models.InvoiceItem{VATRate: " ", VATAmount: decimal.NewFromInt(10), AmountWithoutVAT: decimal.NewFromInt(100)},
+			want: VAT{Rate: 10, Enabled: true},
+		},
+		{
+			name: "empty rate without VAT amount",
+			item: models.InvoiceItem{AmountWithoutVAT: decimal.NewFromInt(100)},
+			want: noVAT,
+		},
+		{
+			name:    "unsupported rate",
+			item:    models.InvoiceItem{LineNumber: 3, Name: "Труба", VATRate: "12%"},
+			wantErr: true,
+		},
+		{
+			name:    "garbage rate",
+			item:    models.InvoiceItem{LineNumber: 4, Name: "Муфта", VATRate: "n/a"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := itemVAT(&tt.item)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: itemVAT = %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDocumentVATEnabled(t *testing.T) {
+	positions := func(rates ...string) []*Position {
+		var result []*Position
+		for _, rate := range rates {
+			vat, err := itemVAT(&models.InvoiceItem{VATRate: rate})
+			if err != nil {
+				t.Fatalf("itemVAT(%q): %v", rate, err)
+			}
+			result = append(result, &Position{VAT: vat.Rate, VatEnabled: boolPtr(vat.Enabled)})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		positions []*Position
+		want      bool
+	}{
+		{"every line without VAT", positions("без НДС", "без НДС"), false},
+		{"tax agent and without VAT", positions("НДС исчисляется налоговым агентом", "без НДС"), false},
+		{"zero rate is VAT", positions("0%", "без НДС"), true},
+		{"mixed", positions("без НДС", "20%"), true},
+		{"unknown position VAT", []*Position{{}}, true},
+		{"no positions", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := documentVATEnabled(tt.positions); got == nil || *got != tt.want {
+			t.Errorf("%s: documentVATEnabled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,19 +2,16 @@ package parser
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/text/encoding/charmap"
-	"golang.org/x/text/transform"
 
 	"upd-loader-go/internal/models"
 )
@@ -153,21 +150,24 @@ func (p *UPDParser) parseMetaXML(extractDir string) (*models.MetaInfo, error) {
 	}
 
 	// Parse XML structure for meta.xml
+	// Root element is DocumentPackage or ContainerDescription depending on the operator
+	type metaFile struct {
+		Path string `xml:"Path,attr"`
+	}
 	type MetaXML struct {
-		XMLName  xml.Name `xml:"DocumentPackage"`
 		DocFlows []struct {
-			ID         string `xml:"Id,attr"`
-			MainImage  struct {
-				Path string `xml:"Path,attr"`
-			} `xml:"MainImage"`
-			ExternalCard struct {
-				Path string `xml:"Path,attr"`
-			} `xml:"ExternalCard"`
+			ID           string   `xml:"Id,attr"`
+			MainImage    metaFile `xml:"MainImage"`
+			ExternalCard metaFile `xml:"ExternalCard"`
+			Documents    []struct {
+				MainImage    metaFile `xml:"Files>MainImage"`
+				ExternalCard metaFile `xml:"Files>ExternalCard"`
+			} `xml:"Documents>Document"`
 		} `xml:"DocFlow"`
 	}
 
 	var meta MetaXML
-	if err := xml.Unmarshal(data, &meta); err != nil {
+	if err := unmarshalXML(data, &meta); err != nil {
 		return nil, fmt.Errorf("failed to parse meta.xml: %v", err)
 	}
 
@@ -180,6 +180,16 @@ func (p *UPDParser) parseMetaXML(extractDir string) (*models.MetaInfo, error) {
 		return nil, fmt.Errorf("DocFlow ID not found")
 	}
 
+	// Taxcom containers keep file paths in Documents/Document/Files
+	for _, document := range docFlow.Documents {
+		if docFlow.MainImage.Path == "" {
+			docFlow.MainImage = document.MainImage
+		}
+		if docFlow.ExternalCard.Path == "" {
+			docFlow.ExternalCard = document.ExternalCard
+		}
+	}
+
 	if docFlow.MainImage.Path == "" || docFlow.ExternalCard.Path == "" {
 		return nil, fmt.Errorf("file paths not found in meta.xml")
 	}
@@ -199,7 +209,7 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 		return nil, fmt.Errorf("card.xml not found: %s", cardPath)
 	}
 
-	content, err := p.readFileWithEncoding(fullCardPath)
+	content, err := os.ReadFile(fullCardPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read card.xml: %v", err)
 	}
@@ -216,6 +226,7 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 		} `xml:"Description"`
 		Sender struct {
 			Abonent struct {
+				ID   string `xml:"Id,attr"`
 				INN  string `xml:"Inn,attr"`
 				KPP  string `xml:"Kpp,attr"`
 				Name string `xml:"Name,attr"`
@@ -224,7 +235,7 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 	}
 
 	var card CardXML
-	if err := xml.Unmarshal([]byte(content), &card); err != nil {
+	if err := unmarshalXML(content, &card); err != nil {
 		return nil, fmt.Errorf("failed to parse card.xml: %v", err)
 	}
 
@@ -233,6 +244,8 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 	if card.Description.Date != "" {
 		if parsedDate, err := time.Parse(time.RFC3339, strings.Replace(card.Description.Date, "Z", "+00:00", 1)); err == nil {
 			date = parsedDate
+		} else if parsedDate, err := time.Parse("2006-01-02T15:04:05", card.Description.Date); err == nil {
+			date = parsedDate
 		}
 	}
 
@@ -243,6 +256,7 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 		SenderINN:          card.Sender.Abonent.INN,
 		SenderKPP:          card.Sender.Abonent.KPP,
 		SenderName:         card.Sender.Abonent.Name,
+		SenderID:           card.Sender.Abonent.ID,
 	}, nil
 }
 
@@ -250,23 +264,25 @@ func (p *UPDParser) parseCardXML(extractDir, cardPath string) (*models.CardInfo,
 func (p *UPDParser) parseUPDContent(extractDir, mainDocumentPath string) (*models.UPDContent, error) {
 	fullUPDPath := filepath.Join(extractDir, mainDocumentPath)
 
-	if _, err := os.Stat(fullUPDPath); os.IsNotExist(err) {
+	info, err := os.Stat(fullUPDPath)
+	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("main UPD file not found: %s", mainDocumentPath)
 	}
 
-	content, err := p.readFileWithEncoding(fullUPDPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read UPD file: %v", err)
-	}
-
 	// If file contains only XML header, create basic structure
-	if len(strings.TrimSpace(content)) <= 100 {
+	if err == nil && info.Size() <= 100 {
 		p.logger.Warning("UPD file contains only XML header, creating basic structure")
 		return p.createBasicUPDContent(), nil
 	}
 
+	file, err := os.Open(fullUPDPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UPD file: %v", err)
+	}
+	defer file.Close()
+
 	// Parse full UPD content
-	return p.parseFullUPDContent(content)
+	return p.parseFullUPDContent(file)
 }
 
 // createBasicUPDContent creates basic UPD structure when full data is not available
@@ -279,234 +295,53 @@ func (p *UPDParser) createBasicUPDContent() *models.UPDContent {
 	)
 }
 
-// parseFullUPDContent parses full UPD content from XML
-func (p *UPDParser) parseFullUPDContent(content string) (*models.UPDContent, error) {
+// parseFullUPDContent parses full UPD content from XML stream. The document is
+// decoded as a stream; only the items are kept, as matching and upload need
+// every line. Use StreamUPDItems where lines can be processed one by one.
+func (p *UPDParser) parseFullUPDContent(r io.Reader) (*models.UPDContent, error) {
 	p.logger.Info("Parsing full UPD document...")
 
-	// Define XML structure for UPD 5.03
-	type UPDXML struct {
-		XMLName    xml.Name `xml:"Файл"`
-		Version    string   `xml:"ВерсФорм,attr"`
-		InvoiceInfo struct {
-			Number string `xml:"НомерДок,attr"`
-			Date   string `xml:"ДатаДок,attr"`
-		} `xml:"СвСчФакт"`
-		SellerInfo struct {
-			LegalEntity struct {
-				Name string `xml:"НаимОрг,attr"`
-				INN  string `xml:"ИННЮЛ,attr"`
-				KPP  string `xml:"КПП,attr"`
-			} `xml:"ИдСв>СвЮЛУч"`
-			Individual struct {
-				INN string `xml:"ИННФЛ,attr"`
-				FIO struct {
-					Surname    string `xml:"Фамилия,attr"`
-					Name       string `xml:"Имя,attr"`
-					Patronymic string `xml:"Отчество,attr"`
-				} `xml:"ФИО"`
-			} `xml:"ИдСв>СвИП"`
-		} `xml:"СвПрод"`
-		BuyerInfo struct {
-			LegalEntity struct {
-				Name string `xml:"НаимОрг,attr"`
-				INN  string `xml:"ИННЮЛ,attr"`
-				KPP  string `xml:"КПП,attr"`
-			} `xml:"ИдСв>СвЮЛУч"`
-			Individual struct {
-				INN string `xml:"ИННФЛ,attr"`
-				FIO struct {
-					Surname    string `xml:"Фамилия,attr"`
-					Name       string `xml:"Имя,attr"`
-					Patronymic string `xml:"Отчество,attr"`
-				} `xml:"ФИО"`
-			} `xml:"ИдСв>СвИП"`
-		} `xml:"ГрузПолуч"`
-		Table struct {
-			Items []struct {
-				Name           string `xml:"НаимТов,attr"`
-				Quantity       string `xml:"КолТов,attr"`
-				Price          string `xml:"ЦенаТов,attr"`
-				AmountWithoutVAT string `xml:"СтТовБезНДС,attr"`
-				VATRate        string `xml:"НалСт,attr"`
-				AmountWithVAT  string `xml:"СтТовУчНал,attr"`
-				Additional struct {
-					Article string `xml:"КодТов,attr"`
-				} `xml:"ДопСведТов"`
-				VATSum struct {
-					Amount string `xml:",chardata"`
-				} `xml:"СумНал>СумНал"`
-			} `xml:"СведТов"`
-		} `xml:"ТаблСчФакт"`
-		Totals struct {
-			TotalWithoutVAT string `xml:"СтТовБезНДСВсего"`
-			TotalWithVAT    string `xml:"СтТовУчНалВсего"`
-			VATSum          string `xml:"СумНал"`
-		} `xml:"ВсегоОпл"`
-		Transfer struct {
-			Basis struct {
-				RequisiteNumber string `xml:"РеквНомерДок,attr"`
-			} `xml:"СвПер>ОснПер"`
-		} `xml:"СвПродПер"`
-	}
-
-	var upd UPDXML
-	if err := xml.Unmarshal([]byte(content), &upd); err != nil {
-		p.logger.Warningf("Error parsing full UPD: %v, creating basic structure", err)
-		return p.createBasicUPDContent(), nil
-	}
-
-	// Parse invoice number and date
-	invoiceNumber := upd.InvoiceInfo.Number
-	if invoiceNumber == "" {
-		invoiceNumber = "Не указан"
-	}
-
-	invoiceDate := time.Now()
-	if upd.InvoiceInfo.Date != "" {
-		if parsedDate, err := time.Parse("02.01.2006", upd.InvoiceInfo.Date); err == nil {
-			invoiceDate = parsedDate
-		}
-	}
-
-	// Parse seller
-	seller := p.parseOrganization(upd.SellerInfo.LegalEntity.Name, upd.SellerInfo.LegalEntity.INN, upd.SellerInfo.LegalEntity.KPP,
-		upd.SellerInfo.Individual.INN, upd.SellerInfo.Individual.FIO.Surname, upd.SellerInfo.Individual.FIO.Name, upd.SellerInfo.Individual.FIO.Patronymic)
-
-	// Parse buyer
-	buyer := p.parseOrganization(upd.BuyerInfo.LegalEntity.Name, upd.BuyerInfo.LegalEntity.INN, upd.BuyerInfo.LegalEntity.KPP,
-		upd.BuyerInfo.Individual.INN, upd.BuyerInfo.Individual.FIO.Surname, upd.BuyerInfo.Individual.FIO.Name, upd.BuyerInfo.Individual.FIO.Patronymic)
-
-	// Parse items
-	items := p.parseInvoiceItems(upd.Table.Items)
-
-	// Parse totals
-	totalWithoutVAT := p.parseDecimal(upd.Totals.TotalWithoutVAT)
-	totalWithVAT := p.parseDecimal(upd.Totals.TotalWithVAT)
-	totalVAT := p.parseDecimal(upd.Totals.VATSum)
-
-	// Extract requisite number
-	requisiteNumber := ""
-	if upd.Transfer.Basis.RequisiteNumber != "" {
-		// Extract only numbers from requisite
-		re := regexp.MustCompile(`\d+`)
-		numbers := re.FindAllString(upd.Transfer.Basis.RequisiteNumber, -1)
-		if len(numbers) > 0 {
-			requisiteNumber = numbers[0]
-		}
-	}
-
-	updContent := models.NewUPDContent(invoiceNumber, invoiceDate, seller, buyer)
-	updContent.Items = items
-	updContent.TotalWithoutVAT = totalWithoutVAT
-	updContent.TotalVAT = totalVAT
-	updContent.TotalWithVAT = totalWithVAT
-	updContent.RequisiteNumber = requisiteNumber
-
-	p.logger.Infof("UPD parsed: № %s, seller INN %s, buyer INN %s", invoiceNumber, seller.INN, buyer.INN)
-
-	return updContent, nil
-}
-
-// parseOrganization parses organization from legal entity or individual data
-func (p *UPDParser) parseOrganization(legalName, legalINN, legalKPP, individualINN, surname, name, patronymic string) models.Organization {
-	// Try legal entity first
-	if legalINN != "" {
-		return models.Organization{
-			Name: legalName,
-			INN:  legalINN,
-			KPP:  legalKPP,
-		}
-	}
-
-	// Try individual
-	if individualINN != "" {
-		fullName := strings.TrimSpace(fmt.Sprintf("%s %s %s", surname, name, patronymic))
-		if fullName == "" {
-			fullName = "Не указано"
-		}
-		return models.Organization{
-			Name: fullName,
-			INN:  individualINN,
-		}
-	}
-
-	// Default
-	return models.Organization{
-		Name: "Не указано",
-		INN:  "0000000000",
-	}
-}
-
-// parseInvoiceItems parses invoice items from XML
-func (p *UPDParser) parseInvoiceItems(xmlItems []struct {
-	Name           string `xml:"НаимТов,attr"`
-	Quantity       string `xml:"КолТов,attr"`
-	Price          string `xml:"ЦенаТов,attr"`
-	AmountWithoutVAT string `xml:"СтТовБезНДС,attr"`
-	VATRate        string `xml:"НалСт,attr"`
-	AmountWithVAT  string `xml:"СтТовУчНал,attr"`
-	Additional struct {
-		Article string `xml:"КодТов,attr"`
-	} `xml:"ДопСведТов"`
-	VATSum struct {
-		Amount string `xml:",chardata"`
-	} `xml:"СумНал>СумНал"`
-}) []models.InvoiceItem {
 	var items []models.InvoiceItem
-
-	for i, xmlItem := range xmlItems {
-		item := models.InvoiceItem{
-			LineNumber:       i + 1,
-			Name:             xmlItem.Name,
-			Quantity:         p.parseDecimal(xmlItem.Quantity),
-			Price:            p.parseDecimal(xmlItem.Price),
-			AmountWithoutVAT: p.parseDecimal(xmlItem.AmountWithVAT), // Use amount with VAT as main amount
-			VATRate:          xmlItem.VATRate,
-			VATAmount:        p.parseDecimal(xmlItem.VATSum.Amount),
-			AmountWithVAT:    p.parseDecimal(xmlItem.AmountWithVAT),
-			Article:          xmlItem.Additional.Article,
-		}
-
+	updContent, err := p.StreamUPDItems(r, func(item models.InvoiceItem) error {
 		items = append(items, item)
-		p.logger.Debugf("Item %d: %s, article: %s, quantity: %s, price: %s, amount with VAT: %s",
-			i+1, item.Name, item.Article, item.Quantity, item.Price, item.AmountWithVAT)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	updContent.Items = items
 	p.logger.Infof("Parsed %d items", len(items))
-	return items
-}
 
-// parseDecimal safely parses decimal from string
-func (p *UPDParser) parseDecimal(s string) decimal.Decimal {
-	if s == "" {
-		return decimal.Zero
+	if !updContent.IsDefaultCurrency() {
+		p.logger.Infof("UPD currency: %s (%s), rate %s", updContent.CurrencyCode, updContent.CurrencyISOCode(), updContent.ExchangeRate)
 	}
 
-	if d, err := decimal.NewFromString(s); err == nil {
-		return d
-	}
+	p.logger.Infof("UPD parsed: № %s, seller INN %s, buyer INN %s", updContent.InvoiceNumber, updContent.Seller.INN, updContent.Buyer.INN)
 
-	return decimal.Zero
+	return updContent, nil
 }
 
-// readFileWithEncoding reads file with specified encoding
-func (p *UPDParser) readFileWithEncoding(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+// StreamUPDItems parses a UPD XML document calling fn for every item without
+// keeping the items in memory. Returned content has no items. Documents
+// without a declared encoding are read in the parser encoding unless they
+// are UTF-8.
+func (p *UPDParser) StreamUPDItems(r io.Reader, fn func(item models.InvoiceItem) error) (*models.UPDContent, error) {
+	decoder := NewUPDStreamDecoder(r, p.encoding, p.logger)
+	content, err := decoder.DecodeItems(fn)
 	if err != nil {
-		return "", err
+		return nil, &UPDParsingError{Message: fmt.Sprintf("malformed UPD XML: %v", err)}
 	}
-	defer file.Close()
-
-	// Use Windows-1251 decoder
-	decoder := charmap.Windows1251.NewDecoder()
-	reader := transform.NewReader(file, decoder)
 
-	content, err := io.ReadAll(reader)
-	if err != nil {
-		return "", err
-	}
+	p.logger.Infof("Streamed %d items", decoder.ItemCount())
+	return content, nil
+}
 
-	return string(content), nil
+// unmarshalXML decodes XML honoring the encoding declared in the prolog
+func unmarshalXML(data []byte, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charsetReader
+	return decoder.Decode(v)
 }
 
 // cleanupExtractDir removes the extraction directory
@@ -0,0 +1,607 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/htmlindex"
+
+	"upd-loader-go/internal/models"
+)
+
+var requisiteNumberRe = regexp.MustCompile(`\d+`)
+
+// prologPeekSize is the document prefix inspected to detect its encoding
+const prologPeekSize = 4096
+
+// gtinRe matches EAN-8, UPC-A, EAN-13 and GTIN-14 barcodes
+var gtinRe = regexp.MustCompile(`^(\d{8}|\d{12,14})$`)
+
+// ogrnRe matches ОГРН (13 digits) and ОГРНИП (15 digits)
+var ogrnRe = regexp.MustCompile(`\b(\d{15}|\d{13})\b`)
+
+// partyInfo collects seller or buyer identification while streaming
+type partyInfo struct {
+	kind          string
+	legalName     string
+	legalINN      string
+	legalKPP      string
+	individualINN string
+	ogrn          string
+	okpo          string
+	surname       string
+	name          string
+	patronymic    string
+	address       *models.Address
+	accounts      []models.BankAccount
+}
+
+// UPDStreamDecoder decodes UPD XML as a token stream and emits invoice items
+// one by one, so memory usage does not depend on the number of СведТов lines.
+type UPDStreamDecoder struct {
+	decoder *xml.Decoder
+	logger  *logrus.Logger
+	path    []string
+
+	fileID         string
+	invoiceNumber  string
+	invoiceDate    string
+	currencyCode   string
+	legacyCurrency string
+	currencyName   string
+	currencyRate   string
+	seller         partyInfo
+	buyer          partyInfo
+	shipper        partyInfo
+	consignee      partyInfo
+	requisite      string
+	requisiteDate  string
+	totalNoVAT     string
+	totalWithVAT   string
+	totalVAT       string
+
+	item      *models.InvoiceItem
+	itemCount int
+	text      strings.Builder
+	done      bool
+}
+
+// NewUPDStreamDecoder creates a stream decoder over UPD XML.
+// Encodings declared in the XML prolog (e.g. windows-1251) are decoded on the
+// fly. Documents without a declared encoding that are not valid UTF-8 are
+// decoded from defaultEncoding; empty defaultEncoding means UTF-8.
+func NewUPDStreamDecoder(r io.Reader, defaultEncoding string, logger *logrus.Logger) *UPDStreamDecoder {
+	decoder := xml.NewDecoder(defaultCharset(r, defaultEncoding))
+	decoder.CharsetReader = charsetReader
+
+	return &UPDStreamDecoder{
+		decoder: decoder,
+		logger:  logger,
+	}
+}
+
+// defaultCharset returns r converted to UTF-8 from the encoding when the
+// document declares no encoding in its prolog and its beginning is not UTF-8
+func defaultCharset(r io.Reader, encoding string) io.Reader {
+	buffered := bufio.NewReaderSize(r, prologPeekSize)
+	if encoding == "" || strings.EqualFold(encoding, "utf-8") {
+		return buffered
+	}
+
+	head, err := buffered.Peek(prologPeekSize)
+	if declaresEncoding(head) || isUTF8Prefix(head, err == nil) {
+		return buffered
+	}
+
+	enc, err := htmlindex.Get(encoding)
+	if err != nil {
+		return errReader{fmt.Errorf("unsupported default encoding: %s", encoding)}
+	}
+	return enc.NewDecoder().Reader(buffered)
+}
+
+// declaresEncoding reports whether the XML prolog has an encoding attribute
+func declaresEncoding(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(head, []byte("<?xml")) {
+		return false
+	}
+	end := bytes.Index(head, []byte("?>"))
+	return end > 0 && bytes.Contains(head[:end], []byte("encoding"))
+}
+
+// isUTF8Prefix reports whether head is valid UTF-8. A truncated prefix may
+// end in the middle of a character, which is not counted as invalid.
+func isUTF8Prefix(head []byte, truncated bool) bool {
+	if truncated {
+		i := len(head) - 1
+		for i > 0 && len(head)-i < utf8.UTFMax && !utf8.RuneStart(head[i]) {
+			i--
+		}
+		head = head[:max(i, 0)]
+	}
+	return utf8.Valid(head)
+}
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// charsetReader converts declared document encoding to UTF-8
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported encoding: %s", label)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// Next returns the next invoice item. It returns io.EOF when the document is
+// fully read; Content is complete only after that.
+func (d *UPDStreamDecoder) Next() (*models.InvoiceItem, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	for {
+		token, err := d.decoder.Token()
+		if err == io.EOF {
+			d.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			d.path = append(d.path, t.Name.Local)
+			d.text.Reset()
+			d.handleStart(t)
+		case xml.CharData:
+			if d.item != nil || d.within("ВсегоОпл") || d.within("АдрГАР") {
+				d.text.Write(t)
+			}
+		case xml.EndElement:
+			item := d.handleEnd(t.Name.Local)
+			if len(d.path) > 0 {
+				d.path = d.path[:len(d.path)-1]
+			}
+			if item != nil {
+				return item, nil
+			}
+		}
+	}
+}
+
+// DecodeItems reads the whole document calling fn for every invoice item
+// and returns the document content without items.
+func (d *UPDStreamDecoder) DecodeItems(fn func(item models.InvoiceItem) error) (*models.UPDContent, error) {
+	for {
+		item, err := d.Next()
+		if err == io.EOF {
+			return d.Content(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(*item); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ItemCount returns the number of items emitted so far
+func (d *UPDStreamDecoder) ItemCount() int {
+	return d.itemCount
+}
+
+// Content returns document header and totals collected so far. Items are not included.
+func (d *UPDStreamDecoder) Content() *models.UPDContent {
+	invoiceNumber := d.invoiceNumber
+	if invoiceNumber == "" {
+		invoiceNumber = "Не указан"
+	}
+
+	invoiceDate := time.Now()
+	if d.invoiceDate != "" {
+		if parsedDate, err := time.Parse("02.01.2006", d.invoiceDate); err == nil {
+			invoiceDate = parsedDate
+		}
+	}
+
+	buyer := d.buyer
+	if buyer.legalINN == "" && buyer.individualINN == "" {
+		buyer = d.consignee
+	}
+
+	seller, buyerOrg := d.seller.organization(), buyer.organization()
+	seller.ActualAddress = d.shipper.actualAddressOf(&seller)
+	buyerOrg.ActualAddress = d.consignee.actualAddressOf(&buyerOrg)
+
+	content := models.NewUPDContent(invoiceNumber, invoiceDate, seller, buyerOrg)
+	content.FileID = d.fileID
+
+	if code := d.currencyCode; code != "" {
+		content.CurrencyCode = code
+	} else if d.legacyCurrency != "" {
+		content.CurrencyCode = d.legacyCurrency
+	}
+	content.CurrencyName = d.currencyName
+	if rate := parseDecimal(d.currencyRate); rate.GreaterThan(decimal.Zero) {
+		content.ExchangeRate = rate
+	}
+
+	content.TotalWithoutVAT = parseDecimal(d.totalNoVAT)
+	content.TotalWithVAT = parseDecimal(d.totalWithVAT)
+	content.TotalVAT = parseDecimal(d.totalVAT)
+
+	if numbers := requisiteNumberRe.FindAllString(d.requisite, -1); len(numbers) > 0 {
+		content.RequisiteNumber = numbers[0]
+	}
+	if d.requisiteDate != "" {
+		if parsedDate, err := time.Parse("02.01.2006", d.requisiteDate); err == nil {
+			content.RequisiteDate = parsedDate
+		}
+	}
+
+	return content
+}
+
+// handleStart processes element attributes
+func (d *UPDStreamDecoder) handleStart(el xml.StartElement) {
+	switch el.Name.Local {
+	case "Файл":
+		d.fileID = attr(el, "ИдФайл")
+	case "СвСчФакт":
+		d.invoiceNumber = attr(el, "НомерДок")
+		d.invoiceDate = attr(el, "ДатаДок")
+		d.legacyCurrency = attr(el, "КодОКВ")
+		// Format 5.01 names invoice number and date differently
+		if d.invoiceNumber == "" {
+			d.invoiceNumber = attr(el, "НомерСчФ")
+		}
+		if d.invoiceDate == "" {
+			d.invoiceDate = attr(el, "ДатаСчФ")
+		}
+	case "ДенИзм":
+		d.currencyCode = attr(el, "КодОКВ")
+		d.currencyName = attr(el, "НаимОКВ")
+		d.currencyRate = attr(el, "КурсВал")
+	case "ДопСвФХЖ1":
+		// Format 5.01 has currency name and rate in additional information
+		if name := attr(el, "НаимОКВ"); name != "" && d.currencyName == "" {
+			d.currencyName = name
+		}
+		if rate := attr(el, "КурсВал"); rate != "" && d.currencyRate == "" {
+			d.currencyRate = rate
+		}
+	case "СвПрод", "СвПокуп", "ГрузОтпр", "ГрузПолуч":
+		if party := d.currentParty(); party != nil {
+			party.okpo = attr(el, "ОКПО")
+		}
+	case "СвЮЛУч", "СвИП", "СвФЛУчастФХЖ", "ФИО", "АдрРФ", "АдрИнф", "АдрГАР", "МуниципРайон", "ГородСелПоселен",
+		"НаселенПункт", "ЭлУлДорСети", "Здание", "ПомещЗдания", "БанкРекв", "СвБанк":
+		if party := d.currentParty(); party != nil {
+			party.apply(el)
+		}
+	case "СведТов":
+		d.item = &models.InvoiceItem{
+			LineNumber:       d.itemCount + 1,
+			Name:             attr(el, "НаимТов"),
+			UnitCode:         attr(el, "ОКЕИ_Тов"),
+			UnitName:         attr(el, "НаимЕдИзм"),
+			Quantity:         parseDecimal(attr(el, "КолТов")),
+			Price:            parseDecimal(attr(el, "ЦенаТов")),
+			AmountWithoutVAT: parseDecimal(attr(el, "СтТовБезНДС")),
+			VATRate:          attr(el, "НалСт"),
+			AmountWithVAT:    parseDecimal(attr(el, "СтТовУчНал")),
+		}
+	case "ДопСведТов":
+		if d.item != nil {
+			d.item.Code = attr(el, "КодТов")
+			d.item.Article = attr(el, "АртикулТов")
+			if d.item.Article == "" {
+				d.item.Article = d.item.Code
+			}
+			if isGTIN(d.item.Code) {
+				d.item.GTIN = d.item.Code
+			}
+			d.item.Kind = attr(el, "ПрТовРаб")
+			d.item.CountryName = attr(el, "КрНаимСтрПр")
+			if d.item.UnitName == "" {
+				d.item.UnitName = attr(el, "НаимЕдИзм")
+			}
+		}
+	case "СвДТ":
+		if d.item != nil && d.item.CountryCode == "" {
+			d.item.CountryCode = attr(el, "КодПроисх")
+		}
+	case "ВсегоОпл":
+		d.totalNoVAT = attr(el, "СтТовБезНДСВсего")
+		d.totalWithVAT = attr(el, "СтТовУчНалВсего")
+	case "ОснПер":
+		if d.requisite == "" && d.parentIs("СвПер") {
+			d.requisite = attr(el, "РеквНомерДок")
+			d.requisiteDate = attr(el, "РеквДатаДок")
+			if d.requisite == "" && d.requisiteDate == "" {
+				// Format 5.01 basis document
+				d.requisite = attr(el, "НомОсн")
+				d.requisiteDate = attr(el, "ДатаОсн")
+			}
+		}
+	}
+}
+
+// handleEnd processes element text and returns a completed item
+func (d *UPDStreamDecoder) handleEnd(name string) *models.InvoiceItem {
+	text := strings.TrimSpace(d.text.String())
+
+	switch name {
+	case "СумНал":
+		if d.item != nil && d.parentIs("СумНал") {
+			d.item.VATAmount = parseDecimal(text)
+		} else if d.parentIs("СумНалВсего") || d.parentIs("ВсегоОпл") {
+			if text != "" {
+				d.totalVAT = text
+			}
+		}
+	case "Регион", "НаимРегион":
+		if party := d.currentParty(); party != nil && d.parentIs("АдрГАР") {
+			party.setText(name, text)
+		}
+	case "КрНаимСтрПр":
+		// Format 5.03 country name is an element
+		if d.item != nil && d.parentIs("ДопСведТов") && text != "" {
+			d.item.CountryName = text
+		}
+	case "СтТовБезНДСВсего":
+		if d.parentIs("ВсегоОпл") && text != "" {
+			d.totalNoVAT = text
+		}
+	case "СтТовУчНалВсего":
+		if d.parentIs("ВсегоОпл") && text != "" {
+			d.totalWithVAT = text
+		}
+	case "КИЗ":
+		// Marking code starts with GTIN: (01) and 14 digits
+		if d.item != nil && d.item.GTIN == "" && len(text) >= 16 && strings.HasPrefix(text, "01") && isGTIN(text[2:16]) {
+			d.item.GTIN = text[2:16]
+		}
+	case "СведТов":
+		item := d.item
+		d.item = nil
+		if item != nil {
+			d.itemCount++
+			d.logger.Debugf("Item %d: %s, article: %s, quantity: %s, price: %s, amount with VAT: %s",
+				item.LineNumber, item.Name, item.Article, item.Quantity, item.Price, item.AmountWithVAT)
+		}
+		return item
+	}
+
+	return nil
+}
+
+// currentParty returns the party the current element belongs to
+func (d *UPDStreamDecoder) currentParty() *partyInfo {
+	for i := len(d.path) - 1; i >= 0; i-- {
+		switch d.path[i] {
+		case "СвПрод":
+			return &d.seller
+		case "СвПокуп":
+			return &d.buyer
+		case "ГрузОт":
+			return &d.shipper
+		case "ГрузПолуч":
+			return &d.consignee
+		}
+	}
+	return nil
+}
+
+// parentIs checks the parent of the current element
+func (d *UPDStreamDecoder) parentIs(name string) bool {
+	return len(d.path) >= 2 && d.path[len(d.path)-2] == name
+}
+
+// within reports whether the decoder is inside the element
+func (d *UPDStreamDecoder) within(element string) bool {
+	for _, name := range d.path {
+		if name == element {
+			return true
+		}
+	}
+	return false
+}
+
+// apply fills party fields from element attributes
+func (pi *partyInfo) apply(el xml.StartElement) {
+	switch el.Name.Local {
+	case "СвЮЛУч":
+		pi.kind = models.PartyLegal
+		pi.legalName = attr(el, "НаимОрг")
+		pi.legalINN = attr(el, "ИННЮЛ")
+		pi.legalKPP = attr(el, "КПП")
+	case "СвИП":
+		pi.kind = models.PartyEntrepreneur
+		pi.individualINN = attr(el, "ИННФЛ")
+		// ОГРНИП is written in registration certificate details
+		pi.ogrn = ogrnRe.FindString(attr(el, "СвГосРегИП"))
+	case "СвФЛУчастФХЖ":
+		pi.kind = models.PartyIndividual
+		pi.individualINN = attr(el, "ИННФЛ")
+	case "ФИО":
+		if pi.kind != models.PartyLegal && pi.kind != "" && pi.surname == "" {
+			pi.surname = attr(el, "Фамилия")
+			pi.name = attr(el, "Имя")
+			pi.patronymic = attr(el, "Отчество")
+		}
+	case "АдрРФ":
+		pi.address = &models.Address{
+			PostalCode: attr(el, "Индекс"),
+			RegionCode: attr(el, "КодРегион"),
+			Region:     attr(el, "НаимРегион"),
+			District:   attr(el, "Район"),
+			City:       attr(el, "Город"),
+			Settlement: attr(el, "НаселПункт"),
+			Street:     attr(el, "Улица"),
+			House:      joinNonEmpty(" ", attr(el, "Дом"), attr(el, "Корпус")),
+			Apartment:  attr(el, "Кварт"),
+		}
+	case "АдрИнф":
+		pi.address = &models.Address{Street: attr(el, "АдрТекст")}
+	case "АдрГАР":
+		// Region code and name are elements, they are set by setText
+		pi.address = &models.Address{PostalCode: attr(el, "Индекс")}
+	case "МуниципРайон":
+		if pi.address != nil {
+			pi.address.District = attr(el, "Наим")
+		}
+	case "ГородСелПоселен":
+		if pi.address != nil {
+			pi.address.City = attr(el, "Наим")
+		}
+	case "НаселенПункт":
+		if pi.address != nil {
+			pi.address.Settlement = joinNonEmpty(" ", attr(el, "Вид"), attr(el, "Наим"))
+		}
+	case "ЭлУлДорСети":
+		if pi.address != nil {
+			pi.address.Street = joinNonEmpty(" ", attr(el, "Тип"), attr(el, "Наим"))
+		}
+	case "Здание":
+		if pi.address != nil {
+			pi.address.House = joinNonEmpty(" ", pi.address.House, attr(el, "Тип"), attr(el, "Номер"))
+		}
+	case "ПомещЗдания":
+		if pi.address != nil {
+			pi.address.Apartment = joinNonEmpty(" ", attr(el, "Тип"), attr(el, "Номер"))
+		}
+	case "БанкРекв":
+		pi.accounts = append(pi.accounts, models.BankAccount{AccountNumber: attr(el, "НомерСчета")})
+	case "СвБанк":
+		if n := len(pi.accounts); n > 0 {
+			pi.accounts[n-1].BankName = attr(el, "НаимБанк")
+			pi.accounts[n-1].BIC = attr(el, "БИК")
+			pi.accounts[n-1].CorrespondentAccount = attr(el, "КорСчет")
+		}
+	}
+}
+
+// setText fills party fields given as element text
+func (pi *partyInfo) setText(name, text string) {
+	if pi.address == nil || text == "" {
+		return
+	}
+	switch name {
+	case "Регион":
+		pi.address.RegionCode = text
+	case "НаимРегион":
+		pi.address.Region = text
+	}
+}
+
+// joinNonEmpty joins non-empty parts with separator
+func joinNonEmpty(sep string, parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+// organization converts collected party data to organization model
+func (pi *partyInfo) organization() models.Organization {
+	if pi.legalINN != "" {
+		return models.Organization{
+			Name:         pi.legalName,
+			INN:          pi.legalINN,
+			KPP:          pi.legalKPP,
+			Address:      pi.address,
+			Kind:         models.PartyLegal,
+			OKPO:         pi.okpo,
+			BankAccounts: pi.accounts,
+		}
+	}
+
+	if pi.individualINN != "" {
+		fullName := joinNonEmpty(" ", pi.surname, pi.name, pi.patronymic)
+		if fullName == "" {
+			fullName = "Не указано"
+		}
+		return models.Organization{
+			Name:         fullName,
+			INN:          pi.individualINN,
+			Address:      pi.address,
+			Kind:         pi.kind,
+			Surname:      pi.surname,
+			FirstName:    pi.name,
+			Patronymic:   pi.patronymic,
+			OGRN:         pi.ogrn,
+			OKPO:         pi.okpo,
+			BankAccounts: pi.accounts,
+		}
+	}
+
+	return models.Organization{
+		Name: "Не указано",
+		INN:  "0000000000",
+	}
+}
+
+// actualAddressOf returns shipper or consignee address as actual address of
+// the party when shipper or consignee is the party itself at another address
+func (pi *partyInfo) actualAddressOf(party *models.Organization) *models.Address {
+	inn := pi.legalINN
+	if inn == "" {
+		inn = pi.individualINN
+	}
+	if inn != party.INN || pi.address.String() == "" || pi.address.String() == party.Address.String() {
+		return nil
+	}
+	return pi.address
+}
+
+// attr returns attribute value by local name
+func attr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// parseDecimal safely parses decimal from string
+func parseDecimal(s string) decimal.Decimal {
+	if s == "" {
+		return decimal.Zero
+	}
+
+	if d, err := decimal.NewFromString(strings.TrimSpace(s)); err == nil {
+		return d
+	}
+
+	return decimal.Zero
+}
+
+// isGTIN reports whether product code looks like a barcode
+func isGTIN(code string) bool {
+	return gtinRe.MatchString(code)
+}
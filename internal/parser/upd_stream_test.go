@@ -0,0 +1,261 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"upd-loader-go/internal/generator"
+	"upd-loader-go/internal/models"
+)
+
+func discardLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// generatedUPD returns UPD XML in the encoding with the given number of lines
+func generatedUPD(tb testing.TB, encoding string, lines int) []byte {
+	tb.Helper()
+	spec := generator.Spec{
+		Seed:   1,
+		Number: "B-1",
+		Date:   "2025-07-01",
+		Seller: generator.PartySpec{Type: "legal", Name: "ООО \"Продавец\"", INN: "7843316106", KPP: "784301001"},
+		Buyer:  generator.PartySpec{Type: "legal", Name: "ООО \"Покупатель\"", INN: "7701234567", KPP: "770101001"},
+		Generate: &generator.GenerateSpec{
+			Count:        lines,
+			ArticleStart: 100000,
+			Quantities:   []string{"1", "0.5", "3.250"},
+			Prices:       []string{"99.90", "1250"},
+			VATRates:     []string{"20%", "10%", "без НДС"},
+		},
+	}
+	doc, err := spec.Document()
+	if err != nil {
+		tb.Fatalf("failed to build document: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := generator.WriteUPDXML(&buf, doc, generator.Options{Encoding: encoding}); err != nil {
+		tb.Fatalf("failed to write XML: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkUPDStreamDecoder(b *testing.B) {
+	for _, lines := range []int{1000, 10000, 50000} {
+		data := generatedUPD(b, "windows-1251", lines)
+		b.Run(fmt.Sprintf("%d_lines", lines), func(b *testing.B) {
+			logger := discardLogger()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				decoder := NewUPDStreamDecoder(bytes.NewReader(data), "", logger)
+				if _, err := decoder.DecodeItems(func(models.InvoiceItem) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+				if decoder.ItemCount() != lines {
+					b.Fatalf("decoded %d lines, want %d", decoder.ItemCount(), lines)
+				}
+			}
+		})
+	}
+}
+
+// peakStreamHeap streams a generated document of the given number of lines
+// from a file and returns the peak live heap growth observed while decoding
+func peakStreamHeap(t *testing.T, lines int) uint64 {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upd.xml")
+	if err := os.WriteFile(path, generatedUPD(t, "windows-1251", lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	var peak uint64
+	sample := func() {
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > baseline && stats.HeapAlloc-baseline > peak {
+			peak = stats.HeapAlloc - baseline
+		}
+	}
+
+	p := NewUPDParser("windows-1251", discardLogger())
+	count := 0
+	_, err = p.StreamUPDItems(file, func(models.InvoiceItem) error {
+		if count++; count%1000 == 0 {
+			sample()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("stream failed: %v", err)
+	}
+	if count != lines {
+		t.Fatalf("streamed %d lines, want %d", count, lines)
+	}
+	return peak
+}
+
+// TestStreamUPDItemsMemory checks that streaming keeps memory flat: the peak
+// live heap for 50k lines stays about the same as for 10k lines
+func TestStreamUPDItemsMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large documents in short mode")
+	}
+
+	peak10k := peakStreamHeap(t, 10000)
+	peak50k := peakStreamHeap(t, 50000)
+	t.Logf("peak live heap: 10k lines %d KB, 50k lines %d KB", peak10k/1024, peak50k/1024)
+
+	// Holding the lines would take several MB more for 40k extra lines
+	const slack = 512 * 1024
+	if peak50k > 2*peak10k+slack {
+		t.Errorf("peak heap grows with document size: 10k lines %d KB, 50k lines %d KB", peak10k/1024, peak50k/1024)
+	}
+}
+
+func TestStreamDecoderReadsGeneratedDocument(t *testing.T) {
+	decoder := NewUPDStreamDecoder(bytes.NewReader(generatedUPD(t, "windows-1251", 3)), "", discardLogger())
+
+	var items []models.InvoiceItem
+	content, err := decoder.DecodeItems(func(item models.InvoiceItem) error {
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("decoded %d lines, want 3", len(items))
+	}
+	if content.InvoiceNumber != "B-1" || content.Seller.INN != "7843316106" || content.Buyer.INN != "7701234567" {
+		t.Errorf("header = %s, %s, %s", content.InvoiceNumber, content.Seller.INN, content.Buyer.INN)
+	}
+	if items[0].Article != "100000" || items[2].VATRate != "без НДС" {
+		t.Errorf("lines = %+v", items)
+	}
+}
+
+func TestStreamDecoderReadsCountry(t *testing.T) {
+	spec := generator.Spec{
+		Number: "B-1",
+		Date:   "2025-07-01",
+		Seller: generator.PartySpec{Type: "legal", Name: "ООО \"Продавец\"", INN: "7843316106", KPP: "784301001"},
+		Buyer:  generator.PartySpec{Type: "legal", Name: "ООО \"Покупатель\"", INN: "7701234567", KPP: "770101001"},
+		Items:  []generator.ItemSpec{{Name: "Труба", Quantity: "1", Price: "100", VATRate: "20%"}},
+	}
+	doc, err := spec.Document()
+	if err != nil {
+		t.Fatalf("failed to build document: %v", err)
+	}
+	doc.Content.Items[0].CountryCode = "156"
+	doc.Content.Items[0].CountryName = "КИТАЙ"
+
+	var buf bytes.Buffer
+	if err := generator.WriteUPDXML(&buf, doc, generator.Options{}); err != nil {
+		t.Fatalf("failed to write XML: %v", err)
+	}
+
+	decoder := NewUPDStreamDecoder(&buf, "", discardLogger())
+	var items []models.InvoiceItem
+	if _, err := decoder.DecodeItems(func(item models.InvoiceItem) error {
+		items = append(items, item)
+		return nil
+	}); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(items) != 1 || items[0].CountryCode != "156" || items[0].CountryName != "КИТАЙ" {
+		t.Errorf("lines = %+v, want country 156 КИТАЙ", items)
+	}
+}
+
+func TestMalformedUPDReturnsError(t *testing.T) {
+	valid := string(generatedUPD(t, "utf-8", 3))
+
+	tests := []struct {
+		name string
+		xml  string
+	}{
+		{"truncated", valid[:len(valid)/2]},
+		{"mismatched tags", strings.Replace(valid, "</ТаблСчФакт>", "</СвСчФакт>", 1)},
+		{"not XML", "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<Файл><Документ"},
+		{"unknown encoding", "<?xml version=\"1.0\" encoding=\"koi9\"?>\n<Файл/>"},
+	}
+
+	p := NewUPDParser("utf-8", discardLogger())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := p.parseFullUPDContent(strings.NewReader(tt.xml))
+			if err == nil {
+				t.Fatalf("expected error, got content № %s with %d lines", content.InvoiceNumber, len(content.Items))
+			}
+
+			_, err = p.StreamUPDItems(strings.NewReader(tt.xml), func(models.InvoiceItem) error { return nil })
+			if err == nil {
+				t.Error("StreamUPDItems: expected error")
+			}
+		})
+	}
+}
+
+func TestUPDWithoutEncodingDeclaration(t *testing.T) {
+	withoutProlog := func(data []byte) string {
+		_, rest, _ := strings.Cut(string(data), "\n")
+		return rest
+	}
+
+	tests := []struct {
+		name            string
+		xml             string
+		defaultEncoding string
+		wantErr         bool
+	}{
+		{"windows-1251 without prolog", withoutProlog(generatedUPD(t, "windows-1251", 3)), "windows-1251", false},
+		{"windows-1251 with prolog without encoding", `<?xml version="1.0"?>` + "\n" + withoutProlog(generatedUPD(t, "windows-1251", 3)), "windows-1251", false},
+		{"utf-8 without prolog", withoutProlog(generatedUPD(t, "utf-8", 3)), "windows-1251", false},
+		{"declared encoding wins", string(generatedUPD(t, "utf-8", 3)), "windows-1251", false},
+		{"windows-1251 read as utf-8", withoutProlog(generatedUPD(t, "windows-1251", 3)), "utf-8", true},
+		{"unknown default encoding", withoutProlog(generatedUPD(t, "windows-1251", 3)), "koi9", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewUPDParser(tt.defaultEncoding, discardLogger())
+			content, err := p.parseFullUPDContent(strings.NewReader(tt.xml))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %d lines", len(content.Items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if content.Seller.Name != "ООО \"Продавец\"" || len(content.Items) != 3 || content.Items[0].Name != "Товар 1" {
+				t.Errorf("seller %q, %d lines: %+v", content.Seller.Name, len(content.Items), content.Items)
+			}
+		})
+	}
+}
@@ -1,30 +1,70 @@
 package processor
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
 	"upd-loader-go/internal/config"
+	"upd-loader-go/internal/generator"
 	"upd-loader-go/internal/models"
 	"upd-loader-go/internal/moysklad"
 	"upd-loader-go/internal/parser"
+	"upd-loader-go/internal/render"
+	"upd-loader-go/internal/xsd"
 )
 
+// maxReportedViolations limits schema violations listed in export error
+const maxReportedViolations = 5
+
 // UPDProcessor handles UPD document processing
 type UPDProcessor struct {
 	config     *config.Config
 	parser     *parser.UPDParser
 	moyskladAPI *moysklad.API
 	logger     *logrus.Logger
+
+	schemaOnce sync.Once
+	schema     *xsd.Schema
+	schemaErr  error
 }
 
 // NewUPDProcessor creates a new UPD processor
 func NewUPDProcessor(cfg *config.Config, logger *logrus.Logger) *UPDProcessor {
 	updParser := parser.NewUPDParser(cfg.UPDEncoding, logger)
-	moyskladAPI := moysklad.NewAPI(cfg.MoySkladAPIURL, cfg.MoySkladAPIToken, cfg.MoySkladOrganizationID, logger)
+	limits := moysklad.DefaultLimits()
+	limits.RequestsPerSecond = cfg.MoySkladRateLimit
+	limits.MaxConcurrent = cfg.MoySkladMaxConcurrent
+	limits.MaxRetries = cfg.MoySkladMaxRetries
+	cacheOptions := moysklad.CacheOptions{
+		TTL:        cfg.MoySkladCacheTTL,
+		MaxEntries: cfg.MoySkladCacheSize,
+		FilePath:   cfg.MoySkladCacheFile,
+	}
+	uploadOptions := moysklad.UploadOptions{
+		MissingProducts:  cfg.MissingProducts,
+		QuarantineFolder: cfg.QuarantineFolder,
+		MappingsFile:     cfg.ItemMappingsFile,
+		MatchThreshold:   cfg.MatchThreshold,
+		MatchStrategies:  cfg.MatchStrategies,
+
+		CounterpartyUpdates: cfg.CounterpartyUpdates,
+		CounterpartyGroups:  cfg.CounterpartyGroups,
+
+		CounterpartyStores: cfg.CounterpartyStores,
+		OrganizationStores: cfg.OrganizationStores,
+		StockCheck:         cfg.StockCheck,
+
+		Attributes: cfg.DocumentAttributes,
+	}
+	moyskladAPI := moysklad.NewAPI(cfg.MoySkladAPIURL, cfg.MoySkladAPIToken, cfg.MoySkladOrganizationID, limits, cacheOptions, uploadOptions, logger)
 
 	return &UPDProcessor{
 		config:      cfg,
@@ -36,6 +76,71 @@ func NewUPDProcessor(cfg *config.Config, logger *logrus.Logger) *UPDProcessor {
 
 // ProcessUPDFile processes UPD file
 func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *models.ProcessingResult {
+	updDocument, failure := p.parseUPDFile(fileContent, filename)
+	if failure != nil {
+		return failure
+	}
+
+	// Upload to MoySkald
+	uploadResult, err := p.uploadToMoySkald(updDocument, p.attachments(updDocument, fileContent, filename))
+	if err != nil {
+		p.logger.Errorf("MoySkald API error: %v", err)
+		return p.createUploadErrorResult(err)
+	}
+
+	// Create success result
+	return p.createSuccessResult(updDocument, uploadResult)
+}
+
+// PlanUPDFile parses UPD file and builds upload plan without writing to
+// MoySkald. Result is returned only when planning failed.
+func (p *UPDProcessor) PlanUPDFile(fileContent []byte, filename string) (*moysklad.UploadPlan, *models.ProcessingResult) {
+	updDocument, failure := p.parseUPDFile(fileContent, filename)
+	if failure != nil {
+		return nil, failure
+	}
+
+	p.logger.Info("Planning upload to MoySkald...")
+	if !p.moyskladAPI.VerifyToken() {
+		return nil, &models.ProcessingResult{
+			Success:   false,
+			Message:   "❌ MoySkald upload error:\ninvalid MoySkald API token",
+			ErrorCode: "MOYSKLAD_API_ERROR",
+		}
+	}
+
+	plan, err := p.moyskladAPI.PlanUpload(updDocument)
+	if err != nil {
+		p.logger.Errorf("MoySkald API error: %v", err)
+		return nil, p.createUploadErrorResult(err)
+	}
+	if !plan.AlreadyLoaded() {
+		plan.Attachments = p.attachments(updDocument, fileContent, filename)
+	}
+
+	return plan, nil
+}
+
+// ExecutePlan uploads UPD to MoySkald exactly as described by the plan
+func (p *UPDProcessor) ExecutePlan(plan *moysklad.UploadPlan) *models.ProcessingResult {
+	p.logger.Info("Uploading to MoySkald by plan...")
+
+	if !p.moyskladAPI.VerifyToken() {
+		return p.createUploadErrorResult(fmt.Errorf("invalid MoySkald API token"))
+	}
+
+	uploadResult, err := p.moyskladAPI.ExecutePlan(plan)
+	if err != nil {
+		p.logger.Errorf("MoySkald API error: %v", err)
+		return p.createUploadErrorResult(err)
+	}
+
+	return p.createSuccessResult(plan.UPDDocument, uploadResult)
+}
+
+// parseUPDFile validates and parses UPD file. Result is returned only when
+// the file cannot be processed.
+func (p *UPDProcessor) parseUPDFile(fileContent []byte, filename string) (*models.UPDDocument, *models.ProcessingResult) {
 	var tempZipPath string
 
 	defer func() {
@@ -48,7 +153,7 @@ func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *mode
 
 	// Check file size
 	if int64(len(fileContent)) > p.config.MaxFileSize {
-		return &models.ProcessingResult{
+		return nil, &models.ProcessingResult{
 			Success:   false,
 			Message:   fmt.Sprintf("❌ File too large. Maximum size: %d MB", p.config.MaxFileSize/1024/1024),
 			ErrorCode: "FILE_TOO_LARGE",
@@ -57,7 +162,7 @@ func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *mode
 
 	// Check file extension
 	if !strings.HasSuffix(strings.ToLower(filename), ".zip") {
-		return &models.ProcessingResult{
+		return nil, &models.ProcessingResult{
 			Success:   false,
 			Message:   "❌ Only ZIP archives with UPD are supported",
 			ErrorCode: "INVALID_FILE_TYPE",
@@ -66,7 +171,7 @@ func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *mode
 
 	// Create temporary file
 	if err := p.config.EnsureTempDir(); err != nil {
-		return &models.ProcessingResult{
+		return nil, &models.ProcessingResult{
 			Success:   false,
 			Message:   fmt.Sprintf("❌ Failed to create temp directory: %v", err),
 			ErrorCode: "TEMP_DIR_ERROR",
@@ -76,7 +181,7 @@ func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *mode
 	var err error
 	tempZipPath, err = p.saveTempFile(fileContent, filename)
 	if err != nil {
-		return &models.ProcessingResult{
+		return nil, &models.ProcessingResult{
 			Success:   false,
 			Message:   fmt.Sprintf("❌ Failed to save temp file: %v", err),
 			ErrorCode: "TEMP_FILE_ERROR",
@@ -87,26 +192,14 @@ func (p *UPDProcessor) ProcessUPDFile(fileContent []byte, filename string) *mode
 	updDocument, err := p.parseUPD(tempZipPath)
 	if err != nil {
 		p.logger.Errorf("UPD parsing error: %v", err)
-		return &models.ProcessingResult{
+		return nil, &models.ProcessingResult{
 			Success:   false,
 			Message:   fmt.Sprintf("❌ UPD processing error:\n%v", err),
 			ErrorCode: "PARSING_ERROR",
 		}
 	}
 
-	// Upload to MoySkald
-	invoiceResult, err := p.uploadToMoySkald(updDocument)
-	if err != nil {
-		p.logger.Errorf("MoySkald API error: %v", err)
-		return &models.ProcessingResult{
-			Success:   false,
-			Message:   fmt.Sprintf("❌ MoySkald upload error:\n%v", err),
-			ErrorCode: "MOYSKLAD_API_ERROR",
-		}
-	}
-
-	// Create success result
-	return p.createSuccessResult(updDocument, invoiceResult)
+	return updDocument, nil
 }
 
 // saveTempFile saves temporary file
@@ -132,7 +225,7 @@ func (p *UPDProcessor) parseUPD(zipPath string) (*models.UPDDocument, error) {
 }
 
 // uploadToMoySkald uploads to MoySkald
-func (p *UPDProcessor) uploadToMoySkald(updDocument *models.UPDDocument) (map[string]interface{}, error) {
+func (p *UPDProcessor) uploadToMoySkald(updDocument *models.UPDDocument, attachments []models.RenderedFile) (*moysklad.UploadResult, error) {
 	p.logger.Info("Uploading to MoySkald...")
 
 	// Verify token
@@ -141,43 +234,115 @@ func (p *UPDProcessor) uploadToMoySkald(updDocument *models.UPDDocument) (map[st
 	}
 
 	// Create invoice
-	return p.moyskladAPI.CreateInvoiceFromUPD(updDocument)
+	return p.moyskladAPI.CreateInvoiceFromUPD(updDocument, attachments)
 }
 
-// createSuccessResult creates successful processing result
-func (p *UPDProcessor) createSuccessResult(updDocument *models.UPDDocument, invoiceResult map[string]interface{}) *models.ProcessingResult {
-	// New response structure contains factureout and demand
-	factureout, _ := invoiceResult["factureout"].(map[string]interface{})
-	demand, _ := invoiceResult["demand"].(map[string]interface{})
+// attachments returns files attached to created documents according to
+// ATTACH_FILES: the original archive and printable forms named after ИдФайл
+func (p *UPDProcessor) attachments(updDocument *models.UPDDocument, fileContent []byte, filename string) []models.RenderedFile {
+	if p.config.AttachFiles == "none" {
+		return nil
+	}
+
+	baseName := updDocument.FileName()
+	if baseName == "" {
+		baseName = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
 
-	var invoiceID, invoiceName, demandID, demandName string
-	if factureout != nil {
-		invoiceID, _ = factureout["id"].(string)
-		invoiceName, _ = factureout["name"].(string)
+	files := []models.RenderedFile{{FileName: baseName + ".zip", Content: fileContent}}
+	if p.config.AttachFiles == "all" {
+		for _, file := range p.RenderPrintable(updDocument) {
+			files = append(files, models.RenderedFile{FileName: baseName + filepath.Ext(file.FileName), Content: file.Content})
+		}
 	}
-	if demand != nil {
-		demandID, _ = demand["id"].(string)
-		demandName, _ = demand["name"].(string)
+	return files
+}
+
+// createSuccessResult creates successful processing result
+func (p *UPDProcessor) createSuccessResult(updDocument *models.UPDDocument, uploadResult *moysklad.UploadResult) *models.ProcessingResult {
+	var invoiceID, invoiceName, baseID, baseName string
+	var invoiceURL, baseURL string
+
+	// Invoice and base document are factureout and demand for sales,
+	// facturein and supply for purchases
+	purchase := uploadResult.Direction == moysklad.DirectionPurchase
+	if purchase {
+		if uploadResult.FactureIn != nil {
+			invoiceID, invoiceName = uploadResult.FactureIn.ID, uploadResult.FactureIn.Name
+		}
+		if uploadResult.Supply != nil {
+			baseID, baseName = uploadResult.Supply.ID, uploadResult.Supply.Name
+		}
+		if invoiceID != "" {
+			invoiceURL = p.moyskladAPI.GetFactureInURL(invoiceID)
+		}
+		if baseID != "" {
+			baseURL = p.moyskladAPI.GetSupplyURL(baseID)
+		}
+	} else {
+		if uploadResult.FactureOut != nil {
+			invoiceID, invoiceName = uploadResult.FactureOut.ID, uploadResult.FactureOut.Name
+		}
+		if uploadResult.Demand != nil {
+			baseID, baseName = uploadResult.Demand.ID, uploadResult.Demand.Name
+		}
+		if invoiceID != "" {
+			invoiceURL = p.moyskladAPI.GetInvoiceURL(invoiceID)
+		}
+		if baseID != "" {
+			baseURL = p.moyskladAPI.GetDemandURL(baseID)
+		}
 	}
 
 	if invoiceName == "" {
 		invoiceName = "Не указано"
 	}
-	if demandName == "" {
-		demandName = "Не указано"
+	if baseName == "" {
+		baseName = "Не указано"
 	}
 
-	// Get document URLs
-	var invoiceURL, demandURL string
-	if invoiceID != "" {
-		invoiceURL = p.moyskladAPI.GetInvoiceURL(invoiceID)
+	// Format detailed message
+	message := p.formatSuccessMessage(updDocument, purchase, invoiceName, invoiceURL, baseName, baseURL, uploadResult.AlreadyExists)
+	if len(uploadResult.AttachedFiles) > 0 {
+		message += fmt.Sprintf("\n📎 Attached to documents: %s", strings.Join(uploadResult.AttachedFiles, ", "))
 	}
-	if demandID != "" {
-		demandURL = p.moyskladAPI.GetDemandURL(demandID)
+	if len(uploadResult.CreatedAssortment) > 0 {
+		message += "\n\n🆕 Created in MoySkald, check before use:\n"
+		for _, item := range uploadResult.CreatedAssortment {
+			message += fmt.Sprintf("• %s\n", item)
+		}
+	}
+	if len(uploadResult.CounterpartyChanges) > 0 {
+		if uploadResult.CounterpartyUpdated {
+			message += "\n\n📝 Counterparty requisites updated from UPD:\n"
+		} else {
+			message += "\n\n📝 Counterparty requisites in MoySkald differ from UPD:\n"
+		}
+		for _, change := range uploadResult.CounterpartyChanges {
+			if change.Field == "accounts" {
+				message += fmt.Sprintf("• new bank account %s\n", change.New)
+			} else if change.Old == "" {
+				message += fmt.Sprintf("• %s: %s\n", change.Field, change.New)
+			} else {
+				message += fmt.Sprintf("• %s: %s → %s\n", change.Field, change.Old, change.New)
+			}
+		}
+	}
+	if len(uploadResult.StockShortages) > 0 {
+		message += "\n\n⚠️ Shipped quantity exceeds store stock:\n"
+		for _, shortage := range uploadResult.StockShortages {
+			message += fmt.Sprintf("• %s\n", shortage)
+		}
+	}
+	if len(uploadResult.AttachmentErrors) > 0 {
+		message += "\n\n⚠️ Could not attach UPD files, attach them manually in MoySkald:\n"
+		for _, failure := range uploadResult.AttachmentErrors {
+			message += fmt.Sprintf("• %s\n", failure)
+		}
+	}
+	if !uploadResult.Residual.IsZero() {
+		message += fmt.Sprintf("\n\n⚠️ Document total differs from UPD total by %s %s, check prices and quantities", uploadResult.Residual.StringFixed(2), updDocument.Content.CurrencySymbol())
 	}
-
-	// Format detailed message
-	message := p.formatSuccessMessage(updDocument, invoiceName, invoiceURL, demandName, demandURL, invoiceResult)
 
 	return &models.ProcessingResult{
 		Success:            true,
@@ -185,18 +350,77 @@ func (p *UPDProcessor) createSuccessResult(updDocument *models.UPDDocument, invo
 		UPDDocument:        updDocument,
 		MoySkladInvoiceID:  invoiceID,
 		MoySkladInvoiceURL: invoiceURL,
+		AlreadyLoaded:      uploadResult.AlreadyExists,
+		CreatedProducts:    uploadResult.CreatedAssortment,
+	}
+}
+
+// createUploadErrorResult creates failed upload result including rollback
+// of documents created before the failure
+func (p *UPDProcessor) createUploadErrorResult(err error) *models.ProcessingResult {
+	result := &models.ProcessingResult{
+		Success:   false,
+		Message:   fmt.Sprintf("❌ MoySkald upload error:\n%v", err),
+		ErrorCode: "MOYSKLAD_API_ERROR",
+	}
+
+	// Unmatched lines are offered to the user with candidates to choose from
+	var unmatchedErr *moysklad.UnmatchedItemsError
+	if errors.As(err, &unmatchedErr) {
+		result.UnmatchedItems = unmatchedErr.Items
+		result.ErrorCode = "PRODUCTS_NOT_MATCHED"
+	}
+
+	// Unresolved demand or supply store is chosen by the user
+	var storeErr *moysklad.StoreChoiceError
+	if errors.As(err, &storeErr) {
+		result.StoreChoice = &storeErr.Choice
+		result.ErrorCode = "STORE_NOT_RESOLVED"
+	}
+
+	var uploadErr *moysklad.UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.Rollback == nil {
+		return result
+	}
+
+	result.RolledBack = uploadErr.Rollback.RolledBack
+	result.RollbackFailed = uploadErr.Rollback.Failed
+
+	if len(result.RolledBack) > 0 {
+		result.Message += "\n\n↩️ Rolled back:\n"
+		for _, item := range result.RolledBack {
+			result.Message += fmt.Sprintf("• %s\n", item)
+		}
 	}
+	if len(result.RollbackFailed) > 0 {
+		result.Message += "\n⚠️ Could not roll back, remove manually in MoySkald:\n"
+		for _, item := range result.RollbackFailed {
+			result.Message += fmt.Sprintf("• %s\n", item)
+		}
+		result.ErrorCode = "MOYSKLAD_ROLLBACK_ERROR"
+	}
+
+	return result
 }
 
-// formatSuccessMessage formats success message
-func (p *UPDProcessor) formatSuccessMessage(updDocument *models.UPDDocument, invoiceName, invoiceURL, demandName, demandURL string, invoiceResult map[string]interface{}) string {
+// formatSuccessMessage formats success message. Base document is the demand
+// for sales and the supply for purchases.
+func (p *UPDProcessor) formatSuccessMessage(updDocument *models.UPDDocument, purchase bool, invoiceName, invoiceURL, baseName, baseURL string, alreadyLoaded bool) string {
 	content := updDocument.Content
 
+	invoiceLabel, baseLabel := "Invoice", "Shipment"
+	if purchase {
+		invoiceLabel, baseLabel = "Received invoice", "Supply"
+	}
+
 	message := "✅ UPD successfully processed and uploaded to MoySkald!\n\n"
+	if alreadyLoaded {
+		message = "ℹ️ This UPD was already loaded to MoySkald, no new documents created.\n\n"
+	}
 
 	// Information about created documents
-	message += fmt.Sprintf("📄 Invoice: %s\n", invoiceName)
-	message += fmt.Sprintf("📦 Shipment: %s\n", demandName)
+	message += fmt.Sprintf("📄 %s: %s\n", invoiceLabel, invoiceName)
+	message += fmt.Sprintf("📦 %s: %s\n", baseLabel, baseName)
 	message += fmt.Sprintf(" Date: %s\n\n", content.InvoiceDate.Format("02.01.2006"))
 
 	// Information about participants
@@ -213,19 +437,24 @@ func (p *UPDProcessor) formatSuccessMessage(updDocument *models.UPDDocument, inv
 	message += "\n\n"
 
 	// Financial information
+	currency := content.CurrencySymbol()
 	if content.TotalWithVAT.GreaterThan(content.TotalWithoutVAT) {
-		message += fmt.Sprintf("💰 Amount without VAT: %s ₽\n", content.TotalWithoutVAT.StringFixed(2))
-		message += fmt.Sprintf("🧾 VAT: %s ₽\n", content.TotalVAT.StringFixed(2))
-		message += fmt.Sprintf("💵 Total with VAT: %s ₽\n\n", content.TotalWithVAT.StringFixed(2))
+		message += fmt.Sprintf("💰 Amount without VAT: %s %s\n", content.TotalWithoutVAT.StringFixed(2), currency)
+		message += fmt.Sprintf("🧾 VAT: %s %s\n", content.TotalVAT.StringFixed(2), currency)
+		message += fmt.Sprintf("💵 Total with VAT: %s %s\n", content.TotalWithVAT.StringFixed(2), currency)
+		if !content.IsDefaultCurrency() {
+			message += fmt.Sprintf("💱 Currency: %s, rate %s\n", content.CurrencyISOCode(), content.ExchangeRate.String())
+		}
+		message += "\n"
 	}
 
 	// Links to documents
 	message += "🔗 Links in MoySkald:\n"
 	if invoiceURL != "" {
-		message += fmt.Sprintf("• Invoice: %s\n", invoiceURL)
+		message += fmt.Sprintf("• %s: %s\n", invoiceLabel, invoiceURL)
 	}
-	if demandURL != "" {
-		message += fmt.Sprintf("• Shipment: %s\n", demandURL)
+	if baseURL != "" {
+		message += fmt.Sprintf("• %s: %s\n", baseLabel, baseURL)
 	}
 
 	if updDocument.MetaInfo.DocFlowID != "" {
@@ -245,7 +474,184 @@ func (p *UPDProcessor) CheckMoySkaldConnection() bool {
 	return p.moyskladAPI.VerifyToken()
 }
 
+// VerifyAttributes reports attributes configured for UPD metadata that are
+// missing in MoySkald. UPD are still loaded without such attributes.
+func (p *UPDProcessor) VerifyAttributes() []string {
+	problems, err := p.moyskladAPI.VerifyAttributes()
+	if err != nil {
+		p.logger.Warningf("Failed to verify document attributes: %v", err)
+		return nil
+	}
+	for _, problem := range problems {
+		p.logger.Warningf("Document attribute problem: %s", problem)
+	}
+	return problems
+}
+
 // GetMoySkaldStatus gets detailed MoySkald API status
-func (p *UPDProcessor) GetMoySkaldStatus() map[string]interface{} {
+func (p *UPDProcessor) GetMoySkaldStatus() *moysklad.AccessStatus {
 	return p.moyskladAPI.VerifyAPIAccess()
-}
\ No newline at end of file
+}
+
+// ExportDemandUPD builds an outgoing UPD container for MoySkald demand.
+// demandRef is a demand ID or a link to the demand in MoySkald web interface.
+func (p *UPDProcessor) ExportDemandUPD(demandRef string) (*models.ExportResult, error) {
+	demandID := parseDemandID(demandRef)
+	if demandID == "" {
+		return nil, fmt.Errorf("demand ID not specified")
+	}
+
+	p.logger.Infof("Exporting UPD for demand %s", demandID)
+
+	content, err := p.moyskladAPI.GetDemandUPDContent(demandID)
+	if err != nil {
+		return nil, err
+	}
+
+	document := generator.NewDocument(content, generator.FormatVersion, models.NewUUID(), models.NewUUID())
+	if err := p.validateExport(document); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := generator.WriteContainer(&buf, document, generator.Options{}); err != nil {
+		return nil, fmt.Errorf("failed to build UPD container: %v", err)
+	}
+
+	p.logger.Infof("UPD container built: %s", document.CardInfo.ExternalIdentifier)
+	return &models.ExportResult{
+		FileName:    document.CardInfo.ExternalIdentifier + ".zip",
+		Content:     buf.Bytes(),
+		UPDDocument: document,
+	}, nil
+}
+
+// validateExport checks UPD XML of the exported document against the schema
+// UPD_XSD_PATH, so documents EDO operators would reject are not sent
+func (p *UPDProcessor) validateExport(document *models.UPDDocument) error {
+	if p.config.UPDSchemaPath == "" {
+		return nil
+	}
+
+	p.schemaOnce.Do(func() {
+		p.schema, p.schemaErr = xsd.LoadFile(p.config.UPDSchemaPath)
+	})
+	if p.schemaErr != nil {
+		return fmt.Errorf("failed to load UPD schema: %v", p.schemaErr)
+	}
+
+	var buf bytes.Buffer
+	if err := generator.WriteUPDXML(&buf, document, generator.Options{}); err != nil {
+		return fmt.Errorf("failed to build UPD XML: %v", err)
+	}
+	violations, err := p.schema.Validate(&buf)
+	if err != nil {
+		return fmt.Errorf("failed to validate UPD XML: %v", err)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	for _, violation := range violations {
+		p.logger.Warningf("Exported UPD schema violation: %s", violation)
+	}
+	messages := make([]string, 0, maxReportedViolations)
+	for _, violation := range violations[:min(len(violations), maxReportedViolations)] {
+		messages = append(messages, violation.Error())
+	}
+	if len(violations) > maxReportedViolations {
+		messages = append(messages, fmt.Sprintf("...and %d more", len(violations)-maxReportedViolations))
+	}
+	return fmt.Errorf("UPD does not match the schema:\n%s", strings.Join(messages, "\n"))
+}
+
+// ExportMappings returns counterparty item mappings as CSV file
+func (p *UPDProcessor) ExportMappings() (*models.RenderedFile, int, error) {
+	content, count, err := p.moyskladAPI.ExportMappings()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to export mappings: %v", err)
+	}
+	return &models.RenderedFile{FileName: "item_mappings.csv", Content: content}, count, nil
+}
+
+// ImportMappings imports counterparty item mappings from CSV file
+func (p *UPDProcessor) ImportMappings(fileContent []byte) (int, error) {
+	return p.moyskladAPI.ImportMappings(fileContent)
+}
+
+// LearnMapping maps counterparty item to MoySkald product or service.
+// args are counterparty INN, supplier article, supplier name and MoySkald
+// article or name separated by semicolons; supplier article may be empty.
+func (p *UPDProcessor) LearnMapping(args string) (*moysklad.ItemMapping, error) {
+	parts := strings.Split(args, ";")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("expected 4 fields separated by semicolons, got %d", len(parts))
+	}
+	return p.moyskladAPI.LearnMapping(parts[0], parts[1], parts[2], parts[3])
+}
+
+// ChooseCandidate remembers the candidate chosen by the user for an
+// unmatched UPD line, so the next upload matches the line by mapping
+func (p *UPDProcessor) ChooseCandidate(item models.UnmatchedItem, candidate models.MatchCandidate) (*moysklad.ItemMapping, error) {
+	return p.moyskladAPI.SaveMapping(&moysklad.ItemMapping{
+		SupplierINN:     item.PartyINN,
+		SupplierArticle: item.Article,
+		SupplierName:    item.Name,
+		AssortmentType:  candidate.Type,
+		AssortmentID:    candidate.ID,
+		AssortmentName:  candidate.Name,
+	})
+}
+
+// ChooseStore remembers the store chosen by the user for documents with the
+// counterparty, so the next upload ships from or receives to it
+func (p *UPDProcessor) ChooseStore(choice models.StoreChoice, storeID string) (*moysklad.Store, error) {
+	return p.moyskladAPI.ChooseStore(choice.Direction, choice.PartyINN, storeID)
+}
+
+// RenderPrintable renders printable UPD forms according to PRINTABLE_FORMAT.
+// PDF rendering errors fall back to HTML so the user still gets a printable form.
+func (p *UPDProcessor) RenderPrintable(updDocument *models.UPDDocument) []models.RenderedFile {
+	format := p.config.PrintableFormat
+	if format == "none" || updDocument == nil {
+		return nil
+	}
+
+	baseName := fmt.Sprintf("УПД_%s_%s", updDocument.Content.InvoiceNumber, updDocument.Content.InvoiceDate.Format("2006-01-02"))
+	baseName = strings.NewReplacer("/", "-", "\\", "-", " ", "_").Replace(baseName)
+
+	var files []models.RenderedFile
+	needHTML := format == "html" || format == "both"
+
+	if format == "pdf" || format == "both" {
+		var buf bytes.Buffer
+		if err := render.PDF(&buf, updDocument, p.config.PDFFontPath); err != nil {
+			p.logger.Warnf("PDF rendering failed, falling back to HTML: %v", err)
+			needHTML = true
+		} else {
+			files = append(files, models.RenderedFile{FileName: baseName + ".pdf", Content: buf.Bytes()})
+		}
+	}
+
+	if needHTML {
+		var buf bytes.Buffer
+		if err := render.HTML(&buf, updDocument); err != nil {
+			p.logger.Errorf("HTML rendering failed: %v", err)
+		} else {
+			files = append(files, models.RenderedFile{FileName: baseName + ".html", Content: buf.Bytes()})
+		}
+	}
+
+	return files
+}
+
+// parseDemandID extracts demand ID from ID or MoySkald web link
+func parseDemandID(demandRef string) string {
+	demandRef = strings.TrimSpace(demandRef)
+	if i := strings.Index(demandRef, "?"); i >= 0 {
+		if values, err := url.ParseQuery(demandRef[i+1:]); err == nil && values.Get("id") != "" {
+			return values.Get("id")
+		}
+	}
+	return demandRef
+}
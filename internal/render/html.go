@@ -0,0 +1,144 @@
+package render
+
+import (
+	"html/template"
+	"io"
+
+	"upd-loader-go/internal/models"
+)
+
+var htmlTemplate = template.Must(template.New("upd").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>УПД № {{.Number}} от {{.Date}}</title>
+<style>
+@page { size: A4 landscape; margin: 8mm; }
+body { font-family: Arial, "DejaVu Sans", sans-serif; font-size: 8pt; margin: 0; }
+table { border-collapse: collapse; width: 100%; }
+.header td { vertical-align: top; padding: 1px 3px; }
+.status { width: 110px; border-right: 2px solid #000; }
+.status .box { border: 1px solid #000; display: inline-block; padding: 0 6px; }
+.field { border-bottom: 1px solid #000; }
+.num { width: 30px; text-align: right; white-space: nowrap; }
+.goods { margin-top: 6px; }
+.goods th, .goods td { border: 1px solid #000; padding: 1px 3px; }
+.goods th { font-weight: normal; text-align: center; }
+.goods td.r { text-align: right; white-space: nowrap; }
+.goods td.c { text-align: center; }
+.goods tr.total td { font-weight: bold; }
+.signs { margin-top: 8px; }
+.signs td { padding: 6px 3px 1px; vertical-align: bottom; }
+.signs .line { border-bottom: 1px solid #000; min-width: 120px; }
+.signs .hint { font-size: 6pt; text-align: center; vertical-align: top; padding-top: 0; }
+.transfer { margin-top: 8px; border-top: 2px solid #000; }
+.transfer td { width: 50%; vertical-align: top; padding: 3px; }
+.transfer td + td { border-left: 2px solid #000; }
+</style>
+</head>
+<body>
+<table class="header">
+<tr>
+<td class="status" rowspan="12">
+<b>Универсальный передаточный документ</b><br><br>
+Статус: <span class="box">{{.Status}}</span><br><br>
+<small>1 — счет-фактура и передаточный документ (акт)<br>2 — передаточный документ (акт)</small>
+</td>
+<td colspan="2">Счет-фактура № <span class="field">{{.Number}}</span> от <span class="field">{{.Date}}</span></td>
+<td class="num">(1)</td>
+</tr>
+<tr><td colspan="2">Исправление № <span class="field">--</span> от <span class="field">--</span></td><td class="num">(1а)</td></tr>
+<tr><td>Продавец:</td><td class="field">{{.Seller.Name}}</td><td class="num">(2)</td></tr>
+<tr><td>Адрес:</td><td class="field">{{.Seller.Address}}</td><td class="num">(2а)</td></tr>
+<tr><td>ИНН/КПП продавца:</td><td class="field">{{.Seller.INNKPP}}</td><td class="num">(2б)</td></tr>
+<tr><td>Грузоотправитель и его адрес:</td><td class="field">{{.Consignor}}</td><td class="num">(3)</td></tr>
+<tr><td>Грузополучатель и его адрес:</td><td class="field">{{.Consignee}}</td><td class="num">(4)</td></tr>
+<tr><td>К платежно-расчетному документу:</td><td class="field">{{.PaymentDoc}}</td><td class="num">(5)</td></tr>
+<tr><td>Документ об отгрузке:</td><td class="field">{{.ShipmentDoc}}</td><td class="num">(5а)</td></tr>
+<tr><td>Покупатель:</td><td class="field">{{.Buyer.Name}}</td><td class="num">(6)</td></tr>
+<tr><td>Адрес:</td><td class="field">{{.Buyer.Address}}</td><td class="num">(6а)</td></tr>
+<tr><td>ИНН/КПП покупателя:</td><td class="field">{{.Buyer.INNKPP}}</td><td class="num">(6б)</td></tr>
+<tr><td></td><td>Валюта: наименование, код:</td><td class="field">{{.CurrencyName}}, {{.CurrencyCode}}</td><td class="num">(7)</td></tr>
+<tr><td></td><td>Идентификатор государственного контракта, договора (соглашения) (при наличии):</td><td class="field">--</td><td class="num">(8)</td></tr>
+</table>
+
+<table class="goods">
+<thead>
+<tr>
+<th rowspan="2">№ п/п</th>
+<th rowspan="2">Код товара/ работ, услуг</th>
+<th rowspan="2">Наименование товара (описание выполненных работ, оказанных услуг), имущественного права</th>
+<th rowspan="2">Код вида товара</th>
+<th colspan="2">Единица измерения</th>
+<th rowspan="2">Коли&shy;чество (объем)</th>
+<th rowspan="2">Цена (тариф) за единицу измерения</th>
+<th rowspan="2">Стоимость товаров (работ, услуг), имущественных прав без налога — всего</th>
+<th rowspan="2">В том числе сумма акциза</th>
+<th rowspan="2">Нало&shy;говая ставка</th>
+<th rowspan="2">Сумма налога, предъявляемая покупателю</th>
+<th rowspan="2">Стоимость товаров (работ, услуг), имущественных прав с налогом — всего</th>
+<th colspan="2">Страна происхождения товара</th>
+<th rowspan="2">Регистрационный номер декларации на товары или партии товаров</th>
+</tr>
+<tr><th>код</th><th>условное обозначение (национальное)</th><th>цифровой код</th><th>краткое наименование</th></tr>
+<tr><th>А</th><th>Б</th><th>1</th><th>1а</th><th>2</th><th>2а</th><th>3</th><th>4</th><th>5</th><th>6</th><th>7</th><th>8</th><th>9</th><th>10</th><th>10а</th><th>11</th></tr>
+</thead>
+<tbody>
+{{range .Lines}}<tr>
+<td class="c">{{.Number}}</td><td>{{.Code}}</td><td>{{.Name}}</td><td class="c">--</td>
+<td class="c">{{.UnitCode}}</td><td class="c">{{.UnitName}}</td>
+<td class="r">{{.Quantity}}</td><td class="r">{{.Price}}</td><td class="r">{{.AmountNoVAT}}</td>
+<td class="c">{{.Excise}}</td><td class="c">{{.VATRate}}</td><td class="r">{{.VATAmount}}</td><td class="r">{{.AmountTotal}}</td>
+<td class="c">{{.CountryCode}}</td><td class="c">{{.CountryName}}</td><td class="c">{{.Declaration}}</td>
+</tr>
+{{end}}<tr class="total">
+<td colspan="8">Всего к оплате</td><td class="r">{{.TotalNoVAT}}</td><td class="c" colspan="2">X</td>
+<td class="r">{{.TotalVAT}}</td><td class="r">{{.TotalWithVAT}}</td><td colspan="3"></td>
+</tr>
+</tbody>
+</table>
+
+<table class="signs">
+<tr>
+<td>Руководитель организации или иное уполномоченное лицо</td><td class="line"></td><td class="line"></td>
+<td>Главный бухгалтер или иное уполномоченное лицо</td><td class="line"></td><td class="line"></td>
+</tr>
+<tr><td></td><td class="hint">(подпись)</td><td class="hint">(ф.и.о.)</td><td></td><td class="hint">(подпись)</td><td class="hint">(ф.и.о.)</td></tr>
+<tr>
+<td>Индивидуальный предприниматель или иное уполномоченное лицо</td><td class="line"></td><td class="line">{{if .SellerIsIP}}{{.Seller.Name}}{{end}}</td>
+<td colspan="3" class="line"></td>
+</tr>
+<tr><td></td><td class="hint">(подпись)</td><td class="hint">(ф.и.о.)</td><td colspan="3" class="hint">(реквизиты свидетельства о государственной регистрации индивидуального предпринимателя)</td></tr>
+</table>
+
+<table class="transfer">
+<tr>
+<td>
+Основание передачи (сдачи) / получения (приемки): <span class="field">{{.ShipmentBasis}}</span> [8]<br>
+Данные о транспортировке и грузе: <span class="field">--</span> [9]<br><br>
+Товар (груз) передал / услуги, результаты работ, права сдал: ____________ / ____________ / ____________ [10]<br>
+Дата отгрузки, передачи (сдачи): <span class="field">{{.Date}}</span> [11]<br>
+Иные сведения об отгрузке, передаче: <span class="field">--</span> [12]<br>
+Ответственный за правильность оформления факта хозяйственной жизни: ____________ / ____________ [13]<br>
+Наименование экономического субъекта — составителя документа: <span class="field">{{.Seller.Name}}, ИНН/КПП {{.Seller.INNKPP}}</span> [14]<br>
+М.П.
+</td>
+<td>
+Товар (груз) получил / услуги, результаты работ, права принял: ____________ / ____________ / ____________ [15]<br>
+Дата получения (приемки): ____________ [16]<br>
+Иные сведения о получении, приемке: <span class="field">--</span> [17]<br>
+Ответственный за правильность оформления факта хозяйственной жизни: ____________ / ____________ [18]<br>
+Наименование экономического субъекта — составителя документа: <span class="field">{{.Buyer.Name}}, ИНН/КПП {{.Buyer.INNKPP}}</span> [19]<br>
+М.П.
+</td>
+</tr>
+</table>
+{{if .DocFlowID}}<p><small>Идентификатор документооборота: {{.DocFlowID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// HTML renders the document as an HTML page in the UPD print layout
+func HTML(w io.Writer, doc *models.UPDDocument) error {
+	return htmlTemplate.Execute(w, newView(doc))
+}
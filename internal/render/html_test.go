@@ -0,0 +1,118 @@
+package render
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+func testDocument() *models.UPDDocument {
+	seller := models.Organization{Name: "ИП Иванов Иван Иванович", INN: "500100732259"}
+	buyer := models.Organization{Name: "ООО \"Покупатель\"", INN: "7701234567", KPP: "770101001"}
+	content := models.NewUPDContent("B-17", time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), seller, buyer)
+	content.RequisiteNumber = "42"
+	content.Items = []models.InvoiceItem{
+		{
+			LineNumber:       1,
+			Name:             "Труба 100x2.5",
+			Article:          "A-1",
+			UnitCode:         "796",
+			UnitName:         "шт",
+			Quantity:         decimal.RequireFromString("10"),
+			Price:            decimal.RequireFromString("102.875"),
+			AmountWithoutVAT: decimal.RequireFromString("1028.75"),
+			VATRate:          "20%",
+			VATAmount:        decimal.RequireFromString("205.75"),
+			AmountWithVAT:    decimal.RequireFromString("1234.50"),
+			CountryCode:      "156",
+			CountryName:      "КИТАЙ",
+		},
+		{
+			LineNumber:       2,
+			Name:             "Доставка",
+			Quantity:         decimal.RequireFromString("1"),
+			Price:            decimal.RequireFromString("500"),
+			AmountWithoutVAT: decimal.RequireFromString("500"),
+			VATRate:          "без НДС",
+			AmountWithVAT:    decimal.RequireFromString("500"),
+		},
+	}
+	content.TotalWithoutVAT = decimal.RequireFromString("1528.75")
+	content.TotalVAT = decimal.RequireFromString("205.75")
+	content.TotalWithVAT = decimal.RequireFromString("1734.50")
+
+	return &models.UPDDocument{
+		MetaInfo: models.MetaInfo{DocFlowID: "flow-1"},
+		Content:  *content,
+	}
+}
+
+func TestHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := HTML(&buf, testDocument()); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	out := buf.String()
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"header", []string{
+			`Счет-фактура № <span class="field">B-17</span> от <span class="field">01.07.2025</span>`,
+			`<td class="field">500100732259</td>`,
+			`<td class="field">7701234567/770101001</td>`,
+			`<td class="field">Российский рубль, 643</td>`,
+		}},
+		{"lines", []string{
+			`<td class="r">102,88</td><td class="r">1 028,75</td>`,
+			`<td class="c">156</td><td class="c">КИТАЙ</td><td class="c">--</td>`,
+			`<td class="r">без НДС</td><td class="r">500,00</td>
+<td class="c">--</td><td class="c">--</td><td class="c">--</td>`,
+		}},
+		{"totals", []string{
+			`<td colspan="8">Всего к оплате</td><td class="r">1 528,75</td>`,
+			`<td class="r">205,75</td><td class="r">1 734,50</td>`,
+		}},
+		{"signatures", []string{
+			"Руководитель организации или иное уполномоченное лицо",
+			"Главный бухгалтер или иное уполномоченное лицо",
+			`Индивидуальный предприниматель или иное уполномоченное лицо</td><td class="line"></td><td class="line">ИП Иванов Иван Иванович</td>`,
+		}},
+		{"transfer", []string{
+			`<span class="field">Счет № 42</span> [8]`,
+			`Дата отгрузки, передачи (сдачи): <span class="field">01.07.2025</span> [11]`,
+			`ИНН/КПП 7701234567/770101001</span> [19]`,
+			"Идентификатор документооборота: flow-1",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output does not contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTMLLegalSeller(t *testing.T) {
+	doc := testDocument()
+	doc.Content.Seller = models.Organization{Name: "ООО \"Продавец\"", INN: "7843316106", KPP: "784301001"}
+
+	var buf bytes.Buffer
+	if err := HTML(&buf, doc); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	// The entrepreneur signature is left blank for organizations
+	if want := `Индивидуальный предприниматель или иное уполномоченное лицо</td><td class="line"></td><td class="line"></td>`; !strings.Contains(buf.String(), want) {
+		t.Errorf("output does not contain %q", want)
+	}
+}
@@ -0,0 +1,239 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-pdf/fpdf"
+
+	"upd-loader-go/internal/models"
+)
+
+const fontFamily = "upd"
+
+// goods table columns: header, width in mm and alignment
+var pdfColumns = []struct {
+	header string
+	width  float64
+	align  string
+}{
+	{"№", 7, "C"},
+	{"Код товара", 18, "L"},
+	{"Наименование товара (описание работ, услуг), имущественного права", 62, "L"},
+	{"Код вида товара", 12, "C"},
+	{"Ед. код", 10, "C"},
+	{"Ед. обозн.", 12, "C"},
+	{"Кол-во", 15, "R"},
+	{"Цена за ед.", 19, "R"},
+	{"Стоимость без налога", 21, "R"},
+	{"В т.ч. акциз", 14, "C"},
+	{"Ставка", 12, "C"},
+	{"Сумма налога", 18, "R"},
+	{"Стоимость с налогом", 21, "R"},
+	{"Страна код", 10, "C"},
+	{"Страна", 12, "C"},
+	{"Рег. номер декларации", 14, "C"},
+}
+
+// PDF renders the document as an A4 landscape PDF. fontPath must point to a
+// TrueType font with Cyrillic glyphs (e.g. DejaVuSans.ttf).
+func PDF(w io.Writer, doc *models.UPDDocument, fontPath string) error {
+	fontData, err := os.ReadFile(fontPath)
+	if err != nil {
+		return fmt.Errorf("failed to load PDF font: %v", err)
+	}
+
+	v := newView(doc)
+
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pdf.SetMargins(8, 8, 8)
+	pdf.SetAutoPageBreak(true, 10)
+	pdf.AddUTF8FontFromBytes(fontFamily, "", fontData)
+	pdf.SetTitle(fmt.Sprintf("УПД № %s от %s", v.Number, v.Date), true)
+	pdf.AddPage()
+
+	// Header block with status on the left
+	pdf.SetFont(fontFamily, "", 9)
+	top := pdf.GetY()
+	pdf.MultiCell(30, 4, "Универсальный передаточный документ\n\nСтатус: "+v.Status+"\n\n1 — счет-фактура и передаточный документ (акт)\n2 — передаточный документ (акт)", "R", "L", false)
+
+	pdf.SetXY(40, top)
+	headerRows := []struct{ label, value, num string }{
+		{"Счет-фактура №", v.Number + " от " + v.Date, "(1)"},
+		{"Исправление №", "-- от --", "(1а)"},
+		{"Продавец:", v.Seller.Name, "(2)"},
+		{"Адрес:", v.Seller.Address, "(2а)"},
+		{"ИНН/КПП продавца:", v.Seller.INNKPP, "(2б)"},
+		{"Грузоотправитель и его адрес:", v.Consignor, "(3)"},
+		{"Грузополучатель и его адрес:", v.Consignee, "(4)"},
+		{"К платежно-расчетному документу:", v.PaymentDoc, "(5)"},
+		{"Документ об отгрузке:", v.ShipmentDoc, "(5а)"},
+		{"Покупатель:", v.Buyer.Name, "(6)"},
+		{"Адрес:", v.Buyer.Address, "(6а)"},
+		{"ИНН/КПП покупателя:", v.Buyer.INNKPP, "(6б)"},
+		{"Валюта: наименование, код:", v.CurrencyName + ", " + v.CurrencyCode, "(7)"},
+		{"Идентификатор гос. контракта:", "--", "(8)"},
+	}
+	pdf.SetFont(fontFamily, "", 8)
+	for _, row := range headerRows {
+		pdf.SetX(40)
+		pdf.CellFormat(55, 4.2, row.label, "", 0, "L", false, 0, "")
+		pdf.CellFormat(175, 4.2, truncate(pdf, row.value, 175), "B", 0, "L", false, 0, "")
+		pdf.CellFormat(10, 4.2, row.num, "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(3)
+
+	// Goods table
+	pdf.SetFont(fontFamily, "", 6)
+	drawTableHeader(pdf)
+
+	pdf.SetFont(fontFamily, "", 7)
+	for _, line := range v.Lines {
+		values := []string{
+			fmt.Sprintf("%d", line.Number), line.Code, line.Name, "--", line.UnitCode, line.UnitName,
+			line.Quantity, line.Price, line.AmountNoVAT, line.Excise, line.VATRate, line.VATAmount,
+			line.AmountTotal, line.CountryCode, line.CountryName, line.Declaration,
+		}
+		drawRow(pdf, values)
+	}
+
+	// Totals
+	pdf.SetFont(fontFamily, "", 7)
+	labelWidth := 0.0
+	for _, column := range pdfColumns[:8] {
+		labelWidth += column.width
+	}
+	pdf.CellFormat(labelWidth, 5, "Всего к оплате", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(pdfColumns[8].width, 5, v.TotalNoVAT, "1", 0, "R", false, 0, "")
+	pdf.CellFormat(pdfColumns[9].width+pdfColumns[10].width, 5, "X", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(pdfColumns[11].width, 5, v.TotalVAT, "1", 0, "R", false, 0, "")
+	pdf.CellFormat(pdfColumns[12].width, 5, v.TotalWithVAT, "1", 1, "R", false, 0, "")
+	pdf.Ln(4)
+
+	// Signature blocks
+	pdf.SetFont(fontFamily, "", 7)
+	signLine := func(label, name string) {
+		pdf.CellFormat(60, 5, label, "", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 5, "", "B", 0, "C", false, 0, "")
+		pdf.CellFormat(4, 5, "", "", 0, "C", false, 0, "")
+		pdf.CellFormat(40, 5, name, "B", 0, "C", false, 0, "")
+		pdf.CellFormat(6, 5, "", "", 0, "C", false, 0, "")
+	}
+	signLine("Руководитель организации", "")
+	signLine("Главный бухгалтер", "")
+	pdf.Ln(6)
+	ipName := ""
+	if v.SellerIsIP {
+		ipName = v.Seller.Name
+	}
+	signLine("Индивидуальный предприниматель", ipName)
+	pdf.Ln(8)
+
+	// Transfer blocks
+	half := 140.5
+	y := pdf.GetY()
+	pdf.Line(8, y, 289, y)
+	pdf.SetXY(8, y+1)
+	pdf.MultiCell(half, 4, fmt.Sprintf(
+		"Основание передачи (сдачи) / получения (приемки): %s [8]\n"+
+			"Данные о транспортировке и грузе: -- [9]\n"+
+			"Товар (груз) передал / услуги, результаты работ, права сдал: ____________ / ____________ [10]\n"+
+			"Дата отгрузки, передачи (сдачи): %s [11]\n"+
+			"Иные сведения об отгрузке, передаче: -- [12]\n"+
+			"Ответственный за правильность оформления факта хозяйственной жизни: ____________ / ____________ [13]\n"+
+			"Наименование экономического субъекта — составителя документа: %s, ИНН/КПП %s [14]",
+		v.ShipmentBasis, v.Date, v.Seller.Name, v.Seller.INNKPP), "R", "L", false)
+	pdf.SetXY(8+half, y+1)
+	pdf.MultiCell(half, 4, fmt.Sprintf(
+		"Товар (груз) получил / услуги, результаты работ, права принял: ____________ / ____________ [15]\n"+
+			"Дата получения (приемки): ____________ [16]\n"+
+			"Иные сведения о получении, приемке: -- [17]\n"+
+			"Ответственный за правильность оформления факта хозяйственной жизни: ____________ / ____________ [18]\n"+
+			"Наименование экономического субъекта — составителя документа: %s, ИНН/КПП %s [19]",
+		v.Buyer.Name, v.Buyer.INNKPP), "", "L", false)
+
+	if v.DocFlowID != "" {
+		pdf.Ln(2)
+		pdf.SetFont(fontFamily, "", 6)
+		pdf.CellFormat(0, 4, "Идентификатор документооборота: "+v.DocFlowID, "", 1, "L", false, 0, "")
+	}
+
+	if err := pdf.Error(); err != nil {
+		return fmt.Errorf("failed to render PDF: %v", err)
+	}
+	return pdf.Output(w)
+}
+
+// drawTableHeader draws the goods table header with column numbers
+func drawTableHeader(pdf *fpdf.Fpdf) {
+	numbers := []string{"А", "Б", "1", "1а", "2", "2а", "3", "4", "5", "6", "7", "8", "9", "10", "10а", "11"}
+
+	height := 0.0
+	for _, column := range pdfColumns {
+		lines := pdf.SplitText(column.header, column.width-1)
+		if h := float64(len(lines)) * 2.8; h > height {
+			height = h
+		}
+	}
+
+	x, y := pdf.GetXY()
+	for _, column := range pdfColumns {
+		pdf.Rect(x, y, column.width, height, "D")
+		pdf.SetXY(x, y)
+		pdf.MultiCell(column.width, 2.8, column.header, "", "C", false)
+		x += column.width
+	}
+	pdf.SetXY(8, y+height)
+
+	for i, column := range pdfColumns {
+		ln := 0
+		if i == len(pdfColumns)-1 {
+			ln = 1
+		}
+		pdf.CellFormat(column.width, 3.5, numbers[i], "1", ln, "C", false, 0, "")
+	}
+}
+
+// drawRow draws a table row growing its height to fit wrapped text
+func drawRow(pdf *fpdf.Fpdf, values []string) {
+	const lineHeight = 3.2
+
+	height := lineHeight
+	for i, column := range pdfColumns {
+		lines := pdf.SplitText(values[i], column.width-1)
+		if h := float64(len(lines)) * lineHeight; h > height {
+			height = h
+		}
+	}
+
+	_, pageHeight := pdf.GetPageSize()
+	_, _, _, bottom := pdf.GetMargins()
+	if pdf.GetY()+height > pageHeight-bottom {
+		pdf.AddPage()
+		pdf.SetFont(fontFamily, "", 6)
+		drawTableHeader(pdf)
+		pdf.SetFont(fontFamily, "", 7)
+	}
+
+	x, y := pdf.GetXY()
+	for i, column := range pdfColumns {
+		pdf.Rect(x, y, column.width, height, "D")
+		pdf.SetXY(x, y)
+		pdf.MultiCell(column.width, lineHeight, values[i], "", column.align, false)
+		x += column.width
+	}
+	pdf.SetXY(8, y+height)
+}
+
+// truncate shortens text to fit the cell width
+func truncate(pdf *fpdf.Fpdf, text string, width float64) string {
+	runes := []rune(text)
+	for len(runes) > 0 && pdf.GetStringWidth(string(runes)) > width-1 {
+		runes = runes[:len(runes)-1]
+	}
+	if len(runes) < len([]rune(text)) && len(runes) > 1 {
+		return string(runes[:len(runes)-1]) + "…"
+	}
+	return string(runes)
+}
@@ -0,0 +1,171 @@
+// Package render produces the printable UPD form (HTML and PDF) from a parsed document.
+package render
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+
+	"upd-loader-go/internal/models"
+)
+
+// view is the printable representation shared by HTML and PDF renderers
+type view struct {
+	Status        string
+	Number        string
+	Date          string
+	Seller        partyView
+	Buyer         partyView
+	Consignor     string
+	Consignee     string
+	PaymentDoc    string
+	ShipmentDoc   string
+	CurrencyName  string
+	CurrencyCode  string
+	Lines         []lineView
+	TotalNoVAT    string
+	TotalVAT      string
+	TotalWithVAT  string
+	DocFlowID     string
+	SellerIsIP    bool
+	ShipmentBasis string
+}
+
+type partyView struct {
+	Name    string
+	Address string
+	INNKPP  string
+}
+
+type lineView struct {
+	Number      int
+	Code        string
+	Name        string
+	UnitCode    string
+	UnitName    string
+	Quantity    string
+	Price       string
+	AmountNoVAT string
+	Excise      string
+	VATRate     string
+	VATAmount   string
+	AmountTotal string
+	CountryCode string
+	CountryName string
+	Declaration string
+}
+
+// newView builds printable view of the document
+func newView(doc *models.UPDDocument) *view {
+	content := doc.Content
+
+	v := &view{
+		Status:       "1",
+		Number:       content.InvoiceNumber,
+		Date:         content.InvoiceDate.Format("02.01.2006"),
+		Seller:       newPartyView(content.Seller),
+		Buyer:        newPartyView(content.Buyer),
+		Consignor:    "он же",
+		Consignee:    partyLine(content.Buyer),
+		PaymentDoc:   "--",
+		ShipmentDoc:  fmt.Sprintf("№ п/п 1-%d № %s от %s", len(content.Items), content.InvoiceNumber, content.InvoiceDate.Format("02.01.2006")),
+		CurrencyName: content.CurrencyName,
+		CurrencyCode: content.CurrencyCode,
+		TotalNoVAT:   money(content.TotalWithoutVAT),
+		TotalVAT:     money(content.TotalVAT),
+		TotalWithVAT: money(content.TotalWithVAT),
+		DocFlowID:    doc.MetaInfo.DocFlowID,
+		SellerIsIP:   len(content.Seller.INN) == 12,
+	}
+
+	if v.CurrencyCode == "" {
+		v.CurrencyCode = models.DefaultCurrencyCode
+	}
+	if v.CurrencyName == "" {
+		if content.IsDefaultCurrency() {
+			v.CurrencyName = "Российский рубль"
+		} else {
+			v.CurrencyName = content.CurrencyISOCode()
+		}
+	}
+	if content.RequisiteNumber != "" {
+		v.ShipmentBasis = "Счет № " + content.RequisiteNumber
+	} else {
+		v.ShipmentBasis = "Без документа-основания"
+	}
+
+	for _, item := range content.Items {
+		line := lineView{
+			Number:      item.LineNumber,
+			Code:        dash(item.Article),
+			Name:        item.Name,
+			UnitCode:    dash(item.UnitCode),
+			UnitName:    dash(item.UnitName),
+			Quantity:    item.Quantity.String(),
+			Price:       money(item.Price),
+			AmountNoVAT: money(item.AmountWithoutVAT),
+			Excise:      "без акциза",
+			VATRate:     dash(item.VATRate),
+			VATAmount:   money(item.VATAmount),
+			AmountTotal: money(item.AmountWithVAT),
+			CountryCode: dash(item.CountryCode),
+			CountryName: dash(item.CountryName),
+			Declaration: "--",
+		}
+		if strings.EqualFold(item.VATRate, "без НДС") {
+			line.VATAmount = "без НДС"
+		}
+		v.Lines = append(v.Lines, line)
+	}
+
+	return v
+}
+
+func newPartyView(org models.Organization) partyView {
+	innKPP := org.INN
+	if org.KPP != "" {
+		innKPP += "/" + org.KPP
+	}
+
+	return partyView{Name: org.Name, Address: dash(org.Address.String()), INNKPP: innKPP}
+}
+
+func partyLine(org models.Organization) string {
+	p := newPartyView(org)
+	if p.Address == "--" {
+		return p.Name
+	}
+	return p.Name + ", " + p.Address
+}
+
+// money formats amount with thousands separators and two decimals
+func money(value decimal.Decimal) string {
+	s := value.StringFixed(2)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	var b strings.Builder
+	for i, r := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+	}
+
+	return sign + b.String() + "," + fracPart
+}
+
+func dash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "--"
+	}
+	return s
+}
@@ -0,0 +1,441 @@
+// Package xsd implements a lightweight XML Schema checker for the FNS UPD
+// formats. It supports the subset of XSD used by ON_NSCHFDOPPR schemas:
+// nested and named complex types, sequences and choices with occurrence
+// bounds, attributes and simple type facets (enumerations, lengths,
+// patterns, decimal digits and bounds). Load rejects schemas using anything
+// else, so a document is never reported valid against a rule that was not
+// checked. Schematron rules in annotations are not XSD and are ignored.
+package xsd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const unbounded = -1
+
+// builtinTypes are XSD types whose values are checked
+var builtinTypes = map[string]bool{
+	"string":             true,
+	"normalizedString":   true,
+	"token":              true,
+	"decimal":            true,
+	"integer":            true,
+	"nonNegativeInteger": true,
+	"positiveInteger":    true,
+	"date":               true,
+}
+
+// Schema is a parsed XML schema
+type Schema struct {
+	elements     map[string]*elementDecl
+	complexTypes map[string]*complexType
+	simpleTypes  map[string]*simpleType
+
+	// references and problems are collected while loading
+	references []typeReference
+	problems   []string
+}
+
+// typeReference is a type name used by a declaration
+type typeReference struct {
+	where  string
+	name   string
+	simple bool
+}
+
+type elementDecl struct {
+	name      string
+	minOccurs int
+	maxOccurs int
+	typeName  string
+	complex   *complexType
+	simple    *simpleType
+}
+
+type complexType struct {
+	attributes []*attributeDecl
+	content    *group
+	mixed      bool
+}
+
+// group is a sequence, choice or all of particles
+type group struct {
+	kind      string
+	minOccurs int
+	maxOccurs int
+	particles []*particle
+}
+
+// particle is either an element or a nested group
+type particle struct {
+	element *elementDecl
+	group   *group
+}
+
+type attributeDecl struct {
+	name     string
+	required bool
+	fixed    string
+	typeName string
+	simple   *simpleType
+}
+
+type simpleType struct {
+	base           string
+	enumerations   []string
+	length         int
+	minLength      int
+	maxLength      int
+	totalDigits    int
+	fractionDigits int
+	minInclusive   string
+	maxInclusive   string
+	patterns       []*regexp.Regexp
+}
+
+// node is a generic XML element used for both schema and document trees
+type node struct {
+	name     string
+	attrs    []xml.Attr
+	children []*node
+	text     strings.Builder
+}
+
+func (n *node) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// LoadFile loads schema from an XSD file
+func LoadFile(path string) (*Schema, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Load(file)
+}
+
+// Load parses schema from reader. Constructs the checker does not support,
+// unknown types and patterns that do not compile are returned as an error.
+func Load(r io.Reader) (*Schema, error) {
+	root, err := readTree(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %v", err)
+	}
+	if root.name != "schema" {
+		return nil, fmt.Errorf("not an XML schema: root element %s", root.name)
+	}
+
+	schema := &Schema{
+		elements:     make(map[string]*elementDecl),
+		complexTypes: make(map[string]*complexType),
+		simpleTypes:  make(map[string]*simpleType),
+	}
+
+	for _, child := range root.children {
+		switch child.name {
+		case "element":
+			el := schema.parseElement(child, "")
+			schema.elements[el.name] = el
+		case "complexType":
+			name := child.attr("name")
+			schema.complexTypes[name] = schema.parseComplexType(child, "type "+name)
+		case "simpleType":
+			name := child.attr("name")
+			schema.simpleTypes[name] = schema.parseSimpleType(child, "type "+name)
+		case "annotation":
+		default:
+			schema.unsupported("schema", child.name)
+		}
+	}
+	schema.resolveReferences()
+
+	if len(schema.problems) > 0 {
+		return nil, fmt.Errorf("schema cannot be checked:\n%s", strings.Join(schema.problems, "\n"))
+	}
+	return schema, nil
+}
+
+// unsupported records a construct the checker does not support
+func (s *Schema) unsupported(where, construct string) {
+	s.problems = append(s.problems, fmt.Sprintf("%s: %s is not supported", where, construct))
+}
+
+// reference records a type name to resolve once all types are loaded
+func (s *Schema) reference(where, name string, simple bool) {
+	if name != "" {
+		s.references = append(s.references, typeReference{where: where, name: name, simple: simple})
+	}
+}
+
+// resolveReferences checks that referenced types are built-in or declared
+func (s *Schema) resolveReferences() {
+	for _, ref := range s.references {
+		if builtin, ok := strings.CutPrefix(ref.name, "xs:"); ok {
+			if !builtinTypes[builtin] {
+				s.unsupported(ref.where, "type "+ref.name)
+			}
+			continue
+		}
+		if s.simpleTypes[ref.name] != nil {
+			continue
+		}
+		if s.complexTypes[ref.name] != nil {
+			if ref.simple {
+				s.problems = append(s.problems, fmt.Sprintf("%s: complex type %s is used as a simple type", ref.where, ref.name))
+			}
+			continue
+		}
+		s.problems = append(s.problems, fmt.Sprintf("%s: unknown type %s", ref.where, ref.name))
+	}
+	s.references = nil
+}
+
+func (s *Schema) parseElement(n *node, parentPath string) *elementDecl {
+	el := &elementDecl{
+		name:      n.attr("name"),
+		minOccurs: parseOccurs(n.attr("minOccurs"), 1),
+		maxOccurs: parseOccurs(n.attr("maxOccurs"), 1),
+		typeName:  n.attr("type"),
+	}
+	path := parentPath + "/" + el.name
+
+	for _, a := range n.attrs {
+		switch a.Name.Local {
+		case "ref", "fixed", "default", "nillable", "abstract", "substitutionGroup":
+			s.unsupported(path, "element attribute "+a.Name.Local)
+		}
+	}
+	s.reference(path, el.typeName, false)
+
+	for _, child := range n.children {
+		switch child.name {
+		case "complexType":
+			el.complex = s.parseComplexType(child, path)
+		case "simpleType":
+			el.simple = s.parseSimpleType(child, path)
+		case "annotation":
+		default:
+			s.unsupported(path, child.name)
+		}
+	}
+	if el.typeName == "" && el.complex == nil && el.simple == nil && n.attr("ref") == "" {
+		s.problems = append(s.problems, fmt.Sprintf("%s: element has no type", path))
+	}
+
+	return el
+}
+
+func (s *Schema) parseComplexType(n *node, path string) *complexType {
+	ct := &complexType{mixed: n.attr("mixed") == "true"}
+
+	for _, child := range n.children {
+		switch child.name {
+		case "attribute":
+			ct.attributes = append(ct.attributes, s.parseAttribute(child, path))
+		case "sequence", "choice", "all":
+			ct.content = s.parseGroup(child, path)
+		case "annotation":
+		default:
+			s.unsupported(path, child.name)
+		}
+	}
+
+	return ct
+}
+
+func (s *Schema) parseGroup(n *node, path string) *group {
+	g := &group{
+		kind:      n.name,
+		minOccurs: parseOccurs(n.attr("minOccurs"), 1),
+		maxOccurs: parseOccurs(n.attr("maxOccurs"), 1),
+	}
+
+	for _, child := range n.children {
+		switch child.name {
+		case "element":
+			el := s.parseElement(child, path)
+			if g.kind == "all" && (el.maxOccurs == unbounded || el.maxOccurs > 1) {
+				s.unsupported(path+"/"+el.name, "maxOccurs above 1 in all")
+			}
+			g.particles = append(g.particles, &particle{element: el})
+		case "sequence", "choice":
+			if g.kind == "all" {
+				s.unsupported(path, child.name+" in all")
+			}
+			g.particles = append(g.particles, &particle{group: s.parseGroup(child, path)})
+		case "annotation":
+		default:
+			s.unsupported(path, child.name)
+		}
+	}
+
+	return g
+}
+
+func (s *Schema) parseAttribute(n *node, parentPath string) *attributeDecl {
+	attr := &attributeDecl{
+		name:     n.attr("name"),
+		required: n.attr("use") == "required",
+		fixed:    n.attr("fixed"),
+		typeName: n.attr("type"),
+	}
+	path := parentPath + "@" + attr.name
+
+	if n.attr("ref") != "" {
+		s.unsupported(path, "attribute ref")
+	}
+	s.reference(path, attr.typeName, true)
+
+	for _, child := range n.children {
+		switch child.name {
+		case "simpleType":
+			attr.simple = s.parseSimpleType(child, path)
+		case "annotation":
+		default:
+			s.unsupported(path, child.name)
+		}
+	}
+
+	return attr
+}
+
+func (s *Schema) parseSimpleType(n *node, path string) *simpleType {
+	st := &simpleType{length: -1, minLength: -1, maxLength: -1, totalDigits: -1, fractionDigits: -1}
+
+	for _, child := range n.children {
+		switch child.name {
+		case "restriction":
+		case "annotation":
+			continue
+		default:
+			s.unsupported(path, child.name)
+			continue
+		}
+
+		st.base = child.attr("base")
+		if st.base == "" {
+			s.unsupported(path, "restriction without base")
+		}
+		s.reference(path, st.base, true)
+
+		for _, facet := range child.children {
+			value := facet.attr("value")
+			switch facet.name {
+			case "enumeration":
+				st.enumerations = append(st.enumerations, value)
+			case "length":
+				st.length = s.parseFacet(path, facet.name, value)
+			case "minLength":
+				st.minLength = s.parseFacet(path, facet.name, value)
+			case "maxLength":
+				st.maxLength = s.parseFacet(path, facet.name, value)
+			case "totalDigits":
+				st.totalDigits = s.parseFacet(path, facet.name, value)
+			case "fractionDigits":
+				st.fractionDigits = s.parseFacet(path, facet.name, value)
+			case "minInclusive":
+				st.minInclusive = value
+			case "maxInclusive":
+				st.maxInclusive = value
+			case "pattern":
+				re, err := regexp.Compile("^(?:" + value + ")$")
+				if err != nil {
+					s.problems = append(s.problems, fmt.Sprintf("%s: pattern %q does not compile: %v", path, value, err))
+					continue
+				}
+				st.patterns = append(st.patterns, re)
+			case "annotation":
+			default:
+				s.unsupported(path, "facet "+facet.name)
+			}
+		}
+	}
+
+	return st
+}
+
+// parseFacet parses numeric facet value
+func (s *Schema) parseFacet(path, name, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		s.problems = append(s.problems, fmt.Sprintf("%s: invalid %s %q", path, name, value))
+		return -1
+	}
+	return n
+}
+
+func parseOccurs(value string, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+	if value == "unbounded" {
+		return unbounded
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n
+	}
+	return defaultValue
+}
+
+// readTree reads XML into a generic node tree, decoding declared encodings
+func readTree(r io.Reader) (*node, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported encoding: %s", label)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+
+	var root *node
+	var stack []*node
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	return root, nil
+}
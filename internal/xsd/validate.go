@@ -0,0 +1,474 @@
+package xsd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// ValidationError describes a single schema violation
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// Validate checks document against the schema and returns all violations found
+func (s *Schema) Validate(r io.Reader) ([]*ValidationError, error) {
+	root, err := readTree(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document: %v", err)
+	}
+
+	decl, ok := s.elements[root.name]
+	if !ok {
+		return []*ValidationError{{Path: "/" + root.name, Message: "unexpected root element"}}, nil
+	}
+
+	var errs []*ValidationError
+	s.validateElement(root, decl, "", &errs)
+	return errs, nil
+}
+
+func (s *Schema) validateElement(n *node, decl *elementDecl, parentPath string, errs *[]*ValidationError) {
+	path := parentPath + "/" + n.name
+
+	ct := decl.complex
+	if ct == nil && decl.typeName != "" {
+		ct = s.complexTypes[decl.typeName]
+	}
+
+	if ct == nil {
+		if len(n.children) > 0 {
+			*errs = append(*errs, &ValidationError{Path: path, Message: "element must not have child elements"})
+			return
+		}
+		st := decl.simple
+		if st == nil {
+			st = s.simpleTypes[decl.typeName]
+		}
+		if msg := s.checkValue(strings.TrimSpace(n.text.String()), decl.typeName, st); msg != "" {
+			*errs = append(*errs, &ValidationError{Path: path, Message: msg})
+		}
+		return
+	}
+
+	s.validateAttributes(n, ct, path, errs)
+	if !ct.mixed && strings.TrimSpace(n.text.String()) != "" {
+		*errs = append(*errs, &ValidationError{Path: path, Message: "text is not allowed"})
+	}
+
+	allowed := make(map[string]*elementDecl)
+	if ct.content != nil {
+		ct.content.collect(allowed)
+	}
+
+	unknown := false
+	for _, child := range n.children {
+		childDecl, ok := allowed[child.name]
+		if !ok {
+			*errs = append(*errs, &ValidationError{Path: path + "/" + child.name, Message: "element is not allowed here"})
+			unknown = true
+			continue
+		}
+		s.validateElement(child, childDecl, path, errs)
+	}
+	if ct.content == nil {
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, child := range n.children {
+		present[child.name] = true
+	}
+	missing := ct.content.missing(present)
+	for _, name := range missing {
+		*errs = append(*errs, &ValidationError{Path: path, Message: "missing required element " + name})
+	}
+
+	// Order and occurrences are checked once all children are known and
+	// present, otherwise the violations above explain the mismatch better
+	if !unknown && len(missing) == 0 {
+		if err := ct.content.checkOrder(n.children, path); err != nil {
+			*errs = append(*errs, err)
+		}
+	}
+}
+
+func (s *Schema) validateAttributes(n *node, ct *complexType, path string, errs *[]*ValidationError) {
+	declared := make(map[string]*attributeDecl, len(ct.attributes))
+	for _, attr := range ct.attributes {
+		declared[attr.name] = attr
+	}
+
+	seen := make(map[string]bool, len(n.attrs))
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" || a.Name.Space == "xsi" ||
+			strings.HasPrefix(a.Name.Space, "http://www.w3.org/") {
+			continue
+		}
+
+		seen[a.Name.Local] = true
+		attr, ok := declared[a.Name.Local]
+		if !ok {
+			*errs = append(*errs, &ValidationError{Path: path + "@" + a.Name.Local, Message: "attribute is not allowed"})
+			continue
+		}
+
+		st := attr.simple
+		if st == nil {
+			st = s.simpleTypes[attr.typeName]
+		}
+		if msg := s.checkValue(a.Value, attr.typeName, st); msg != "" {
+			*errs = append(*errs, &ValidationError{Path: path + "@" + a.Name.Local, Message: msg})
+		} else if attr.fixed != "" && a.Value != attr.fixed {
+			*errs = append(*errs, &ValidationError{Path: path + "@" + a.Name.Local, Message: fmt.Sprintf("value %q must be %q", a.Value, attr.fixed)})
+		}
+	}
+
+	for _, attr := range ct.attributes {
+		if attr.required && !seen[attr.name] {
+			*errs = append(*errs, &ValidationError{Path: path, Message: "missing required attribute " + attr.name})
+		}
+	}
+}
+
+// checkValue checks value against simple type facets including its named base types
+func (s *Schema) checkValue(value, typeName string, st *simpleType) string {
+	for depth := 0; st != nil && depth < 10; depth++ {
+		if msg := st.check(value); msg != "" {
+			return msg
+		}
+		typeName = st.base
+		st = s.simpleTypes[typeName]
+	}
+
+	switch strings.TrimPrefix(typeName, "xs:") {
+	case "decimal":
+		if _, err := decimal.NewFromString(value); err != nil {
+			return fmt.Sprintf("value %q is not a number", value)
+		}
+	case "integer", "nonNegativeInteger", "positiveInteger":
+		number, err := decimal.NewFromString(value)
+		if err != nil || !number.IsInteger() || strings.Contains(value, ".") {
+			return fmt.Sprintf("value %q is not an integer", value)
+		}
+		if typeName == "xs:nonNegativeInteger" && number.IsNegative() || typeName == "xs:positiveInteger" && !number.IsPositive() {
+			return fmt.Sprintf("value %q is out of range of %s", value, typeName)
+		}
+	case "date":
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return fmt.Sprintf("value %q is not a date", value)
+		}
+	}
+
+	return ""
+}
+
+func (st *simpleType) check(value string) string {
+	length := utf8.RuneCountInString(value)
+
+	if len(st.enumerations) > 0 {
+		found := false
+		for _, enum := range st.enumerations {
+			if enum == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("value %q is not one of %s", value, strings.Join(st.enumerations, ", "))
+		}
+	}
+
+	if st.length >= 0 && length != st.length {
+		return fmt.Sprintf("value %q must be %d characters long", value, st.length)
+	}
+	if st.minLength >= 0 && length < st.minLength {
+		return fmt.Sprintf("value %q is shorter than %d characters", value, st.minLength)
+	}
+	if st.maxLength >= 0 && length > st.maxLength {
+		return fmt.Sprintf("value %q is longer than %d characters", value, st.maxLength)
+	}
+
+	if len(st.patterns) > 0 {
+		matched := false
+		for _, re := range st.patterns {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Sprintf("value %q does not match pattern", value)
+		}
+	}
+
+	if st.totalDigits >= 0 || st.fractionDigits >= 0 || st.minInclusive != "" || st.maxInclusive != "" {
+		number, err := decimal.NewFromString(value)
+		if err != nil {
+			return fmt.Sprintf("value %q is not a number", value)
+		}
+		digits := strings.TrimLeft(number.Abs().Coefficient().String(), "0")
+		if st.totalDigits >= 0 && len(digits) > st.totalDigits {
+			return fmt.Sprintf("value %q has more than %d digits", value, st.totalDigits)
+		}
+		if st.fractionDigits >= 0 && -number.Exponent() > int32(st.fractionDigits) {
+			return fmt.Sprintf("value %q has more than %d fraction digits", value, st.fractionDigits)
+		}
+		if st.minInclusive != "" {
+			if min, err := decimal.NewFromString(st.minInclusive); err == nil && number.LessThan(min) {
+				return fmt.Sprintf("value %q is less than %s", value, st.minInclusive)
+			}
+		}
+		if st.maxInclusive != "" {
+			if max, err := decimal.NewFromString(st.maxInclusive); err == nil && number.GreaterThan(max) {
+				return fmt.Sprintf("value %q is greater than %s", value, st.maxInclusive)
+			}
+		}
+	}
+
+	return ""
+}
+
+// collect gathers all elements allowed by the group
+func (g *group) collect(allowed map[string]*elementDecl) {
+	for _, p := range g.particles {
+		if p.element != nil {
+			allowed[p.element.name] = p.element
+		} else {
+			p.group.collect(allowed)
+		}
+	}
+}
+
+// missing returns names of required elements that are absent
+func (g *group) missing(present map[string]bool) []string {
+	if g.kind == "choice" {
+		if g.minOccurs == 0 || g.satisfied(present) {
+			return nil
+		}
+		var names []string
+		for _, p := range g.particles {
+			if p.element != nil {
+				names = append(names, p.element.name)
+			}
+		}
+		return []string{"(one of " + strings.Join(names, ", ") + ")"}
+	}
+
+	if g.minOccurs == 0 && !g.satisfied(present) {
+		return nil
+	}
+
+	var result []string
+	for _, p := range g.particles {
+		if p.element != nil {
+			if p.element.minOccurs > 0 && !present[p.element.name] {
+				result = append(result, p.element.name)
+			}
+		} else {
+			result = append(result, p.group.missing(present)...)
+		}
+	}
+	return result
+}
+
+// satisfied reports whether any alternative of a choice is present
+func (g *group) satisfied(present map[string]bool) bool {
+	for _, p := range g.particles {
+		switch {
+		case p.element != nil:
+			if present[p.element.name] {
+				return true
+			}
+		case p.group.kind == "sequence":
+			if len(p.group.missing(present)) > 0 {
+				continue
+			}
+			for _, sub := range p.group.particles {
+				if sub.element != nil && present[sub.element.name] {
+					return true
+				}
+			}
+		default:
+			if p.group.satisfied(present) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOrder matches children against the content model and reports the
+// first child that breaks element order or occurrence bounds
+func (g *group) checkOrder(children []*node, path string) *ValidationError {
+	m := &contentMatcher{children: children, expected: make(map[string]bool)}
+	if m.matchGroup(g, positions{0: true})[len(children)] {
+		return nil
+	}
+
+	var expected []string
+	for name := range m.expected {
+		expected = append(expected, name)
+	}
+	sort.Strings(expected)
+	hint := ""
+	if len(expected) > 0 {
+		hint = ", expected " + strings.Join(expected, " or ")
+	}
+
+	if m.furthest == len(children) {
+		return &ValidationError{Path: path, Message: "content is incomplete" + hint}
+	}
+	child := children[m.furthest]
+	if m.furthest > 0 && children[m.furthest-1].name == child.name {
+		return &ValidationError{Path: path + "/" + child.name, Message: "element occurs more times than allowed" + hint}
+	}
+	return &ValidationError{Path: path + "/" + child.name, Message: "element is out of order" + hint}
+}
+
+// positions is a set of child indexes
+type positions map[int]bool
+
+// contentMatcher matches children against a content model. A particle
+// started at a set of positions ends at every position it can consume
+// children up to; the document is valid when the model can end after the
+// last child. furthest is the first child no attempt could consume and
+// expected are names that would have been accepted there.
+type contentMatcher struct {
+	children []*node
+	furthest int
+	expected map[string]bool
+}
+
+// matchGroup matches group repeated within its occurrence bounds
+func (m *contentMatcher) matchGroup(g *group, starts positions) positions {
+	ends := positions{}
+	if g.minOccurs == 0 {
+		for p := range starts {
+			ends[p] = true
+		}
+	}
+
+	frontier := starts
+	for count := 1; len(frontier) > 0 && (g.maxOccurs == unbounded || count <= g.maxOccurs); count++ {
+		next := m.matchOnce(g, frontier)
+		if count < g.minOccurs {
+			frontier = next
+			continue
+		}
+		// Positions already reached repeat the same matches
+		frontier = positions{}
+		for p := range next {
+			if !ends[p] {
+				ends[p] = true
+				frontier[p] = true
+			}
+		}
+	}
+	return ends
+}
+
+// matchOnce matches a single occurrence of the group
+func (m *contentMatcher) matchOnce(g *group, starts positions) positions {
+	switch g.kind {
+	case "choice":
+		ends := positions{}
+		for _, p := range g.particles {
+			for end := range m.matchParticle(p, starts) {
+				ends[end] = true
+			}
+		}
+		return ends
+	case "all":
+		ends := positions{}
+		for start := range starts {
+			for end := range m.matchAll(g, start) {
+				ends[end] = true
+			}
+		}
+		return ends
+	default:
+		current := starts
+		for _, p := range g.particles {
+			current = m.matchParticle(p, current)
+			if len(current) == 0 {
+				break
+			}
+		}
+		return current
+	}
+}
+
+func (m *contentMatcher) matchParticle(p *particle, starts positions) positions {
+	if p.group != nil {
+		return m.matchGroup(p.group, starts)
+	}
+
+	el := p.element
+	ends := positions{}
+	for start := range starts {
+		count := 0
+		for start+count < len(m.children) && m.children[start+count].name == el.name &&
+			(el.maxOccurs == unbounded || count < el.maxOccurs) {
+			count++
+		}
+		for n := el.minOccurs; n <= count; n++ {
+			ends[start+n] = true
+		}
+		m.reach(start + count)
+		if (el.maxOccurs == unbounded || count < el.maxOccurs) && m.furthest == start+count {
+			m.expected[el.name] = true
+		}
+	}
+	return ends
+}
+
+// matchAll matches elements of all group in any order, each at most once
+func (m *contentMatcher) matchAll(g *group, start int) positions {
+	names := make(map[string]*elementDecl)
+	for _, p := range g.particles {
+		names[p.element.name] = p.element
+	}
+
+	ends := positions{}
+	seen := make(map[string]bool)
+	for pos := start; ; pos++ {
+		complete := true
+		for name, el := range names {
+			if el.minOccurs > 0 && !seen[name] {
+				complete = false
+			}
+		}
+		if complete {
+			ends[pos] = true
+		}
+		if pos == len(m.children) || names[m.children[pos].name] == nil || seen[m.children[pos].name] {
+			m.reach(pos)
+			for name := range names {
+				if !seen[name] && m.furthest == pos {
+					m.expected[name] = true
+				}
+			}
+			return ends
+		}
+		seen[m.children[pos].name] = true
+	}
+}
+
+// reach records that children before the position were consumed
+func (m *contentMatcher) reach(pos int) {
+	if pos > m.furthest {
+		m.furthest = pos
+		m.expected = make(map[string]bool)
+	}
+}
@@ -0,0 +1,251 @@
+package xsd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSchema = `<?xml version="1.0" encoding="UTF-8"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+	<xs:element name="Файл">
+		<xs:complexType>
+			<xs:sequence>
+				<xs:element name="Заголовок" type="ТекстТип"/>
+				<xs:element name="Примечание" type="ТекстТип" minOccurs="0" maxOccurs="2"/>
+				<xs:choice>
+					<xs:element name="ЮЛ" type="ИННТип"/>
+					<xs:element name="ИП" type="ИННТип"/>
+				</xs:choice>
+				<xs:element name="Строка" maxOccurs="unbounded">
+					<xs:complexType>
+						<xs:attribute name="Номер" type="xs:positiveInteger" use="required"/>
+						<xs:attribute name="Сумма" use="required">
+							<xs:simpleType>
+								<xs:restriction base="xs:decimal">
+									<xs:totalDigits value="10"/>
+									<xs:fractionDigits value="2"/>
+									<xs:maxInclusive value="1000"/>
+								</xs:restriction>
+							</xs:simpleType>
+						</xs:attribute>
+						<xs:attribute name="Ставка">
+							<xs:simpleType>
+								<xs:restriction base="xs:string">
+									<xs:enumeration value="20%"/>
+									<xs:enumeration value="без НДС"/>
+								</xs:restriction>
+							</xs:simpleType>
+						</xs:attribute>
+					</xs:complexType>
+				</xs:element>
+				<xs:sequence minOccurs="0" maxOccurs="2">
+					<xs:element name="Подпись" type="ТекстТип"/>
+					<xs:element name="Дата" type="xs:date"/>
+				</xs:sequence>
+			</xs:sequence>
+			<xs:attribute name="ВерсФорм" type="xs:string" use="required" fixed="5.03"/>
+		</xs:complexType>
+	</xs:element>
+	<xs:simpleType name="ТекстТип">
+		<xs:restriction base="xs:string">
+			<xs:minLength value="1"/>
+			<xs:maxLength value="10"/>
+		</xs:restriction>
+	</xs:simpleType>
+	<xs:simpleType name="ИННТип">
+		<xs:restriction base="xs:string">
+			<xs:pattern value="[0-9]{10}|[0-9]{12}"/>
+		</xs:restriction>
+	</xs:simpleType>
+</xs:schema>`
+
+const validDocument = `<Файл ВерсФорм="5.03">
+	<Заголовок>УПД</Заголовок>
+	<Примечание>1</Примечание>
+	<ЮЛ>7843316106</ЮЛ>
+	<Строка Номер="1" Сумма="100.50" Ставка="20%"/>
+	<Строка Номер="2" Сумма="1000"/>
+	<Подпись>Иванов</Подпись>
+	<Дата>2026-10-18</Дата>
+</Файл>`
+
+func loadTestSchema(t *testing.T) *Schema {
+	t.Helper()
+	schema, err := Load(strings.NewReader(testSchema))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return schema
+}
+
+func TestValidateValid(t *testing.T) {
+	schema := loadTestSchema(t)
+
+	for name, document := range map[string]string{
+		"full": validDocument,
+		"minimal": `<Файл ВерсФорм="5.03"><Заголовок>УПД</Заголовок><ИП>781490187318</ИП>
+			<Строка Номер="1" Сумма="1"/></Файл>`,
+		"repeated sequence": `<Файл ВерсФорм="5.03"><Заголовок>УПД</Заголовок><ИП>781490187318</ИП>
+			<Строка Номер="1" Сумма="1"/><Подпись>А</Подпись><Дата>2026-10-18</Дата><Подпись>Б</Подпись><Дата>2026-10-18</Дата></Файл>`,
+	} {
+		errs, err := schema.Validate(strings.NewReader(document))
+		if err != nil {
+			t.Fatalf("%s: Validate failed: %v", name, err)
+		}
+		for _, violation := range errs {
+			t.Errorf("%s: unexpected violation %v", name, violation)
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	schema := loadTestSchema(t)
+
+	tests := []struct {
+		name    string
+		replace [2]string
+		want    string
+	}{
+		{"elements out of order", [2]string{"<Заголовок>УПД</Заголовок>\n\t<Примечание>1</Примечание>", "<Примечание>1</Примечание><Заголовок>УПД</Заголовок>"},
+			"/Файл/Примечание: element is out of order, expected Заголовок"},
+		{"choice after sequence", [2]string{"<ЮЛ>7843316106</ЮЛ>\n\t<Строка Номер=\"1\" Сумма=\"100.50\" Ставка=\"20%\"/>", "<Строка Номер=\"1\" Сумма=\"100.50\" Ставка=\"20%\"/><ЮЛ>7843316106</ЮЛ>"},
+			"/Файл/Строка: element is out of order, expected ИП or Примечание or ЮЛ"},
+		{"maxOccurs of element", [2]string{"<Примечание>1</Примечание>", "<Примечание>1</Примечание><Примечание>2</Примечание><Примечание>3</Примечание>"},
+			"/Файл/Примечание: element occurs more times than allowed, expected ИП or ЮЛ"},
+		{"both choice alternatives", [2]string{"<ЮЛ>7843316106</ЮЛ>", "<ЮЛ>7843316106</ЮЛ><ИП>781490187318</ИП>"},
+			"/Файл/ИП: element is out of order, expected Строка"},
+		{"maxOccurs of group", [2]string{"<Дата>2026-10-18</Дата>", "<Дата>2026-10-18</Дата><Подпись>Б</Подпись><Дата>2026-10-18</Дата><Подпись>В</Подпись><Дата>2026-10-18</Дата>"},
+			"/Файл/Подпись: element is out of order"},
+		{"incomplete group", [2]string{"<Дата>2026-10-18</Дата>", "<Дата>2026-10-18</Дата><Подпись>Б</Подпись>"},
+			"/Файл: content is incomplete, expected Дата"},
+		{"missing element of optional group", [2]string{"<Дата>2026-10-18</Дата>", ""},
+			"/Файл: missing required element Дата"},
+		{"missing required element", [2]string{"<Заголовок>УПД</Заголовок>", ""},
+			"/Файл: missing required element Заголовок"},
+		{"missing choice", [2]string{"<ЮЛ>7843316106</ЮЛ>", ""},
+			"/Файл: missing required element (one of ЮЛ, ИП)"},
+		{"unknown element", [2]string{"<ЮЛ>", "<Лишний/><ЮЛ>"},
+			"/Файл/Лишний: element is not allowed here"},
+		{"pattern", [2]string{"7843316106", "78433161"},
+			`/Файл/ЮЛ: value "78433161" does not match pattern`},
+		{"enumeration", [2]string{`Ставка="20%"`, `Ставка="18%"`},
+			`/Файл/Строка@Ставка: value "18%" is not one of 20%, без НДС`},
+		{"fraction digits", [2]string{`Сумма="100.50"`, `Сумма="100.505"`},
+			`/Файл/Строка@Сумма: value "100.505" has more than 2 fraction digits`},
+		{"maxInclusive", [2]string{`Сумма="1000"`, `Сумма="1000.01"`},
+			`/Файл/Строка@Сумма: value "1000.01" is greater than 1000`},
+		{"positive integer", [2]string{`Номер="2"`, `Номер="0"`},
+			`/Файл/Строка@Номер: value "0" is out of range of xs:positiveInteger`},
+		{"integer", [2]string{`Номер="2"`, `Номер="2.5"`},
+			`/Файл/Строка@Номер: value "2.5" is not an integer`},
+		{"date", [2]string{"2026-10-18", "18.10.2026"},
+			`/Файл/Дата: value "18.10.2026" is not a date`},
+		{"fixed attribute", [2]string{`ВерсФорм="5.03"`, `ВерсФорм="5.01"`},
+			`/Файл@ВерсФорм: value "5.01" must be "5.03"`},
+		{"missing attribute", [2]string{` Номер="2"`, ""},
+			"/Файл/Строка: missing required attribute Номер"},
+		{"unknown attribute", [2]string{`Номер="2"`, `Номер="2" Код="1"`},
+			"/Файл/Строка@Код: attribute is not allowed"},
+		{"max length", [2]string{"<Подпись>Иванов</Подпись>", "<Подпись>Иванов-Петров</Подпись>"},
+			`/Файл/Подпись: value "Иванов-Петров" is longer than 10 characters`},
+		{"text in complex element", [2]string{"<Строка Номер=\"2\" Сумма=\"1000\"/>", "<Строка Номер=\"2\" Сумма=\"1000\">текст</Строка>"},
+			"/Файл/Строка: text is not allowed"},
+		{"children of simple element", [2]string{"<Заголовок>УПД</Заголовок>", "<Заголовок><Текст>УПД</Текст></Заголовок>"},
+			"/Файл/Заголовок: element must not have child elements"},
+	}
+
+	for _, tt := range tests {
+		if !strings.Contains(validDocument, tt.replace[0]) {
+			t.Fatalf("%s: %q is not in the document", tt.name, tt.replace[0])
+		}
+		document := strings.Replace(validDocument, tt.replace[0], tt.replace[1], 1)
+
+		errs, err := schema.Validate(strings.NewReader(document))
+		if err != nil {
+			t.Fatalf("%s: Validate failed: %v", tt.name, err)
+		}
+		var got []string
+		for _, violation := range errs {
+			got = append(got, violation.Error())
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: violations %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"XSD character class", `<xs:element name="А"><xs:simpleType><xs:restriction base="xs:string"><xs:pattern value="\i\c*"/></xs:restriction></xs:simpleType></xs:element>`,
+			`/А: pattern "\\i\\c*" does not compile`},
+		{"Unicode block", `<xs:simpleType name="Т"><xs:restriction base="xs:string"><xs:pattern value="\p{IsCyrillic}+"/></xs:restriction></xs:simpleType>`,
+			`type Т: pattern "\\p{IsCyrillic}+" does not compile`},
+		{"import", `<xs:import namespace="urn:other"/>`, "schema: import is not supported"},
+		{"element ref", `<xs:element name="А"><xs:complexType><xs:sequence><xs:element ref="Б"/></xs:sequence></xs:complexType></xs:element>`,
+			"/А/: element attribute ref is not supported"},
+		{"wildcard", `<xs:element name="А"><xs:complexType><xs:sequence><xs:any/></xs:sequence></xs:complexType></xs:element>`,
+			"/А: any is not supported"},
+		{"extension", `<xs:complexType name="Т"><xs:complexContent><xs:extension base="Б"/></xs:complexContent></xs:complexType>`,
+			"type Т: complexContent is not supported"},
+		{"attribute group", `<xs:complexType name="Т"><xs:attributeGroup ref="Б"/></xs:complexType>`,
+			"type Т: attributeGroup is not supported"},
+		{"union", `<xs:simpleType name="Т"><xs:union memberTypes="xs:string"/></xs:simpleType>`,
+			"type Т: union is not supported"},
+		{"facet", `<xs:simpleType name="Т"><xs:restriction base="xs:string"><xs:whiteSpace value="collapse"/></xs:restriction></xs:simpleType>`,
+			"type Т: facet whiteSpace is not supported"},
+		{"built-in type", `<xs:element name="А" type="xs:dateTime"/>`, "/А: type xs:dateTime is not supported"},
+		{"unknown type", `<xs:element name="А" type="БТип"/>`, "/А: unknown type БТип"},
+		{"complex attribute type", `<xs:complexType name="Т"><xs:attribute name="А" type="Т"/></xs:complexType>`,
+			"type Т@А: complex type Т is used as a simple type"},
+		{"untyped element", `<xs:element name="А"/>`, "/А: element has no type"},
+		{"identity constraint", `<xs:element name="А" type="xs:string"><xs:unique name="У"/></xs:element>`,
+			"/А: unique is not supported"},
+	}
+
+	for _, tt := range tests {
+		schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">` + tt.schema + `</xs:schema>`
+		_, err := Load(strings.NewReader(schema))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestBundledSchemas(t *testing.T) {
+	paths, err := filepath.Glob("../../data/*/*.xsd")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no bundled schemas: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := LoadFile(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	// The real 5.03 UPD conforms to the bundled 5.03 schema
+	schema, err := LoadFile("../../data/XSD_UPD_503/ON_NSCHFDOPPR.xsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, _ := filepath.Glob("../../Sample/*/*/ON_NSCHFDOPPR_*.xml")
+	for _, path := range samples {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs, err := schema.Validate(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		for _, violation := range errs {
+			t.Errorf("%s: %v", filepath.Base(path), violation)
+		}
+	}
+}